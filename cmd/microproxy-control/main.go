@@ -9,6 +9,7 @@ import (
 	"syscall"
 
 	"github.com/pzaino/microproxy/internal/controlplane/api"
+	"github.com/pzaino/microproxy/internal/dataplane/providers"
 	"github.com/pzaino/microproxy/pkg/config"
 )
 
@@ -19,23 +20,41 @@ func main() {
 	)
 	flag.Parse()
 
-	cfg := config.NewConfig()
-	if *configPath != "" {
-		loadedCfg, err := config.LoadConfig(*configPath)
-		if err != nil {
-			slog.Error("failed to load config", "error", err)
-			os.Exit(1)
-		}
-		cfg = loadedCfg
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		providers.StopExternal()
+		slog.Error("failed to load config", "error", err)
+		os.Exit(1)
 	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
 	slog.Info("starting control-plane API", "address", *listenAddr)
-	if err := api.Serve(ctx, *listenAddr, cfg); err != nil {
+	err = api.Serve(ctx, *listenAddr, cfg)
+	providers.StopExternal()
+	if err != nil {
 		slog.Error("control-plane API exited with error", "error", err)
 		os.Exit(1)
 	}
 	slog.Info("control-plane API stopped")
 }
+
+// loadConfig registers the config's external plugins before validating it,
+// so plugin provider types are validated by their plugins.
+func loadConfig(path string) (*config.Config, error) {
+	cfg := config.NewConfig()
+	if path == "" {
+		return cfg, nil
+	}
+	if err := cfg.Load(path); err != nil {
+		return nil, err
+	}
+	if err := providers.SyncExternal(cfg.ProviderPlugins); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
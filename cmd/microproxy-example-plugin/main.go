@@ -0,0 +1,80 @@
+// Command microproxy-example-plugin is the reference external provider
+// plugin. It serves a direct-egress provider type over the stdio plugin
+// protocol: endpoints stand for egress locations picked by their country,
+// and connections go straight to their target.
+//
+// Run it from the data plane config:
+//
+//	provider_plugins:
+//	  - type: example
+//	    command: /usr/local/bin/microproxy-example-plugin
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pzaino/microproxy/internal/dataplane/providers"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+func main() {
+	log.SetPrefix("microproxy-example-plugin: ")
+	if err := providers.Serve(examplePlugin{}, os.Stdin, os.Stdout); err != nil {
+		log.Fatalf("serve: %v", err)
+	}
+}
+
+type examplePlugin struct{}
+
+func (examplePlugin) ValidateConfig(provider config.ProviderConfig) error {
+	errs := &config.ValidationErrors{}
+	switch strings.ToLower(strings.TrimSpace(provider.Auth.Type)) {
+	case "", "none":
+	default:
+		errs.Add("auth.type", "must be none for direct egress")
+	}
+	return errs.OrNil()
+}
+
+// ResolveEndpoint picks the endpoint of the hinted country.
+func (examplePlugin) ResolveEndpoint(_ context.Context, provider config.ProviderConfig, hint map[string]string) (config.ProviderEndpoint, error) {
+	country := hint["country"]
+	if country == "" {
+		return config.ProviderEndpoint{}, providers.ErrUnsupported
+	}
+	for _, endpoint := range provider.Endpoints {
+		if strings.EqualFold(endpoint.Country, country) {
+			return endpoint, nil
+		}
+	}
+	return config.ProviderEndpoint{}, errors.New("no endpoint in country " + country)
+}
+
+func (examplePlugin) PrepareRequest(_ context.Context, provider config.ProviderConfig, req *http.Request) error {
+	req.Header.Set("X-Egress-Provider", provider.Name)
+	return nil
+}
+
+func (examplePlugin) PlanDial(_ context.Context, _ config.ProviderConfig, _ config.ProviderEndpoint, plan providers.DialPlan) (providers.DialPlan, error) {
+	return plan, nil
+}
+
+func (examplePlugin) Rotate(_ context.Context, provider config.ProviderConfig, _ string) (providers.RotateResult, error) {
+	if !provider.Session.Supported {
+		return providers.RotateResult{}, providers.ErrUnsupported
+	}
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return providers.RotateResult{SessionID: hex.EncodeToString(id)}, nil
+}
+
+func (examplePlugin) FetchStatus(context.Context, config.ProviderConfig) (providers.StatusSnapshot, error) {
+	return providers.StatusSnapshot{State: "healthy"}, nil
+}
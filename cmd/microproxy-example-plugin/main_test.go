@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/pzaino/microproxy/internal/dataplane"
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/internal/dataplane/providers"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+// servePluginEnv makes the test binary run the plugin's main, so the tests
+// spawn the reference plugin as the data plane would.
+const servePluginEnv = "MICROPROXY_EXAMPLE_PLUGIN_SERVE"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(servePluginEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func pluginConfig(pluginType string) config.ProviderPluginConfig {
+	return config.ProviderPluginConfig{
+		Type:    pluginType,
+		Command: os.Args[0],
+		Env:     map[string]string{servePluginEnv: "1"},
+	}
+}
+
+var exampleProvider = config.ProviderConfig{
+	Name: "egress",
+	Type: "example",
+	Endpoints: []config.ProviderEndpoint{
+		{URL: "http://us.egress.local", Country: "us"},
+		{URL: "http://de.egress.local", Country: "de"},
+	},
+}
+
+func TestExamplePlugin_ServesCalls(t *testing.T) {
+	t.Parallel()
+	plugin := providers.NewExternalPlugin(pluginConfig("example"))
+	defer plugin.Close()
+	ctx := context.Background()
+
+	withAuth := exampleProvider
+	withAuth.Auth = config.ProviderAuthConfig{Type: "basic"}
+	if err := plugin.ValidateConfig(withAuth); err == nil {
+		t.Fatalf("expected basic auth to be rejected")
+	}
+	if err := plugin.ValidateConfig(exampleProvider); err != nil {
+		t.Fatalf("validate config: %v", err)
+	}
+
+	endpoint, err := plugin.ResolveEndpoint(ctx, exampleProvider, map[string]string{"country": "DE"})
+	if err != nil || endpoint.URL != "http://de.egress.local" {
+		t.Fatalf("expected the de endpoint, got %+v, %v", endpoint, err)
+	}
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen target: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		if conn, err := target.Accept(); err == nil {
+			_, _ = conn.Write([]byte("hi"))
+			conn.Close()
+		}
+	}()
+	conn, err := plugin.Dial(ctx, exampleProvider, endpoint, providers.DialPlan{Network: "tcp", Address: target.Addr().String()})
+	if err != nil {
+		t.Fatalf("dial through plugin: %v", err)
+	}
+	greeting, _ := io.ReadAll(conn)
+	conn.Close()
+	if string(greeting) != "hi" {
+		t.Fatalf("expected to reach the target, got %q", greeting)
+	}
+
+	if _, err := plugin.Rotate(ctx, exampleProvider, ""); !errors.Is(err, providers.ErrUnsupported) {
+		t.Fatalf("expected rotation without sessions to be unsupported, got %v", err)
+	}
+	status, err := plugin.FetchStatus(ctx, exampleProvider)
+	if err != nil || status.State != "healthy" {
+		t.Fatalf("expected a healthy status, got %+v, %v", status, err)
+	}
+}
+
+func TestExamplePlugin_ServesDataPlaneProvider(t *testing.T) {
+	t.Parallel()
+
+	var egressHeader string
+	origin := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		egressHeader = req.Header.Get("X-Egress-Provider")
+		_, _ = rw.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+
+	provider := exampleProvider
+	provider.Type = "example_dataplane"
+	cfg := &config.Config{
+		ProviderPlugins: []config.ProviderPluginConfig{pluginConfig("example_dataplane")},
+		Providers:       []config.ProviderConfig{provider},
+		Routing:         config.RoutingConfig{DefaultProvider: provider.Name},
+	}
+	if err := providers.RegisterExternal(cfg.ProviderPlugins[0]); err != nil {
+		t.Fatalf("register plugin: %v", err)
+	}
+	plugin, _ := providers.Lookup("example_dataplane")
+	defer plugin.(*providers.ExternalPlugin).Close()
+	runtime := dataplane.NewRequestRuntime(cfg)
+	defer runtime.Registry.(*dataplane.ProviderRegistry).Close()
+	proxy := httptest.NewServer(listeners.MetadataMiddleware(listeners.NewForwardProxyHandlerWithRuntime(runtime)))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+	req.Header.Set(listeners.HintCountryHeader, "de")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("forward request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Fatalf("expected 200 ok, got %d %q", resp.StatusCode, body)
+	}
+	if egressHeader != "egress" {
+		t.Fatalf("expected the plugin to prepare the request, got header %q", egressHeader)
+	}
+}
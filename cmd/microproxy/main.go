@@ -11,7 +11,9 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/pzaino/microproxy/internal/controlplane/api"
 	"github.com/pzaino/microproxy/internal/dataplane"
+	"github.com/pzaino/microproxy/internal/dataplane/providers"
 	"github.com/pzaino/microproxy/internal/observability"
 	"github.com/pzaino/microproxy/pkg/config"
 )
@@ -27,13 +29,24 @@ func main() {
 func run() error {
 	var configPath string
 	var healthAddr string
+	var controlAddr string
 
 	flag.StringVar(&configPath, "config", "", "path to configuration file (.yaml/.yml/.json)")
 	flag.StringVar(&healthAddr, "health-addr", ":9090", "health endpoint listen address")
+	flag.StringVar(&controlAddr, "control-addr", "", "control-plane API listen address; empty disables the in-process API")
 	flag.Parse()
 
-	cfg, err := config.LoadConfig(configPath)
-	if err != nil {
+	// External plugins validate their providers, so they are registered
+	// before the config is validated and stopped when the process exits.
+	cfg := config.NewConfig()
+	if err := cfg.Load(configPath); err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	defer providers.StopExternal()
+	if err := providers.SyncExternal(cfg.ProviderPlugins); err != nil {
+		return fmt.Errorf("register provider plugins: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
 		return fmt.Errorf("load config: %w", err)
 	}
 
@@ -42,7 +55,8 @@ func run() error {
 	}
 
 	observabilityManager := observability.NewListenerManager(cfg)
-	dataPlaneManager := dataplane.NewListenerManager(cfg)
+	runtime := dataplane.NewRequestRuntime(cfg)
+	dataPlaneManager := dataplane.NewListenerManagerWithRuntime(cfg, runtime)
 
 	svcCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stopSignals()
@@ -54,19 +68,34 @@ func run() error {
 		return fmt.Errorf("start observability manager: %w", err)
 	}
 
-	<-svcCtx.Done()
-	log.Println("shutdown signal received; stopping managers")
+	// The in-process control plane administers the registry serving
+	// traffic, so rotations and session changes reach the listeners.
+	controlErr := make(chan error, 1)
+	if controlAddr != "" {
+		go func() {
+			controlErr <- api.ServeWithDataPlane(svcCtx, controlAddr, cfg, runtime.Registry.(*dataplane.ProviderRegistry))
+		}()
+	}
+
+	var shutdownErr error
+	select {
+	case <-svcCtx.Done():
+		log.Println("shutdown signal received; stopping managers")
+	case err := <-controlErr:
+		if err != nil {
+			shutdownErr = fmt.Errorf("control-plane API: %w", err)
+		}
+		log.Printf("control-plane API stopped: %v; stopping managers", err)
+	}
 
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancel()
 
-	var shutdownErr error
 	if err := observabilityManager.Shutdown(shutdownCtx); err != nil {
 		shutdownErr = errors.Join(shutdownErr, fmt.Errorf("shutdown observability manager: %w", err))
 	}
 	if err := dataPlaneManager.Shutdown(shutdownCtx); err != nil {
 		shutdownErr = errors.Join(shutdownErr, fmt.Errorf("shutdown data-plane manager: %w", err))
 	}
-
 	return shutdownErr
 }
@@ -2,4 +2,7 @@ module github.com/pzaino/microproxy
 
 go 1.26.2
 
-require gopkg.in/yaml.v2 v2.4.0
+require (
+	golang.org/x/crypto v0.54.0
+	gopkg.in/yaml.v2 v2.4.0
+)
@@ -21,6 +21,10 @@ type Handlers struct {
 	providerStore ProviderStateStore
 	resolver      *dataplane.RouteResolver
 	registry      *dataplane.ProviderRegistry
+	// dataPlane is the registry serving traffic, when the control plane runs
+	// in the data plane's process. Rotations and sessions act on it; registry
+	// is the control plane's own view and carries no traffic.
+	dataPlane     *dataplane.ProviderRegistry
 	policyEngine  *policy.Engine
 	applyManager  *runtimeapply.Manager
 	ops           *opStore
@@ -28,6 +32,13 @@ type Handlers struct {
 }
 
 func NewHandlers(cfg *config.Config) *Handlers {
+	return NewHandlersWithDataPlane(cfg, nil)
+}
+
+// NewHandlersWithDataPlane is NewHandlers administering dataPlane, the
+// registry the data plane serves traffic with. Without one, provider rotation
+// fails as unavailable and no sessions are listed.
+func NewHandlersWithDataPlane(cfg *config.Config, dataPlane *dataplane.ProviderRegistry) *Handlers {
 	if cfg == nil {
 		cfg = config.NewConfig()
 	}
@@ -48,6 +59,7 @@ func NewHandlers(cfg *config.Config) *Handlers {
 		providerStore: store,
 		resolver:      dataplane.NewRouteResolver(cfg),
 		registry:      dataplane.NewProviderRegistry(cfg),
+		dataPlane:     dataPlane,
 		policyEngine:  policy.NewEngine(cfg),
 		ops:           newOpStore(),
 		audit:         &auditLog{},
@@ -165,6 +177,40 @@ func (h *Handlers) providerHealth(providerID string) ProviderHealthView {
 	return view
 }
 
+// GetProviderCredentials reports how the provider's pooled upstream
+// credentials are used. Providers without a pool return an empty list.
+// Without a data plane attached the pool is listed with no usage.
+func (h *Handlers) GetProviderCredentials(rw http.ResponseWriter, req *http.Request) {
+	providerID := strings.TrimSpace(req.PathValue("providerID"))
+	if _, ok := h.providerStore.GetProvider(providerID); !ok {
+		writeError(rw, http.StatusNotFound, "not_found", "provider not found", requestIDFromRequest(req))
+		return
+	}
+	registry := h.dataPlane
+	if registry == nil {
+		registry = h.registry
+	}
+	items := []ProviderCredentialUsage{}
+	if registry != nil {
+		for _, usage := range registry.SnapshotProviderCredentials(providerID) {
+			state := "active"
+			if usage.Quarantined {
+				state = "quarantined"
+			}
+			items = append(items, ProviderCredentialUsage{
+				Username:         usage.Username,
+				State:            state,
+				Requests:         usage.Requests,
+				Failures:         usage.Failures,
+				LastUsedAt:       usage.LastUsedAt,
+				LastFailureAt:    usage.LastFailureAt,
+				QuarantinedUntil: usage.QuarantinedUntil,
+			})
+		}
+	}
+	writeJSON(rw, http.StatusOK, ProviderCredentialsResponse{Items: items})
+}
+
 func (h *Handlers) CreateProvider(rw http.ResponseWriter, req *http.Request) {
 	if req.Method != http.MethodPost {
 		writeError(rw, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed", requestIDFromRequest(req))
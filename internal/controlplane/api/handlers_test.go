@@ -1,12 +1,15 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 
+	"github.com/pzaino/microproxy/internal/dataplane"
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
 	"github.com/pzaino/microproxy/pkg/config"
 )
 
@@ -117,3 +120,126 @@ func TestListProvidersIncludesRuntimeHealth(t *testing.T) {
 		t.Fatalf("expected endpoint health reason to be populated")
 	}
 }
+
+func TestGetProviderCredentialsReportsPoolUsage(t *testing.T) {
+	cfg := &config.Config{
+		Providers: []config.ProviderConfig{{
+			Name:      "p1",
+			Type:      "http_proxy",
+			Endpoints: []config.ProviderEndpoint{{URL: "http://p1-primary.example", Priority: 1}},
+			Auth: config.ProviderAuthConfig{Type: "basic", Pool: config.ProviderCredentialPoolConfig{
+				Credentials: []config.ProviderCredential{{Username: "sub-1", Password: "pool-secret"}, {Username: "sub-2", Password: "pool-secret"}},
+			}},
+		}},
+	}
+	h := NewHandlers(cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/providers/p1/credentials", nil)
+	req.SetPathValue("providerID", "p1")
+	rw := httptest.NewRecorder()
+	h.GetProviderCredentials(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected 200 got %d", rw.Code)
+	}
+	if strings.Contains(rw.Body.String(), "pool-secret") {
+		t.Fatalf("expected pooled passwords to stay private, got %s", rw.Body.String())
+	}
+	var response ProviderCredentialsResponse
+	if err := json.Unmarshal(rw.Body.Bytes(), &response); err != nil {
+		t.Fatalf("unmarshal response: %v", err)
+	}
+	if len(response.Items) != 2 || response.Items[0].Username != "sub-1" || response.Items[0].State != "active" {
+		t.Fatalf("expected two active pooled credentials, got %+v", response.Items)
+	}
+
+	missing := httptest.NewRequest(http.MethodGet, "/api/v1/providers/nope/credentials", nil)
+	missing.SetPathValue("providerID", "nope")
+	missingRW := httptest.NewRecorder()
+	h.GetProviderCredentials(missingRW, missing)
+	if missingRW.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 got %d", missingRW.Code)
+	}
+
+	getReq := httptest.NewRequest(http.MethodGet, "/api/v1/providers/p1", nil)
+	getReq.SetPathValue("providerID", "p1")
+	getRW := httptest.NewRecorder()
+	h.GetProvider(getRW, getReq)
+	if strings.Contains(getRW.Body.String(), "pool-secret") {
+		t.Fatalf("expected provider view to redact pooled passwords, got %s", getRW.Body.String())
+	}
+
+	registry := dataplane.NewProviderRegistry(cfg)
+	served, _ := registry.Get("p1")
+	endpoint := served.Endpoints[0]
+	if _, err := endpoint.Adapter.PrepareRequest(httptest.NewRequest(http.MethodGet, "http://example.com", nil), endpoint.URL); err != nil {
+		t.Fatalf("prepare request: %v", err)
+	}
+	servedRW := httptest.NewRecorder()
+	NewHandlersWithDataPlane(cfg, registry).GetProviderCredentials(servedRW, req)
+	var servedResponse ProviderCredentialsResponse
+	if err := json.Unmarshal(servedRW.Body.Bytes(), &servedResponse); err != nil {
+		t.Fatalf("unmarshal response: %v", err)
+	}
+	if len(servedResponse.Items) != 2 || servedResponse.Items[0].Requests != 1 {
+		t.Fatalf("expected the data plane's usage, got %+v", servedResponse.Items)
+	}
+}
+
+func TestSessionHandlersListRefreshAndKill(t *testing.T) {
+	cfg := &config.Config{
+		Providers: []config.ProviderConfig{{
+			Name:      "p1",
+			Type:      "http_proxy",
+			Endpoints: []config.ProviderEndpoint{{URL: "http://p1-primary.example", Priority: 1}},
+			Session:   config.ProviderSessionConfig{Supported: true, RefreshSupported: true},
+		}},
+	}
+	registry := dataplane.NewProviderRegistry(cfg)
+	h := NewHandlersWithDataPlane(cfg, registry)
+	provider, _ := registry.Get("p1")
+	ctx := listeners.WithUpstreamHints(context.Background(), listeners.UpstreamHints{Session: "s1"})
+	dataplane.NewEndpointSelector(registry).Select(ctx, provider, httptest.NewRequest(http.MethodGet, "http://example.com", nil))
+	shadowCtx := listeners.WithUpstreamHints(context.Background(), listeners.UpstreamHints{Session: "shadow"})
+	dataplane.NewEndpointSelector(h.registry).Select(shadowCtx, provider, httptest.NewRequest(http.MethodGet, "http://example.com", nil))
+
+	listRW := httptest.NewRecorder()
+	h.ListSessions(listRW, httptest.NewRequest(http.MethodGet, "/api/v1/sessions", nil))
+	var list SessionListResponse
+	if err := json.Unmarshal(listRW.Body.Bytes(), &list); err != nil {
+		t.Fatalf("unmarshal response: %v", err)
+	}
+	if len(list.Items) != 1 || list.Items[0].ID != "s1" || list.Items[0].Provider != "p1" || list.Items[0].Endpoint != "http://p1-primary.example" {
+		t.Fatalf("expected only the data plane's session s1 pinned to p1, got %+v", list.Items)
+	}
+
+	refreshReq := httptest.NewRequest(http.MethodPost, "/api/v1/sessions/s1/refresh", nil)
+	refreshReq.SetPathValue("sessionID", "s1")
+	refreshRW := httptest.NewRecorder()
+	h.RefreshSession(refreshRW, refreshReq)
+	if refreshRW.Code != http.StatusAccepted || !strings.Contains(refreshRW.Body.String(), `"status":"succeeded"`) {
+		t.Fatalf("expected a succeeded refresh, got %d %s", refreshRW.Code, refreshRW.Body.String())
+	}
+
+	getReq := httptest.NewRequest(http.MethodGet, "/api/v1/sessions/s1", nil)
+	getReq.SetPathValue("sessionID", "s1")
+	getRW := httptest.NewRecorder()
+	h.GetSession(getRW, getReq)
+	var got SessionResponse
+	if err := json.Unmarshal(getRW.Body.Bytes(), &got); err != nil {
+		t.Fatalf("unmarshal response: %v", err)
+	}
+	if got.Session.VendorSessionID == "" || got.Session.VendorSessionID == "s1" {
+		t.Fatalf("expected refresh to replace the vendor session id, got %+v", got.Session)
+	}
+
+	for _, code := range []int{http.StatusNoContent, http.StatusNotFound} {
+		killReq := httptest.NewRequest(http.MethodDelete, "/api/v1/sessions/s1", nil)
+		killReq.SetPathValue("sessionID", "s1")
+		killRW := httptest.NewRecorder()
+		h.KillSession(killRW, killReq)
+		if killRW.Code != code {
+			t.Fatalf("expected %d got %d", code, killRW.Code)
+		}
+	}
+}
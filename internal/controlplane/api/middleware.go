@@ -262,7 +262,7 @@ func isRoleAllowed(r role, method, path string) bool {
 		return true
 	}
 	if r == roleOperator {
-		return path == "/api/v1/providers" || strings.HasPrefix(path, "/api/v1/providers/")
+		return path == "/api/v1/providers" || strings.HasPrefix(path, "/api/v1/providers/") || strings.HasPrefix(path, "/api/v1/sessions/")
 	}
 	return false
 }
@@ -78,6 +78,44 @@ type ProviderSpec struct {
 	HealthMeta map[string]any `json:"health_strategy,omitempty"`
 }
 
+// ProviderCredentialsResponse lists the usage of a provider's pooled
+// upstream credentials. Passwords are never included.
+type ProviderCredentialsResponse struct {
+	Items []ProviderCredentialUsage `json:"items"`
+}
+
+type ProviderCredentialUsage struct {
+	Username         string    `json:"username"`
+	State            string    `json:"state"` // active, quarantined
+	Requests         uint64    `json:"requests"`
+	Failures         uint64    `json:"failures"`
+	LastUsedAt       time.Time `json:"last_used_at,omitempty"`
+	LastFailureAt    time.Time `json:"last_failure_at,omitempty"`
+	QuarantinedUntil time.Time `json:"quarantined_until,omitempty"`
+}
+
+// SessionView is a sticky session as the data plane pinned it.
+type SessionView struct {
+	ID              string    `json:"id"`
+	TenantID        string    `json:"tenant_id,omitempty"`
+	Provider        string    `json:"provider"`
+	Endpoint        string    `json:"endpoint,omitempty"`
+	Credential      string    `json:"credential,omitempty"`
+	VendorSessionID string    `json:"vendor_session_id"`
+	CreatedAt       time.Time `json:"created_at"`
+	LastUsedAt      time.Time `json:"last_used_at"`
+	ExpiresAt       time.Time `json:"expires_at"`
+	Requests        uint64    `json:"requests"`
+}
+
+type SessionResponse struct {
+	Session SessionView `json:"session"`
+}
+
+type SessionListResponse struct {
+	Items []SessionView `json:"items"`
+}
+
 type ProviderCapabilitiesResponse struct {
 	Capabilities ProviderSpec `json:"capabilities"`
 }
@@ -158,6 +196,16 @@ func sanitizeProviderAuth(auth config.ProviderAuthConfig) config.ProviderAuthCon
 	if strings.TrimSpace(sanitized.Token) != "" {
 		sanitized.Token = redactedSecretValue
 	}
+	if len(sanitized.Pool.Credentials) > 0 {
+		credentials := make([]config.ProviderCredential, len(sanitized.Pool.Credentials))
+		for i, credential := range sanitized.Pool.Credentials {
+			if strings.TrimSpace(credential.Password) != "" {
+				credential.Password = redactedSecretValue
+			}
+			credentials[i] = credential
+		}
+		sanitized.Pool.Credentials = credentials
+	}
 
 	if len(sanitized.Headers) == 0 {
 		return sanitized
@@ -23,6 +23,7 @@ var expectedControlPlaneRoutes = map[string][]string{
 	"/api/v1/providers/{providerID}/rotate":                 {"POST"},
 	"/api/v1/providers/{providerID}/sessions/{sid}/refresh": {"POST"},
 	"/api/v1/providers/{providerID}/capabilities":           {"GET"},
+	"/api/v1/providers/{providerID}/credentials":            {"GET"},
 	"/api/v1/operations/{operationID}":                      {"GET"},
 	"/api/v1/policies":                                      {"GET"},
 	"/api/v1/policies/dry-run":                              {"POST"},
@@ -32,7 +33,8 @@ var expectedControlPlaneRoutes = map[string][]string{
 	"/api/v1/tenants":                                       {"GET"},
 	"/api/v1/tenants/{tenantID}":                            {"GET"},
 	"/api/v1/sessions":                                      {"GET"},
-	"/api/v1/sessions/{sessionID}":                          {"GET"},
+	"/api/v1/sessions/{sessionID}":                          {"DELETE", "GET"},
+	"/api/v1/sessions/{sessionID}/refresh":                  {"POST"},
 }
 
 type openAPIDoc struct {
@@ -1,10 +1,14 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 	"sync"
+
+	"github.com/pzaino/microproxy/internal/dataplane"
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
 )
 
 type opStore struct {
@@ -17,23 +21,59 @@ type opStore struct {
 func newOpStore() *opStore {
 	return &opStore{byID: map[string]AsyncOperation{}, byKey: map[string]string{}}
 }
-func (s *opStore) create(kind, providerID, sessionID, idem string) AsyncOperation {
+
+// create records an operation and runs it, unless idem names an earlier
+// operation, which is returned as it is. run may be nil for operations that
+// have nothing to do yet. The ID and idempotency key are reserved before run
+// starts and the lock is not held while it runs, so a slow operation does not
+// hold up others; a repeat of the key meanwhile sees it running.
+func (s *opStore) create(kind, providerID, sessionID, idem string, run func() error) AsyncOperation {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	if idem != "" {
 		if id, ok := s.byKey[idem]; ok {
-			return s.byID[id]
+			op := s.byID[id]
+			s.mu.Unlock()
+			return op
 		}
 	}
 	s.seq++
 	id := fmt.Sprintf("op-%d", s.seq)
-	op := AsyncOperation{ID: id, Status: "succeeded", Kind: kind, ProviderID: providerID, SessionID: sessionID}
+	op := AsyncOperation{ID: id, Status: "running", Kind: kind, ProviderID: providerID, SessionID: sessionID}
 	s.byID[id] = op
 	if idem != "" {
 		s.byKey[idem] = id
 	}
+	s.mu.Unlock()
+
+	op.Status = "succeeded"
+	if run != nil {
+		if err := run(); err != nil {
+			op.Status = "failed"
+			op.Error = &ErrorModel{Code: operationErrorCode(err), Message: err.Error()}
+		}
+	}
+	s.mu.Lock()
+	s.byID[id] = op
+	s.mu.Unlock()
 	return op
 }
+
+// errDataPlaneUnavailable fails operations on the serving data plane when the
+// API runs without one.
+var errDataPlaneUnavailable = errors.New("no data plane attached to the control plane")
+
+func operationErrorCode(err error) string {
+	switch {
+	case errors.Is(err, errDataPlaneUnavailable):
+		return "unavailable"
+	case errors.Is(err, listeners.ErrRotateIdentityUnsupported), errors.Is(err, dataplane.ErrSessionRefreshUnsupported):
+		return "unsupported"
+	case errors.Is(err, dataplane.ErrSessionNotFound):
+		return "not_found"
+	}
+	return "operation_failed"
+}
+
 func (s *opStore) get(id string) (AsyncOperation, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -51,10 +91,22 @@ func (h *Handlers) RotateProvider(rw http.ResponseWriter, req *http.Request) {
 		writeError(rw, 404, "not_found", "provider not found", requestIDFromRequest(req))
 		return
 	}
-	op := h.ops.create("provider.rotate", pid, "", strings.TrimSpace(req.Header.Get("Idempotency-Key")))
-	h.emitAudit(req, "providers.rotate", pid, op, "applied")
+	op := h.ops.create("provider.rotate", pid, "", strings.TrimSpace(req.Header.Get("Idempotency-Key")), func() error {
+		if h.dataPlane == nil {
+			return errDataPlaneUnavailable
+		}
+		return h.dataPlane.RotateIdentity(req.Context(), pid)
+	})
+	h.emitAudit(req, "providers.rotate", pid, op, operationResult(op))
 	writeJSON(rw, http.StatusAccepted, map[string]any{"operation": op})
 }
+func operationResult(op AsyncOperation) string {
+	if op.Status == "failed" {
+		return "failed"
+	}
+	return "applied"
+}
+
 func (h *Handlers) RefreshProviderSession(rw http.ResponseWriter, req *http.Request) {
 	pid := strings.TrimSpace(req.PathValue("providerID"))
 	sid := strings.TrimSpace(req.PathValue("sid"))
@@ -66,8 +118,15 @@ func (h *Handlers) RefreshProviderSession(rw http.ResponseWriter, req *http.Requ
 		writeError(rw, 404, "not_found", "provider not found", requestIDFromRequest(req))
 		return
 	}
-	op := h.ops.create("provider.session.refresh", pid, sid, strings.TrimSpace(req.Header.Get("Idempotency-Key")))
-	h.emitAudit(req, "providers.rotate", pid, op, "applied")
+	if session, ok := h.session(sid); !ok || session.Provider != pid {
+		writeError(rw, 404, "not_found", "session not found", requestIDFromRequest(req))
+		return
+	}
+	op := h.ops.create("provider.session.refresh", pid, sid, strings.TrimSpace(req.Header.Get("Idempotency-Key")), func() error {
+		_, err := h.dataPlane.Sessions().Refresh(sid)
+		return err
+	})
+	h.emitAudit(req, "providers.rotate", pid, op, operationResult(op))
 	writeJSON(rw, http.StatusAccepted, map[string]any{"operation": op})
 }
 func (h *Handlers) GetProviderCapabilities(rw http.ResponseWriter, req *http.Request) {
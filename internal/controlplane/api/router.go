@@ -3,6 +3,7 @@ package api
 import (
 	"net/http"
 
+	"github.com/pzaino/microproxy/internal/dataplane"
 	"github.com/pzaino/microproxy/pkg/config"
 )
 
@@ -15,7 +16,13 @@ func NewRouter(cfg *config.Config) http.Handler {
 }
 
 func NewRouterWithError(cfg *config.Config) (http.Handler, error) {
-	handlers := NewHandlers(cfg)
+	return NewRouterWithDataPlane(cfg, nil)
+}
+
+// NewRouterWithDataPlane is NewRouterWithError for handlers that administer
+// the data plane serving with dataPlane.
+func NewRouterWithDataPlane(cfg *config.Config, dataPlane *dataplane.ProviderRegistry) (http.Handler, error) {
+	handlers := NewHandlersWithDataPlane(cfg, dataPlane)
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("GET /api/v1/health", handlers.Health)
@@ -31,6 +38,7 @@ func NewRouterWithError(cfg *config.Config) (http.Handler, error) {
 	mux.HandleFunc("POST /api/v1/providers/{providerID}/rotate", handlers.RotateProvider)
 	mux.HandleFunc("POST /api/v1/providers/{providerID}/sessions/{sid}/refresh", handlers.RefreshProviderSession)
 	mux.HandleFunc("GET /api/v1/providers/{providerID}/capabilities", handlers.GetProviderCapabilities)
+	mux.HandleFunc("GET /api/v1/providers/{providerID}/credentials", handlers.GetProviderCredentials)
 	mux.HandleFunc("GET /api/v1/operations/{operationID}", handlers.GetOperationStatus)
 
 	mux.HandleFunc("GET /api/v1/policies", handlers.StubCollection("policies"))
@@ -43,8 +51,10 @@ func NewRouterWithError(cfg *config.Config) (http.Handler, error) {
 	mux.HandleFunc("GET /api/v1/tenants", handlers.StubCollection("tenants"))
 	mux.HandleFunc("GET /api/v1/tenants/{tenantID}", handlers.StubItem("tenants", "tenantID"))
 
-	mux.HandleFunc("GET /api/v1/sessions", handlers.StubCollection("sessions"))
-	mux.HandleFunc("GET /api/v1/sessions/{sessionID}", handlers.StubItem("sessions", "sessionID"))
+	mux.HandleFunc("GET /api/v1/sessions", handlers.ListSessions)
+	mux.HandleFunc("GET /api/v1/sessions/{sessionID}", handlers.GetSession)
+	mux.HandleFunc("DELETE /api/v1/sessions/{sessionID}", handlers.KillSession)
+	mux.HandleFunc("POST /api/v1/sessions/{sessionID}/refresh", handlers.RefreshSession)
 
 	authMiddleware, err := newAuthMiddleware()
 	if err != nil {
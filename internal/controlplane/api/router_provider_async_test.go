@@ -2,11 +2,17 @@ package api
 
 import (
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/pzaino/microproxy/internal/dataplane"
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
 	"github.com/pzaino/microproxy/pkg/config"
 )
 
@@ -57,3 +63,176 @@ func TestProviderAsyncFailureMapping(t *testing.T) {
 		t.Fatalf("expected 404 got %d", rw.Code)
 	}
 }
+
+// newTestRouterWithDataPlane is newTestRouter administering a data plane
+// serving cfg, whose runtime it returns.
+func newTestRouterWithDataPlane(t *testing.T, cfg *config.Config) (http.Handler, listeners.RequestRuntime) {
+	t.Helper()
+	t.Setenv(controlPlaneAPIKeysEnv, defaultControlAPIKey)
+	t.Setenv(controlPlaneJWTsEnv, "")
+	t.Setenv(developmentModeEnv, "false")
+	runtime := dataplane.NewRequestRuntime(cfg)
+	router, err := NewRouterWithDataPlane(cfg, runtime.Registry.(*dataplane.ProviderRegistry))
+	if err != nil {
+		t.Fatalf("new router: %v", err)
+	}
+	return router, runtime
+}
+
+func rotateProvider(t *testing.T, h http.Handler, provider string) AsyncOperation {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/providers/"+provider+"/rotate", nil)
+	withDefaultAuth(req)
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if rw.Code != http.StatusAccepted {
+		t.Fatalf("%s: expected 202 got %d", provider, rw.Code)
+	}
+	var body map[string]AsyncOperation
+	if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%s: unmarshal operation: %v", provider, err)
+	}
+	return body["operation"]
+}
+
+func TestProviderRotateReportsAdapterOutcome(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.Providers = []config.ProviderConfig{
+		{
+			Name:      "rotating",
+			Type:      "http_proxy",
+			Auth:      config.ProviderAuthConfig{Type: "basic", Username: "acme", Password: "secret", Preset: "brightdata"},
+			Endpoints: []config.ProviderEndpoint{{URL: "http://rotating.example:3128"}},
+			Session:   config.ProviderSessionConfig{Supported: true},
+			Rotation:  config.ProviderRotationConfig{Enabled: true, Mode: "manual"},
+		},
+		{
+			Name:      "static",
+			Type:      "http_proxy",
+			Endpoints: []config.ProviderEndpoint{{URL: "http://static.example:3128"}},
+		},
+	}
+	h, _ := newTestRouterWithDataPlane(t, cfg)
+
+	for provider, want := range map[string]AsyncOperation{
+		"rotating": {Status: "succeeded"},
+		"static":   {Status: "failed", Error: &ErrorModel{Code: "unsupported"}},
+	} {
+		op := rotateProvider(t, h, provider)
+		if op.Status != want.Status {
+			t.Fatalf("%s: expected status %q got %q", provider, want.Status, op.Status)
+		}
+		if want.Error != nil && (op.Error == nil || op.Error.Code != want.Error.Code) {
+			t.Fatalf("%s: expected error code %q got %+v", provider, want.Error.Code, op.Error)
+		}
+	}
+
+	if op := rotateProvider(t, newTestRouter(t, cfg), "rotating"); op.Status != "failed" || op.Error == nil || op.Error.Code != "unavailable" {
+		t.Fatalf("expected rotation without a data plane to fail as unavailable, got %+v", op)
+	}
+}
+
+func TestProviderRotateChangesServingIdentity(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte("ok"))
+	}))
+	defer target.Close()
+	var mu sync.Mutex
+	var usernames []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		username, _, _ := (&http.Request{Header: http.Header{"Authorization": req.Header.Values("Proxy-Authorization")}}).BasicAuth()
+		mu.Lock()
+		usernames = append(usernames, username)
+		mu.Unlock()
+		req.Header.Del("Proxy-Authorization")
+		rsp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer rsp.Body.Close()
+		rw.WriteHeader(rsp.StatusCode)
+		_, _ = io.Copy(rw, rsp.Body)
+	}))
+	defer upstream.Close()
+
+	cfg := config.NewConfig()
+	cfg.Providers = []config.ProviderConfig{{
+		Name:      "residential",
+		Type:      "http_proxy",
+		Auth:      config.ProviderAuthConfig{Type: "basic", Username: "acme", Password: "secret", UsernameTemplate: "{username}[-session-{session}]"},
+		Endpoints: []config.ProviderEndpoint{{URL: upstream.URL, Priority: 1}},
+		Session:   config.ProviderSessionConfig{Supported: true},
+		Rotation:  config.ProviderRotationConfig{Enabled: true, Mode: "manual"},
+	}}
+	cfg.Routing.DefaultProvider = "residential"
+	h, runtime := newTestRouterWithDataPlane(t, cfg)
+	proxy := httptest.NewServer(listeners.MetadataMiddleware(listeners.NewForwardProxyHandlerWithRuntime(runtime)))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	get := func() {
+		resp, err := client.Get(target.URL)
+		if err != nil {
+			t.Fatalf("forward request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+	}
+	get()
+	if op := rotateProvider(t, h, "residential"); op.Status != "succeeded" {
+		t.Fatalf("expected the rotation to succeed, got %+v", op)
+	}
+	get()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(usernames) != 2 || !strings.HasPrefix(usernames[0], "acme-session-") {
+		t.Fatalf("expected two session logins, got %q", usernames)
+	}
+	if usernames[0] == usernames[1] {
+		t.Fatalf("expected rotating through the API to change the serving session, got %q", usernames)
+	}
+}
+
+func TestOperationStoreDoesNotBlockOnRunningOperations(t *testing.T) {
+	ops := newOpStore()
+	done := ops.create("provider.rotate", "fast", "", "", nil)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	slow := make(chan AsyncOperation, 1)
+	go func() {
+		slow <- ops.create("provider.rotate", "slow", "", "k-slow", func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	answered := make(chan struct{})
+	go func() {
+		defer close(answered)
+		if op, ok := ops.get(done.ID); !ok || op.Status != "succeeded" {
+			t.Errorf("expected the finished operation, got %+v", op)
+		}
+		if op := ops.create("provider.rotate", "slow", "", "k-slow", nil); op.Status != "running" {
+			t.Errorf("expected a repeated key to see the running operation, got %+v", op)
+		}
+	}()
+	select {
+	case <-answered:
+	case <-time.After(time.Second):
+		t.Fatalf("expected lookups not to wait for a running operation")
+	}
+
+	close(release)
+	op := <-slow
+	if got, _ := ops.get(op.ID); got.Status != "succeeded" {
+		t.Fatalf("expected the slow operation to be stored as succeeded, got %+v", got)
+	}
+}
@@ -7,13 +7,20 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/pzaino/microproxy/internal/dataplane"
 	"github.com/pzaino/microproxy/pkg/config"
 )
 
 const defaultShutdownTimeout = 10 * time.Second
 
 func Serve(ctx context.Context, addr string, cfg *config.Config) error {
-	router, err := NewRouterWithError(cfg)
+	return ServeWithDataPlane(ctx, addr, cfg, nil)
+}
+
+// ServeWithDataPlane is Serve for an API that administers the data plane
+// serving with dataPlane.
+func ServeWithDataPlane(ctx context.Context, addr string, cfg *config.Config, dataPlane *dataplane.ProviderRegistry) error {
+	router, err := NewRouterWithDataPlane(cfg, dataPlane)
 	if err != nil {
 		return fmt.Errorf("configure control-plane server: %w", err)
 	}
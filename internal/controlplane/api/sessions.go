@@ -0,0 +1,80 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pzaino/microproxy/internal/dataplane"
+)
+
+// session returns the live sticky session with id on the serving data
+// plane.
+func (h *Handlers) session(id string) (dataplane.SessionInfo, bool) {
+	if h.dataPlane == nil {
+		return dataplane.SessionInfo{}, false
+	}
+	return h.dataPlane.Sessions().Get(id)
+}
+
+func sessionView(info dataplane.SessionInfo) SessionView {
+	return SessionView{
+		ID:              info.ID,
+		TenantID:        info.TenantID,
+		Provider:        info.Provider,
+		Endpoint:        info.Endpoint,
+		Credential:      info.Credential,
+		VendorSessionID: info.VendorSessionID,
+		CreatedAt:       info.CreatedAt,
+		LastUsedAt:      info.LastUsedAt,
+		ExpiresAt:       info.ExpiresAt,
+		Requests:        info.Requests,
+	}
+}
+
+// ListSessions lists the open sticky sessions.
+func (h *Handlers) ListSessions(rw http.ResponseWriter, req *http.Request) {
+	items := []SessionView{}
+	if h.dataPlane != nil {
+		for _, info := range h.dataPlane.Sessions().List() {
+			items = append(items, sessionView(info))
+		}
+	}
+	writeJSON(rw, http.StatusOK, SessionListResponse{Items: items})
+}
+
+func (h *Handlers) GetSession(rw http.ResponseWriter, req *http.Request) {
+	info, ok := h.session(strings.TrimSpace(req.PathValue("sessionID")))
+	if !ok {
+		writeError(rw, http.StatusNotFound, "not_found", "session not found", requestIDFromRequest(req))
+		return
+	}
+	writeJSON(rw, http.StatusOK, SessionResponse{Session: sessionView(info)})
+}
+
+// RefreshSession moves the session to a new vendor session ID. Providers
+// without refresh_supported fail the operation as unsupported.
+func (h *Handlers) RefreshSession(rw http.ResponseWriter, req *http.Request) {
+	sid := strings.TrimSpace(req.PathValue("sessionID"))
+	info, ok := h.session(sid)
+	if !ok {
+		writeError(rw, http.StatusNotFound, "not_found", "session not found", requestIDFromRequest(req))
+		return
+	}
+	op := h.ops.create("session.refresh", info.Provider, sid, strings.TrimSpace(req.Header.Get("Idempotency-Key")), func() error {
+		_, err := h.dataPlane.Sessions().Refresh(sid)
+		return err
+	})
+	h.emitAudit(req, "sessions.refresh", sid, op, operationResult(op))
+	writeJSON(rw, http.StatusAccepted, map[string]any{"operation": op})
+}
+
+// KillSession ends the session; the next request naming it opens a new one.
+func (h *Handlers) KillSession(rw http.ResponseWriter, req *http.Request) {
+	sid := strings.TrimSpace(req.PathValue("sessionID"))
+	if h.dataPlane == nil || h.dataPlane.Sessions().Kill(sid) != nil {
+		writeError(rw, http.StatusNotFound, "not_found", "session not found", requestIDFromRequest(req))
+		return
+	}
+	h.emitAudit(req, "sessions.delete", sid, nil, "applied")
+	writeNoContent(rw)
+}
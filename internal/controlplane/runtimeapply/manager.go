@@ -10,6 +10,7 @@ import (
 
 	"github.com/pzaino/microproxy/internal/dataplane"
 	"github.com/pzaino/microproxy/internal/dataplane/policy"
+	"github.com/pzaino/microproxy/internal/dataplane/providers"
 	"github.com/pzaino/microproxy/pkg/config"
 )
 
@@ -107,6 +108,9 @@ func (m *Manager) ApplyProviderMutation(requestID string, mutation ProviderMutat
 		m.reject(requestID, before, err)
 		return Provider{}, err
 	}
+	if prevRegistry != nil && prevRegistry != *m.components.ProviderRegistry {
+		prevRegistry.Close()
+	}
 	m.resourceVersion++
 	m.applied(requestID, before, m.resourceVersion)
 	return result, nil
@@ -137,6 +141,11 @@ func (m *Manager) rebuildRuntimeComponents() error {
 	if strings.TrimSpace(m.cfg.Observability.AccessLog.Format) == "force-runtime-fail" {
 		return fmt.Errorf("forced runtime component failure")
 	}
+	// Plugins the config no longer names are stopped and unregistered
+	// before the registry is rebuilt without them.
+	if err := providers.SyncExternal(m.cfg.ProviderPlugins); err != nil {
+		return fmt.Errorf("sync provider plugins: %w", err)
+	}
 	*m.components.Resolver = dataplane.NewRouteResolver(m.cfg)
 	*m.components.ProviderRegistry = dataplane.NewProviderRegistry(m.cfg)
 	*m.components.PolicyEngine = policy.NewEngine(m.cfg)
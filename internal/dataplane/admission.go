@@ -0,0 +1,107 @@
+package dataplane
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+const defaultQueueTimeout = time.Second
+
+// admissionGate enforces a requests-per-minute budget and a concurrency cap
+// for a provider or a single endpoint.
+type admissionGate struct {
+	rpm   *rateLimiter
+	slots chan struct{}
+}
+
+// newAdmissionGate returns nil when neither limit is configured.
+func newAdmissionGate(name string, maxRequestsPerMinute, concurrency int) *admissionGate {
+	if maxRequestsPerMinute <= 0 && concurrency <= 0 {
+		return nil
+	}
+	gate := &admissionGate{}
+	if maxRequestsPerMinute > 0 {
+		gate.rpm = newBucketLimiter(name, rateLimitKeyListener, float64(maxRequestsPerMinute)/60, float64(maxRequestsPerMinute))
+	}
+	if concurrency > 0 {
+		gate.slots = make(chan struct{}, concurrency)
+	}
+	return gate
+}
+
+func (g *admissionGate) TryAcquire() (func(), bool) {
+	if g.slots != nil {
+		select {
+		case g.slots <- struct{}{}:
+		default:
+			return nil, false
+		}
+	}
+	if g.rpm != nil {
+		if allowed, _ := g.rpm.allow(""); !allowed {
+			g.releaseSlot()
+			return nil, false
+		}
+	}
+	return g.releaser(), true
+}
+
+func (g *admissionGate) Acquire(ctx context.Context) (func(), error) {
+	if g.slots != nil {
+		select {
+		case g.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if g.rpm != nil {
+		for {
+			allowed, wait := g.rpm.allow("")
+			if allowed {
+				break
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				g.releaseSlot()
+				return nil, ctx.Err()
+			}
+		}
+	}
+	return g.releaser(), nil
+}
+
+func (g *admissionGate) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(g.releaseSlot)
+	}
+}
+
+func (g *admissionGate) releaseSlot() {
+	if g.slots != nil {
+		<-g.slots
+	}
+}
+
+func normalizeQuotaStrategy(limits config.ProviderLimitsConfig) (string, time.Duration) {
+	switch strings.ToLower(strings.TrimSpace(limits.Strategy)) {
+	case listeners.QuotaStrategyQueue:
+		timeout := time.Duration(limits.QueueTimeoutMillis) * time.Millisecond
+		if timeout <= 0 {
+			timeout = defaultQueueTimeout
+		}
+		return listeners.QuotaStrategyQueue, timeout
+	case listeners.QuotaStrategyReject:
+		return listeners.QuotaStrategyReject, 0
+	default:
+		return listeners.QuotaStrategySpill, 0
+	}
+}
@@ -0,0 +1,203 @@
+package dataplane
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+func TestAdmissionGate_ConcurrencyAndRelease(t *testing.T) {
+	t.Parallel()
+
+	gate := newAdmissionGate("provider", 0, 1)
+	release, ok := gate.TryAcquire()
+	if !ok {
+		t.Fatalf("expected first slot to be available")
+	}
+	if _, ok := gate.TryAcquire(); ok {
+		t.Fatalf("expected concurrency cap to refuse second slot")
+	}
+	release()
+	release()
+	if _, ok := gate.TryAcquire(); !ok {
+		t.Fatalf("expected slot to be available after release")
+	}
+	if _, ok := gate.TryAcquire(); ok {
+		t.Fatalf("expected double release to free only one slot")
+	}
+}
+
+func TestAdmissionGate_RequestsPerMinute(t *testing.T) {
+	t.Parallel()
+
+	gate := newAdmissionGate("provider", 2, 0)
+	now := time.Unix(1700000000, 0)
+	gate.rpm.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if _, ok := gate.TryAcquire(); !ok {
+			t.Fatalf("expected request %d within budget", i)
+		}
+	}
+	if _, ok := gate.TryAcquire(); ok {
+		t.Fatalf("expected third request in the same minute to be refused")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := gate.Acquire(ctx); err == nil {
+		t.Fatalf("expected queued acquire to time out")
+	}
+
+	now = now.Add(30 * time.Second)
+	if _, ok := gate.TryAcquire(); !ok {
+		t.Fatalf("expected token to refill after 30s")
+	}
+}
+
+func TestForwardProxy_ProviderConcurrencyRejectsWhileTunnelOpen(t *testing.T) {
+	t.Parallel()
+
+	target := startPingPongTCPServer(t)
+	defer target.Close()
+
+	cfg := &config.Config{
+		Providers: []config.ProviderConfig{{
+			Name:      "primary",
+			Type:      "direct",
+			Endpoints: []config.ProviderEndpoint{{URL: "http://direct.local", Priority: 1}},
+			Limits:    config.ProviderLimitsConfig{Concurrency: 1, Strategy: "reject"},
+		}},
+		Routing: config.RoutingConfig{DefaultProvider: "primary"},
+	}
+	proxy := startRuntimeProxy(t, cfg)
+	defer proxy.Close()
+
+	held, status := openConnectTunnel(t, proxy.URL, target.Addr().String())
+	if !strings.Contains(status, "200") {
+		t.Fatalf("expected first tunnel to be established, got %q", status)
+	}
+
+	rejected, status := openConnectTunnel(t, proxy.URL, target.Addr().String())
+	rejected.Close()
+	if !strings.Contains(status, "429") {
+		t.Fatalf("expected 429 while tunnel holds the slot, got %q", status)
+	}
+
+	held.Close()
+	waitForConnectStatus(t, proxy.URL, target.Addr().String(), "200")
+}
+
+func TestForwardProxy_ProviderConcurrencySpillsToFallback(t *testing.T) {
+	t.Parallel()
+
+	target := startPingPongTCPServer(t)
+	defer target.Close()
+
+	cfg := &config.Config{
+		Providers: []config.ProviderConfig{
+			{
+				Name:      "primary",
+				Type:      "direct",
+				Endpoints: []config.ProviderEndpoint{{URL: "http://primary.local", Priority: 1}},
+				Limits:    config.ProviderLimitsConfig{Concurrency: 1, FallbackProvider: "secondary"},
+			},
+			{
+				Name:      "secondary",
+				Type:      "direct",
+				Endpoints: []config.ProviderEndpoint{{URL: "http://secondary.local", Priority: 1, Concurrency: 1}},
+			},
+		},
+		Routing: config.RoutingConfig{DefaultProvider: "primary"},
+	}
+	proxy := startRuntimeProxy(t, cfg)
+	defer proxy.Close()
+
+	first, status := openConnectTunnel(t, proxy.URL, target.Addr().String())
+	defer first.Close()
+	if !strings.Contains(status, "200") {
+		t.Fatalf("expected primary tunnel, got %q", status)
+	}
+	second, status := openConnectTunnel(t, proxy.URL, target.Addr().String())
+	defer second.Close()
+	if !strings.Contains(status, "200") {
+		t.Fatalf("expected fallback provider tunnel, got %q", status)
+	}
+	third, status := openConnectTunnel(t, proxy.URL, target.Addr().String())
+	defer third.Close()
+	if !strings.Contains(status, "429") {
+		t.Fatalf("expected 429 once primary and fallback are saturated, got %q", status)
+	}
+}
+
+func TestForwardProxy_ProviderConcurrencyQueuesUntilSlotFrees(t *testing.T) {
+	t.Parallel()
+
+	target := startPingPongTCPServer(t)
+	defer target.Close()
+
+	cfg := &config.Config{
+		Providers: []config.ProviderConfig{{
+			Name:      "primary",
+			Type:      "direct",
+			Endpoints: []config.ProviderEndpoint{{URL: "http://direct.local", Priority: 1}},
+			Limits:    config.ProviderLimitsConfig{Concurrency: 1, Strategy: "queue", QueueTimeoutMillis: 3000},
+		}},
+		Routing: config.RoutingConfig{DefaultProvider: "primary"},
+	}
+	proxy := startRuntimeProxy(t, cfg)
+	defer proxy.Close()
+
+	held, status := openConnectTunnel(t, proxy.URL, target.Addr().String())
+	if !strings.Contains(status, "200") {
+		t.Fatalf("expected first tunnel to be established, got %q", status)
+	}
+	time.AfterFunc(100*time.Millisecond, func() { _ = held.Close() })
+
+	queued, status := openConnectTunnel(t, proxy.URL, target.Addr().String())
+	defer queued.Close()
+	if !strings.Contains(status, "200") {
+		t.Fatalf("expected queued tunnel to be established once the slot frees, got %q", status)
+	}
+}
+
+// openConnectTunnel issues a CONNECT and returns the connection with its status line.
+func openConnectTunnel(t *testing.T, proxyURL, targetAddr string) (net.Conn, string) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", strings.TrimPrefix(proxyURL, "http://"), time.Second)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", targetAddr, targetAddr); err != nil {
+		t.Fatalf("write connect: %v", err)
+	}
+	statusLine, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("read connect status: %v", err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, statusLine
+}
+
+func waitForConnectStatus(t *testing.T, proxyURL, targetAddr, want string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, status := openConnectTunnel(t, proxyURL, targetAddr)
+		conn.Close()
+		if strings.Contains(status, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected CONNECT status %s, last got %q", want, status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
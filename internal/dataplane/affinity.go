@@ -0,0 +1,163 @@
+package dataplane
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+// Affinity key sources.
+const (
+	AffinityKeyTenant        = "tenant"
+	AffinityKeySessionHeader = "session_header"
+	AffinityKeyProxyUser     = "proxy_user"
+	AffinityKeyClientIP      = "client_ip"
+
+	DefaultAffinityHeader   = listeners.HintSessionHeader
+	defaultAffinityReplicas = 100
+)
+
+// endpointAffinity pins requests sharing a key to the same endpoint using a
+// consistent-hash ring, so only keys owned by an endpoint that opens or closes
+// get remapped.
+type endpointAffinity struct {
+	key      string
+	header   string
+	replicas int
+
+	mu      sync.Mutex
+	members string
+	ring    []ringPoint
+}
+
+type ringPoint struct {
+	hash     uint64
+	endpoint string
+}
+
+// newEndpointAffinity returns nil when affinity is not configured.
+func newEndpointAffinity(cfg config.ProviderAffinityConfig) *endpointAffinity {
+	key := strings.ToLower(strings.TrimSpace(cfg.Key))
+	switch key {
+	case AffinityKeyTenant, AffinityKeySessionHeader, AffinityKeyProxyUser, AffinityKeyClientIP:
+	default:
+		return nil
+	}
+	header := strings.TrimSpace(cfg.Header)
+	if header == "" {
+		header = DefaultAffinityHeader
+	}
+	replicas := cfg.Replicas
+	if replicas <= 0 {
+		replicas = defaultAffinityReplicas
+	}
+	return &endpointAffinity{key: key, header: header, replicas: replicas}
+}
+
+// keyFor extracts the affinity key from the request, or "" when absent.
+func (a *endpointAffinity) keyFor(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	switch a.key {
+	case AffinityKeyTenant:
+		metadata, _ := listeners.MetadataFromContext(req.Context())
+		return metadata.TenantID
+	case AffinityKeySessionHeader:
+		return strings.TrimSpace(req.Header.Get(a.header))
+	case AffinityKeyProxyUser:
+		return proxyAuthUsername(req)
+	case AffinityKeyClientIP:
+		if req.RemoteAddr == "" {
+			return ""
+		}
+		return listeners.ClientIPFromAddr(req.RemoteAddr)
+	default:
+		return ""
+	}
+}
+
+// pin moves the endpoint owning key to the front of the top priority tier.
+// Lower tiers keep their order and only serve as failover.
+func (a *endpointAffinity) pin(provider listeners.RuntimeProvider, endpoints []listeners.RuntimeEndpoint, key string) {
+	if key == "" || len(endpoints) < 2 {
+		return
+	}
+	tierPriority := providerPriority(provider, endpoints[0])
+	end := 1
+	for end < len(endpoints) && providerPriority(provider, endpoints[end]) == tierPriority {
+		end++
+	}
+	tier := endpoints[:end]
+	owner := a.lookup(tier, key)
+	for i, endpoint := range tier {
+		if describeEndpoint(endpoint.URL) == owner {
+			copy(tier[1:i+1], tier[:i])
+			tier[0] = endpoint
+			return
+		}
+	}
+}
+
+func (a *endpointAffinity) lookup(tier []listeners.RuntimeEndpoint, key string) string {
+	names := make([]string, 0, len(tier))
+	for _, endpoint := range tier {
+		names = append(names, describeEndpoint(endpoint.URL))
+	}
+	sort.Strings(names)
+	members := strings.Join(names, "\n")
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if members != a.members {
+		a.members = members
+		a.ring = buildHashRing(names, a.replicas)
+	}
+	if len(a.ring) == 0 {
+		return ""
+	}
+	hash := hashKey(key)
+	idx := sort.Search(len(a.ring), func(i int) bool { return a.ring[i].hash >= hash })
+	if idx == len(a.ring) {
+		idx = 0
+	}
+	return a.ring[idx].endpoint
+}
+
+func buildHashRing(endpoints []string, replicas int) []ringPoint {
+	ring := make([]ringPoint, 0, len(endpoints)*replicas)
+	for _, endpoint := range endpoints {
+		for i := 0; i < replicas; i++ {
+			ring = append(ring, ringPoint{hash: hashKey(endpoint + "#" + strconv.Itoa(i)), endpoint: endpoint})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+func hashKey(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func proxyAuthUsername(req *http.Request) string {
+	value := strings.TrimSpace(req.Header.Get("Proxy-Authorization"))
+	scheme, encoded, ok := strings.Cut(value, " ")
+	if !ok || !strings.EqualFold(scheme, "basic") {
+		return ""
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return ""
+	}
+	username, _, _ := strings.Cut(string(decoded), ":")
+	return username
+}
@@ -0,0 +1,134 @@
+package dataplane
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+func newAffinityTestRegistry() *ProviderRegistry {
+	return NewProviderRegistry(&config.Config{Providers: []config.ProviderConfig{{
+		Name: "provider-a",
+		Type: "direct",
+		Endpoints: []config.ProviderEndpoint{
+			{URL: "http://a.example", Priority: 1},
+			{URL: "http://b.example", Priority: 1},
+			{URL: "http://c.example", Priority: 1},
+			{URL: "http://backup.example", Priority: 2},
+		},
+		Affinity: config.ProviderAffinityConfig{Key: "session_header"},
+		Health:   config.ProviderHealthConfig{Enabled: true, IntervalSeconds: 60, TimeoutSeconds: 1, FailureThreshold: 1},
+	}}})
+}
+
+func affinityLeader(t *testing.T, registry *ProviderRegistry, selector *EndpointSelector, session string) string {
+	t.Helper()
+	provider, ok := registry.Get("provider-a")
+	if !ok {
+		t.Fatalf("expected provider in registry")
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://target.example/", nil)
+	req.Header.Set(DefaultAffinityHeader, session)
+	selected := selector.Select(t.Context(), provider, req)
+	if len(selected) == 0 {
+		t.Fatalf("expected endpoints for session %q", session)
+	}
+	return selected[0].URL.Host
+}
+
+func TestEndpointSelector_AffinityIsStickyAndSpreads(t *testing.T) {
+	t.Parallel()
+
+	registry := newAffinityTestRegistry()
+	selector := NewEndpointSelector(registry)
+
+	owners := map[string]int{}
+	for i := 0; i < 60; i++ {
+		session := fmt.Sprintf("crawl-%d", i)
+		first := affinityLeader(t, registry, selector, session)
+		for j := 0; j < 3; j++ {
+			if got := affinityLeader(t, registry, selector, session); got != first {
+				t.Fatalf("expected session %q to stay on %s, got %s", session, first, got)
+			}
+		}
+		owners[first]++
+	}
+	if owners["backup.example"] != 0 {
+		t.Fatalf("expected lower priority tier to be failover only, got %v", owners)
+	}
+	if len(owners) != 3 {
+		t.Fatalf("expected sessions spread across the top tier, got %v", owners)
+	}
+}
+
+func TestEndpointSelector_AffinityRemapsMinimallyWhenEndpointOpens(t *testing.T) {
+	t.Parallel()
+
+	registry := newAffinityTestRegistry()
+	now := time.Date(2026, 4, 25, 12, 0, 0, 0, time.UTC)
+	registry.now = func() time.Time { return now }
+	selector := NewEndpointSelector(registry)
+
+	before := map[string]string{}
+	for i := 0; i < 60; i++ {
+		session := fmt.Sprintf("crawl-%d", i)
+		before[session] = affinityLeader(t, registry, selector, session)
+	}
+
+	opened, _ := url.Parse("http://b.example")
+	registry.ObserveEndpointOutcome("provider-a", opened, fmt.Errorf("connect refused"), listeners.TimeoutClassification(TimeoutUnknown))
+
+	for session, owner := range before {
+		got := affinityLeader(t, registry, selector, session)
+		if owner != "b.example" && got != owner {
+			t.Fatalf("expected session %q to keep %s after unrelated endpoint opened, got %s", session, owner, got)
+		}
+		if got == "b.example" {
+			t.Fatalf("expected open endpoint to be skipped for session %q", session)
+		}
+	}
+}
+
+func TestForwardProxy_StripsAffinityHeaderUpstream(t *testing.T) {
+	t.Parallel()
+
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(DefaultAffinityHeader) != "" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	cfg := &config.Config{
+		Providers: []config.ProviderConfig{{
+			Name:      "provider-direct",
+			Type:      "direct",
+			Endpoints: []config.ProviderEndpoint{{URL: "http://direct-a.local", Priority: 1}, {URL: "http://direct-b.local", Priority: 1}},
+			Affinity:  config.ProviderAffinityConfig{Key: "session_header"},
+		}},
+		Routing: config.RoutingConfig{DefaultProvider: "provider-direct"},
+	}
+	proxy := startRuntimeProxy(t, cfg)
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	req, _ := http.NewRequest(http.MethodGet, target.URL, nil)
+	req.Header.Set(DefaultAffinityHeader, "crawl-1")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected session header to be stripped upstream, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,95 @@
+package dataplane
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+// loginTemplate builds a provider's vendor-style upstream login from the
+// request's targeting hints.
+type loginTemplate struct {
+	username string
+	password string
+	session  bool
+	geo      config.ProviderGeoTargetingConfig
+	// sessions supplies the vendor session ID of open sticky sessions.
+	sessions providerSessions
+	// countries holds the configured country of each endpoint host, used
+	// when the request asks for none.
+	countries map[string]string
+}
+
+// newLoginTemplate returns nil when the provider sends its login as
+// configured.
+func newLoginTemplate(provider config.ProviderConfig, sessions providerSessions) *loginTemplate {
+	username, password := provider.Auth.AuthTemplates()
+	if username == "" && password == "" {
+		return nil
+	}
+	tmpl := &loginTemplate{
+		username:  username,
+		password:  password,
+		session:   provider.Session.Supported,
+		geo:       provider.GeoTargeting,
+		sessions:  sessions,
+		countries: map[string]string{},
+	}
+	for _, endpoint := range provider.Endpoints {
+		country := strings.TrimSpace(endpoint.Country)
+		if parsed, err := url.Parse(endpoint.URL); err == nil && country != "" {
+			tmpl.countries[parsed.Host] = country
+		}
+	}
+	return tmpl
+}
+
+// apply renders auth's username and password for a request to endpoint.
+func (t *loginTemplate) apply(ctx context.Context, endpoint *url.URL, auth config.ProviderAuthConfig) config.ProviderAuthConfig {
+	if t == nil {
+		return auth
+	}
+	hints := listeners.UpstreamHintsFromContext(ctx)
+	values := map[string]string{"username": auth.Username, "password": auth.Password}
+	if endpoint != nil {
+		values["country"] = t.countries[endpoint.Host]
+	}
+	if hints.Country != "" && t.geo.Allows("country") {
+		values["country"] = hints.Country
+	}
+	if t.geo.Allows("city") {
+		values["city"] = hints.City
+	}
+	if t.session {
+		values["session"] = hints.Session
+		if vendorID, ok := t.sessions.vendorSession(ctx); ok {
+			values["session"] = vendorID
+		}
+		if hints.SessionTTLMinutes > 0 {
+			values["session_ttl"] = strconv.Itoa(hints.SessionTTLMinutes)
+		}
+	}
+
+	if t.username != "" {
+		username, err := config.RenderAuthTemplate(t.username, values)
+		if err != nil {
+			slog.Warn("upstream username template not applied", "error", err)
+			return auth
+		}
+		auth.Username = username
+	}
+	if t.password != "" {
+		password, err := config.RenderAuthTemplate(t.password, values)
+		if err != nil {
+			slog.Warn("upstream password template not applied", "error", err)
+			return auth
+		}
+		auth.Password = password
+	}
+	return auth
+}
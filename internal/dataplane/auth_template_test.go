@@ -0,0 +1,130 @@
+package dataplane
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+func TestLoginTemplate_AppliesSupportedHints(t *testing.T) {
+	t.Parallel()
+
+	provider := config.ProviderConfig{
+		Auth:         config.ProviderAuthConfig{Type: "basic", Username: "acme", Password: "secret", Preset: "smartproxy"},
+		Endpoints:    []config.ProviderEndpoint{{URL: "http://gate.example:7000", Country: "de"}},
+		GeoTargeting: config.ProviderGeoTargetingConfig{Supported: true, Modes: []string{"country"}},
+	}
+	endpoint, _ := url.Parse("http://gate.example:7000")
+	hints := listeners.UpstreamHints{Country: "us", City: "boston", Session: "abc", SessionTTLMinutes: 10}
+	ctx := listeners.WithUpstreamHints(context.Background(), hints)
+
+	if got := newLoginTemplate(provider, providerSessions{}).apply(ctx, endpoint, provider.Auth); got.Username != "user-acme-country-us" || got.Password != "secret" {
+		t.Fatalf("expected country hint only, got %q / %q", got.Username, got.Password)
+	}
+	if got := newLoginTemplate(provider, providerSessions{}).apply(context.Background(), endpoint, provider.Auth); got.Username != "user-acme-country-de" {
+		t.Fatalf("expected endpoint country without hints, got %q", got.Username)
+	}
+
+	provider.Session.Supported = true
+	provider.GeoTargeting.Modes = nil
+	if got := newLoginTemplate(provider, providerSessions{}).apply(ctx, endpoint, provider.Auth); got.Username != "user-acme-country-us-city-boston-session-abc-sessionduration-10" {
+		t.Fatalf("expected every hint, got %q", got.Username)
+	}
+
+	provider.Auth.Preset = ""
+	if tmpl := newLoginTemplate(provider, providerSessions{}); tmpl != nil {
+		t.Fatalf("expected no template without a preset")
+	}
+}
+
+func TestForwardProxy_HTTPProxyAdapterUsernameTemplate(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var leaked, logins []string
+	targetHTTP := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		for header := range req.Header {
+			if strings.HasPrefix(header, "X-Microproxy-") {
+				leaked = append(leaked, header)
+			}
+		}
+		mu.Unlock()
+		_, _ = rw.Write([]byte("ok"))
+	}))
+	defer targetHTTP.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		decoded, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(req.Header.Get("Proxy-Authorization"), "Basic "))
+		mu.Lock()
+		logins = append(logins, string(decoded))
+		mu.Unlock()
+		rsp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer rsp.Body.Close()
+		rw.WriteHeader(rsp.StatusCode)
+		_, _ = io.Copy(rw, rsp.Body)
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		Providers: []config.ProviderConfig{{
+			Name: "residential",
+			Type: "http_proxy",
+			Auth: config.ProviderAuthConfig{
+				Type:             "basic",
+				Username:         "acme",
+				Password:         "secret",
+				UsernameTemplate: "user-{username}[-country-{country}][-session-{session}][-sesstime-{session_ttl}]",
+			},
+			Endpoints:    []config.ProviderEndpoint{{URL: upstream.URL, Priority: 1, Country: "de"}},
+			Session:      config.ProviderSessionConfig{Supported: true},
+			GeoTargeting: config.ProviderGeoTargetingConfig{Supported: true},
+		}},
+		Routing: config.RoutingConfig{DefaultProvider: "residential"},
+	}
+	proxy := startRuntimeProxy(t, cfg)
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	for _, hints := range []map[string]string{
+		{listeners.HintCountryHeader: "us", listeners.HintSessionHeader: "abc-123", listeners.HintSessionTTLHeader: "10"},
+		{},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, targetHTTP.URL, nil)
+		for header, value := range hints {
+			req.Header.Set(header, value)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("forward request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"user-acme-country-us-session-abc123-sesstime-10:secret", "user-acme-country-de:secret"}
+	if len(logins) != len(want) || logins[0] != want[0] || logins[1] != want[1] {
+		t.Fatalf("expected upstream logins %q, got %q", want, logins)
+	}
+	if len(leaked) != 0 {
+		t.Fatalf("expected hint headers to be stripped, origin saw %q", leaked)
+	}
+}
@@ -0,0 +1,247 @@
+package dataplane
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/internal/dataplane/providers"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+// builtinPlugin is a provider type shipped with the data plane. It is
+// registered like any other plugin, but its providers are served by an
+// in-process adapter with access to the registry's transports, credential
+// pools and sessions instead of through pluginAdapter. Its Plugin methods act
+// on the serving registry's providers; ValidateConfig has nothing to add to
+// config.ProviderConfig.Validate.
+type builtinPlugin struct {
+	adapter func(f upstreamAdapterFactory, provider config.ProviderConfig, credentials *credentialPool, transports adapterTransports) listeners.UpstreamAdapter
+}
+
+// builtinCapabilityTypes maps capabilities to the built-in type serving a
+// provider whose own type no plugin serves. Providers without any of these
+// capabilities are served as HTTP proxies.
+var builtinCapabilityTypes = map[string]string{
+	"direct":        "direct",
+	"socks5_proxy":  "socks5_proxy",
+	"forward_proxy": "http_proxy",
+}
+
+func init() {
+	httpProxy := builtinPlugin{adapter: newHTTPProxyAdapter}
+	providers.Register("direct", builtinPlugin{adapter: newDirectAdapter})
+	providers.Register("socks5_proxy", builtinPlugin{adapter: newSOCKS5ProxyAdapter})
+	for _, providerType := range []string{"http_proxy", "https_proxy", "legacy_upstream_proxy"} {
+		providers.Register(providerType, httpProxy)
+	}
+}
+
+// lookupProviderPlugin returns the plugin serving provider: the one
+// registered for its type or, for types nobody registered, the built-in its
+// capabilities name.
+func lookupProviderPlugin(provider config.ProviderConfig) providers.Plugin {
+	if plugin, ok := providers.Lookup(provider.Type); ok {
+		return plugin
+	}
+	providerType := "http_proxy"
+	for _, capability := range provider.Capabilities {
+		if builtin, ok := builtinCapabilityTypes[strings.ToLower(strings.TrimSpace(capability))]; ok {
+			providerType = builtin
+			break
+		}
+	}
+	plugin, _ := providers.Lookup(providerType)
+	return plugin
+}
+
+func newDirectAdapter(_ upstreamAdapterFactory, provider config.ProviderConfig, _ *credentialPool, transports adapterTransports) listeners.UpstreamAdapter {
+	return directAdapter{auth: provider.Auth, http2: provider.HTTP2, transports: transports}
+}
+
+func newHTTPProxyAdapter(f upstreamAdapterFactory, provider config.ProviderConfig, credentials *credentialPool, transports adapterTransports) listeners.UpstreamAdapter {
+	return httpProxyAdapter{
+		auth:        provider.Auth,
+		login:       newLoginTemplate(provider, providerSessions{manager: f.sessions, provider: provider.Name}),
+		credentials: credentials,
+		rotation:    newSessionRotator(provider),
+		transports:  transports,
+	}
+}
+
+func newSOCKS5ProxyAdapter(f upstreamAdapterFactory, provider config.ProviderConfig, credentials *credentialPool, transports adapterTransports) listeners.UpstreamAdapter {
+	return socks5ProxyAdapter{
+		auth:        provider.Auth,
+		login:       newLoginTemplate(provider, providerSessions{manager: f.sessions, provider: provider.Name}),
+		credentials: credentials,
+		rotation:    newSessionRotator(provider),
+		udp:         hasCapability(provider, "udp"),
+		transports:  transports,
+	}
+}
+
+// servingRegistry is the registry of the latest RequestRuntime, the one
+// serving traffic. Built-in plugins act through its adapters, so calls made
+// through the plugin registry share the providers' credential pools, rotation
+// state and sessions. Registries built for other uses never serve.
+var servingRegistry atomic.Pointer[ProviderRegistry]
+
+// errBuiltinNotServed fails built-in plugin calls for providers no serving
+// registry holds.
+var errBuiltinNotServed = errors.New("provider is not served by the data plane")
+
+// builtinDialTimeout bounds built-in plugin dials like the forward proxy's.
+const builtinDialTimeout = 10 * time.Second
+
+// served returns the serving registry and the endpoints it holds for
+// provider.
+func (builtinPlugin) served(provider config.ProviderConfig) (*ProviderRegistry, []listeners.RuntimeEndpoint, error) {
+	registry := servingRegistry.Load()
+	if registry == nil {
+		return nil, nil, fmt.Errorf("%w: %s", errBuiltinNotServed, provider.Name)
+	}
+	runtimeProvider, ok := registry.Get(provider.Name)
+	if !ok || len(runtimeProvider.Endpoints) == 0 {
+		return nil, nil, fmt.Errorf("%w: %s", errBuiltinNotServed, provider.Name)
+	}
+	return registry, runtimeProvider.Endpoints, nil
+}
+
+func (builtinPlugin) ValidateConfig(config.ProviderConfig) error { return nil }
+
+// ResolveEndpoint returns the first endpoint the serving registry would try:
+// a usable endpoint in the hinted country if there is one, of the best
+// priority.
+func (p builtinPlugin) ResolveEndpoint(_ context.Context, provider config.ProviderConfig, hint map[string]string) (config.ProviderEndpoint, error) {
+	_, endpoints, err := p.served(provider)
+	if err != nil {
+		return config.ProviderEndpoint{}, err
+	}
+	country := strings.ToLower(strings.TrimSpace(hint["country"]))
+	var (
+		best               config.ProviderEndpoint
+		bestMiss, bestPrio int
+		found              bool
+	)
+	for _, runtimeEndpoint := range endpoints {
+		if !endpointUsable(runtimeEndpoint) {
+			continue
+		}
+		configured := pluginProvider{provider: provider}.endpoint(runtimeEndpoint.URL)
+		miss := 0
+		if country != "" && !strings.EqualFold(configured.Country, country) {
+			miss = 1
+		}
+		if !found || miss < bestMiss || (miss == bestMiss && runtimeEndpoint.Priority < bestPrio) {
+			best, bestMiss, bestPrio, found = configured, miss, runtimeEndpoint.Priority, true
+		}
+	}
+	if !found {
+		return config.ProviderEndpoint{}, fmt.Errorf("provider %s has no healthy endpoint", provider.Name)
+	}
+	return best, nil
+}
+
+// PrepareRequest applies the serving adapter's upstream auth to req.
+func (p builtinPlugin) PrepareRequest(ctx context.Context, provider config.ProviderConfig, req *http.Request) error {
+	_, endpoints, err := p.served(provider)
+	if err != nil {
+		return err
+	}
+	prepared, err := endpoints[0].Adapter.PrepareRequest(req.WithContext(ctx), endpoints[0].URL)
+	if err != nil {
+		return err
+	}
+	req.Header = prepared.Header
+	return nil
+}
+
+// Dial opens plan through endpoint with the serving adapter, as a CONNECT
+// tunnel would.
+func (p builtinPlugin) Dial(ctx context.Context, provider config.ProviderConfig, endpoint config.ProviderEndpoint, plan providers.DialPlan) (net.Conn, error) {
+	if plan.Network != "" && plan.Network != "tcp" {
+		return nil, providers.ErrUnsupported
+	}
+	_, endpoints, err := p.served(provider)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := url.Parse(endpoint.URL)
+	if err != nil {
+		return nil, err
+	}
+	adapter := endpoints[0].Adapter
+	for _, runtimeEndpoint := range endpoints {
+		if describeEndpoint(runtimeEndpoint.URL) == describeEndpoint(parsed) {
+			adapter = runtimeEndpoint.Adapter
+			break
+		}
+	}
+	dialer := &net.Dialer{Timeout: builtinDialTimeout, KeepAlive: 30 * time.Second}
+	return adapter.DialConnect(ctx, plan.Address, parsed, dialer)
+}
+
+// Rotate rotates the provider's identity, or refreshes sessionID when set.
+func (p builtinPlugin) Rotate(ctx context.Context, provider config.ProviderConfig, sessionID string) (providers.RotateResult, error) {
+	registry, _, err := p.served(provider)
+	if err != nil {
+		return providers.RotateResult{}, err
+	}
+	if sessionID == "" {
+		err := registry.RotateIdentity(ctx, provider.Name)
+		if errors.Is(err, listeners.ErrRotateIdentityUnsupported) {
+			return providers.RotateResult{}, providers.ErrUnsupported
+		}
+		return providers.RotateResult{}, err
+	}
+	session, err := registry.Sessions().Refresh(sessionID)
+	if errors.Is(err, ErrSessionRefreshUnsupported) {
+		return providers.RotateResult{}, providers.ErrUnsupported
+	}
+	if err != nil {
+		return providers.RotateResult{}, err
+	}
+	return providers.RotateResult{SessionID: session.ID}, nil
+}
+
+// FetchStatus summarises the serving registry's endpoint health: healthy
+// when every endpoint is, unhealthy when none is usable, degraded otherwise.
+func (p builtinPlugin) FetchStatus(_ context.Context, provider config.ProviderConfig) (providers.StatusSnapshot, error) {
+	_, endpoints, err := p.served(provider)
+	if err != nil {
+		return providers.StatusSnapshot{}, err
+	}
+	var healthy, usable int
+	for _, endpoint := range endpoints {
+		if endpoint.Health.State == string(EndpointHealthHealthy) {
+			healthy++
+		}
+		if endpointUsable(endpoint) {
+			usable++
+		}
+	}
+	switch {
+	case healthy == len(endpoints):
+		return providers.StatusSnapshot{State: "healthy"}, nil
+	case usable == 0:
+		return providers.StatusSnapshot{State: "unhealthy", Reason: "no usable endpoint"}, nil
+	}
+	return providers.StatusSnapshot{State: "degraded", Reason: fmt.Sprintf("%d of %d endpoints healthy", healthy, len(endpoints))}, nil
+}
+
+// endpointUsable reports whether the registry still sends traffic to
+// endpoint.
+func endpointUsable(endpoint listeners.RuntimeEndpoint) bool {
+	switch EndpointHealthState(endpoint.Health.State) {
+	case EndpointHealthUnhealthy, EndpointHealthOpen:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+package dataplane
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/internal/observability"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+// connDropClientIP is reported when a client address is outside a
+// listener's or tenant's allowed subnets.
+const connDropClientIP = "client_ip_denied"
+
+// clientACL holds the subnets a listener or tenant accepts clients from.
+// Deny entries win over allow entries; an empty allow list admits everyone
+// not denied.
+type clientACL struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// newClientACL returns nil when neither list is set.
+func newClientACL(allow, deny []string) *clientACL {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil
+	}
+	return &clientACL{allow: listeners.ParseCIDRs(allow), deny: listeners.ParseCIDRs(deny)}
+}
+
+// permits reports whether the client at remoteAddr, with or without a port,
+// may connect. A nil ACL permits everyone; otherwise an address that does
+// not parse is refused.
+func (a *clientACL) permits(remoteAddr string) bool {
+	if a == nil {
+		return true
+	}
+	addr, err := netip.ParseAddr(listeners.ClientIPFromAddr(remoteAddr))
+	if err != nil {
+		return false
+	}
+	if listeners.AddrInPrefixes(addr, a.deny) {
+		return false
+	}
+	return len(a.allow) == 0 || listeners.AddrInPrefixes(addr, a.allow)
+}
+
+// tenantClientFilter is implemented by resolvers that restrict tenants to
+// client subnets.
+type tenantClientFilter interface {
+	allowsTenantClient(tenantID, clientIP string) bool
+}
+
+func newTenantACLs(tenants []config.TenantConfig) map[string]*clientACL {
+	acls := map[string]*clientACL{}
+	for _, tenant := range tenants {
+		if acl := newClientACL(tenant.AllowCIDRs, tenant.DenyCIDRs); acl != nil {
+			acls[tenant.ID] = acl
+		}
+	}
+	return acls
+}
+
+func (r *RouteResolver) allowsTenantClient(tenantID, clientIP string) bool {
+	return r.tenantACLs[tenantID].permits(clientIP)
+}
+
+// runtimeTenantFilter returns the tenant subnet checks of runtime, if any.
+func runtimeTenantFilter(runtime listeners.RequestRuntime) tenantClientFilter {
+	filter, _ := runtime.Resolver.(tenantClientFilter)
+	return filter
+}
+
+// aclListener closes accepted connections from clients outside the
+// listener's subnets.
+type aclListener struct {
+	net.Listener
+	name string
+	acl  *clientACL
+}
+
+func filterClients(listener net.Listener, name string, acl *clientACL) net.Listener {
+	if acl == nil {
+		return listener
+	}
+	return &aclListener{Listener: listener, name: name, acl: acl}
+}
+
+func (l *aclListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.acl.permits(conn.RemoteAddr().String()) {
+			return conn, nil
+		}
+		observability.RecordConnectionDropped(l.name, connDropClientIP)
+		_ = conn.Close()
+	}
+}
+
+// clientACLMiddleware refuses HTTP requests from clients outside the
+// listener's subnets, or outside those of the request's tenant, with a 403
+// JSON error.
+func clientACLMiddleware(listenerACL *clientACL, tenants tenantClientFilter, next http.Handler) http.Handler {
+	if listenerACL == nil && tenants == nil {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		metadata, _ := listeners.MetadataFromContext(req.Context())
+		if listenerACL.permits(req.RemoteAddr) && (tenants == nil || tenants.allowsTenantClient(metadata.TenantID, req.RemoteAddr)) {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		listeners.UpdateMetadata(req.Context(), func(metadata *listeners.RequestMetadata) {
+			metadata.PolicyAction = "deny"
+			metadata.PolicyReason = connDropClientIP
+			metadata.PolicyCategory = "security"
+		})
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(rw).Encode(map[string]any{
+			"error": map[string]string{
+				"code":     connDropClientIP,
+				"message":  "client address not allowed",
+				"category": "security",
+			},
+		})
+	})
+}
@@ -0,0 +1,105 @@
+package dataplane
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+func TestClientACL_AllowAndDeny(t *testing.T) {
+	t.Parallel()
+
+	if acl := newClientACL(nil, nil); acl != nil || !acl.permits("192.0.2.1:1000") {
+		t.Fatalf("expected nil ACL to permit everyone")
+	}
+	acl := newClientACL([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.9.0.0/16"})
+	for addr, want := range map[string]bool{
+		"10.1.2.3:1000":        true,
+		"10.9.1.1:1000":        false,
+		"192.0.2.1:1000":       false,
+		"[2001:db8::1]:1000":   true,
+		"[::ffff:10.1.2.3]:80": true,
+		"not-an-ip":            false,
+	} {
+		if got := acl.permits(addr); got != want {
+			t.Fatalf("%s: expected permits=%v, got %v", addr, want, got)
+		}
+	}
+	if acl := newClientACL(nil, []string{"10.0.0.0/8"}); !acl.permits("192.0.2.1:1000") || acl.permits("10.0.0.1:1000") {
+		t.Fatalf("expected deny-only ACL to refuse only denied clients")
+	}
+}
+
+func TestRouteResolver_ClientCIDRRule(t *testing.T) {
+	t.Parallel()
+
+	resolver := NewRouteResolver(&config.Config{Routing: config.RoutingConfig{
+		DefaultProvider: "public",
+		Rules: []config.RoutingRule{
+			{Name: "office", Match: map[string]string{"client_cidr": "10.0.0.0/8,192.168.0.0/16"}, Provider: "office"},
+		},
+	}})
+	for clientIP, want := range map[string]string{"10.0.0.7": "office", "192.168.1.1": "office", "192.0.2.1": "public"} {
+		decision, _ := resolver.Resolve(nil, listeners.RequestMetadata{ClientIP: clientIP})
+		if decision.Provider != want {
+			t.Fatalf("client %s: expected provider %q, got %q", clientIP, want, decision.Provider)
+		}
+	}
+}
+
+func TestSOCKS5ListenerManager_DenyCIDRsAtAccept(t *testing.T) {
+	t.Parallel()
+
+	proxyAddr := startLimitedSOCKS5Listener(t, config.ListenerConfig{DenyCIDRs: []string{"127.0.0.0/8"}})
+	conn, err := net.DialTimeout("tcp", proxyAddr, time.Second)
+	if err != nil {
+		t.Fatalf("dial socks listener: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	_, _ = conn.Write([]byte{0x05, 0x01, 0x00})
+	if _, err := conn.Read(make([]byte, 2)); err == nil || isTimeoutError(err) {
+		t.Fatalf("expected denied client to be disconnected, got %v", err)
+	}
+}
+
+func TestHTTPListenerManager_TenantAllowCIDRs(t *testing.T) {
+	t.Parallel()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	defer origin.Close()
+
+	cfg := &config.Config{
+		Listeners: []config.ListenerConfig{{Name: "edge", Type: "http", Address: "127.0.0.1:0", AllowCIDRs: []string{"127.0.0.0/8"}, Enabled: true}},
+		Tenants:   []config.TenantConfig{{Name: "remote", ID: "remote", AllowCIDRs: []string{"10.0.0.0/8"}}},
+	}
+	manager := NewHTTPListenerManager(cfg.Listeners, time.Second, false, NewRequestRuntime(cfg))
+	if err := manager.Start(context.Background()); err != nil {
+		t.Fatalf("start http manager: %v", err)
+	}
+	defer func() { _ = manager.Shutdown(context.Background()) }()
+	proxyURL := &url.URL{Scheme: "http", Host: manager.servers[0].listener.Addr().String()}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 5 * time.Second}
+
+	for tenant, want := range map[string]int{"": http.StatusNoContent, "remote": http.StatusForbidden} {
+		req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+		req.Header.Set("X-Tenant-ID", tenant)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request for tenant %q: %v", tenant, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("tenant %q: expected %d, got %d", tenant, want, resp.StatusCode)
+		}
+	}
+}
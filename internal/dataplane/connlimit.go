@@ -0,0 +1,108 @@
+package dataplane
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/internal/observability"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+// Reasons reported when a listener drops a connection.
+const (
+	connDropMaxConnections    = "max_connections"
+	connDropMaxConnsPerIP     = "max_connections_per_ip"
+	connDropReadHeaderTimeout = "read_header_timeout"
+)
+
+// connLimiter caps the connections a listener holds open, in total and per
+// client IP.
+type connLimiter struct {
+	listener string
+	max      int
+	maxPerIP int
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+// newConnLimiter returns nil when the listener has no connection caps.
+func newConnLimiter(cfg config.ListenerConfig) *connLimiter {
+	if cfg.MaxConnections <= 0 && cfg.MaxConnectionsPerIP <= 0 {
+		return nil
+	}
+	return &connLimiter{
+		listener: cfg.Name,
+		max:      cfg.MaxConnections,
+		maxPerIP: cfg.MaxConnectionsPerIP,
+		perIP:    map[string]int{},
+	}
+}
+
+// acquire reserves a slot for a connection from remoteAddr. When a cap is
+// reached it returns the reason instead.
+func (l *connLimiter) acquire(remoteAddr string) (func(), string) {
+	ip := listeners.ClientIPFromAddr(remoteAddr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.total >= l.max {
+		return nil, connDropMaxConnections
+	}
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return nil, connDropMaxConnsPerIP
+	}
+	l.total++
+	l.perIP[ip]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.total--
+			if l.perIP[ip]--; l.perIP[ip] <= 0 {
+				delete(l.perIP, ip)
+			}
+		})
+	}, ""
+}
+
+// limitListener closes accepted connections over the limiter's caps and ties
+// each admitted connection's slot to its Close.
+type limitListener struct {
+	net.Listener
+	limiter *connLimiter
+}
+
+func limitConnections(listener net.Listener, limiter *connLimiter) net.Listener {
+	if limiter == nil {
+		return listener
+	}
+	return &limitListener{Listener: listener, limiter: limiter}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		release, reason := l.limiter.acquire(conn.RemoteAddr().String())
+		if reason != "" {
+			observability.RecordConnectionDropped(l.limiter.listener, reason)
+			_ = conn.Close()
+			continue
+		}
+		return listeners.WrapConnRelease(conn, release), nil
+	}
+}
+
+// listenerTunnelLimits converts a listener's tunnel settings.
+func listenerTunnelLimits(cfg config.ListenerConfig) listeners.TunnelLimits {
+	return listeners.TunnelLimits{
+		IdleTimeout: time.Duration(cfg.TunnelIdleTimeoutSeconds) * time.Second,
+		MaxLifetime: time.Duration(cfg.MaxTunnelLifetimeSeconds) * time.Second,
+	}
+}
@@ -0,0 +1,195 @@
+package dataplane
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+func TestConnLimiter_TotalAndPerIPCaps(t *testing.T) {
+	t.Parallel()
+
+	if limiter := newConnLimiter(config.ListenerConfig{Name: "edge"}); limiter != nil {
+		t.Fatalf("expected nil limiter without connection caps")
+	}
+
+	limiter := newConnLimiter(config.ListenerConfig{Name: "edge", MaxConnections: 3, MaxConnectionsPerIP: 2})
+	releaseA, reason := limiter.acquire("10.0.0.1:1000")
+	if reason != "" {
+		t.Fatalf("expected first connection to be admitted, got %q", reason)
+	}
+	if _, reason := limiter.acquire("10.0.0.1:1001"); reason != "" {
+		t.Fatalf("expected second connection from the same IP to be admitted, got %q", reason)
+	}
+	if _, reason := limiter.acquire("10.0.0.1:1002"); reason != connDropMaxConnsPerIP {
+		t.Fatalf("expected per-IP cap, got %q", reason)
+	}
+	if _, reason := limiter.acquire("10.0.0.2:1000"); reason != "" {
+		t.Fatalf("expected connection from another IP to be admitted, got %q", reason)
+	}
+	if _, reason := limiter.acquire("10.0.0.3:1000"); reason != connDropMaxConnections {
+		t.Fatalf("expected listener cap, got %q", reason)
+	}
+
+	releaseA()
+	releaseA()
+	if _, reason := limiter.acquire("10.0.0.3:1000"); reason != "" {
+		t.Fatalf("expected released slot to be reusable once, got %q", reason)
+	}
+	if _, reason := limiter.acquire("10.0.0.4:1000"); reason != connDropMaxConnections {
+		t.Fatalf("expected double release to free a single slot, got %q", reason)
+	}
+}
+
+func startLimitedSOCKS5Listener(t *testing.T, listenerCfg config.ListenerConfig) string {
+	t.Helper()
+	listenerCfg.Name, listenerCfg.Type, listenerCfg.Address, listenerCfg.Enabled = "socks", "socks5", "127.0.0.1:0", true
+	mgr := NewSOCKS5ListenerManager([]config.ListenerConfig{listenerCfg}, time.Second, NewRequestRuntime(&config.Config{}))
+	if err := mgr.Start(context.Background()); err != nil {
+		t.Fatalf("start socks5 manager: %v", err)
+	}
+	t.Cleanup(func() { _ = mgr.Shutdown(context.Background()) })
+	return mgr.servers[0].listener.Addr().String()
+}
+
+func TestSOCKS5ListenerManager_MaxConnectionsPerIP(t *testing.T) {
+	t.Parallel()
+
+	target := startEchoTCPServer(t)
+	defer target.Close()
+	proxyAddr := startLimitedSOCKS5Listener(t, config.ListenerConfig{MaxConnectionsPerIP: 1})
+
+	host, port := splitAddr(t, target.Addr().String())
+	first := dialSOCKS5Tunnel(t, proxyAddr, host, port, "", "")
+	defer first.Close()
+
+	second, err := net.DialTimeout("tcp", proxyAddr, time.Second)
+	if err != nil {
+		t.Fatalf("dial socks listener: %v", err)
+	}
+	defer second.Close()
+	_ = second.SetDeadline(time.Now().Add(2 * time.Second))
+	_, _ = second.Write([]byte{0x05, 0x01, 0x00})
+	if _, err := second.Read(make([]byte, 2)); err == nil {
+		t.Fatalf("expected connection over the per-IP cap to be closed")
+	}
+
+	first.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.DialTimeout("tcp", proxyAddr, time.Second)
+		if err != nil {
+			t.Fatalf("dial socks listener: %v", err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(time.Second))
+		_, _ = conn.Write([]byte{0x05, 0x01, 0x00})
+		_, err = io.ReadFull(conn, make([]byte, 2))
+		conn.Close()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected slot to free once the first tunnel closed: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestSOCKS5ListenerManager_HandshakeTimeout(t *testing.T) {
+	t.Parallel()
+
+	proxyAddr := startLimitedSOCKS5Listener(t, config.ListenerConfig{ReadHeaderTimeoutSeconds: 1})
+	conn, err := net.DialTimeout("tcp", proxyAddr, time.Second)
+	if err != nil {
+		t.Fatalf("dial socks listener: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil || isTimeoutError(err) {
+		t.Fatalf("expected silent client to be disconnected, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Fatalf("expected disconnect after the handshake timeout, got %s", elapsed)
+	}
+}
+
+func TestSOCKS5ListenerManager_TunnelIdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	target := startEchoTCPServer(t)
+	defer target.Close()
+	proxyAddr := startLimitedSOCKS5Listener(t, config.ListenerConfig{TunnelIdleTimeoutSeconds: 1})
+
+	host, port := splitAddr(t, target.Addr().String())
+	conn := dialSOCKS5Tunnel(t, proxyAddr, host, port, "", "")
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(4 * time.Second))
+
+	// Traffic inside the window keeps the tunnel open past one timeout.
+	buf := make([]byte, 4)
+	for i := 0; i < 3; i++ {
+		time.Sleep(400 * time.Millisecond)
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("write ping %d: %v", i, err)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("expected active tunnel to stay open, got %v", err)
+		}
+	}
+	if _, err := conn.Read(buf); err == nil || isTimeoutError(err) {
+		t.Fatalf("expected idle tunnel to be closed, got %v", err)
+	}
+}
+
+func TestHTTPListenerManager_MaxTunnelLifetime(t *testing.T) {
+	t.Parallel()
+
+	target := startEchoTCPServer(t)
+	defer target.Close()
+	listenerCfg := config.ListenerConfig{
+		Name:                     "edge",
+		Type:                     "http",
+		Address:                  "127.0.0.1:0",
+		Enabled:                  true,
+		ReadHeaderTimeoutSeconds: 5,
+		MaxTunnelLifetimeSeconds: 1,
+	}
+	manager := NewHTTPListenerManager([]config.ListenerConfig{listenerCfg}, time.Second, false, NewRequestRuntime(&config.Config{}))
+	if got := manager.servers[0].server.ReadHeaderTimeout; got != 5*time.Second {
+		t.Fatalf("expected read header timeout of 5s, got %s", got)
+	}
+	if err := manager.Start(context.Background()); err != nil {
+		t.Fatalf("start http manager: %v", err)
+	}
+	defer func() { _ = manager.Shutdown(context.Background()) }()
+
+	conn, status := openConnectTunnel(t, "http://"+manager.servers[0].listener.Addr().String(), target.Addr().String())
+	defer conn.Close()
+	if !strings.Contains(status, "200") {
+		t.Fatalf("expected CONNECT to succeed, got %q", status)
+	}
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	start := time.Now()
+	buf := make([]byte, 4)
+	for {
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			break
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			if isTimeoutError(err) {
+				t.Fatalf("expected tunnel to be closed at its lifetime, got %v", err)
+			}
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Fatalf("expected busy tunnel to live until its lifetime, closed after %s", elapsed)
+	}
+}
@@ -0,0 +1,279 @@
+package dataplane
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/internal/observability"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+// Credential pool strategies.
+const (
+	CredentialStrategyRoundRobin    = "round_robin"
+	CredentialStrategyLeastUsed     = "least_used"
+	CredentialStrategySticky        = "sticky_session"
+	defaultCredentialQuarantineHits = 3
+	defaultCredentialQuarantine     = 5 * time.Minute
+)
+
+// errSocksAuthFailed is returned when a SOCKS5 server refuses the
+// username/password subnegotiation.
+var errSocksAuthFailed = errors.New("socks authentication failed")
+
+// credentialPool hands out a provider's basic credentials in turn and
+// quarantines those the upstream keeps refusing.
+type credentialPool struct {
+	provider        string
+	strategy        string
+	quarantineAfter int
+	quarantineFor   time.Duration
+	now             func() time.Time
+	// sessions pins sticky sessions to the credential they started with.
+	sessions providerSessions
+
+	mu      sync.Mutex
+	members []*pooledCredential
+	next    int
+}
+
+type pooledCredential struct {
+	username string
+	password string
+
+	requests         uint64
+	failures         uint64
+	consecutive      int
+	lastUsedAt       time.Time
+	lastFailureAt    time.Time
+	quarantinedUntil time.Time
+}
+
+// CredentialUsage is a point-in-time view of one pooled credential.
+type CredentialUsage struct {
+	Username         string
+	Requests         uint64
+	Failures         uint64
+	LastUsedAt       time.Time
+	LastFailureAt    time.Time
+	Quarantined      bool
+	QuarantinedUntil time.Time
+}
+
+// newCredentialPool returns nil when the provider has no pool. A credentials
+// file that cannot be read is logged and skipped, leaving the inline entries.
+func newCredentialPool(provider config.ProviderConfig, sessions providerSessions) *credentialPool {
+	cfg := provider.Auth.Pool
+	if !cfg.Enabled() {
+		return nil
+	}
+	credentials := append([]config.ProviderCredential(nil), cfg.Credentials...)
+	if path := strings.TrimSpace(cfg.File); path != "" {
+		loaded, err := config.LoadCredentialsFile(path)
+		if err != nil {
+			slog.Warn("credential pool file not loaded", "provider", provider.Name, "path", path, "error", err)
+		}
+		credentials = append(credentials, loaded...)
+	}
+	if len(credentials) == 0 {
+		return nil
+	}
+
+	pool := &credentialPool{
+		provider:        provider.Name,
+		strategy:        strings.ToLower(strings.TrimSpace(cfg.Strategy)),
+		quarantineAfter: cfg.QuarantineAfter,
+		quarantineFor:   time.Duration(cfg.QuarantineSeconds) * time.Second,
+		now:             time.Now,
+		sessions:        sessions,
+	}
+	if pool.quarantineAfter <= 0 {
+		pool.quarantineAfter = defaultCredentialQuarantineHits
+	}
+	if pool.quarantineFor <= 0 {
+		pool.quarantineFor = defaultCredentialQuarantine
+	}
+	for _, credential := range credentials {
+		pool.members = append(pool.members, &pooledCredential{username: credential.Username, password: credential.Password})
+	}
+	return pool
+}
+
+type pooledCredentialContextKey struct{}
+
+// withCredential picks a credential for the request under ctx, unless one is
+// already picked or a policy chose the upstream login.
+func (p *credentialPool) withCredential(ctx context.Context) context.Context {
+	if p == nil {
+		return ctx
+	}
+	if _, ok := ctx.Value(pooledCredentialContextKey{}).(*pooledCredential); ok {
+		return ctx
+	}
+	if _, ok := listeners.UpstreamCredentialsFromContext(ctx); ok {
+		return ctx
+	}
+	credential := p.pick(listeners.UpstreamHintsFromContext(ctx).Session, p.sessions.credential(ctx))
+	p.sessions.pinCredential(ctx, credential.username)
+	return context.WithValue(ctx, pooledCredentialContextKey{}, credential)
+}
+
+// pooledAuth swaps auth's username and password for the credential picked
+// under ctx.
+func pooledAuth(ctx context.Context, auth config.ProviderAuthConfig) config.ProviderAuthConfig {
+	credential, ok := ctx.Value(pooledCredentialContextKey{}).(*pooledCredential)
+	if !ok {
+		return auth
+	}
+	auth.Type = "basic"
+	auth.Username, auth.Password = credential.username, credential.password
+	return auth
+}
+
+// pick returns the next credential outside quarantine, preferring pinned,
+// the credential of an open sticky session. Sticky picks map the session to
+// a credential by rendezvous hashing, so a session only moves when its
+// credential is quarantined; requests without a session fall back to round
+// robin. When every credential is quarantined the one released soonest is
+// used.
+func (p *credentialPool) pick(session, pinned string) *pooledCredential {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+
+	var chosen *pooledCredential
+	for _, member := range p.members {
+		if pinned != "" && member.username == pinned && !member.quarantinedUntil.After(now) {
+			chosen = member
+		}
+	}
+	switch {
+	case chosen != nil:
+	case p.strategy == CredentialStrategySticky && session != "":
+		var best uint64
+		for _, member := range p.members {
+			if member.quarantinedUntil.After(now) {
+				continue
+			}
+			if score := rendezvousScore(session, member.username); chosen == nil || score > best {
+				chosen, best = member, score
+			}
+		}
+	case p.strategy == CredentialStrategyLeastUsed:
+		for _, member := range p.members {
+			if !member.quarantinedUntil.After(now) && (chosen == nil || member.requests < chosen.requests) {
+				chosen = member
+			}
+		}
+	default:
+		for range p.members {
+			member := p.members[p.next%len(p.members)]
+			p.next++
+			if !member.quarantinedUntil.After(now) {
+				chosen = member
+				break
+			}
+		}
+	}
+	if chosen == nil {
+		for _, member := range p.members {
+			if chosen == nil || member.quarantinedUntil.Before(chosen.quarantinedUntil) {
+				chosen = member
+			}
+		}
+	}
+	chosen.requests++
+	chosen.lastUsedAt = now
+	return chosen
+}
+
+func rendezvousScore(session, username string) uint64 {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(session))
+	_, _ = hash.Write([]byte{0})
+	_, _ = hash.Write([]byte(username))
+	return hash.Sum64()
+}
+
+// observe records how the upstream answered the credential picked under ctx;
+// status is 0 when the exchange has none. 407 responses and refused SOCKS
+// logins count as failures; other errors say nothing about the credential
+// and are ignored. A 403 to a forwarded request comes from the origin, so it
+// counts as a success.
+func (p *credentialPool) observe(ctx context.Context, status int, err error) {
+	if p == nil {
+		return
+	}
+	credential, ok := ctx.Value(pooledCredentialContextKey{}).(*pooledCredential)
+	if !ok {
+		return
+	}
+	failed := status == http.StatusProxyAuthRequired || errors.Is(err, errSocksAuthFailed)
+	if !failed && err != nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !failed {
+		credential.consecutive = 0
+		observability.RecordUpstreamCredentialUse(p.provider, credential.username, "success")
+		return
+	}
+	now := p.now()
+	credential.failures++
+	credential.consecutive++
+	credential.lastFailureAt = now
+	observability.RecordUpstreamCredentialUse(p.provider, credential.username, "auth_failure")
+	if credential.consecutive >= p.quarantineAfter {
+		credential.consecutive = 0
+		credential.quarantinedUntil = now.Add(p.quarantineFor)
+		observability.RecordUpstreamCredentialQuarantined(p.provider, credential.username)
+		slog.Warn("upstream credential quarantined", "provider", p.provider, "username", credential.username, "until", credential.quarantinedUntil)
+	}
+}
+
+// observeConnect is observe for the proxy's answer to a CONNECT, where a 403
+// is the proxy refusing the credential too.
+func (p *credentialPool) observeConnect(ctx context.Context, status int, err error) {
+	if status == http.StatusForbidden {
+		status = http.StatusProxyAuthRequired
+	}
+	p.observe(ctx, status, err)
+}
+
+func responseStatus(resp *http.Response) int {
+	if resp == nil {
+		return 0
+	}
+	return resp.StatusCode
+}
+
+func (p *credentialPool) snapshot() []CredentialUsage {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	usage := make([]CredentialUsage, 0, len(p.members))
+	for _, member := range p.members {
+		usage = append(usage, CredentialUsage{
+			Username:         member.username,
+			Requests:         member.requests,
+			Failures:         member.failures,
+			LastUsedAt:       member.lastUsedAt,
+			LastFailureAt:    member.lastFailureAt,
+			Quarantined:      member.quarantinedUntil.After(now),
+			QuarantinedUntil: member.quarantinedUntil,
+		})
+	}
+	return usage
+}
@@ -0,0 +1,272 @@
+package dataplane
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+func testCredentialPool(strategy string, usernames ...string) *credentialPool {
+	provider := config.ProviderConfig{Name: "pool", Auth: config.ProviderAuthConfig{Type: "basic"}}
+	provider.Auth.Pool.Strategy = strategy
+	provider.Auth.Pool.QuarantineAfter = 2
+	provider.Auth.Pool.QuarantineSeconds = 60
+	for _, username := range usernames {
+		provider.Auth.Pool.Credentials = append(provider.Auth.Pool.Credentials, config.ProviderCredential{Username: username, Password: "pass-" + username})
+	}
+	return newCredentialPool(provider, providerSessions{})
+}
+
+func TestCredentialPool_Strategies(t *testing.T) {
+	t.Parallel()
+
+	roundRobin := testCredentialPool("", "a", "b", "c")
+	var got []string
+	for range 4 {
+		got = append(got, roundRobin.pick("", "").username)
+	}
+	if strings.Join(got, ",") != "a,b,c,a" {
+		t.Fatalf("expected round robin order a,b,c,a, got %s", strings.Join(got, ","))
+	}
+
+	leastUsed := testCredentialPool(CredentialStrategyLeastUsed, "a", "b")
+	leastUsed.members[0].requests = 5
+	if picked := leastUsed.pick("", "").username; picked != "b" {
+		t.Fatalf("expected least used credential b, got %s", picked)
+	}
+
+	sticky := testCredentialPool(CredentialStrategySticky, "a", "b", "c", "d")
+	first := sticky.pick("session1", "").username
+	for range 5 {
+		if picked := sticky.pick("session1", "").username; picked != first {
+			t.Fatalf("expected session to stay on %s, got %s", first, picked)
+		}
+	}
+}
+
+func TestCredentialPool_QuarantinesRefusedCredential(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1_700_000_000, 0)
+	pool := testCredentialPool(CredentialStrategySticky, "a", "b")
+	pool.now = func() time.Time { return now }
+
+	ctx := listeners.WithUpstreamHints(context.Background(), listeners.UpstreamHints{Session: "s1"})
+	stuck := pool.pick("s1", "").username
+	for range 2 {
+		reqCtx := pool.withCredential(ctx)
+		if auth := pooledAuth(reqCtx, config.ProviderAuthConfig{}); auth.Username != stuck || auth.Password != "pass-"+stuck {
+			t.Fatalf("expected pooled login %s, got %q / %q", stuck, auth.Username, auth.Password)
+		}
+		pool.observe(reqCtx, http.StatusProxyAuthRequired, nil)
+	}
+
+	if picked := pool.pick("s1", "").username; picked == stuck {
+		t.Fatalf("expected quarantined credential %s to be skipped", stuck)
+	}
+	var quarantined bool
+	for _, usage := range pool.snapshot() {
+		if usage.Username == stuck {
+			quarantined = usage.Quarantined
+			if usage.Failures != 2 {
+				t.Fatalf("expected 2 failures, got %d", usage.Failures)
+			}
+		}
+	}
+	if !quarantined {
+		t.Fatalf("expected %s to be reported quarantined", stuck)
+	}
+
+	now = now.Add(61 * time.Second)
+	if picked := pool.pick("s1", "").username; picked != stuck {
+		t.Fatalf("expected %s back after the quarantine, got %s", stuck, picked)
+	}
+}
+
+func TestForwardProxy_CredentialPoolRotatesAwayFromRefusedLogin(t *testing.T) {
+	t.Parallel()
+
+	targetHTTP := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte("ok"))
+	}))
+	defer targetHTTP.Close()
+
+	var mu sync.Mutex
+	var logins []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		decoded, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(req.Header.Get("Proxy-Authorization"), "Basic "))
+		mu.Lock()
+		logins = append(logins, string(decoded))
+		mu.Unlock()
+		if string(decoded) == "banned:pass" {
+			rw.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		rsp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer rsp.Body.Close()
+		rw.WriteHeader(rsp.StatusCode)
+		_, _ = io.Copy(rw, rsp.Body)
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		Providers: []config.ProviderConfig{{
+			Name: "pooled",
+			Type: "http_proxy",
+			Auth: config.ProviderAuthConfig{
+				Type: "basic",
+				Pool: config.ProviderCredentialPoolConfig{
+					Credentials:     []config.ProviderCredential{{Username: "banned", Password: "pass"}, {Username: "good", Password: "pass"}},
+					QuarantineAfter: 1,
+				},
+			},
+			Endpoints: []config.ProviderEndpoint{{URL: upstream.URL, Priority: 1}},
+		}},
+		Routing: config.RoutingConfig{DefaultProvider: "pooled"},
+	}
+	proxy := startRuntimeProxy(t, cfg)
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	var statuses []int
+	for range 4 {
+		resp, err := client.Get(targetHTTP.URL)
+		if err != nil {
+			t.Fatalf("forward request failed: %v", err)
+		}
+		resp.Body.Close()
+		statuses = append(statuses, resp.StatusCode)
+	}
+
+	if statuses[0] != http.StatusProxyAuthRequired {
+		t.Fatalf("expected the first request to surface the refused login, got %d", statuses[0])
+	}
+	for _, status := range statuses[1:] {
+		if status != http.StatusOK {
+			t.Fatalf("expected later requests to use the good login, got %v", statuses)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, login := range logins[1:] {
+		if login != "good:pass" {
+			t.Fatalf("expected quarantined login to be skipped, got %q", logins)
+		}
+	}
+}
+
+func TestForwardProxy_CredentialPoolIgnoresOriginForbidden(t *testing.T) {
+	t.Parallel()
+
+	targetHTTP := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusForbidden)
+	}))
+	defer targetHTTP.Close()
+	upstream, _ := startCountingUpstreamProxy(t)
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		Providers: []config.ProviderConfig{{
+			Name: "pooled",
+			Type: "http_proxy",
+			Auth: config.ProviderAuthConfig{
+				Type: "basic",
+				Pool: config.ProviderCredentialPoolConfig{
+					Credentials:     []config.ProviderCredential{{Username: "only", Password: "pass"}},
+					QuarantineAfter: 1,
+				},
+			},
+			Endpoints: []config.ProviderEndpoint{{URL: upstream.URL, Priority: 1}},
+		}},
+		Routing: config.RoutingConfig{DefaultProvider: "pooled"},
+	}
+	runtime := NewRequestRuntime(cfg)
+	registry := runtime.Registry.(*ProviderRegistry)
+	proxy := httptest.NewServer(listeners.MetadataMiddleware(listeners.NewForwardProxyHandlerWithRuntime(runtime)))
+	defer proxy.Close()
+
+	client := proxyClient(t, proxy.URL)
+	for range 2 {
+		resp, err := client.Get(targetHTTP.URL)
+		if err != nil {
+			t.Fatalf("forward request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected the origin's 403, got %d", resp.StatusCode)
+		}
+	}
+
+	usage := registry.SnapshotProviderCredentials("pooled")
+	if len(usage) != 1 || usage[0].Failures != 0 || usage[0].Quarantined {
+		t.Fatalf("expected the credential to stay healthy, got %+v", usage)
+	}
+}
+
+func TestForwardProxy_CredentialPoolQuarantinesRefusedSOCKS5Login(t *testing.T) {
+	t.Parallel()
+
+	targetHTTP := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte("ok"))
+	}))
+	defer targetHTTP.Close()
+	socksListener := startSOCKS5Proxy(t, "good", "pass")
+	defer socksListener.Close()
+
+	cfg := &config.Config{
+		Providers: []config.ProviderConfig{{
+			Name: "pooled-socks",
+			Type: "socks5_proxy",
+			Auth: config.ProviderAuthConfig{
+				Type: "basic",
+				Pool: config.ProviderCredentialPoolConfig{
+					Credentials:     []config.ProviderCredential{{Username: "banned", Password: "pass"}, {Username: "good", Password: "pass"}},
+					QuarantineAfter: 1,
+				},
+			},
+			Endpoints: []config.ProviderEndpoint{{URL: "socks5://" + socksListener.Addr().String(), Priority: 1}},
+		}},
+		Routing: config.RoutingConfig{DefaultProvider: "pooled-socks"},
+	}
+	runtime := NewRequestRuntime(cfg)
+	registry := runtime.Registry.(*ProviderRegistry)
+	proxy := httptest.NewServer(listeners.MetadataMiddleware(listeners.NewForwardProxyHandlerWithRuntime(runtime)))
+	defer proxy.Close()
+
+	client := proxyClient(t, proxy.URL)
+	for range 3 {
+		resp, err := client.Get(targetHTTP.URL)
+		if err != nil {
+			t.Fatalf("forward request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	for _, usage := range registry.SnapshotProviderCredentials("pooled-socks") {
+		switch usage.Username {
+		case "banned":
+			if usage.Failures == 0 || !usage.Quarantined {
+				t.Fatalf("expected the refused login to be quarantined, got %+v", usage)
+			}
+		case "good":
+			if usage.Failures != 0 || usage.Requests == 0 {
+				t.Fatalf("expected the accepted login to serve requests, got %+v", usage)
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package dataplane
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+// startSlowUpstream holds every request until delay passes or the caller
+// gives up, then answers with body.
+func startSlowUpstream(t *testing.T, delay time.Duration, body string, hits, cancelled *atomic.Int64) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		hits.Add(1)
+		_, _ = io.Copy(io.Discard, req.Body)
+		select {
+		case <-time.After(delay):
+			_, _ = rw.Write([]byte(body))
+		case <-req.Context().Done():
+			cancelled.Add(1)
+		}
+	}))
+}
+
+func hedgingConfig(delay time.Duration, endpoints ...string) *config.Config {
+	cfg := retryProviderConfig(config.ProviderRetryConfig{}, endpoints...)
+	cfg.Providers[0].Hedging = config.ProviderHedgingConfig{DelayMillis: int(delay / time.Millisecond)}
+	return cfg
+}
+
+func TestForwardProxy_HedgeWinsOverSlowEndpoint(t *testing.T) {
+	t.Parallel()
+
+	var slowHits, slowCancelled, fastHits, fastCancelled atomic.Int64
+	slow := startSlowUpstream(t, 5*time.Second, "slow", &slowHits, &slowCancelled)
+	defer slow.Close()
+	fast := startSlowUpstream(t, 0, "fast", &fastHits, &fastCancelled)
+	defer fast.Close()
+
+	proxy := startRuntimeProxy(t, hedgingConfig(50*time.Millisecond, slow.URL, fast.URL))
+	defer proxy.Close()
+
+	started := time.Now()
+	status, body := doProxyRequest(t, proxy.URL, http.MethodGet, "http://target.example/", nil)
+	if status != http.StatusOK || body != "fast" {
+		t.Fatalf("expected hedge response, got %d %q", status, body)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Fatalf("expected hedge to cut latency, took %s", elapsed)
+	}
+	if slowHits.Load() != 1 || fastHits.Load() != 1 {
+		t.Fatalf("expected one attempt per endpoint, got slow=%d fast=%d", slowHits.Load(), fastHits.Load())
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for slowCancelled.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if slowCancelled.Load() != 1 {
+		t.Fatalf("expected losing attempt to be cancelled")
+	}
+}
+
+func TestForwardProxy_HedgeNotLaunchedForFastEndpoint(t *testing.T) {
+	t.Parallel()
+
+	var primaryHits, secondaryHits, cancelled atomic.Int64
+	primary := startSlowUpstream(t, 0, "primary", &primaryHits, &cancelled)
+	defer primary.Close()
+	secondary := startSlowUpstream(t, 0, "secondary", &secondaryHits, &cancelled)
+	defer secondary.Close()
+
+	proxy := startRuntimeProxy(t, hedgingConfig(time.Second, primary.URL, secondary.URL))
+	defer proxy.Close()
+
+	for i := 0; i < 3; i++ {
+		if status, body := doProxyRequest(t, proxy.URL, http.MethodGet, "http://target.example/", nil); status != http.StatusOK || body != "primary" {
+			t.Fatalf("expected primary response, got %d %q", status, body)
+		}
+	}
+	if secondaryHits.Load() != 0 {
+		t.Fatalf("expected no hedge for fast responses, got %d", secondaryHits.Load())
+	}
+}
+
+func TestForwardProxy_HedgeSkipsNonIdempotentMethods(t *testing.T) {
+	t.Parallel()
+
+	var primaryHits, secondaryHits, cancelled atomic.Int64
+	primary := startSlowUpstream(t, 200*time.Millisecond, "primary", &primaryHits, &cancelled)
+	defer primary.Close()
+	secondary := startSlowUpstream(t, 0, "secondary", &secondaryHits, &cancelled)
+	defer secondary.Close()
+
+	proxy := startRuntimeProxy(t, hedgingConfig(20*time.Millisecond, primary.URL, secondary.URL))
+	defer proxy.Close()
+
+	if status, body := doProxyRequest(t, proxy.URL, http.MethodPost, "http://target.example/", []byte("order")); status != http.StatusOK || body != "primary" {
+		t.Fatalf("expected primary response for POST, got %d %q", status, body)
+	}
+	if secondaryHits.Load() != 0 {
+		t.Fatalf("expected POST not to be hedged")
+	}
+}
@@ -0,0 +1,295 @@
+package dataplane
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+// writeSelfSignedCert writes a 127.0.0.1 certificate and key into a temp dir
+// and returns their paths with a pool that trusts the certificate.
+func writeSelfSignedCert(t *testing.T) (string, string, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "microproxy-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+// startHTTPListener starts a single listener through HTTPListenerManager and
+// returns its bound address.
+func startHTTPListener(t *testing.T, listenerCfg config.ListenerConfig) string {
+	t.Helper()
+	listenerCfg.Name = "h2-test"
+	listenerCfg.Address = "127.0.0.1:0"
+	listenerCfg.Enabled = true
+	manager := NewHTTPListenerManager([]config.ListenerConfig{listenerCfg}, time.Second, false, NewRequestRuntime(&config.Config{}))
+	if err := manager.Start(context.Background()); err != nil {
+		t.Fatalf("start listener: %v", err)
+	}
+	t.Cleanup(func() { _ = manager.Shutdown(context.Background()) })
+	return manager.servers[0].listener.Addr().String()
+}
+
+// h2cClient speaks prior-knowledge h2c to the proxy whatever the request URL.
+func h2cClient(proxyAddr string) *http.Transport {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Transport{
+		Protocols: protocols,
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, proxyAddr)
+		},
+	}
+}
+
+func startProtoOrigin(t *testing.T) *httptest.Server {
+	t.Helper()
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(rw, req.Proto)
+	}))
+	origin.EnableHTTP2 = true
+	return origin
+}
+
+func TestHTTPListener_H2CForward(t *testing.T) {
+	t.Parallel()
+
+	origin := startProtoOrigin(t)
+	origin.Start()
+	defer origin.Close()
+
+	proxyAddr := startHTTPListener(t, config.ListenerConfig{Type: "http", HTTP2: true})
+	req, _ := http.NewRequest(http.MethodGet, origin.URL+"/", nil)
+	resp, err := h2cClient(proxyAddr).RoundTrip(req)
+	if err != nil {
+		t.Fatalf("h2c request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 over HTTP/2, got %d over %s", resp.StatusCode, resp.Proto)
+	}
+	if string(body) != "HTTP/1.1" {
+		t.Fatalf("expected origin to be reached over HTTP/1.1, got %q", body)
+	}
+
+	plainAddr := startHTTPListener(t, config.ListenerConfig{Type: "http"})
+	if resp, err := h2cClient(plainAddr).RoundTrip(req.Clone(context.Background())); err == nil {
+		resp.Body.Close()
+		t.Fatalf("expected h2c to be refused without http2 enabled")
+	}
+}
+
+func TestHTTPSListener_H2Connect(t *testing.T) {
+	t.Parallel()
+
+	target := startPingPongTCPServer(t)
+	defer target.Close()
+
+	certFile, keyFile, pool := writeSelfSignedCert(t)
+	proxyAddr := startHTTPListener(t, config.ListenerConfig{
+		Type:  "https",
+		HTTP2: true,
+		TLS:   &config.TLSConfig{CertFile: certFile, KeyFile: keyFile},
+	})
+
+	protocols := new(http.Protocols)
+	protocols.SetHTTP2(true)
+	transport := &http.Transport{Protocols: protocols, TLSClientConfig: &tls.Config{RootCAs: pool}}
+	defer transport.CloseIdleConnections()
+
+	requestBody, requestWriter := io.Pipe()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "https", Host: proxyAddr},
+		Host:   target.Addr().String(),
+		Header: http.Header{},
+		Body:   requestBody,
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("h2 CONNECT failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 over HTTP/2, got %d over %s", resp.StatusCode, resp.Proto)
+	}
+
+	if _, err := io.WriteString(requestWriter, "ping"); err != nil {
+		t.Fatalf("write through tunnel: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("expected pong through h2 tunnel, got %q err=%v", buf, err)
+	}
+	_ = requestWriter.Close()
+}
+
+// streamWriter stands in for an HTTP/2 response stream: the status is
+// published once and body writes reach the client as they are flushed.
+type streamWriter struct {
+	header http.Header
+	status chan int
+	body   *io.PipeWriter
+}
+
+func (w *streamWriter) Header() http.Header { return w.header }
+
+func (w *streamWriter) WriteHeader(status int) { w.status <- status }
+
+func (w *streamWriter) Write(p []byte) (int, error) { return w.body.Write(p) }
+
+func (w *streamWriter) Flush() {}
+
+// net/http clients cannot send :protocol, so the extended CONNECT request is
+// handed to the proxy the way the HTTP/2 server would present it.
+func TestForwardProxy_H2ExtendedConnect(t *testing.T) {
+	t.Parallel()
+
+	backend := startEchoUpgradeServer(t)
+	defer backend.Close()
+
+	handler := listeners.MetadataMiddleware(listeners.NewForwardProxyHandlerWithRuntime(NewRequestRuntime(&config.Config{})))
+	requestBody, requestWriter := io.Pipe()
+	responseBody, responseWriter := io.Pipe()
+	req := httptest.NewRequest(http.MethodConnect, "/ws", requestBody)
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	req.Host = strings.TrimPrefix(backend.URL, "http://")
+	req.Header.Set(":protocol", "echo")
+	rw := &streamWriter{header: http.Header{}, status: make(chan int, 1), body: responseWriter}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(rw, req)
+		_ = responseWriter.Close()
+	}()
+
+	select {
+	case status := <-rw.status:
+		if status != http.StatusOK {
+			t.Fatalf("expected 200 for extended CONNECT, got %d", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for extended CONNECT response")
+	}
+	if rw.header.Get("Upgrade") != "" || rw.header.Get("Connection") != "" {
+		t.Fatalf("expected HTTP/1.1 upgrade headers to be stripped, got %v", rw.header)
+	}
+
+	if _, err := io.WriteString(requestWriter, "ping"); err != nil {
+		t.Fatalf("write through upgrade: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(responseBody, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected echo through extended CONNECT, got %q err=%v", buf, err)
+	}
+	_ = requestWriter.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected tunnel to close after the client stream ended")
+	}
+}
+
+func TestForwardProxy_DirectProviderHTTP2ToOrigin(t *testing.T) {
+	t.Parallel()
+
+	origin := startProtoOrigin(t)
+	origin.StartTLS()
+	defer origin.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(origin.Certificate())
+
+	for _, tc := range []struct {
+		http2 bool
+		want  string
+	}{
+		{http2: true, want: "HTTP/2.0"},
+		{http2: false, want: "HTTP/1.1"},
+	} {
+		cfg := &config.Config{
+			Providers: []config.ProviderConfig{{
+				Name:      "provider-direct",
+				Type:      "direct",
+				Endpoints: []config.ProviderEndpoint{{URL: "http://direct-a.local", Priority: 1}},
+				HTTP2:     tc.http2,
+			}},
+			Routing: config.RoutingConfig{DefaultProvider: "provider-direct"},
+		}
+		handler := listeners.NewForwardProxyHandlerWithRuntime(NewRequestRuntime(cfg))
+		handler.Transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		proxy := httptest.NewServer(listeners.MetadataMiddleware(handler))
+
+		conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+		if err != nil {
+			t.Fatalf("dial proxy: %v", err)
+		}
+		host := strings.TrimPrefix(origin.URL, "https://")
+		_, _ = fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", origin.URL, host)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("read proxy response: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		conn.Close()
+		handler.CloseIdleConnections()
+		proxy.Close()
+
+		if resp.StatusCode != http.StatusOK || string(body) != tc.want {
+			t.Fatalf("http2=%t: expected origin to see %s, got %d %q", tc.http2, tc.want, resp.StatusCode, body)
+		}
+	}
+}
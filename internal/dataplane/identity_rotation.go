@@ -0,0 +1,136 @@
+package dataplane
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+// Identity rotation modes.
+const (
+	RotationPerRequest = "per_request"
+	RotationInterval   = "interval"
+	RotationOnFailure  = "on_failure"
+	RotationManual     = "manual"
+)
+
+// sessionRotator owns the session token a session-based provider receives
+// when the client does not pin one with a session hint. Rotating the token
+// moves later requests to a new upstream identity.
+type sessionRotator struct {
+	provider string
+	mode     string
+	interval time.Duration
+	now      func() time.Time
+
+	mu        sync.Mutex
+	token     string
+	rotatedAt time.Time
+}
+
+// newSessionRotator returns nil when rotation is disabled, the provider keeps
+// no sessions, or its auth templates have no {session} to rotate.
+func newSessionRotator(provider config.ProviderConfig) *sessionRotator {
+	if !provider.Rotation.Enabled || !provider.Session.Supported {
+		return nil
+	}
+	username, password := provider.Auth.AuthTemplates()
+	if !strings.Contains(username+password, "{session}") {
+		return nil
+	}
+	mode := strings.ToLower(strings.TrimSpace(provider.Rotation.Mode))
+	if mode == "" {
+		mode = RotationManual
+	}
+	r := &sessionRotator{
+		provider: provider.Name,
+		mode:     mode,
+		interval: time.Duration(provider.Rotation.IntervalSeconds) * time.Second,
+		now:      time.Now,
+	}
+	r.token, r.rotatedAt = newSessionToken(), r.now()
+	return r
+}
+
+type rotatedSessionContextKey struct{}
+
+// withSession sets the provider's session token as the request's session
+// hint, unless the client sent its own.
+func (r *sessionRotator) withSession(ctx context.Context) context.Context {
+	if r == nil {
+		return ctx
+	}
+	hints := listeners.UpstreamHintsFromContext(ctx)
+	if hints.Session != "" {
+		return ctx
+	}
+	hints.Session = r.current()
+	ctx = context.WithValue(ctx, rotatedSessionContextKey{}, hints.Session)
+	return listeners.WithUpstreamHints(ctx, hints)
+}
+
+func (r *sessionRotator) current() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch r.mode {
+	case RotationPerRequest:
+		r.token, r.rotatedAt = newSessionToken(), r.now()
+	case RotationInterval:
+		if now := r.now(); r.interval > 0 && now.Sub(r.rotatedAt) >= r.interval {
+			r.token, r.rotatedAt = newSessionToken(), now
+		}
+	}
+	return r.token
+}
+
+// rotate replaces the session token now, whatever the mode.
+func (r *sessionRotator) rotate(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rotateLocked(reason)
+}
+
+func (r *sessionRotator) rotateLocked(reason string) {
+	r.token, r.rotatedAt = newSessionToken(), r.now()
+	slog.Info("upstream session rotated", "provider", r.provider, "reason", reason)
+}
+
+// observe rotates an on_failure session after the upstream failed a request
+// that used it: a transport error, a refused login, rate limiting or a
+// server error. Failures of a token already rotated away are ignored.
+func (r *sessionRotator) observe(ctx context.Context, status int, err error) {
+	if r == nil || r.mode != RotationOnFailure {
+		return
+	}
+	token, ok := ctx.Value(rotatedSessionContextKey{}).(string)
+	if !ok {
+		return
+	}
+	failed := (err != nil && !errors.Is(err, context.Canceled)) || status == http.StatusProxyAuthRequired || status == http.StatusForbidden ||
+		status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+	if !failed {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if token == r.token {
+		r.rotateLocked("upstream_failure")
+	}
+}
+
+func newSessionToken() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,182 @@
+package dataplane
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/internal/observability"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+func testSessionRotator(mode string, intervalSeconds int) *sessionRotator {
+	return newSessionRotator(config.ProviderConfig{
+		Name:     "rotating",
+		Auth:     config.ProviderAuthConfig{Type: "basic", Username: "acme", Password: "secret", Preset: "brightdata"},
+		Session:  config.ProviderSessionConfig{Supported: true},
+		Rotation: config.ProviderRotationConfig{Enabled: true, Mode: mode, IntervalSeconds: intervalSeconds},
+	})
+}
+
+func sessionOf(ctx context.Context) string {
+	return listeners.UpstreamHintsFromContext(ctx).Session
+}
+
+func TestSessionRotator_Modes(t *testing.T) {
+	t.Parallel()
+
+	manual := testSessionRotator("", 0)
+	first := sessionOf(manual.withSession(context.Background()))
+	if first == "" || sessionOf(manual.withSession(context.Background())) != first {
+		t.Fatalf("expected a stable manual session, got %q", first)
+	}
+	manual.rotate("manual")
+	if next := sessionOf(manual.withSession(context.Background())); next == first {
+		t.Fatalf("expected rotate to change the session, still %q", next)
+	}
+
+	perRequest := testSessionRotator(RotationPerRequest, 0)
+	if a, b := sessionOf(perRequest.withSession(context.Background())), sessionOf(perRequest.withSession(context.Background())); a == b {
+		t.Fatalf("expected a new session per request, got %q twice", a)
+	}
+
+	now := time.Unix(1_700_000_000, 0)
+	interval := testSessionRotator(RotationInterval, 60)
+	interval.now = func() time.Time { return now }
+	interval.rotatedAt = now
+	first = sessionOf(interval.withSession(context.Background()))
+	now = now.Add(59 * time.Second)
+	if next := sessionOf(interval.withSession(context.Background())); next != first {
+		t.Fatalf("expected the session to hold within the interval, got %q then %q", first, next)
+	}
+	now = now.Add(time.Second)
+	if next := sessionOf(interval.withSession(context.Background())); next == first {
+		t.Fatalf("expected the session to rotate after the interval, still %q", next)
+	}
+
+	onFailure := testSessionRotator(RotationOnFailure, 0)
+	ctx := onFailure.withSession(context.Background())
+	first = sessionOf(ctx)
+	onFailure.observe(ctx, http.StatusOK, nil)
+	if next := sessionOf(onFailure.withSession(context.Background())); next != first {
+		t.Fatalf("expected success to keep the session, got %q then %q", first, next)
+	}
+	onFailure.observe(ctx, http.StatusBadGateway, nil)
+	second := sessionOf(onFailure.withSession(context.Background()))
+	if second == first {
+		t.Fatalf("expected failure to rotate the session, still %q", second)
+	}
+	onFailure.observe(ctx, 0, errors.New("connection reset"))
+	if next := sessionOf(onFailure.withSession(context.Background())); next != second {
+		t.Fatalf("expected a late failure of the old session to be ignored, got %q then %q", second, next)
+	}
+
+	pinned := listeners.WithUpstreamHints(context.Background(), listeners.UpstreamHints{Session: "client"})
+	if got := sessionOf(manual.withSession(pinned)); got != "client" {
+		t.Fatalf("expected the client's session hint to win, got %q", got)
+	}
+}
+
+func TestNewSessionRotator_RequiresSessionTemplate(t *testing.T) {
+	t.Parallel()
+
+	provider := config.ProviderConfig{
+		Auth:     config.ProviderAuthConfig{Type: "basic", Username: "acme", Password: "secret"},
+		Session:  config.ProviderSessionConfig{Supported: true},
+		Rotation: config.ProviderRotationConfig{Enabled: true},
+	}
+	if rotator := newSessionRotator(provider); rotator != nil {
+		t.Fatalf("expected no rotation without a {session} template")
+	}
+	adapter := upstreamAdapterFactory{}.ForProvider(config.ProviderConfig{Type: "http_proxy", Auth: provider.Auth}, nil)
+	if err := adapter.RotateIdentity(context.Background()); !errors.Is(err, listeners.ErrRotateIdentityUnsupported) {
+		t.Fatalf("expected unsupported rotation, got %v", err)
+	}
+}
+
+func TestForwardProxy_RotateIdentityChangesUpstreamSession(t *testing.T) {
+	t.Parallel()
+
+	targetHTTP := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte("ok"))
+	}))
+	defer targetHTTP.Close()
+
+	var mu sync.Mutex
+	var usernames []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		decoded, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(req.Header.Get("Proxy-Authorization"), "Basic "))
+		username, _, _ := strings.Cut(string(decoded), ":")
+		mu.Lock()
+		usernames = append(usernames, username)
+		mu.Unlock()
+		rsp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer rsp.Body.Close()
+		rw.WriteHeader(rsp.StatusCode)
+		_, _ = io.Copy(rw, rsp.Body)
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		Providers: []config.ProviderConfig{{
+			Name:      "residential",
+			Type:      "http_proxy",
+			Auth:      config.ProviderAuthConfig{Type: "basic", Username: "acme", Password: "secret", UsernameTemplate: "{username}[-session-{session}]"},
+			Endpoints: []config.ProviderEndpoint{{URL: upstream.URL, Priority: 1}},
+			Session:   config.ProviderSessionConfig{Supported: true},
+			Rotation:  config.ProviderRotationConfig{Enabled: true, Mode: RotationManual},
+		}},
+		Routing: config.RoutingConfig{DefaultProvider: "residential"},
+	}
+	runtime := NewRequestRuntime(cfg)
+	registry := runtime.Registry.(*ProviderRegistry)
+	proxy := httptest.NewServer(listeners.MetadataMiddleware(observability.HTTPMiddleware(listeners.NewForwardProxyHandlerWithRuntime(runtime), false)))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	get := func() {
+		resp, err := client.Get(targetHTTP.URL)
+		if err != nil {
+			t.Fatalf("forward request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+	}
+	get()
+	get()
+	if err := registry.RotateIdentity(context.Background(), "residential"); err != nil {
+		t.Fatalf("rotate identity: %v", err)
+	}
+	get()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(usernames) != 3 || !strings.HasPrefix(usernames[0], "acme-session-") {
+		t.Fatalf("expected three session logins, got %q", usernames)
+	}
+	if usernames[0] != usernames[1] {
+		t.Fatalf("expected the session to hold until rotated, got %q", usernames)
+	}
+	if usernames[2] == usernames[1] {
+		t.Fatalf("expected rotation to change the upstream session, got %q", usernames)
+	}
+	if err := registry.RotateIdentity(context.Background(), "missing"); err == nil {
+		t.Fatalf("expected an error for an unknown provider")
+	}
+}
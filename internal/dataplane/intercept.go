@@ -0,0 +1,252 @@
+package dataplane
+
+import (
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+const (
+	defaultLeafCacheSize = 1024
+	defaultLeafValidity  = 24 * time.Hour
+	// Cached leaves are re-minted this long before they expire.
+	leafRenewBefore = time.Hour
+)
+
+// tlsInterceptor selects CONNECT tunnels for interception and presents leaf
+// certificates minted from the configured CA. When the CA cannot be loaded
+// the selected tunnels fail their handshake instead of silently bypassing
+// the policies that rely on interception.
+type tlsInterceptor struct {
+	caCert  *x509.Certificate
+	caDER   []byte
+	caKey   crypto.Signer
+	leafKey *ecdsa.PrivateKey
+	loadErr error
+
+	validity  time.Duration
+	listeners map[string]bool
+	tenants   map[string]bool
+	domains   []string
+	bypass    []string
+	leaves    *leafCache
+}
+
+func newTLSInterceptor(cfg *config.Config) *tlsInterceptor {
+	if cfg == nil || cfg.Interception.CA == nil {
+		return nil
+	}
+	interception := cfg.Interception
+	interceptor := &tlsInterceptor{
+		validity:  defaultLeafValidity,
+		listeners: map[string]bool{},
+		tenants:   map[string]bool{},
+		domains:   normalizeDomains(interception.Domains),
+		bypass:    normalizeDomains(interception.Bypass),
+		leaves:    newLeafCache(interception.CertCacheSize),
+	}
+	if interception.LeafValidityHours > 0 {
+		interceptor.validity = time.Duration(interception.LeafValidityHours) * time.Hour
+	}
+	for _, listener := range cfg.Listeners {
+		if listener.Intercept {
+			interceptor.listeners[listener.Name] = true
+		}
+	}
+	for _, tenant := range cfg.Tenants {
+		if tenant.Intercept {
+			interceptor.tenants[tenant.ID] = true
+		}
+	}
+	if err := interceptor.loadCA(interception.CA.CertFile, interception.CA.KeyFile); err != nil {
+		interceptor.loadErr = err
+		slog.Error("tls interception CA unavailable; intercepted tunnels will fail", "error", err)
+	}
+	return interceptor
+}
+
+func (i *tlsInterceptor) loadCA(certFile, keyFile string) error {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("load interception CA: %w", err)
+	}
+	caCert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parse interception CA: %w", err)
+	}
+	if !caCert.IsCA {
+		return errors.New("interception CA certificate is not a CA")
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return errors.New("interception CA key cannot sign")
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generate leaf key: %w", err)
+	}
+	i.caCert, i.caDER, i.caKey, i.leafKey = caCert, pair.Certificate[0], signer, leafKey
+	return nil
+}
+
+func (i *tlsInterceptor) InterceptTLS(metadata listeners.RequestMetadata, host string) *tls.Config {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if matchesDomain(i.bypass, host) {
+		return nil
+	}
+	if !i.listeners[metadata.Listener] && !i.tenants[metadata.TenantID] && !matchesDomain(i.domains, host) {
+		return nil
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// Inner requests are served over HTTP/1.1 only.
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return i.certificate(host)
+		},
+	}
+}
+
+// certificate returns the cached leaf for host, minting a new one when it is
+// missing or close to expiry.
+func (i *tlsInterceptor) certificate(host string) (*tls.Certificate, error) {
+	if i.loadErr != nil {
+		return nil, i.loadErr
+	}
+	now := time.Now()
+	if leaf, ok := i.leaves.get(host); ok && now.Add(leafRenewBefore).Before(leaf.Leaf.NotAfter) {
+		return leaf, nil
+	}
+	leaf, err := i.mint(host, now)
+	if err != nil {
+		return nil, err
+	}
+	i.leaves.put(host, leaf)
+	return leaf, nil
+}
+
+func (i *tlsInterceptor) mint(host string, now time.Time) (*tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	notAfter := now.Add(i.validity)
+	if notAfter.After(i.caCert.NotAfter) {
+		notAfter = i.caCert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: host},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, i.caCert, &i.leafKey.PublicKey, i.caKey)
+	if err != nil {
+		return nil, fmt.Errorf("mint certificate for %s: %w", host, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der, i.caDER}, PrivateKey: i.leafKey, Leaf: leaf}, nil
+}
+
+// normalizeDomains lower-cases entries and strips wildcard prefixes; every
+// entry covers the domain and its subdomains.
+func normalizeDomains(domains []string) []string {
+	normalized := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+		domain = strings.TrimLeft(strings.TrimPrefix(domain, "*"), ".")
+		if domain != "" {
+			normalized = append(normalized, domain)
+		}
+	}
+	return normalized
+}
+
+func matchesDomain(domains []string, host string) bool {
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// leafCache is a bounded LRU of minted certificates keyed by host.
+type leafCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	order      *list.List
+	entries    map[string]*list.Element
+}
+
+type leafCacheEntry struct {
+	host string
+	cert *tls.Certificate
+}
+
+func newLeafCache(maxEntries int) *leafCache {
+	if maxEntries <= 0 {
+		maxEntries = defaultLeafCacheSize
+	}
+	return &leafCache{maxEntries: maxEntries, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (c *leafCache) get(host string) (*tls.Certificate, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[host]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*leafCacheEntry).cert, true
+}
+
+func (c *leafCache) put(host string, cert *tls.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[host]; ok {
+		element.Value.(*leafCacheEntry).cert = cert
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[host] = c.order.PushFront(&leafCacheEntry{host: host, cert: cert})
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*leafCacheEntry).host)
+	}
+}
+
+func (c *leafCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
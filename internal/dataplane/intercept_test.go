@@ -0,0 +1,288 @@
+package dataplane
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+const testCAName = "microproxy test CA"
+
+// writeTestCA writes a CA certificate and key into a temp dir and returns
+// them as a TLSConfig with a pool that trusts the CA.
+func writeTestCA(t *testing.T) (*config.TLSConfig, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: testCAName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create CA: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	dir := t.TempDir()
+	ca := &config.TLSConfig{CertFile: filepath.Join(dir, "ca.pem"), KeyFile: filepath.Join(dir, "ca-key.pem")}
+	if err := os.WriteFile(ca.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write CA: %v", err)
+	}
+	if err := os.WriteFile(ca.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("write CA key: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return ca, pool
+}
+
+func TestTLSInterceptor_SelectsTunnels(t *testing.T) {
+	t.Parallel()
+
+	ca, _ := writeTestCA(t)
+	interceptor := newTLSInterceptor(&config.Config{
+		Listeners: []config.ListenerConfig{{Name: "mitm", Intercept: true}, {Name: "plain"}},
+		Tenants:   []config.TenantConfig{{ID: "crawl", Intercept: true}},
+		Interception: config.InterceptionConfig{
+			CA:      ca,
+			Domains: []string{"*.shop.example"},
+			Bypass:  []string{"pinned.example", "bank.shop.example"},
+		},
+	})
+
+	for _, tc := range []struct {
+		metadata listeners.RequestMetadata
+		host     string
+		want     bool
+	}{
+		{metadata: listeners.RequestMetadata{Listener: "mitm"}, host: "news.example", want: true},
+		{metadata: listeners.RequestMetadata{Listener: "plain"}, host: "news.example", want: false},
+		{metadata: listeners.RequestMetadata{Listener: "plain", TenantID: "crawl"}, host: "news.example", want: true},
+		{metadata: listeners.RequestMetadata{Listener: "plain"}, host: "www.shop.example", want: true},
+		{metadata: listeners.RequestMetadata{Listener: "plain"}, host: "shop.example.", want: true},
+		{metadata: listeners.RequestMetadata{Listener: "plain"}, host: "notshop.example", want: false},
+		{metadata: listeners.RequestMetadata{Listener: "mitm"}, host: "api.pinned.example", want: false},
+		{metadata: listeners.RequestMetadata{Listener: "plain"}, host: "bank.shop.example", want: false},
+	} {
+		if got := interceptor.InterceptTLS(tc.metadata, tc.host) != nil; got != tc.want {
+			t.Fatalf("listener=%q tenant=%q host=%q: expected intercept=%t, got %t", tc.metadata.Listener, tc.metadata.TenantID, tc.host, tc.want, got)
+		}
+	}
+
+	if newTLSInterceptor(&config.Config{Listeners: []config.ListenerConfig{{Name: "mitm", Intercept: true}}}) != nil {
+		t.Fatalf("expected no interceptor without a CA")
+	}
+}
+
+func TestTLSInterceptor_CachesLeafCertificates(t *testing.T) {
+	t.Parallel()
+
+	ca, pool := writeTestCA(t)
+	interceptor := newTLSInterceptor(&config.Config{Interception: config.InterceptionConfig{CA: ca, CertCacheSize: 1}})
+
+	first, err := interceptor.certificate("a.example")
+	if err != nil {
+		t.Fatalf("mint certificate: %v", err)
+	}
+	if _, err := first.Leaf.Verify(x509.VerifyOptions{DNSName: "a.example", Roots: pool}); err != nil {
+		t.Fatalf("expected leaf to chain to the CA: %v", err)
+	}
+	if again, _ := interceptor.certificate("a.example"); again != first {
+		t.Fatalf("expected cached certificate to be reused")
+	}
+
+	ip, err := interceptor.certificate("127.0.0.1")
+	if err != nil {
+		t.Fatalf("mint IP certificate: %v", err)
+	}
+	if len(ip.Leaf.IPAddresses) != 1 || len(ip.Leaf.DNSNames) != 0 {
+		t.Fatalf("expected IP SAN for IP host, got dns=%v ip=%v", ip.Leaf.DNSNames, ip.Leaf.IPAddresses)
+	}
+	if interceptor.leaves.len() != 1 {
+		t.Fatalf("expected cache bounded to 1 entry, got %d", interceptor.leaves.len())
+	}
+	if again, _ := interceptor.certificate("a.example"); again == first {
+		t.Fatalf("expected evicted certificate to be minted again")
+	}
+}
+
+func TestTLSInterceptor_FailsClosedWithoutCA(t *testing.T) {
+	t.Parallel()
+
+	interceptor := newTLSInterceptor(&config.Config{Interception: config.InterceptionConfig{
+		CA:      &config.TLSConfig{CertFile: filepath.Join(t.TempDir(), "missing.pem"), KeyFile: filepath.Join(t.TempDir(), "missing-key.pem")},
+		Domains: []string{"example.com"},
+	}})
+	tlsConfig := interceptor.InterceptTLS(listeners.RequestMetadata{}, "example.com")
+	if tlsConfig == nil {
+		t.Fatalf("expected selected tunnel to stay intercepted")
+	}
+	if _, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{}); err == nil {
+		t.Fatalf("expected handshake to fail without a usable CA")
+	}
+}
+
+func TestForwardProxy_InterceptsConnectForTenant(t *testing.T) {
+	t.Parallel()
+
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(rw, "ok "+req.URL.Path)
+	}))
+	defer origin.Close()
+	originRoots := x509.NewCertPool()
+	originRoots.AddCert(origin.Certificate())
+
+	ca, caRoots := writeTestCA(t)
+	cfg := &config.Config{
+		Providers: []config.ProviderConfig{{
+			Name:      "origin-direct",
+			Type:      "direct",
+			Endpoints: []config.ProviderEndpoint{{URL: "http://direct.local", Priority: 1}},
+		}},
+		Routing: config.RoutingConfig{Rules: []config.RoutingRule{{
+			Name:      "crawl",
+			Match:     map[string]string{"tenant": "crawl"},
+			Provider:  "origin-direct",
+			PolicyRef: "block-admin",
+		}}},
+		Policies: []config.PolicyConfig{{
+			Name:      "block-admin",
+			Type:      "access",
+			Action:    "deny",
+			Selectors: map[string]string{"path_prefix": "/admin"},
+		}},
+		Tenants:      []config.TenantConfig{{Name: "crawl", ID: "crawl", Intercept: true}},
+		Interception: config.InterceptionConfig{CA: ca},
+	}
+	handler := listeners.NewForwardProxyHandlerWithRuntime(NewRequestRuntime(cfg))
+	handler.Transport.TLSClientConfig = &tls.Config{RootCAs: originRoots}
+	proxy := httptest.NewServer(listeners.MetadataMiddleware(handler))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	intercepted := &http.Client{Transport: &http.Transport{
+		Proxy:              http.ProxyURL(proxyURL),
+		ProxyConnectHeader: http.Header{"X-Tenant-Id": {"crawl"}},
+		TLSClientConfig:    &tls.Config{RootCAs: caRoots},
+	}}
+	resp, err := intercepted.Get(origin.URL + "/products")
+	if err != nil {
+		t.Fatalf("intercepted request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ok /products" {
+		t.Fatalf("expected origin response through interception, got %d %q", resp.StatusCode, body)
+	}
+	if issuer := resp.TLS.PeerCertificates[0].Issuer.CommonName; issuer != testCAName {
+		t.Fatalf("expected certificate minted by the interception CA, got issuer %q", issuer)
+	}
+
+	resp, err = intercepted.Get(origin.URL + "/admin/users")
+	if err != nil {
+		t.Fatalf("intercepted request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected path policy to deny inner request, got %d", resp.StatusCode)
+	}
+
+	tunnelled := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: originRoots},
+	}}
+	resp, err = tunnelled.Get(origin.URL + "/admin/users")
+	if err != nil {
+		t.Fatalf("tunnelled request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected tenants without interception to tunnel untouched, got %d", resp.StatusCode)
+	}
+}
+
+func TestForwardProxy_InterceptedRequestsKeepAuthenticatedTenant(t *testing.T) {
+	t.Parallel()
+
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(rw, "ok "+req.URL.Path)
+	}))
+	defer origin.Close()
+	originRoots := x509.NewCertPool()
+	originRoots.AddCert(origin.Certificate())
+
+	ca, caRoots := writeTestCA(t)
+	cfg := &config.Config{
+		Providers: []config.ProviderConfig{{
+			Name:      "origin-direct",
+			Type:      "direct",
+			Endpoints: []config.ProviderEndpoint{{URL: "http://direct.local", Priority: 1}},
+		}},
+		Routing: config.RoutingConfig{Rules: []config.RoutingRule{{
+			Name:      "crawl",
+			Match:     map[string]string{"tenant": "crawl"},
+			Provider:  "origin-direct",
+			PolicyRef: "block-admin",
+		}}},
+		Policies: []config.PolicyConfig{{
+			Name:      "block-admin",
+			Type:      "access",
+			Action:    "deny",
+			Selectors: map[string]string{"path_prefix": "/admin"},
+		}},
+		Tenants:      []config.TenantConfig{{Name: "crawl", ID: "crawl", Intercept: true}},
+		Interception: config.InterceptionConfig{CA: ca},
+	}
+	handler := listeners.NewForwardProxyHandlerWithRuntime(NewRequestRuntime(cfg))
+	handler.Transport.TLSClientConfig = &tls.Config{RootCAs: originRoots}
+	store := listeners.NewUserStore([]listeners.UserCredential{{Credential: listeners.Credential{Username: "alice", TenantID: "crawl"}, Password: "secret"}}, "")
+	proxy := httptest.NewServer(listeners.ListenerCredentialMiddleware("basic", store, listeners.MetadataMiddleware(handler)))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	proxyURL.User = url.UserPassword("alice", "secret")
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: caRoots},
+	}}
+	req, _ := http.NewRequest(http.MethodGet, origin.URL+"/admin/users", nil)
+	req.Header.Set("X-Tenant-ID", "other")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("intercepted request failed: %v", err)
+	}
+	resp.Body.Close()
+	if issuer := resp.TLS.PeerCertificates[0].Issuer.CommonName; issuer != testCAName {
+		t.Fatalf("expected the authenticated tenant's tunnel to be intercepted, got issuer %q", issuer)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected the authenticated tenant's policy to deny the inner request, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,111 @@
+package dataplane
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+func listenerAuthTestConfig(listenerType string) *config.Config {
+	return &config.Config{
+		Listeners: []config.ListenerConfig{{
+			Name:     "edge",
+			Type:     listenerType,
+			Address:  "127.0.0.1:0",
+			AuthType: "basic",
+			Users: []config.ListenerUserConfig{
+				{Username: "blocked", Password: "secret", TenantID: "blocked"},
+				{Username: "audited", Password: "secret", Policies: []string{"deny-all"}},
+				{Username: "open", Password: "secret"},
+			},
+			Enabled: true,
+		}},
+		Providers: []config.ProviderConfig{
+			{Name: "direct", Type: "direct", Endpoints: []config.ProviderEndpoint{{URL: "http://direct.local", Priority: 1}}},
+		},
+		Routing: config.RoutingConfig{
+			DefaultProvider: "direct",
+			Rules: []config.RoutingRule{
+				{Name: "blocked", Match: map[string]string{"tenant": "blocked"}, Provider: "direct", PolicyRef: "deny-all"},
+			},
+		},
+		Policies: []config.PolicyConfig{{Name: "deny-all", Type: "access", Action: "deny"}},
+	}
+}
+
+func TestHTTPListenerManager_UsersBindTenantAndPolicies(t *testing.T) {
+	t.Parallel()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	defer origin.Close()
+
+	cfg := listenerAuthTestConfig("http")
+	manager := NewHTTPListenerManager(cfg.Listeners, time.Second, false, NewRequestRuntime(cfg))
+	if err := manager.Start(context.Background()); err != nil {
+		t.Fatalf("start http manager: %v", err)
+	}
+	defer func() { _ = manager.Shutdown(context.Background()) }()
+	proxyAddr := manager.servers[0].listener.Addr().String()
+
+	get := func(user, tenant string) int {
+		t.Helper()
+		proxyURL := &url.URL{Scheme: "http", Host: proxyAddr, User: url.UserPassword(user, "secret")}
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 5 * time.Second}
+		req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+		if tenant != "" {
+			req.Header.Set("X-Tenant-ID", tenant)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request as %s: %v", user, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := get("blocked", "other"); code != http.StatusForbidden {
+		t.Fatalf("expected bound tenant to override X-Tenant-ID and be denied, got %d", code)
+	}
+	if code := get("audited", ""); code != http.StatusForbidden {
+		t.Fatalf("expected account policy to deny, got %d", code)
+	}
+	if code := get("open", "blocked"); code != http.StatusNoContent {
+		t.Fatalf("expected account without tenant to ignore X-Tenant-ID, got %d", code)
+	}
+	if code := get("nobody", ""); code != http.StatusProxyAuthRequired {
+		t.Fatalf("expected unknown account to be rejected, got %d", code)
+	}
+}
+
+func TestSOCKS5ListenerManager_UsersBindTenant(t *testing.T) {
+	t.Parallel()
+
+	target := startPingPongTCPServer(t)
+	defer target.Close()
+
+	cfg := listenerAuthTestConfig("socks5")
+	mgr := NewSOCKS5ListenerManager(cfg.Listeners, time.Second, NewRequestRuntime(cfg))
+	if err := mgr.Start(context.Background()); err != nil {
+		t.Fatalf("start socks5 manager: %v", err)
+	}
+	defer func() { _ = mgr.Shutdown(context.Background()) }()
+	proxyAddr := mgr.servers[0].listener.Addr().String()
+	host, port := splitAddr(t, target.Addr().String())
+
+	conn := dialSOCKS5Tunnel(t, proxyAddr, host, port, "open", "secret")
+	conn.Close()
+
+	conn, reply := socks5ConnectWithPassword(t, proxyAddr, "blocked+tenant=other", "secret", target.Addr().String())
+	conn.Close()
+	if reply != listeners.SOCKS5ReplyConnectionNotAllowed {
+		t.Fatalf("expected bound tenant to be denied despite username hints, got reply %d", reply)
+	}
+}
@@ -0,0 +1,288 @@
+package listeners
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded is returned when provider or endpoint limits refuse a request.
+var ErrQuotaExceeded = errors.New("upstream quota exceeded")
+
+// Quota strategies applied when a provider or endpoint has no capacity left.
+const (
+	QuotaStrategySpill  = "spill"
+	QuotaStrategyQueue  = "queue"
+	QuotaStrategyReject = "reject"
+)
+
+// Admission reserves request capacity (rate and concurrency) on an upstream.
+// The returned release func must be called once the request or tunnel is done.
+type Admission interface {
+	// TryAcquire reserves capacity without waiting.
+	TryAcquire() (release func(), ok bool)
+	// Acquire waits for capacity until ctx is done.
+	Acquire(ctx context.Context) (release func(), err error)
+}
+
+// routeTarget is the resolved provider together with its ordered endpoints.
+type routeTarget struct {
+	Provider  RuntimeProvider
+	Endpoints []RuntimeEndpoint
+}
+
+func (h *ForwardProxyHandler) admitProvider(ctx context.Context, provider RuntimeProvider) (func(), error) {
+	if provider.Admission == nil {
+		return func() {}, nil
+	}
+	if release, ok := provider.Admission.TryAcquire(); ok {
+		return release, nil
+	}
+	if provider.QuotaStrategy != QuotaStrategyQueue || provider.QueueTimeout <= 0 {
+		return nil, ErrQuotaExceeded
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, provider.QueueTimeout)
+	defer cancel()
+	release, err := provider.Admission.Acquire(waitCtx)
+	if err != nil {
+		return nil, ErrQuotaExceeded
+	}
+	return release, nil
+}
+
+// attemptEndpoints walks the endpoints of target in order, reserving capacity
+// on each before calling attempt. Endpoints without capacity are skipped
+// (spill), waited on (queue), or end the walk (reject). When every endpoint
+// refused the request for quota reasons the fallback provider, if any, gets a
+// single turn. An attempt may end the walk early by returning an error
+// wrapped with finalAttempt. The release func returned alongside a nil error
+// belongs to the caller.
+func (h *ForwardProxyHandler) attemptEndpoints(req *http.Request, target routeTarget, attempt func(index int, endpoint RuntimeEndpoint) error) (func(), error) {
+	ctx := req.Context()
+	release, err := h.attemptProviderEndpoints(ctx, target, attempt)
+	if err == nil || !errors.Is(err, ErrQuotaExceeded) {
+		return release, err
+	}
+	fallback, ok := h.fallbackTarget(req, target.Provider)
+	if !ok {
+		return nil, err
+	}
+	UpdateMetadata(ctx, func(metadata *RequestMetadata) {
+		metadata.Provider = fallback.Provider.Name
+	})
+	fallbackRelease, fallbackErr := h.attemptProviderEndpoints(ctx, fallback, attempt)
+	if fallbackErr != nil {
+		return nil, errors.Join(err, fallbackErr)
+	}
+	return fallbackRelease, nil
+}
+
+func (h *ForwardProxyHandler) attemptProviderEndpoints(ctx context.Context, target routeTarget, attempt func(index int, endpoint RuntimeEndpoint) error) (func(), error) {
+	releaseProvider, err := h.admitProvider(ctx, target.Provider)
+	if err != nil {
+		return nil, quotaError(target.Provider.Name, "")
+	}
+
+	var errs []error
+	var saturated []RuntimeEndpoint
+	attempts := 0
+	try := func(endpoint RuntimeEndpoint, releaseEndpoint func()) (func(), bool) {
+		err := attempt(attempts, endpoint)
+		attempts++
+		if err != nil {
+			releaseEndpoint()
+			errs = append(errs, err)
+			return nil, false
+		}
+		return releaseAll(releaseEndpoint, releaseProvider), true
+	}
+
+	for _, endpoint := range target.Endpoints {
+		if len(errs) > 0 && isFinalAttempt(errs[len(errs)-1]) {
+			break
+		}
+		releaseEndpoint, ok := tryAcquireEndpoint(endpoint)
+		if !ok {
+			if target.Provider.QuotaStrategy == QuotaStrategyReject {
+				releaseProvider()
+				return nil, quotaError(target.Provider.Name, endpointLabel(endpoint))
+			}
+			saturated = append(saturated, endpoint)
+			continue
+		}
+		if release, ok := try(endpoint, releaseEndpoint); ok {
+			return release, nil
+		}
+	}
+
+	stopped := len(errs) > 0 && isFinalAttempt(errs[len(errs)-1])
+	if !stopped && len(saturated) > 0 && target.Provider.QuotaStrategy == QuotaStrategyQueue && target.Provider.QueueTimeout > 0 {
+		waitCtx, cancel := context.WithTimeout(ctx, target.Provider.QueueTimeout)
+		releaseEndpoint, err := saturated[0].Admission.Acquire(waitCtx)
+		cancel()
+		if err == nil {
+			if release, ok := try(saturated[0], releaseEndpoint); ok {
+				return release, nil
+			}
+		}
+	}
+	releaseProvider()
+
+	if attempts == 0 && len(saturated) > 0 {
+		return nil, quotaError(target.Provider.Name, endpointLabel(saturated[0]))
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("provider %s: no endpoints available", target.Provider.Name)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (h *ForwardProxyHandler) fallbackTarget(req *http.Request, provider RuntimeProvider) (routeTarget, bool) {
+	if provider.QuotaStrategy == QuotaStrategyReject || provider.FallbackProvider == "" || provider.FallbackProvider == provider.Name {
+		return routeTarget{}, false
+	}
+	if h.Registry == nil {
+		return routeTarget{}, false
+	}
+	fallback, ok := h.Registry.Get(provider.FallbackProvider)
+	if !ok {
+		return routeTarget{}, false
+	}
+	// The fallback gets one turn only; never chain further.
+	fallback.FallbackProvider = ""
+	endpoints := fallback.Endpoints
+	if h.Selector != nil {
+		endpoints = h.Selector.Select(req.Context(), fallback, req)
+	}
+	return routeTarget{Provider: fallback, Endpoints: endpoints}, true
+}
+
+func tryAcquireEndpoint(endpoint RuntimeEndpoint) (func(), bool) {
+	if endpoint.Admission == nil {
+		return func() {}, true
+	}
+	return endpoint.Admission.TryAcquire()
+}
+
+func quotaError(provider, endpoint string) error {
+	if endpoint == "" {
+		return &QuotaError{Provider: provider}
+	}
+	return &QuotaError{Provider: provider, Endpoint: endpoint}
+}
+
+// QuotaError reports which provider (and endpoint) ran out of capacity.
+type QuotaError struct {
+	Provider string
+	Endpoint string
+}
+
+func (e *QuotaError) Error() string {
+	if e.Endpoint == "" {
+		return "provider " + e.Provider + ": " + ErrQuotaExceeded.Error()
+	}
+	return "provider " + e.Provider + " endpoint " + e.Endpoint + ": " + ErrQuotaExceeded.Error()
+}
+
+func (e *QuotaError) Unwrap() error { return ErrQuotaExceeded }
+
+func releaseAll(releases ...func()) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			for _, release := range releases {
+				release()
+			}
+		})
+	}
+}
+
+// isDirectTarget reports whether target leaves straight from this host.
+func isDirectTarget(target routeTarget) bool {
+	return len(target.Endpoints) == 0 && target.Provider.FallbackProvider == ""
+}
+
+// openViaEndpoints walks target with attemptEndpoints, calling open with each
+// endpoint's adapter. Errors wrapping unsupported mean the adapter lacks the
+// feature; they move on to the next endpoint without counting against its
+// health.
+func (h *ForwardProxyHandler) openViaEndpoints(req *http.Request, target routeTarget, unsupported error, open func(ctx context.Context, adapter UpstreamAdapter, endpoint *url.URL) error) (func(), error) {
+	ctx := req.Context()
+	return h.attemptEndpoints(req, target, func(_ int, endpoint RuntimeEndpoint) error {
+		var adapter UpstreamAdapter = defaultDirectAdapter{}
+		if endpoint.Adapter != nil {
+			adapter = endpoint.Adapter
+		}
+		started := time.Now()
+		err := open(ctx, adapter, endpoint.URL)
+		if errors.Is(err, unsupported) {
+			return fmt.Errorf("endpoint %s: %w", endpointLabel(endpoint), err)
+		}
+		if err != nil {
+			class := h.classifyTimeout(err)
+			h.observeEndpointOutcome(ctx, endpoint.URL, err, class)
+			return wrapEndpointError(endpoint.URL, err, class)
+		}
+		h.observeEndpointOutcome(ctx, endpoint.URL, nil, "")
+		h.observeEndpointLatency(ctx, endpoint.URL, time.Since(started))
+		return nil
+	})
+}
+
+func endpointLabel(endpoint RuntimeEndpoint) string {
+	if endpoint.URL == nil {
+		return "<direct>"
+	}
+	return endpoint.URL.Redacted()
+}
+
+// releaseOnCloseBody returns capacity when the response body is closed.
+type releaseOnCloseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseOnCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+func (b *releaseOnCloseBody) Write(p []byte) (int, error) {
+	return writeThrough(b.ReadCloser, p)
+}
+
+// releaseOnCloseConn returns capacity when a tunnel connection is closed.
+type releaseOnCloseConn struct {
+	net.Conn
+	release func()
+}
+
+// WrapConnRelease ties release to conn.Close so long-lived tunnels hold their
+// concurrency slot until they are torn down.
+func WrapConnRelease(conn net.Conn, release func()) net.Conn {
+	if release == nil {
+		return conn
+	}
+	return &releaseOnCloseConn{Conn: conn, release: releaseAll(release)}
+}
+
+func (c *releaseOnCloseConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+	return err
+}
+
+func (c *releaseOnCloseConn) CloseWrite() error {
+	type closeWriter interface{ CloseWrite() error }
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
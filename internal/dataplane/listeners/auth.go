@@ -1,12 +1,24 @@
 package listeners
 
 import (
-	"encoding/base64"
 	"net/http"
 	"strings"
 )
 
+// ListenerAuthMiddleware guards a listener with a single basic-auth account.
 func ListenerAuthMiddleware(authType, username, password string, next http.Handler) http.Handler {
+	var store CredentialStore
+	if username != "" || password != "" {
+		store = NewUserStore([]UserCredential{{Credential: Credential{Username: username}, Password: password}}, "")
+	}
+	return ListenerCredentialMiddleware(authType, store, next)
+}
+
+// ListenerCredentialMiddleware checks basic credentials from
+// Proxy-Authorization or Authorization against store and records the
+// authenticated account on the request context. A username carrying hints,
+// such as "alice+session=42", authenticates as its account name.
+func ListenerCredentialMiddleware(authType string, store CredentialStore, next http.Handler) http.Handler {
 	mode := strings.ToLower(strings.TrimSpace(authType))
 	if next == nil {
 		next = http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
@@ -14,23 +26,28 @@ func ListenerAuthMiddleware(authType, username, password string, next http.Handl
 	if mode == "" || mode == "none" {
 		return next
 	}
-	if mode != "basic" {
+	if mode != "basic" || store == nil {
 		return http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
 			http.Error(rw, "unsupported listener auth type", http.StatusInternalServerError)
 		})
 	}
 
-	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-		if subtleEqual(req.Header.Get("Proxy-Authorization"), expected) || subtleEqual(req.Header.Get("Authorization"), expected) {
-			next.ServeHTTP(rw, req)
-			return
+		for _, header := range []string{"Proxy-Authorization", "Authorization"} {
+			username, password, err := parseBasicAuth(req.Header.Get(header))
+			if err != nil {
+				continue
+			}
+			credential, ok := store.Authenticate(username, password)
+			if !ok {
+				credential, ok = store.Authenticate(ParseSOCKSUsername(username).User, password)
+			}
+			if ok {
+				next.ServeHTTP(rw, req.WithContext(WithCredential(req.Context(), credential)))
+				return
+			}
 		}
 		rw.Header().Set("Proxy-Authenticate", `Basic realm="microproxy"`)
 		http.Error(rw, "proxy authentication required", http.StatusProxyAuthRequired)
 	})
 }
-
-func subtleEqual(a, b string) bool {
-	return strings.TrimSpace(a) == strings.TrimSpace(b)
-}
@@ -48,3 +48,47 @@ func TestListenerAuthMiddleware_NonePassthrough(t *testing.T) {
 		t.Fatalf("expected %d, got %d", http.StatusNoContent, rw.Code)
 	}
 }
+
+func TestListenerCredentialMiddleware_BindsAccount(t *testing.T) {
+	t.Parallel()
+
+	store := NewUserStore([]UserCredential{{
+		Credential: Credential{Username: "ci", TenantID: "tenant-ci", Provider: "corp", PolicyRef: "allow"},
+		Password:   "secret",
+	}}, "")
+	var got Credential
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got, _ = CredentialFromContext(req.Context())
+		rw.WriteHeader(http.StatusNoContent)
+	})
+	h := ListenerCredentialMiddleware("basic", store, next)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("ci:secret")))
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if rw.Code != http.StatusNoContent {
+		t.Fatalf("expected %d, got %d", http.StatusNoContent, rw.Code)
+	}
+	want := Credential{Username: "ci", TenantID: "tenant-ci", Provider: "corp", PolicyRef: "allow"}
+	if got != want {
+		t.Fatalf("expected credential %+v, got %+v", want, got)
+	}
+
+	got = Credential{}
+	req = httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("ci+session=s1:secret")))
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if rw.Code != http.StatusNoContent || got != want {
+		t.Fatalf("expected a hinted username to bind %+v, got %d %+v", want, rw.Code, got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("ci:wrong")))
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if rw.Code != http.StatusProxyAuthRequired {
+		t.Fatalf("expected %d, got %d", http.StatusProxyAuthRequired, rw.Code)
+	}
+}
@@ -0,0 +1,144 @@
+package listeners
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// ErrBindUnsupported reports an upstream that cannot accept inbound
+// connections on a client's behalf.
+var ErrBindUnsupported = errors.New("bind not supported")
+
+// TCPBinding waits for one inbound connection, as requested by SOCKS BIND.
+type TCPBinding interface {
+	// Addr is the address the peer is expected to connect to.
+	Addr() net.Addr
+	// Accept waits for the peer until ctx is done and returns the connection
+	// together with the peer address.
+	Accept(ctx context.Context) (net.Conn, net.Addr, error)
+	// Close releases the binding. A connection returned by Accept stays open.
+	Close() error
+}
+
+// TCPBinder is implemented by upstream adapters that can accept an inbound
+// connection for the client.
+type TCPBinder interface {
+	BindTCP(ctx context.Context, peerAddr string, endpoint *url.URL, dialer *net.Dialer) (TCPBinding, error)
+}
+
+// BindTarget opens a binding for a connection expected from peerAddr through
+// the route selected for req. Routes without endpoints listen on this host;
+// otherwise only endpoints whose adapters support BIND are tried. The
+// admission slot is held by the accepted connection, or returned when the
+// binding is closed without one.
+func (h *ForwardProxyHandler) BindTarget(req *http.Request, peerAddr string) (TCPBinding, error) {
+	target, err := h.planTunnel(req)
+	if err != nil {
+		return nil, err
+	}
+	if isDirectTarget(target) {
+		return NewDirectTCPBinding(peerAddr)
+	}
+	var binding TCPBinding
+	release, err := h.openViaEndpoints(req, target, ErrBindUnsupported, func(ctx context.Context, adapter UpstreamAdapter, endpoint *url.URL) error {
+		binder, ok := adapter.(TCPBinder)
+		if !ok {
+			return ErrBindUnsupported
+		}
+		opened, err := binder.BindTCP(ctx, peerAddr, endpoint, h.Dialer)
+		binding = opened
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	h.observeRequestServed(req.Context())
+	return &releaseOnCloseBinding{TCPBinding: binding, release: releaseAll(release)}, nil
+}
+
+// NewDirectTCPBinding listens on every local address. When peerAddr names an
+// IP, connections from other hosts are refused.
+func NewDirectTCPBinding(peerAddr string) (TCPBinding, error) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	binding := &directTCPBinding{listener: listener}
+	if host, _, err := net.SplitHostPort(peerAddr); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			binding.peerIP = ip
+		}
+	}
+	return binding, nil
+}
+
+type directTCPBinding struct {
+	listener net.Listener
+	peerIP   net.IP
+}
+
+func (b *directTCPBinding) Addr() net.Addr { return b.listener.Addr() }
+
+func (b *directTCPBinding) Accept(ctx context.Context) (net.Conn, net.Addr, error) {
+	stop := context.AfterFunc(ctx, func() { _ = b.listener.Close() })
+	defer stop()
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, nil, ctxErr
+			}
+			return nil, nil, err
+		}
+		remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if b.peerIP != nil && (!ok || !remote.IP.Equal(b.peerIP)) {
+			_ = conn.Close()
+			continue
+		}
+		return conn, conn.RemoteAddr(), nil
+	}
+}
+
+func (b *directTCPBinding) Close() error {
+	err := b.listener.Close()
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// releaseOnCloseBinding hands the admission slot to the accepted connection,
+// or returns it when the binding is closed without one.
+type releaseOnCloseBinding struct {
+	TCPBinding
+	release func()
+
+	mu       sync.Mutex
+	accepted bool
+}
+
+func (b *releaseOnCloseBinding) Accept(ctx context.Context) (net.Conn, net.Addr, error) {
+	conn, peer, err := b.TCPBinding.Accept(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	b.mu.Lock()
+	b.accepted = true
+	b.mu.Unlock()
+	return WrapConnRelease(conn, b.release), peer, nil
+}
+
+func (b *releaseOnCloseBinding) Close() error {
+	err := b.TCPBinding.Close()
+	b.mu.Lock()
+	accepted := b.accepted
+	b.mu.Unlock()
+	if !accepted {
+		b.release()
+	}
+	return err
+}
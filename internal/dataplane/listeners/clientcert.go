@@ -0,0 +1,118 @@
+package listeners
+
+import (
+	"crypto/x509"
+	"net/http"
+	"strings"
+)
+
+// ClientCertRule binds client certificates to an account. Exactly one of
+// SPIFFEID, DNSName or CommonName is matched; a leading "*" matches any
+// prefix and a trailing "*" any suffix, so "*.jobs.example" and
+// "spiffe://fleet.example/crawler/*" both work.
+type ClientCertRule struct {
+	SPIFFEID   string
+	DNSName    string
+	CommonName string
+	Credential Credential
+}
+
+// ClientCertMapper maps verified client certificates to accounts. Rules are
+// tried in order and the first match wins.
+type ClientCertMapper struct {
+	rules []ClientCertRule
+}
+
+// NewClientCertMapper returns a mapper for rules.
+func NewClientCertMapper(rules []ClientCertRule) *ClientCertMapper {
+	return &ClientCertMapper{rules: append([]ClientCertRule(nil), rules...)}
+}
+
+// Map returns the account bound to cert. The credential's Username is the
+// certificate's SPIFFE ID, or its subject common name when it has none.
+func (m *ClientCertMapper) Map(cert *x509.Certificate) (Credential, bool) {
+	if m == nil || cert == nil {
+		return Credential{}, false
+	}
+	spiffeIDs := certSPIFFEIDs(cert)
+	for _, rule := range m.rules {
+		var matched bool
+		switch {
+		case rule.SPIFFEID != "":
+			matched = matchAny(rule.SPIFFEID, spiffeIDs)
+		case rule.DNSName != "":
+			matched = matchAny(strings.ToLower(rule.DNSName), lowerAll(cert.DNSNames))
+		case rule.CommonName != "":
+			matched = matchIdentity(rule.CommonName, cert.Subject.CommonName)
+		}
+		if !matched {
+			continue
+		}
+		credential := rule.Credential
+		credential.Username = cert.Subject.CommonName
+		if len(spiffeIDs) > 0 {
+			credential.Username = spiffeIDs[0]
+		}
+		return credential, true
+	}
+	return Credential{}, false
+}
+
+// ClientCertMiddleware binds requests that present a verified client
+// certificate to the account mapper assigns it. Requests without a
+// certificate pass through; the TLS handshake already rejected them when
+// certificates are required. A certificate that matches no rule is refused.
+func ClientCertMiddleware(mapper *ClientCertMapper, next http.Handler) http.Handler {
+	if mapper == nil {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		credential, ok := mapper.Map(req.TLS.PeerCertificates[0])
+		if !ok {
+			http.Error(rw, "client certificate not mapped to a tenant", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(rw, req.WithContext(WithCredential(req.Context(), credential)))
+	})
+}
+
+func certSPIFFEIDs(cert *x509.Certificate) []string {
+	var ids []string
+	for _, uri := range cert.URIs {
+		if strings.EqualFold(uri.Scheme, "spiffe") {
+			ids = append(ids, uri.String())
+		}
+	}
+	return ids
+}
+
+func matchAny(pattern string, values []string) bool {
+	for _, value := range values {
+		if matchIdentity(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchIdentity(pattern, value string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(value, suffix)
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(value, prefix)
+	}
+	return pattern == value
+}
+
+func lowerAll(values []string) []string {
+	lowered := make([]string, len(values))
+	for idx, value := range values {
+		lowered[idx] = strings.ToLower(value)
+	}
+	return lowered
+}
@@ -0,0 +1,44 @@
+package listeners
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+)
+
+func TestClientCertMapper_MatchesInOrder(t *testing.T) {
+	t.Parallel()
+
+	mapper := NewClientCertMapper([]ClientCertRule{
+		{SPIFFEID: "spiffe://fleet.example/crawler/eu-*", Credential: Credential{TenantID: "crawlers-eu"}},
+		{SPIFFEID: "spiffe://fleet.example/crawler/*", Credential: Credential{TenantID: "crawlers", Provider: "corp"}},
+		{DNSName: "*.jobs.example", Credential: Credential{TenantID: "jobs"}},
+		{CommonName: "legacy-bot", Credential: Credential{TenantID: "legacy"}},
+	})
+	spiffe := func(raw string) []*url.URL {
+		uri, _ := url.Parse(raw)
+		return []*url.URL{uri}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		cert     *x509.Certificate
+		tenant   string
+		username string
+	}{
+		{"first rule wins", &x509.Certificate{URIs: spiffe("spiffe://fleet.example/crawler/eu-1")}, "crawlers-eu", "spiffe://fleet.example/crawler/eu-1"},
+		{"prefix match", &x509.Certificate{URIs: spiffe("spiffe://fleet.example/crawler/us-1")}, "crawlers", "spiffe://fleet.example/crawler/us-1"},
+		{"dns san", &x509.Certificate{Subject: pkix.Name{CommonName: "worker"}, DNSNames: []string{"A.Jobs.Example"}}, "jobs", "worker"},
+		{"common name", &x509.Certificate{Subject: pkix.Name{CommonName: "legacy-bot"}}, "legacy", "legacy-bot"},
+		{"no match", &x509.Certificate{Subject: pkix.Name{CommonName: "legacy-bot-2"}}, "", ""},
+	} {
+		credential, ok := mapper.Map(tc.cert)
+		if ok != (tc.tenant != "") {
+			t.Fatalf("%s: expected match=%v, got %v", tc.name, tc.tenant != "", ok)
+		}
+		if credential.TenantID != tc.tenant || credential.Username != tc.username {
+			t.Fatalf("%s: unexpected credential %+v", tc.name, credential)
+		}
+	}
+}
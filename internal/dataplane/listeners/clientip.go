@@ -0,0 +1,49 @@
+package listeners
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// ClientIPFromAddr strips the port from a remote address.
+func ClientIPFromAddr(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// ParseCIDRs parses CIDRs, skipping entries that do not parse.
+func ParseCIDRs(cidrs []string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr)); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+		}
+	}
+	return prefixes
+}
+
+// ClientIPInCIDRs reports whether clientIP falls in one of the
+// comma-separated cidrs, the form of the client_cidr selector.
+func ClientIPInCIDRs(clientIP, cidrs string) bool {
+	addr, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return false
+	}
+	return AddrInPrefixes(addr, ParseCIDRs(strings.Split(cidrs, ",")))
+}
+
+// AddrInPrefixes reports whether addr falls in one of prefixes. IPv4-mapped
+// IPv6 addresses match IPv4 prefixes.
+func AddrInPrefixes(addr netip.Addr, prefixes []netip.Prefix) bool {
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
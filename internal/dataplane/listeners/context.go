@@ -15,6 +15,7 @@ const metadataContextKey contextKey = "request-metadata"
 // RequestMetadata carries per-request values for future routing/observability.
 type RequestMetadata struct {
 	RequestID       string
+	Listener        string
 	TenantID        string
 	Provider        string
 	Policy          string
@@ -26,10 +27,21 @@ type RequestMetadata struct {
 	RequestSize     int64
 	ResponseSize    int64
 	EvaluationClock time.Time
+	// Username and IdentityPolicy come from the authenticated listener
+	// account; IdentityPolicy is a comma-separated list of policy names.
+	Username       string
+	IdentityPolicy string
+	// ClientIP is the address of the downstream client, without port.
+	ClientIP string
 }
 
 type metadataRef struct {
 	metadata RequestMetadata
+	// route is the resolved route, kept so policies can be re-evaluated while
+	// a tunnel is open.
+	route RouteDecision
+	// upstream is the login chosen by an upstream_credentials policy.
+	upstream *UpstreamCredentials
 }
 
 func WithMetadata(ctx context.Context, metadata RequestMetadata) context.Context {
@@ -62,23 +74,75 @@ func UpdateMetadata(ctx context.Context, fn func(metadata *RequestMetadata)) boo
 	return true
 }
 
+func setRouteDecision(ctx context.Context, route RouteDecision) {
+	if ref, ok := ctx.Value(metadataContextKey).(*metadataRef); ok && ref != nil {
+		ref.route = route
+	}
+}
+
+func routeDecisionFromContext(ctx context.Context) (RouteDecision, bool) {
+	ref, ok := ctx.Value(metadataContextKey).(*metadataRef)
+	if !ok || ref == nil {
+		return RouteDecision{}, false
+	}
+	return ref.route, true
+}
+
 // MetadataMiddleware injects request metadata and forwards it via request context.
 func MetadataMiddleware(next http.Handler) http.Handler {
+	return ListenerMetadataMiddleware("", next)
+}
+
+// ListenerMetadataMiddleware is MetadataMiddleware for a named listener. On
+// an authenticated request the tenant comes from the account rather than the
+// X-Tenant-ID header, and the account's provider, when set, replaces
+// X-Provider-ID. Upstream targeting hints are read from the control headers;
+// the session may also come from a "+session=<id>" proxy username hint.
+func ListenerMetadataMiddleware(listener string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		metadata := RequestMetadata{
 			RequestID: requestIDFromRequest(req),
+			Listener:  listener,
 			TenantID:  req.Header.Get("X-Tenant-ID"),
 			Provider:  req.Header.Get("X-Provider-ID"),
+			ClientIP:  ClientIPFromAddr(req.RemoteAddr),
 		}
-		next.ServeHTTP(rw, req.WithContext(WithMetadata(req.Context(), metadata)))
+		if credential, ok := CredentialFromContext(req.Context()); ok {
+			metadata.ApplyCredential(credential)
+		}
+		ctx := WithMetadata(req.Context(), metadata)
+		hints := UpstreamHintsFromHeader(req.Header)
+		if hints.Session == "" {
+			if username, _, err := parseBasicAuth(req.Header.Get("Proxy-Authorization")); err == nil {
+				hints.Session = ParseSOCKSUsername(username).Session
+			}
+		}
+		if hints != (UpstreamHints{}) {
+			ctx = WithUpstreamHints(ctx, hints)
+		}
+		next.ServeHTTP(rw, req.WithContext(ctx))
 	})
 }
 
+// ApplyCredential binds metadata to an authenticated account.
+func (m *RequestMetadata) ApplyCredential(credential Credential) {
+	m.Username = credential.Username
+	m.TenantID = credential.TenantID
+	if credential.Provider != "" {
+		m.Provider = credential.Provider
+	}
+	m.IdentityPolicy = credential.PolicyRef
+}
+
 func requestIDFromRequest(req *http.Request) string {
 	if existing := req.Header.Get("X-Request-ID"); existing != "" {
 		return existing
 	}
+	return NewRequestID()
+}
 
+// NewRequestID returns a random request ID for traffic that carries none.
+func NewRequestID() string {
 	var random [8]byte
 	if _, err := rand.Read(random[:]); err != nil {
 		return "req-unknown"
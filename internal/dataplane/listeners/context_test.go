@@ -33,3 +33,27 @@ func TestMetadataMiddleware_UsesHeaders(t *testing.T) {
 
 	h.ServeHTTP(rw, req)
 }
+
+func TestMetadataMiddleware_SessionFromProxyUsername(t *testing.T) {
+	t.Parallel()
+
+	var got UpstreamHints
+	h := MetadataMiddleware(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		got = UpstreamHintsFromContext(r.Context())
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	req.SetBasicAuth("ci+session=s_1", "secret")
+	req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+	req.Header.Del("Authorization")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if got.Session != "s_1" {
+		t.Fatalf("expected session s_1 from the proxy username, got %q", got.Session)
+	}
+
+	req.Header.Set(HintSessionHeader, "from_header")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if got.Session != "from_header" {
+		t.Fatalf("expected the session header to win, got %q", got.Session)
+	}
+}
@@ -0,0 +1,198 @@
+package listeners
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Credential is an authenticated listener account and the tenant, provider
+// and policies its traffic is bound to. Empty fields leave routing to the
+// usual rules.
+type Credential struct {
+	Username  string
+	TenantID  string
+	Provider  string
+	PolicyRef string
+}
+
+// CredentialStore checks listener usernames and passwords.
+type CredentialStore interface {
+	Authenticate(username, password string) (Credential, bool)
+}
+
+// UserCredential is an inline account. Password may be plain text or an
+// htpasswd hash; when it is empty the password comes from the htpasswd file
+// and the entry only binds the account.
+type UserCredential struct {
+	Credential
+	Password string
+}
+
+// htpasswdCheckInterval bounds how often the htpasswd file is checked for
+// changes.
+const htpasswdCheckInterval = time.Second
+
+// UserStore authenticates inline accounts and an optional htpasswd file.
+type UserStore struct {
+	users map[string]UserCredential
+	path  string
+
+	mu            sync.Mutex
+	fileUsers     map[string]string
+	fileModTime   time.Time
+	fileSize      int64
+	lastCheck     time.Time
+	checkInterval time.Duration
+}
+
+// NewUserStore builds a store from inline users and, when htpasswdPath is
+// set, the accounts in that file. A file that cannot be read is retried on
+// later logins; until it loads, only inline passwords are accepted.
+func NewUserStore(users []UserCredential, htpasswdPath string) *UserStore {
+	store := &UserStore{
+		users:         make(map[string]UserCredential, len(users)),
+		path:          strings.TrimSpace(htpasswdPath),
+		checkInterval: htpasswdCheckInterval,
+	}
+	for _, user := range users {
+		store.users[user.Username] = user
+	}
+	if store.path != "" {
+		store.mu.Lock()
+		store.refreshLocked(time.Now())
+		store.mu.Unlock()
+	}
+	return store
+}
+
+// Authenticate verifies password for username. An inline password takes
+// precedence over an htpasswd entry for the same user.
+func (s *UserStore) Authenticate(username, password string) (Credential, bool) {
+	user, inline := s.users[username]
+	hash := user.Password
+	if hash == "" && s.path != "" {
+		s.mu.Lock()
+		s.refreshLocked(time.Now())
+		hash = s.fileUsers[username]
+		s.mu.Unlock()
+	}
+	if hash == "" || !verifyPassword(hash, password) {
+		return Credential{}, false
+	}
+	if !inline {
+		return Credential{Username: username}, true
+	}
+	credential := user.Credential
+	credential.Username = username
+	return credential, true
+}
+
+func (s *UserStore) refreshLocked(now time.Time) {
+	if !s.lastCheck.IsZero() && now.Sub(s.lastCheck) < s.checkInterval {
+		return
+	}
+	s.lastCheck = now
+	info, err := os.Stat(s.path)
+	if err != nil {
+		slog.Warn("htpasswd file unavailable", "path", s.path, "error", err)
+		return
+	}
+	if s.fileUsers != nil && info.ModTime().Equal(s.fileModTime) && info.Size() == s.fileSize {
+		return
+	}
+	users, err := loadHtpasswd(s.path)
+	if err != nil {
+		slog.Warn("htpasswd file not reloaded", "path", s.path, "error", err)
+		return
+	}
+	s.fileUsers = users
+	s.fileModTime = info.ModTime()
+	s.fileSize = info.Size()
+}
+
+func loadHtpasswd(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" || hash == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, lineNo)
+		}
+		users[username] = hash
+	}
+	return users, scanner.Err()
+}
+
+// verifyPassword checks password against a bcrypt ($2a$, $2b$, $2y$), {SHA}
+// or plain-text htpasswd value. Other schemes, such as $apr1$, never match.
+func verifyPassword(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return subtleEqual(hash[len("{SHA}"):], base64.StdEncoding.EncodeToString(sum[:]))
+	case strings.HasPrefix(hash, "$"):
+		return false
+	default:
+		return subtleEqual(hash, password)
+	}
+}
+
+const credentialContextKey contextKey = "listener-credential"
+
+// WithCredential records the account that authenticated the request.
+func WithCredential(ctx context.Context, credential Credential) context.Context {
+	return context.WithValue(ctx, credentialContextKey, credential)
+}
+
+// CredentialFromContext returns the account that authenticated the request.
+func CredentialFromContext(ctx context.Context) (Credential, bool) {
+	credential, ok := ctx.Value(credentialContextKey).(Credential)
+	return credential, ok
+}
+
+var errInvalidBasicAuth = errors.New("invalid basic credentials")
+
+// parseBasicAuth decodes a "Basic" Authorization or Proxy-Authorization value.
+func parseBasicAuth(header string) (string, string, error) {
+	scheme, encoded, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", errInvalidBasicAuth
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", errInvalidBasicAuth
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", errInvalidBasicAuth
+	}
+	return username, password, nil
+}
+
+func subtleEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
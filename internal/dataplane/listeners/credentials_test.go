@@ -0,0 +1,89 @@
+package listeners
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestUserStore_HtpasswdSchemes(t *testing.T) {
+	t.Parallel()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("bcrypt-pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	content := "# accounts\n" +
+		"alice:" + string(hash) + "\n" +
+		"bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n" +
+		"carol:plain-pass\n" +
+		"dave:$apr1$salt$hash\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write htpasswd: %v", err)
+	}
+	store := NewUserStore([]UserCredential{
+		{Credential: Credential{Username: "alice", TenantID: "tenant-a"}},
+		{Credential: Credential{Username: "carol"}, Password: "inline-pass"},
+	}, path)
+
+	for _, tc := range []struct {
+		user, pass string
+		ok         bool
+		tenant     string
+	}{
+		{"alice", "bcrypt-pass", true, "tenant-a"},
+		{"alice", "wrong", false, ""},
+		{"bob", "password", true, ""},
+		{"bob", "wrong", false, ""},
+		{"carol", "inline-pass", true, ""},
+		{"carol", "plain-pass", false, ""},
+		{"dave", "hash", false, ""},
+		{"nobody", "", false, ""},
+	} {
+		credential, ok := store.Authenticate(tc.user, tc.pass)
+		if ok != tc.ok {
+			t.Fatalf("%s/%s: expected ok=%v, got %v", tc.user, tc.pass, tc.ok, ok)
+		}
+		if ok && (credential.Username != tc.user || credential.TenantID != tc.tenant) {
+			t.Fatalf("%s: unexpected credential %+v", tc.user, credential)
+		}
+	}
+}
+
+func TestUserStore_ReloadsHtpasswd(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte("alice:first\n"), 0o600); err != nil {
+		t.Fatalf("write htpasswd: %v", err)
+	}
+	store := NewUserStore(nil, path)
+	store.checkInterval = 0
+	if _, ok := store.Authenticate("alice", "first"); !ok {
+		t.Fatalf("expected initial password to be accepted")
+	}
+
+	if err := os.WriteFile(path, []byte("alice:second-password\n"), 0o600); err != nil {
+		t.Fatalf("rewrite htpasswd: %v", err)
+	}
+	if _, ok := store.Authenticate("alice", "second-password"); !ok {
+		t.Fatalf("expected reloaded password to be accepted")
+	}
+	if _, ok := store.Authenticate("alice", "first"); ok {
+		t.Fatalf("expected old password to be rejected after reload")
+	}
+
+	// A broken file keeps the previous accounts.
+	if err := os.WriteFile(path, []byte("not a valid line and longer than before\n"), 0o600); err != nil {
+		t.Fatalf("rewrite htpasswd: %v", err)
+	}
+	future := time.Now().Add(time.Minute)
+	_ = os.Chtimes(path, future, future)
+	if _, ok := store.Authenticate("alice", "second-password"); !ok {
+		t.Fatalf("expected previous accounts to survive an invalid reload")
+	}
+}
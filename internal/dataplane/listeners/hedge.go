@@ -0,0 +1,146 @@
+package listeners
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Hedge outcomes reported to registries that record them.
+const (
+	HedgeOutcomePrimary = "primary"
+	HedgeOutcomeHedge   = "hedge"
+	HedgeOutcomeFailed  = "failed"
+)
+
+// hedgeResult is the outcome of one of the two racing attempts.
+type hedgeResult struct {
+	hedge    bool
+	endpoint RuntimeEndpoint
+	resp     *http.Response
+	latency  time.Duration
+	err      error
+}
+
+// hedgeAttempt is a launched attempt that still owns its capacity.
+type hedgeAttempt struct {
+	cancel  context.CancelFunc
+	release func()
+}
+
+// roundTripHedged sends req to the first admitted endpoint and, when no
+// response headers arrived within delay, races it against the next admitted
+// endpoint. The first response wins and the other attempt is cancelled. When
+// the race produced no response the endpoints not yet tried are returned for
+// the sequential path, together with the number of attempts made.
+func (h *ForwardProxyHandler) roundTripHedged(req *http.Request, target routeTarget, delay time.Duration) (*http.Response, []RuntimeEndpoint, int, error) {
+	ctx := req.Context()
+	releaseProvider, err := h.admitProvider(ctx, target.Provider)
+	if err != nil {
+		return nil, nil, 0, quotaError(target.Provider.Name, "")
+	}
+
+	results := make(chan hedgeResult, 2)
+	attempts := map[bool]hedgeAttempt{}
+	next := 0
+	launch := func(hedge bool) bool {
+		for next < len(target.Endpoints) {
+			endpoint := target.Endpoints[next]
+			next++
+			release, ok := tryAcquireEndpoint(endpoint)
+			if !ok {
+				continue
+			}
+			attemptCtx, cancel := context.WithCancel(ctx)
+			attempts[hedge] = hedgeAttempt{cancel: cancel, release: release}
+			index := len(attempts) - 1
+			go func() {
+				started := time.Now()
+				resp, err := h.sendAttempt(req.WithContext(attemptCtx), endpoint, index)
+				results <- hedgeResult{hedge: hedge, endpoint: endpoint, resp: resp, latency: time.Since(started), err: err}
+			}()
+			return true
+		}
+		return false
+	}
+
+	if !launch(false) {
+		releaseProvider()
+		return nil, target.Endpoints, 0, nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	inflight, hedged := 1, false
+	var errs []error
+	for inflight > 0 {
+		select {
+		case <-timer.C:
+			if launch(true) {
+				hedged = true
+				inflight++
+			}
+		case result := <-results:
+			inflight--
+			attempt := attempts[result.hedge]
+			if result.err == nil {
+				h.observeEndpointOutcome(ctx, result.endpoint.URL, nil, "")
+				h.observeEndpointLatency(ctx, result.endpoint.URL, result.latency)
+				if hedged {
+					outcome := HedgeOutcomePrimary
+					if result.hedge {
+						outcome = HedgeOutcomeHedge
+					}
+					h.observeHedge(target.Provider.Name, outcome)
+				}
+				if inflight > 0 {
+					loser := attempts[!result.hedge]
+					loser.cancel()
+					go h.settleHedgeLoser(ctx, results, loser)
+				}
+				result.resp.Body = &releaseOnCloseBody{ReadCloser: result.resp.Body, release: releaseAll(attempt.release, attempt.cancel, releaseProvider)}
+				return result.resp, nil, len(attempts), nil
+			}
+
+			attempt.cancel()
+			attempt.release()
+			class := h.classifyTimeout(result.err)
+			h.observeEndpointOutcome(ctx, result.endpoint.URL, result.err, class)
+			slog.Warn("forward upstream endpoint failed", "provider", providerFromContext(ctx), "endpoint", endpointLabel(result.endpoint), "classification", class, "error", result.err, "hedge", result.hedge)
+			errs = append(errs, wrapEndpointError(result.endpoint.URL, result.err, class))
+		}
+	}
+	releaseProvider()
+	if hedged {
+		h.observeHedge(target.Provider.Name, HedgeOutcomeFailed)
+	}
+	return nil, target.Endpoints[next:], len(attempts), errors.Join(errs...)
+}
+
+// settleHedgeLoser waits for the cancelled attempt so its outcome is still
+// recorded and its capacity returned. Failures caused by the cancellation
+// itself say nothing about the endpoint and are not reported.
+func (h *ForwardProxyHandler) settleHedgeLoser(ctx context.Context, results <-chan hedgeResult, loser hedgeAttempt) {
+	result := <-results
+	defer loser.release()
+	if result.err == nil {
+		drainAndClose(result.resp.Body)
+		h.observeEndpointOutcome(ctx, result.endpoint.URL, nil, "")
+		return
+	}
+	if errors.Is(result.err, context.Canceled) {
+		return
+	}
+	h.observeEndpointOutcome(ctx, result.endpoint.URL, result.err, h.classifyTimeout(result.err))
+}
+
+func (h *ForwardProxyHandler) observeHedge(provider, outcome string) {
+	type hedgeRecorder interface {
+		ObserveHedge(provider, outcome string)
+	}
+	if recorder, ok := h.Registry.(hedgeRecorder); ok {
+		recorder.ObserveHedge(provider, outcome)
+	}
+}
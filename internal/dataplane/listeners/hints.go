@@ -0,0 +1,64 @@
+package listeners
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Control headers carrying upstream targeting hints. They are stripped before
+// the request leaves the proxy.
+const (
+	HintCountryHeader    = "X-Microproxy-Country"
+	HintCityHeader       = "X-Microproxy-City"
+	HintSessionHeader    = "X-Microproxy-Session"
+	HintSessionTTLHeader = "X-Microproxy-Session-TTL" // minutes
+)
+
+// UpstreamHints are the targeting a client asked for. Providers whose auth
+// uses a username template encode them into the upstream login.
+type UpstreamHints struct {
+	Country           string
+	City              string
+	Session           string
+	SessionTTLMinutes int
+}
+
+// UpstreamHintsFromHeader reads hints from the request's control headers.
+// Values are reduced to letters, digits and underscores so they cannot break
+// a vendor's username format; a TTL that is not a positive number is ignored.
+func UpstreamHintsFromHeader(header http.Header) UpstreamHints {
+	hints := UpstreamHints{
+		Country: sanitizeHint(header.Get(HintCountryHeader)),
+		City:    sanitizeHint(header.Get(HintCityHeader)),
+		Session: sanitizeHint(header.Get(HintSessionHeader)),
+	}
+	if ttl, err := strconv.Atoi(strings.TrimSpace(header.Get(HintSessionTTLHeader))); err == nil && ttl > 0 {
+		hints.SessionTTLMinutes = ttl
+	}
+	return hints
+}
+
+const upstreamHintsContextKey contextKey = "upstream-hints"
+
+// WithUpstreamHints records the targeting hints for requests under ctx.
+func WithUpstreamHints(ctx context.Context, hints UpstreamHints) context.Context {
+	return context.WithValue(ctx, upstreamHintsContextKey, hints)
+}
+
+// UpstreamHintsFromContext returns the targeting hints of the request.
+func UpstreamHintsFromContext(ctx context.Context) UpstreamHints {
+	hints, _ := ctx.Value(upstreamHintsContextKey).(UpstreamHints)
+	return hints
+}
+
+func sanitizeHint(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		}
+		return -1
+	}, strings.TrimSpace(value))
+}
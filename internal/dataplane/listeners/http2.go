@@ -0,0 +1,106 @@
+package listeners
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// HTTP1Protocols returns a protocol set limited to HTTP/1.1, the default for
+// upstream transports until a provider opts into HTTP/2.
+func HTTP1Protocols() *http.Protocols {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	return protocols
+}
+
+// handleExtendedConnect serves an RFC 8441 extended CONNECT by replaying it
+// upstream as an HTTP/1.1 Upgrade request, so WebSockets and other upgrades
+// from HTTP/2 clients take the same forward path as HTTP/1.1 clients. The
+// target is https when the client sent :scheme https over TLS; h2c streams
+// carry no scheme and fall back to the port.
+func (h *ForwardProxyHandler) handleExtendedConnect(rw http.ResponseWriter, req *http.Request, protocol string) {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	} else if _, port, err := net.SplitHostPort(req.Host); err == nil && port == "443" {
+		scheme = "https"
+	}
+
+	upgradeReq := req.Clone(req.Context())
+	upgradeReq.Method = http.MethodGet
+	upgradeReq.URL = &url.URL{
+		Scheme:   scheme,
+		Host:     req.Host,
+		Path:     req.URL.Path,
+		RawPath:  req.URL.RawPath,
+		RawQuery: req.URL.RawQuery,
+	}
+	upgradeReq.Header.Del(":protocol")
+	upgradeReq.Header.Set("Connection", "Upgrade")
+	upgradeReq.Header.Set("Upgrade", protocol)
+	if strings.EqualFold(protocol, "websocket") && upgradeReq.Header.Get("Sec-WebSocket-Key") == "" {
+		// RFC 8441 drops the key exchange; HTTP/1.1 origins still require it.
+		var nonce [16]byte
+		_, _ = rand.Read(nonce[:])
+		upgradeReq.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(nonce[:]))
+	}
+
+	h.handleForward(rw, upgradeReq)
+}
+
+// finishExtendedConnect answers an extended CONNECT with 200 once the origin
+// switched protocols and tunnels the HTTP/2 stream to the upgraded body.
+func (h *ForwardProxyHandler) finishExtendedConnect(rw http.ResponseWriter, req *http.Request, resp *http.Response, backConn io.ReadWriteCloser, policyDecision PolicyDecision) {
+	removeHopHeaders(resp.Header)
+	resp.Header.Del("Sec-WebSocket-Accept")
+	if len(policyDecision.ResponseHeadersPatch) > 0 {
+		patchHeaders(resp.Header, policyDecision.ResponseHeadersPatch)
+	}
+	copyHeader(rw.Header(), resp.Header)
+	rw.WriteHeader(http.StatusOK)
+	if err := http.NewResponseController(rw).Flush(); err != nil {
+		_ = backConn.Close()
+		return
+	}
+
+	tunnel(newH2Stream(rw, req), halfCloser{backConn}, nil)
+}
+
+// h2Stream adapts an HTTP/2 request body and response writer pair to the
+// tunnel. A handler cannot end its response stream before returning, so a
+// write half-close closes the request body instead and lets the tunnel
+// finish.
+type h2Stream struct {
+	body       io.ReadCloser
+	rw         http.ResponseWriter
+	controller *http.ResponseController
+}
+
+func newH2Stream(rw http.ResponseWriter, req *http.Request) *h2Stream {
+	return &h2Stream{body: req.Body, rw: rw, controller: http.NewResponseController(rw)}
+}
+
+func (s *h2Stream) Read(p []byte) (int, error) {
+	return s.body.Read(p)
+}
+
+func (s *h2Stream) Write(p []byte) (int, error) {
+	n, err := s.rw.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, s.controller.Flush()
+}
+
+func (s *h2Stream) CloseWrite() error {
+	return s.body.Close()
+}
+
+func (s *h2Stream) Close() error {
+	return s.body.Close()
+}
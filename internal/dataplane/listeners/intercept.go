@@ -0,0 +1,156 @@
+package listeners
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Limits applied to the HTTP/1.1 server that runs inside an intercepted
+// tunnel.
+const (
+	interceptHandshakeTimeout  = 10 * time.Second
+	interceptReadHeaderTimeout = 30 * time.Second
+	interceptIdleTimeout       = 90 * time.Second
+)
+
+// interceptTLS asks the interceptor whether the CONNECT to targetAddr is
+// terminated locally. HTTP/2 CONNECT streams are always tunnelled.
+func (h *ForwardProxyHandler) interceptTLS(req *http.Request, targetAddr string) *tls.Config {
+	if h.Interceptor == nil || req.ProtoMajor != 1 {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		return nil
+	}
+	metadata, _ := MetadataFromContext(req.Context())
+	return h.Interceptor.InterceptTLS(metadata, host)
+}
+
+// interceptConnect terminates TLS on a hijacked CONNECT tunnel and serves the
+// requests inside it through handleForward, so routing, policies, and header
+// or body mutations apply to HTTPS traffic as they do to plain HTTP. Every
+// inner request is sent to the CONNECT target over https, whatever its Host
+// header says.
+func (h *ForwardProxyHandler) interceptConnect(rw http.ResponseWriter, req *http.Request, targetAddr string, tlsConfig *tls.Config) {
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		http.Error(rw, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	clientConn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("hijack failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		clientConn.Close()
+		return
+	}
+
+	tlsConn := tls.Server(&bufferedConn{Conn: clientConn, reader: buffered.Reader}, tlsConfig)
+	handshakeCtx, cancel := context.WithTimeout(req.Context(), interceptHandshakeTimeout)
+	err = tlsConn.HandshakeContext(handshakeCtx)
+	cancel()
+	if err != nil {
+		slog.Debug("tls interception handshake failed", "target", targetAddr, "error", err)
+		_ = tlsConn.Close()
+		return
+	}
+
+	// Inner requests act for the CONNECT: they keep its tenant, requested
+	// provider and authenticated account, so headers inside the tunnel cannot
+	// switch them. The CONNECT's metadata already carries its routed provider,
+	// so the requested one is read again from the header or the account.
+	connect, _ := MetadataFromContext(req.Context())
+	providerID := req.Header.Get("X-Provider-ID")
+	if credential, ok := CredentialFromContext(req.Context()); ok && credential.Provider != "" {
+		providerID = credential.Provider
+	}
+	inner := http.HandlerFunc(func(rw http.ResponseWriter, innerReq *http.Request) {
+		innerReq.URL.Scheme = "https"
+		innerReq.URL.Host = targetAddr
+		metadata := RequestMetadata{
+			RequestID:      requestIDFromRequest(innerReq),
+			Listener:       connect.Listener,
+			TenantID:       connect.TenantID,
+			Provider:       providerID,
+			Username:       connect.Username,
+			IdentityPolicy: connect.IdentityPolicy,
+			ClientIP:       connect.ClientIP,
+		}
+		h.handleForward(rw, innerReq.WithContext(WithMetadata(innerReq.Context(), metadata)))
+	})
+
+	server := &http.Server{
+		Handler:           inner,
+		ReadHeaderTimeout: interceptReadHeaderTimeout,
+		IdleTimeout:       interceptIdleTimeout,
+		ErrorLog:          log.New(io.Discard, "", 0),
+		BaseContext:       func(net.Listener) context.Context { return req.Context() },
+	}
+	_ = server.Serve(newSingleConnListener(tlsConn))
+}
+
+// bufferedConn reads through the bufio.Reader returned by Hijack so bytes the
+// client sent right after CONNECT (usually the ClientHello) are not lost.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// singleConnListener hands one connection to an http.Server and then blocks
+// Accept until that connection is closed, so Serve returns once the tunnel
+// is finished.
+type singleConnListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+	served chan net.Conn
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	l := &singleConnListener{closed: make(chan struct{}), served: make(chan net.Conn, 1)}
+	l.conn = &notifyCloseConn{Conn: conn, onClose: func() { l.once.Do(func() { close(l.closed) }) }}
+	l.served <- l.conn
+	return l
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.served:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close is called by http.Server when Serve returns; the connection itself
+// belongs to the server until it is closed.
+func (l *singleConnListener) Close() error { return nil }
+
+func (l *singleConnListener) Addr() net.Addr { return l.conn.LocalAddr() }
+
+type notifyCloseConn struct {
+	net.Conn
+	onClose func()
+}
+
+func (c *notifyCloseConn) Close() error {
+	err := c.Conn.Close()
+	c.onClose()
+	return err
+}
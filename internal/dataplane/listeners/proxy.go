@@ -2,6 +2,7 @@ package listeners
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -27,6 +28,8 @@ var hopHeaders = map[string]struct{}{
 	"Upgrade":             {},
 }
 
+const controlHeaderPrefix = "X-Microproxy-"
+
 // RouteDecision captures selected runtime routing details.
 type RouteDecision struct {
 	TenantID string
@@ -36,10 +39,12 @@ type RouteDecision struct {
 
 // RuntimeEndpoint is an upstream endpoint eligible for selection.
 type RuntimeEndpoint struct {
-	URL      *url.URL
-	Priority int
-	Adapter  UpstreamAdapter
-	Health   EndpointHealthSnapshot
+	URL       *url.URL
+	Priority  int
+	Weight    int
+	Adapter   UpstreamAdapter
+	Health    EndpointHealthSnapshot
+	Admission Admission
 }
 
 type EndpointHealthSnapshot struct {
@@ -55,6 +60,17 @@ type EndpointHealthSnapshot struct {
 type RuntimeProvider struct {
 	Name      string
 	Endpoints []RuntimeEndpoint
+
+	// Admission gates the provider as a whole; endpoints may carry their own.
+	Admission        Admission
+	QuotaStrategy    string
+	QueueTimeout     time.Duration
+	FallbackProvider string
+
+	Retry RetryPolicy
+	// HedgeDelay launches a second attempt on the next endpoint when the
+	// first has not produced response headers in time; 0 disables hedging.
+	HedgeDelay time.Duration
 }
 
 type TimeoutClassification string
@@ -93,6 +109,7 @@ type PolicyDecision struct {
 	RewritePathPrefix    string
 	RequestBodyPrefix    string
 	ResponseBodyPrefix   string
+	UpstreamCredentials  *UpstreamCredentials
 	Trace                []string
 }
 
@@ -101,6 +118,28 @@ type PolicyEvaluator interface {
 	Evaluate(req *http.Request, metadata RequestMetadata, route RouteDecision) PolicyDecision
 }
 
+// ErrPolicyDenied is returned when policy refuses a tunnel opened outside
+// HTTP, such as a SOCKS request.
+var ErrPolicyDenied = errors.New("denied by policy")
+
+// PolicyDeniedError carries the decision that refused a tunnel.
+type PolicyDeniedError struct {
+	Decision PolicyDecision
+}
+
+func (e *PolicyDeniedError) Error() string {
+	return "policy " + valueOrDefault(e.Decision.PolicyName, "<unnamed>") + ": " + ErrPolicyDenied.Error()
+}
+
+func (e *PolicyDeniedError) Unwrap() error { return ErrPolicyDenied }
+
+// TLSInterceptor decides which CONNECT tunnels are terminated by the proxy.
+type TLSInterceptor interface {
+	// InterceptTLS returns the server TLS configuration presented for host,
+	// or nil when the tunnel must pass through untouched.
+	InterceptTLS(metadata RequestMetadata, host string) *tls.Config
+}
+
 // ForwardProxyHandler implements HTTP forward proxying and CONNECT tunneling.
 type ForwardProxyHandler struct {
 	Transport *http.Transport
@@ -111,13 +150,14 @@ type ForwardProxyHandler struct {
 	Selector          EndpointSelector
 	ClassifyTimeoutFn TimeoutClassifier
 	PolicyEvaluator   PolicyEvaluator
+	Interceptor       TLSInterceptor
 }
 
 func NewForwardProxyHandler() *ForwardProxyHandler {
 	return &ForwardProxyHandler{
 		Transport: &http.Transport{
 			Proxy:                 nil,
-			ForceAttemptHTTP2:     false,
+			Protocols:             HTTP1Protocols(),
 			MaxIdleConns:          100,
 			IdleConnTimeout:       90 * time.Second,
 			TLSHandshakeTimeout:   10 * time.Second,
@@ -134,6 +174,7 @@ func NewForwardProxyHandlerWithRuntime(runtime RequestRuntime) *ForwardProxyHand
 	handler.Selector = runtime.Selector
 	handler.ClassifyTimeoutFn = runtime.ClassifyTimeoutFn
 	handler.PolicyEvaluator = runtime.PolicyEvaluator
+	handler.Interceptor = runtime.Interceptor
 	return handler
 }
 
@@ -144,10 +185,15 @@ type RequestRuntime struct {
 	Selector          EndpointSelector
 	ClassifyTimeoutFn TimeoutClassifier
 	PolicyEvaluator   PolicyEvaluator
+	Interceptor       TLSInterceptor
 }
 
 func (h *ForwardProxyHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	if req.Method == http.MethodConnect {
+		if protocol := req.Header.Get(":protocol"); protocol != "" {
+			h.handleExtendedConnect(rw, req, protocol)
+			return
+		}
 		h.handleConnect(rw, req)
 		return
 	}
@@ -156,7 +202,7 @@ func (h *ForwardProxyHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reques
 }
 
 func (h *ForwardProxyHandler) handleForward(rw http.ResponseWriter, req *http.Request) {
-	decision, endpoints, resolved := h.resolveRoute(req)
+	decision, target, resolved := h.resolveRoute(req)
 	metadata, _ := MetadataFromContext(req.Context())
 	metadata.ContentType = req.Header.Get("Content-Type")
 	metadata.RequestSize = req.ContentLength
@@ -179,8 +225,8 @@ func (h *ForwardProxyHandler) handleForward(rw http.ResponseWriter, req *http.Re
 		return
 	}
 	if policyDecision.Action == "route_override" {
-		if overrideEndpoints, ok := h.resolveOverrideEndpoints(req, policyDecision.RouteOverride); ok {
-			endpoints = overrideEndpoints
+		if overrideTarget, ok := h.resolveOverrideEndpoints(req, policyDecision.RouteOverride); ok {
+			target = overrideTarget
 			UpdateMetadata(req.Context(), func(metadata *RequestMetadata) {
 				metadata.Provider = policyDecision.RouteOverride
 			})
@@ -195,7 +241,18 @@ func (h *ForwardProxyHandler) handleForward(rw http.ResponseWriter, req *http.Re
 	if outReq.URL.Host == "" {
 		outReq.URL.Host = req.Host
 	}
+	upgrade := upgradeType(req.Header)
 	removeHopHeaders(outReq.Header)
+	removeControlHeaders(outReq.Header)
+	if upgrade != "" {
+		outReq.Header.Set("Connection", "Upgrade")
+		outReq.Header.Set("Upgrade", upgrade)
+		if req.ProtoMajor == 2 {
+			// The HTTP/2 stream body carries tunnel data, not a payload.
+			outReq.Body = http.NoBody
+			outReq.ContentLength = 0
+		}
+	}
 	if policyDecision.Action == "headers_patch" {
 		patchHeaders(outReq.Header, policyDecision.HeadersPatch)
 	}
@@ -206,12 +263,21 @@ func (h *ForwardProxyHandler) handleForward(rw http.ResponseWriter, req *http.Re
 		outReq.Body = io.NopCloser(io.MultiReader(strings.NewReader(policyDecision.RequestBodyPrefix), outReq.Body))
 	}
 
-	resp, err := h.roundTripWithFallback(outReq, endpoints)
+	resp, err := h.roundTripWithFallback(outReq, target)
 	if err != nil {
+		if h.applyQuotaDeny(rw, req, err) {
+			return
+		}
 		http.Error(rw, fmt.Sprintf("proxy request failed: %v", err), http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
+	h.observeRequestServed(req.Context())
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		h.finishUpgrade(rw, req, resp, upgrade, policyDecision)
+		return
+	}
 
 	removeHopHeaders(resp.Header)
 	if len(policyDecision.ResponseHeadersPatch) > 0 {
@@ -225,39 +291,105 @@ func (h *ForwardProxyHandler) handleForward(rw http.ResponseWriter, req *http.Re
 	_, _ = io.Copy(rw, resp.Body)
 }
 
-func (h *ForwardProxyHandler) roundTripWithFallback(req *http.Request, endpoints []RuntimeEndpoint) (*http.Response, error) {
-	if len(endpoints) == 0 {
+func (h *ForwardProxyHandler) roundTripWithFallback(req *http.Request, target routeTarget) (*http.Response, error) {
+	if len(target.Endpoints) == 0 && target.Provider.FallbackProvider == "" {
 		return h.Transport.RoundTrip(req)
 	}
 
-	var errs []error
-	for i, endpoint := range endpoints {
-		adapter := endpoint.Adapter
-		if adapter == nil {
-			adapter = defaultDirectAdapter{}
-		}
-		preparedReq, err := adapter.PrepareRequest(req, endpoint.URL)
+	policy := target.Provider.Retry.withDefaults()
+	cleanup, replayable := func() {}, true
+	if policy.MaxAttempts != 1 && (len(target.Endpoints) > 1 || target.Provider.FallbackProvider != "") {
+		var err error
+		cleanup, replayable, err = bufferRequestBody(req, policy)
 		if err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+
+	attempts := 0
+	var hedgeErr error
+	// Hedging an upgrade would open two upstream sessions.
+	if delay := target.Provider.HedgeDelay; delay > 0 && upgradeType(req.Header) == "" && replayable && policy.MaxAttempts != 1 && policy.retriesMethod(req.Method) && target.Provider.QuotaStrategy == QuotaStrategySpill {
+		resp, rest, attempted, err := h.roundTripHedged(req, target, delay)
+		if resp != nil {
+			resp.Body = &releaseOnCloseBody{ReadCloser: resp.Body, release: cleanup}
+			return resp, nil
+		}
+		attempts, hedgeErr = attempted, err
+		if hedgeErr != nil && (len(rest) == 0 || (policy.MaxAttempts > 0 && attempts >= policy.MaxAttempts)) {
+			cleanup()
+			return nil, hedgeErr
+		}
+		target.Endpoints = rest
+	}
+
+	var resp, retriedResp *http.Response
+	release, err := h.attemptEndpoints(req, target, func(_ int, endpoint RuntimeEndpoint) error {
+		attempts++
+		lastAttempt := policy.MaxAttempts > 0 && attempts >= policy.MaxAttempts
+		started := time.Now()
+		attemptResp, err := h.sendAttempt(req, endpoint, attempts-1)
+		if err == nil && policy.retriesStatus(attemptResp.StatusCode) && !lastAttempt && replayable && policy.retriesMethod(req.Method) {
+			// Keep the response in case no other endpoint does better.
+			if retriedResp != nil {
+				drainAndClose(retriedResp.Body)
+			}
+			retriedResp = attemptResp
+			err = fmt.Errorf("upstream responded with status %d", attemptResp.StatusCode)
 			class := h.classifyTimeout(err)
 			h.observeEndpointOutcome(req.Context(), endpoint.URL, err, class)
-			errs = append(errs, wrapEndpointError(endpoint.URL, err, class))
-			continue
+			slog.Warn("forward upstream endpoint returned retryable status", "provider", providerFromContext(req.Context()), "endpoint", endpointLabel(endpoint), "status", attemptResp.StatusCode)
+			return wrapEndpointError(endpoint.URL, err, class)
 		}
-		resp, err := adapter.RoundTrip(preparedReq, endpoint.URL, h.Transport, timeoutForAttempt(h.Dialer.Timeout, i))
 		if err == nil {
 			h.observeEndpointOutcome(req.Context(), endpoint.URL, nil, "")
-			return resp, nil
+			h.observeEndpointLatency(req.Context(), endpoint.URL, time.Since(started))
+			resp = attemptResp
+			return nil
 		}
 		class := h.classifyTimeout(err)
 		h.observeEndpointOutcome(req.Context(), endpoint.URL, err, class)
-		errs = append(errs, wrapEndpointError(endpoint.URL, err, class))
-		endpointLabel := "<direct>"
-		if endpoint.URL != nil {
-			endpointLabel = endpoint.URL.String()
+		slog.Warn("forward upstream endpoint failed", "provider", providerFromContext(req.Context()), "endpoint", endpointLabel(endpoint), "classification", class, "error", err)
+		err = wrapEndpointError(endpoint.URL, err, class)
+		switch {
+		case !replayable:
+			return finalAttempt(errors.Join(err, fmt.Errorf("%w: body exceeds %d bytes", ErrBodyTooLargeToRetry, policy.MaxBodyBytes)))
+		case lastAttempt, !policy.canRetryError(req.Method, err):
+			return finalAttempt(err)
+		}
+		return err
+	})
+	if err != nil {
+		if retriedResp != nil {
+			retriedResp.Body = &releaseOnCloseBody{ReadCloser: retriedResp.Body, release: cleanup}
+			return retriedResp, nil
 		}
-		slog.Warn("forward upstream endpoint failed", "provider", providerFromContext(req.Context()), "endpoint", endpointLabel, "classification", class, "error", err)
+		cleanup()
+		return nil, errors.Join(hedgeErr, err)
+	}
+	if retriedResp != nil {
+		drainAndClose(retriedResp.Body)
+	}
+	resp.Body = &releaseOnCloseBody{ReadCloser: resp.Body, release: releaseAll(release, cleanup)}
+	return resp, nil
+}
+
+// sendAttempt sends req to endpoint with a fresh copy of the body.
+func (h *ForwardProxyHandler) sendAttempt(req *http.Request, endpoint RuntimeEndpoint, attempt int) (*http.Response, error) {
+	adapter := endpoint.Adapter
+	if adapter == nil {
+		adapter = defaultDirectAdapter{}
 	}
-	return nil, errors.Join(errs...)
+	attemptReq, err := rewindRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	preparedReq, err := adapter.PrepareRequest(attemptReq, endpoint.URL)
+	if err != nil {
+		return nil, err
+	}
+	return adapter.RoundTrip(preparedReq, endpoint.URL, h.Transport, timeoutForAttempt(h.Dialer.Timeout, attempt))
 }
 
 func (h *ForwardProxyHandler) handleConnect(rw http.ResponseWriter, req *http.Request) {
@@ -267,48 +399,39 @@ func (h *ForwardProxyHandler) handleConnect(rw http.ResponseWriter, req *http.Re
 		return
 	}
 
-	decision, endpoints, resolved := h.resolveRoute(req)
-	metadata, _ := MetadataFromContext(req.Context())
-	metadata.ContentType = req.Header.Get("Content-Type")
-	metadata.RequestSize = req.ContentLength
-	metadata.EvaluationClock = time.Now().UTC()
-	if resolved {
-		UpdateMetadata(req.Context(), func(metadata *RequestMetadata) {
-			if decision.TenantID != "" {
-				metadata.TenantID = decision.TenantID
-			}
-			metadata.Provider = decision.Provider
-			metadata.Policy = decision.Policy
-		})
-	}
-	policyDecision := h.evaluatePolicy(req, metadata, decision)
-	h.recordPolicyDecision(req.Context(), policyDecision)
+	target, policyDecision := h.planConnect(req)
 	if h.applyDeny(rw, policyDecision) {
 		return
 	}
 	if h.applyRedirect(rw, policyDecision) {
 		return
 	}
-	if policyDecision.Action == "route_override" {
-		if overrideEndpoints, ok := h.resolveOverrideEndpoints(req, policyDecision.RouteOverride); ok {
-			endpoints = overrideEndpoints
-			UpdateMetadata(req.Context(), func(metadata *RequestMetadata) {
-				metadata.Provider = policyDecision.RouteOverride
-			})
-		}
-	}
 
-	var targetConn net.Conn
-	if len(endpoints) == 0 {
-		targetConn, err = h.Dialer.DialContext(req.Context(), "tcp", targetAddr)
-	} else {
-		targetConn, err = h.dialConnectViaUpstream(req.Context(), targetAddr, endpoints)
+	if tlsConfig := h.interceptTLS(req, targetAddr); tlsConfig != nil {
+		h.interceptConnect(rw, req, targetAddr, tlsConfig)
+		return
 	}
+
+	targetConn, err := h.dialTarget(req, targetAddr, target)
 	if err != nil {
+		if h.applyQuotaDeny(rw, req, err) {
+			return
+		}
 		http.Error(rw, fmt.Sprintf("connect target failed: %v", err), http.StatusBadGateway)
 		return
 	}
 
+	if req.ProtoMajor == 2 {
+		rw.WriteHeader(http.StatusOK)
+		if err := http.NewResponseController(rw).Flush(); err != nil {
+			targetConn.Close()
+			return
+		}
+		stream := newH2Stream(rw, req)
+		tunnel(stream, targetConn, h.StartTunnel(req, func() { closeTunnel(stream, targetConn) }))
+		return
+	}
+
 	hijacker, ok := rw.(http.Hijacker)
 	if !ok {
 		targetConn.Close()
@@ -329,35 +452,110 @@ func (h *ForwardProxyHandler) handleConnect(rw http.ResponseWriter, req *http.Re
 		return
 	}
 
+	meter := h.StartTunnel(req, func() { closeTunnel(clientConn, targetConn) })
 	if buffered.Reader.Buffered() > 0 {
-		if _, err := io.CopyN(targetConn, buffered, int64(buffered.Reader.Buffered())); err != nil {
-			clientConn.Close()
-			targetConn.Close()
+		if _, err := io.CopyN(meter.TargetWriter(targetConn), buffered, int64(buffered.Reader.Buffered())); err != nil {
+			closeTunnel(clientConn, targetConn)
+			meter.Finish()
 			return
 		}
 	}
 
-	tunnel(clientConn, targetConn)
+	tunnel(clientConn, targetConn, meter)
+}
+
+// planConnect resolves the route for a CONNECT-style request, evaluates its
+// policy, and applies route_override. Deny and redirect decisions are left to
+// the caller.
+func (h *ForwardProxyHandler) planConnect(req *http.Request) (routeTarget, PolicyDecision) {
+	decision, target, resolved := h.resolveRoute(req)
+	metadata, _ := MetadataFromContext(req.Context())
+	metadata.ContentType = req.Header.Get("Content-Type")
+	metadata.RequestSize = req.ContentLength
+	metadata.EvaluationClock = time.Now().UTC()
+	if resolved {
+		UpdateMetadata(req.Context(), func(metadata *RequestMetadata) {
+			if decision.TenantID != "" {
+				metadata.TenantID = decision.TenantID
+			}
+			metadata.Provider = decision.Provider
+			metadata.Policy = decision.Policy
+		})
+		setRouteDecision(req.Context(), decision)
+	}
+	policyDecision := h.evaluatePolicy(req, metadata, decision)
+	h.recordPolicyDecision(req.Context(), policyDecision)
+	if policyDecision.Action == "route_override" {
+		if overrideTarget, ok := h.resolveOverrideEndpoints(req, policyDecision.RouteOverride); ok {
+			target = overrideTarget
+			UpdateMetadata(req.Context(), func(metadata *RequestMetadata) {
+				metadata.Provider = policyDecision.RouteOverride
+			})
+		}
+	}
+	return target, policyDecision
+}
+
+// planTunnel is planConnect for callers outside HTTP, which cannot answer a
+// redirect and so treat it like a deny.
+func (h *ForwardProxyHandler) planTunnel(req *http.Request) (routeTarget, error) {
+	target, policyDecision := h.planConnect(req)
+	switch policyDecision.Action {
+	case "deny", "redirect":
+		return routeTarget{}, &PolicyDeniedError{Decision: policyDecision}
+	}
+	return target, nil
+}
+
+// ConnectTarget runs req through the same routing, policy, and admission
+// pipeline as HTTP CONNECT and opens a tunnel to targetAddr. A policy deny
+// is reported as a *PolicyDeniedError.
+func (h *ForwardProxyHandler) ConnectTarget(req *http.Request, targetAddr string) (net.Conn, error) {
+	target, err := h.planTunnel(req)
+	if err != nil {
+		return nil, err
+	}
+	return h.dialTarget(req, targetAddr, target)
 }
 
-func (h *ForwardProxyHandler) dialConnectViaUpstream(ctx context.Context, targetAddr string, endpoints []RuntimeEndpoint) (net.Conn, error) {
-	var errs []error
-	for _, endpoint := range endpoints {
+func (h *ForwardProxyHandler) dialTarget(req *http.Request, targetAddr string, target routeTarget) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if isDirectTarget(target) {
+		conn, err = h.Dialer.DialContext(req.Context(), "tcp", targetAddr)
+	} else {
+		conn, err = h.dialConnectViaUpstream(req, targetAddr, target)
+	}
+	if err == nil {
+		h.observeRequestServed(req.Context())
+	}
+	return conn, err
+}
+
+func (h *ForwardProxyHandler) dialConnectViaUpstream(req *http.Request, targetAddr string, target routeTarget) (net.Conn, error) {
+	ctx := req.Context()
+	var conn net.Conn
+	release, err := h.attemptEndpoints(req, target, func(_ int, endpoint RuntimeEndpoint) error {
 		adapter := endpoint.Adapter
 		if adapter == nil {
 			adapter = defaultDirectAdapter{}
 		}
-		conn, err := adapter.DialConnect(ctx, targetAddr, endpoint.URL, h.Dialer)
+		started := time.Now()
+		dialed, err := adapter.DialConnect(ctx, targetAddr, endpoint.URL, h.Dialer)
 		if err != nil {
 			class := h.classifyTimeout(err)
 			h.observeEndpointOutcome(ctx, endpoint.URL, err, class)
-			errs = append(errs, wrapEndpointError(endpoint.URL, err, class))
-			continue
+			return wrapEndpointError(endpoint.URL, err, class)
 		}
 		h.observeEndpointOutcome(ctx, endpoint.URL, nil, "")
-		return conn, nil
+		h.observeEndpointLatency(ctx, endpoint.URL, time.Since(started))
+		conn = dialed
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil, errors.Join(errs...)
+	return WrapConnRelease(conn, release), nil
 }
 
 func (h *ForwardProxyHandler) observeEndpointOutcome(ctx context.Context, endpoint *url.URL, err error, class TimeoutClassification) {
@@ -372,33 +570,67 @@ func (h *ForwardProxyHandler) observeEndpointOutcome(ctx context.Context, endpoi
 	recorder.ObserveEndpointOutcome(metadata.Provider, endpoint, err, class)
 }
 
-func (h *ForwardProxyHandler) resolveRoute(req *http.Request) (RouteDecision, []RuntimeEndpoint, bool) {
+// observeRequestServed reports a request that went through, once, however
+// many endpoints and providers it tried.
+func (h *ForwardProxyHandler) observeRequestServed(ctx context.Context) {
+	type requestServedRecorder interface {
+		ObserveRequestServed(ctx context.Context)
+	}
+	if recorder, ok := h.Registry.(requestServedRecorder); ok {
+		recorder.ObserveRequestServed(ctx)
+	}
+}
+
+func (h *ForwardProxyHandler) observeEndpointLatency(ctx context.Context, endpoint *url.URL, latency time.Duration) {
+	type endpointLatencyRecorder interface {
+		ObserveEndpointLatency(provider string, endpoint *url.URL, latency time.Duration)
+	}
+	recorder, ok := h.Registry.(endpointLatencyRecorder)
+	if !ok {
+		return
+	}
+	metadata, _ := MetadataFromContext(ctx)
+	recorder.ObserveEndpointLatency(metadata.Provider, endpoint, latency)
+}
+
+func (h *ForwardProxyHandler) resolveRoute(req *http.Request) (RouteDecision, routeTarget, bool) {
 	metadata, _ := MetadataFromContext(req.Context())
 	if h.Resolver == nil {
-		return RouteDecision{}, nil, false
+		return RouteDecision{}, routeTarget{}, false
 	}
 
 	decision, err := h.Resolver.Resolve(req, metadata)
+	if err == nil && metadata.Provider == "" {
+		type sessionRouter interface {
+			SessionProvider(ctx context.Context) string
+		}
+		if router, ok := h.Registry.(sessionRouter); ok {
+			// An open sticky session keeps the provider it started on.
+			if pinned := router.SessionProvider(req.Context()); pinned != "" {
+				decision.Provider = pinned
+			}
+		}
+	}
 	if err != nil || decision.Provider == "" || h.Registry == nil || h.Selector == nil {
-		return decision, nil, err == nil
+		return decision, routeTarget{}, err == nil
 	}
 
 	provider, ok := h.Registry.Get(decision.Provider)
 	if !ok {
-		return decision, nil, true
+		return decision, routeTarget{}, true
 	}
-	return decision, h.Selector.Select(req.Context(), provider, req), true
+	return decision, routeTarget{Provider: provider, Endpoints: h.Selector.Select(req.Context(), provider, req)}, true
 }
 
-func (h *ForwardProxyHandler) resolveOverrideEndpoints(req *http.Request, provider string) ([]RuntimeEndpoint, bool) {
+func (h *ForwardProxyHandler) resolveOverrideEndpoints(req *http.Request, provider string) (routeTarget, bool) {
 	if provider == "" || h.Registry == nil || h.Selector == nil {
-		return nil, false
+		return routeTarget{}, false
 	}
 	runtimeProvider, ok := h.Registry.Get(provider)
 	if !ok {
-		return nil, false
+		return routeTarget{}, false
 	}
-	return h.Selector.Select(req.Context(), runtimeProvider, req), true
+	return routeTarget{Provider: runtimeProvider, Endpoints: h.Selector.Select(req.Context(), runtimeProvider, req)}, true
 }
 
 func (h *ForwardProxyHandler) evaluatePolicy(req *http.Request, metadata RequestMetadata, route RouteDecision) PolicyDecision {
@@ -425,6 +657,33 @@ func (h *ForwardProxyHandler) applyDeny(rw http.ResponseWriter, policyDecision P
 	return true
 }
 
+// applyQuotaDeny answers with a 429 quota deny when upstream admission refused err.
+func (h *ForwardProxyHandler) applyQuotaDeny(rw http.ResponseWriter, req *http.Request, err error) bool {
+	if !errors.Is(err, ErrQuotaExceeded) {
+		return false
+	}
+	message := ErrQuotaExceeded.Error()
+	var quotaErr *QuotaError
+	if errors.As(err, &quotaErr) {
+		message = fmt.Sprintf("provider %s: %s", quotaErr.Provider, message)
+	}
+	UpdateMetadata(req.Context(), func(metadata *RequestMetadata) {
+		metadata.PolicyAction = "deny"
+		metadata.PolicyReason = "quota_exceeded"
+		metadata.PolicyCategory = "quota"
+	})
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusTooManyRequests)
+	_ = json.NewEncoder(rw).Encode(map[string]any{
+		"error": map[string]string{
+			"code":     "quota_exceeded",
+			"message":  message,
+			"category": "quota",
+		},
+	})
+	return true
+}
+
 func (h *ForwardProxyHandler) applyRedirect(rw http.ResponseWriter, policyDecision PolicyDecision) bool {
 	if policyDecision.Action != "redirect" || strings.TrimSpace(policyDecision.RedirectURL) == "" {
 		return false
@@ -442,6 +701,9 @@ func (h *ForwardProxyHandler) recordPolicyDecision(ctx context.Context, decision
 		metadata.PolicyCategory = valueOrDefault(decision.DenyCategory, "none")
 		metadata.PolicyTrace = append([]string(nil), decision.Trace...)
 	})
+	if decision.UpstreamCredentials != nil {
+		setUpstreamCredentials(ctx, decision.UpstreamCredentials)
+	}
 }
 
 func applyRewrite(req *http.Request, decision PolicyDecision) {
@@ -476,28 +738,35 @@ func (h *ForwardProxyHandler) classifyTimeout(err error) TimeoutClassification {
 	return h.ClassifyTimeoutFn(err)
 }
 
-func tunnel(clientConn net.Conn, targetConn net.Conn) {
+// tunnel relays both directions until each has finished. A non-nil meter
+// accounts the bytes and is finished once both ends are closed.
+func tunnel(clientConn, targetConn io.ReadWriteCloser, meter *TunnelMeter) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 
 	go func() {
 		defer wg.Done()
-		_, _ = io.Copy(targetConn, clientConn)
+		_, _ = io.Copy(meter.TargetWriter(targetConn), clientConn)
 		closeWrite(targetConn)
 	}()
 
 	go func() {
 		defer wg.Done()
-		_, _ = io.Copy(clientConn, targetConn)
+		_, _ = io.Copy(meter.ClientWriter(clientConn), targetConn)
 		closeWrite(clientConn)
 	}()
 
 	wg.Wait()
+	closeTunnel(clientConn, targetConn)
+	meter.Finish()
+}
+
+func closeTunnel(clientConn, targetConn io.Closer) {
 	_ = clientConn.Close()
 	_ = targetConn.Close()
 }
 
-func closeWrite(conn net.Conn) {
+func closeWrite(conn io.Writer) {
 	type closeWriter interface{ CloseWrite() error }
 	if cw, ok := conn.(closeWriter); ok {
 		_ = cw.CloseWrite()
@@ -556,6 +825,16 @@ func removeHopHeaders(headers http.Header) {
 	}
 }
 
+// removeControlHeaders drops X-Microproxy-* request headers, which steer the
+// proxy itself (session affinity and similar) and must not leak upstream.
+func removeControlHeaders(headers http.Header) {
+	for header := range headers {
+		if strings.HasPrefix(header, controlHeaderPrefix) {
+			headers.Del(header)
+		}
+	}
+}
+
 func patchHeaders(headers http.Header, patch map[string]string) {
 	for key, value := range patch {
 		headers.Set(key, value)
@@ -564,13 +843,26 @@ func patchHeaders(headers http.Header, patch map[string]string) {
 
 func (h *ForwardProxyHandler) CloseIdleConnections() {
 	h.Transport.CloseIdleConnections()
+	h.closeRegistryIdleConnections()
 }
 
 func (h *ForwardProxyHandler) Shutdown(_ context.Context) error {
 	h.Transport.CloseIdleConnections()
+	h.closeRegistryIdleConnections()
 	return nil
 }
 
+// closeRegistryIdleConnections drains idle pools of registries that cache
+// their own upstream transports.
+func (h *ForwardProxyHandler) closeRegistryIdleConnections() {
+	type idleConnectionCloser interface {
+		CloseIdleConnections()
+	}
+	if closer, ok := h.Registry.(idleConnectionCloser); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
 func wrapEndpointError(endpoint *url.URL, err error, class TimeoutClassification) error {
 	if endpoint == nil {
 		return fmt.Errorf("endpoint <direct> failed (%s): %w", class, err)
@@ -605,13 +897,21 @@ func (defaultDirectAdapter) DialConnect(ctx context.Context, targetAddr string,
 }
 
 func (defaultDirectAdapter) RoundTrip(req *http.Request, _ *url.URL, transport *http.Transport, responseHeaderTimeout time.Duration) (*http.Response, error) {
-	cloned := transport.Clone()
-	cloned.ResponseHeaderTimeout = responseHeaderTimeout
-	return cloned.RoundTrip(req)
+	return RoundTripWithResponseHeaderTimeout(transport, req, responseHeaderTimeout)
 }
 
 func (defaultDirectAdapter) RotateIdentity(context.Context) error {
 	return ErrRotateIdentityUnsupported
 }
 
-func (defaultDirectAdapter) Capabilities() []string { return []string{"forward", "connect"} }
+func (defaultDirectAdapter) AssociateUDP(context.Context, *url.URL, *net.Dialer) (UDPAssociation, error) {
+	return NewDirectUDPAssociation()
+}
+
+func (defaultDirectAdapter) BindTCP(_ context.Context, peerAddr string, _ *url.URL, _ *net.Dialer) (TCPBinding, error) {
+	return NewDirectTCPBinding(peerAddr)
+}
+
+func (defaultDirectAdapter) Capabilities() []string {
+	return []string{"forward", "connect", "bind", "udp"}
+}
@@ -0,0 +1,210 @@
+package listeners
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Retry defaults used when a provider leaves the corresponding field unset.
+const (
+	DefaultRetryBodyMemoryBytes int64 = 64 << 10
+	DefaultRetryMaxBodyBytes    int64 = 10 << 20
+)
+
+// DefaultRetryMethods are the idempotent methods retried on another endpoint.
+var DefaultRetryMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete}
+
+// ErrBodyTooLargeToRetry is reported when an attempt failed and the request
+// body was too large to buffer for another attempt.
+var ErrBodyTooLargeToRetry = errors.New("request body too large to retry")
+
+// RetryPolicy controls cross-endpoint retries of forwarded requests.
+type RetryPolicy struct {
+	// MaxAttempts caps attempts across endpoints; 0 tries every endpoint.
+	MaxAttempts int
+	// Methods lists the methods retried after the upstream may have seen the
+	// request. Other methods are only retried when the dial itself failed.
+	Methods []string
+	// RetryOnStatus lists upstream status codes that move on to the next
+	// endpoint. The last response is returned when no endpoint is left.
+	RetryOnStatus []int
+	// BodyMemoryBytes is buffered in memory before spilling to a temp file.
+	BodyMemoryBytes int64
+	// MaxBodyBytes is the largest body buffered for replay.
+	MaxBodyBytes int64
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if len(p.Methods) == 0 {
+		p.Methods = DefaultRetryMethods
+	}
+	if p.BodyMemoryBytes <= 0 {
+		p.BodyMemoryBytes = DefaultRetryBodyMemoryBytes
+	}
+	if p.MaxBodyBytes <= 0 {
+		p.MaxBodyBytes = DefaultRetryMaxBodyBytes
+	}
+	if p.BodyMemoryBytes > p.MaxBodyBytes {
+		p.BodyMemoryBytes = p.MaxBodyBytes
+	}
+	return p
+}
+
+func (p RetryPolicy) retriesMethod(method string) bool {
+	return slices.ContainsFunc(p.Methods, func(candidate string) bool {
+		return strings.EqualFold(candidate, method)
+	})
+}
+
+func (p RetryPolicy) retriesStatus(status int) bool {
+	return slices.Contains(p.RetryOnStatus, status)
+}
+
+// canRetryError reports whether err may be retried for method. Dial failures
+// never reached the upstream, so they are safe for every method.
+func (p RetryPolicy) canRetryError(method string, err error) bool {
+	if p.retriesMethod(method) {
+		return true
+	}
+	// Proxy dial failures surface as "proxyconnect" wrapping the dial error.
+	var opErr *net.OpError
+	for errors.As(err, &opErr) {
+		if opErr.Op == "dial" {
+			return true
+		}
+		err = opErr.Err
+	}
+	return false
+}
+
+// finalAttemptError stops the endpoint walk after a failed attempt.
+type finalAttemptError struct {
+	err error
+}
+
+func (e *finalAttemptError) Error() string { return e.err.Error() }
+func (e *finalAttemptError) Unwrap() error { return e.err }
+
+func finalAttempt(err error) error {
+	return &finalAttemptError{err: err}
+}
+
+func isFinalAttempt(err error) bool {
+	var final *finalAttemptError
+	return errors.As(err, &final)
+}
+
+// replayableBody holds a buffered request body that every attempt can read
+// from the start. Bodies up to the memory limit stay in memory; larger ones
+// spill to a temp file that cleanup removes.
+type replayableBody struct {
+	mem  []byte
+	file *os.File
+	size int64
+
+	cleanupOnce sync.Once
+}
+
+// bufferRequestBody replaces req.Body with a replayable copy and sets
+// req.GetBody. When the body exceeds policy.MaxBodyBytes it is left streaming
+// (already read bytes first) and ok is false; the request can then only be
+// attempted once.
+func bufferRequestBody(req *http.Request, policy RetryPolicy) (cleanup func(), ok bool, err error) {
+	noop := func() {}
+	if req.Body == nil || req.Body == http.NoBody {
+		return noop, true, nil
+	}
+	original := req.Body
+	body := &replayableBody{}
+
+	var mem bytes.Buffer
+	n, err := io.Copy(&mem, io.LimitReader(original, policy.BodyMemoryBytes+1))
+	if err != nil {
+		return noop, false, fmt.Errorf("buffer request body: %w", err)
+	}
+	body.mem, body.size = mem.Bytes(), n
+	if n > policy.BodyMemoryBytes {
+		file, err := os.CreateTemp("", "microproxy-body-*")
+		if err != nil {
+			return noop, false, fmt.Errorf("buffer request body: %w", err)
+		}
+		body.file = file
+		if _, err := file.Write(body.mem); err != nil {
+			body.cleanup()
+			return noop, false, fmt.Errorf("buffer request body: %w", err)
+		}
+		body.mem = nil
+		copied, err := io.Copy(file, io.LimitReader(original, policy.MaxBodyBytes-n+1))
+		if err != nil {
+			body.cleanup()
+			return noop, false, fmt.Errorf("buffer request body: %w", err)
+		}
+		body.size += copied
+	}
+
+	if body.size > policy.MaxBodyBytes {
+		// Too large to replay: stream what was read, then the rest.
+		req.Body = &multiReadCloser{Reader: io.MultiReader(body.reader(), original), closer: original}
+		req.GetBody = nil
+		return body.cleanup, false, nil
+	}
+	_ = original.Close()
+	req.Body = io.NopCloser(body.reader())
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(body.reader()), nil
+	}
+	return body.cleanup, true, nil
+}
+
+func (b *replayableBody) reader() io.Reader {
+	if b.file != nil {
+		return io.NewSectionReader(b.file, 0, b.size)
+	}
+	return bytes.NewReader(b.mem)
+}
+
+func (b *replayableBody) cleanup() {
+	b.cleanupOnce.Do(func() {
+		if b.file != nil {
+			_ = b.file.Close()
+			_ = os.Remove(b.file.Name())
+		}
+	})
+}
+
+type multiReadCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (m *multiReadCloser) Close() error { return m.closer.Close() }
+
+// rewindRequest returns a shallow copy of req with a fresh body for another
+// attempt.
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	if req.GetBody == nil {
+		return req, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	out := *req
+	out.Body = body
+	return &out, nil
+}
+
+// drainAndClose discards a bounded amount of body so the connection can be
+// reused, then closes it.
+func drainAndClose(body io.ReadCloser) {
+	_, _ = io.CopyN(io.Discard, body, 64<<10)
+	_ = body.Close()
+}
@@ -0,0 +1,49 @@
+package listeners
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBufferRequestBody_SpillsToTempFileAndReplays(t *testing.T) {
+	t.Parallel()
+
+	payload := strings.Repeat("abc", 100)
+	req, _ := http.NewRequest(http.MethodPut, "http://target.example", io.NopCloser(strings.NewReader(payload)))
+	cleanup, ok, err := bufferRequestBody(req, RetryPolicy{BodyMemoryBytes: 16}.withDefaults())
+	defer cleanup()
+	if err != nil || !ok {
+		t.Fatalf("expected replayable body, got ok=%v err=%v", ok, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		attempt, err := rewindRequest(req)
+		if err != nil {
+			t.Fatalf("rewind failed: %v", err)
+		}
+		got, _ := io.ReadAll(attempt.Body)
+		if string(got) != payload {
+			t.Fatalf("expected attempt %d to replay %d bytes, got %d", i, len(payload), len(got))
+		}
+	}
+}
+
+func TestBufferRequestBody_TooLargeStreamsOnce(t *testing.T) {
+	t.Parallel()
+
+	payload := strings.Repeat("x", 64)
+	req, _ := http.NewRequest(http.MethodPut, "http://target.example", io.NopCloser(strings.NewReader(payload)))
+	cleanup, ok, err := bufferRequestBody(req, RetryPolicy{MaxBodyBytes: 16}.withDefaults())
+	defer cleanup()
+	if err != nil || ok {
+		t.Fatalf("expected non-replayable body, got ok=%v err=%v", ok, err)
+	}
+	if req.GetBody != nil {
+		t.Fatalf("expected GetBody to be cleared")
+	}
+	if got, _ := io.ReadAll(req.Body); string(got) != payload {
+		t.Fatalf("expected full body to stream once, got %d bytes", len(got))
+	}
+}
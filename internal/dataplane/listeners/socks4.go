@@ -0,0 +1,98 @@
+package listeners
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	socks4Version = 0x04
+	// SOCKS4 replies carry a null version byte.
+	socks4ReplyVersion  = 0x00
+	socks4ReplyGranted  = 0x5A
+	socks4ReplyRejected = 0x5B
+	// socks4MaxField bounds the NUL-terminated USERID and SOCKS4a host.
+	socks4MaxField = 255
+)
+
+// performSOCKS4Handshake parses a SOCKS4 or SOCKS4a CONNECT or BIND request.
+// SOCKS4a is signalled by a destination IP of 0.0.0.x with x non-zero, in
+// which case a host name follows the user ID.
+func performSOCKS4Handshake(reader *bufio.Reader, conn net.Conn, auth SOCKS5AuthConfig) (SOCKS5ConnectRequest, error) {
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(reader, head); err != nil {
+		return SOCKS5ConnectRequest{}, err
+	}
+	username, err := readSOCKS4String(reader)
+	if err != nil {
+		return SOCKS5ConnectRequest{}, err
+	}
+
+	command := head[1]
+	port := int(head[2])<<8 | int(head[3])
+	ip := net.IPv4(head[4], head[5], head[6], head[7])
+	host, atyp := ip.String(), byte(socks5AtypIPv4)
+	if head[4] == 0 && head[5] == 0 && head[6] == 0 && head[7] != 0 {
+		if host, err = readSOCKS4String(reader); err != nil {
+			return SOCKS5ConnectRequest{}, err
+		}
+		atyp = socks5AtypDomain
+	}
+
+	if auth.RequiresUserPass() {
+		_ = writeSOCKS4Reply(conn, SOCKS5ReplyConnectionNotAllowed, nil)
+		return SOCKS5ConnectRequest{}, errors.New("socks4 cannot satisfy listener authentication")
+	}
+	if command != socks5CmdConnect && command != socks5CmdBind {
+		_ = writeSOCKS4Reply(conn, SOCKS5ReplyCommandNotSupported, nil)
+		return SOCKS5ConnectRequest{}, fmt.Errorf("%w %d", errSOCKS5CommandNotSupported, command)
+	}
+
+	return SOCKS5ConnectRequest{
+		Version:  socks4Version,
+		Command:  command,
+		ATYP:     atyp,
+		Host:     host,
+		Port:     port,
+		Target:   net.JoinHostPort(host, strconv.Itoa(port)),
+		Username: username,
+	}, nil
+}
+
+func readSOCKS4String(reader *bufio.Reader) (string, error) {
+	var field []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return string(field), nil
+		}
+		if len(field) == socks4MaxField {
+			return "", errors.New("socks4 field too long")
+		}
+		field = append(field, b)
+	}
+}
+
+// writeSOCKS4Reply maps a SOCKS5 reply code onto SOCKS4 granted or rejected.
+// Only IPv4 bind addresses can be reported.
+func writeSOCKS4Reply(conn net.Conn, status byte, bindAddr net.Addr) error {
+	reply := []byte{socks4ReplyVersion, socks4ReplyRejected, 0, 0, 0, 0, 0, 0}
+	if status == SOCKS5ReplySucceeded {
+		reply[1] = socks4ReplyGranted
+	}
+	if host, port, err := splitHostPort(bindAddr); err == nil {
+		if ip := net.ParseIP(host).To4(); ip != nil {
+			reply[2], reply[3] = byte(port>>8), byte(port)
+			copy(reply[4:], ip)
+		}
+	}
+	_, err := conn.Write(reply)
+	return err
+}
@@ -2,11 +2,14 @@ package listeners
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
+	"strings"
+	"syscall"
 )
 
 const (
@@ -15,89 +18,296 @@ const (
 	socks5AuthUserPass  = 0x02
 	socks5AuthNoMethods = 0xFF
 
-	socks5CmdConnect = 0x01
+	socks5CmdConnect      = 0x01
+	socks5CmdBind         = 0x02
+	socks5CmdUDPAssociate = 0x03
 
 	socks5AtypIPv4   = 0x01
 	socks5AtypDomain = 0x03
 	socks5AtypIPv6   = 0x04
+)
+
+// SOCKS5 reply codes (RFC 1928, section 6).
+const (
+	SOCKS5ReplySucceeded            byte = 0x00
+	SOCKS5ReplyGeneralFailure       byte = 0x01
+	SOCKS5ReplyConnectionNotAllowed byte = 0x02
+	SOCKS5ReplyNetworkUnreachable   byte = 0x03
+	SOCKS5ReplyHostUnreachable      byte = 0x04
+	SOCKS5ReplyConnectionRefused    byte = 0x05
+	SOCKS5ReplyTTLExpired           byte = 0x06
+	SOCKS5ReplyCommandNotSupported  byte = 0x07
+	SOCKS5ReplyAddressNotSupported  byte = 0x08
+)
+
+// SOCKS5ReplyError is a non-success reply from an upstream SOCKS5 server.
+type SOCKS5ReplyError struct {
+	Code byte
+}
+
+func (e *SOCKS5ReplyError) Error() string {
+	return fmt.Sprintf("socks connect failed: %d", e.Code)
+}
+
+// SOCKS5ReplyForError picks the reply code that best describes why a SOCKS
+// request could not be served. Upstream SOCKS5 replies are passed through.
+func SOCKS5ReplyForError(err error) byte {
+	var replyErr *SOCKS5ReplyError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return SOCKS5ReplySucceeded
+	case errors.Is(err, ErrPolicyDenied), errors.Is(err, ErrQuotaExceeded):
+		return SOCKS5ReplyConnectionNotAllowed
+	case errors.Is(err, ErrUDPUnsupported), errors.Is(err, ErrBindUnsupported):
+		return SOCKS5ReplyCommandNotSupported
+	case errors.As(err, &replyErr) && replyErr.Code != SOCKS5ReplySucceeded:
+		return replyErr.Code
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return SOCKS5ReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return SOCKS5ReplyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return SOCKS5ReplyHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return SOCKS5ReplyTTLExpired
+	default:
+		return SOCKS5ReplyGeneralFailure
+	}
+}
+
+var (
+	errSOCKS5CommandNotSupported = errors.New("unsupported socks5 command")
 
-	socks5ReplySucceeded          = 0x00
-	socks5ReplyGeneralFailure     = 0x01
-	socks5ReplyConnectionNotAllow = 0x02
-	socks5ReplyHostUnreachable    = 0x04
-	socks5ReplyCommandNotSupport  = 0x07
-	socks5ReplyAddressNotSupport  = 0x08
+	// ErrSOCKS5UDPFragment reports a UDP datagram with a non-zero FRAG field.
+	// Fragment reassembly is optional in RFC 1928 and not implemented, so such
+	// datagrams are dropped.
+	ErrSOCKS5UDPFragment = errors.New("socks5 udp fragmentation not supported")
 )
 
-// SOCKS5AuthConfig controls handshake authentication behavior.
+// SOCKS5AuthConfig controls handshake authentication behavior. Store, when
+// set, takes the place of the single Username and Password account.
 type SOCKS5AuthConfig struct {
 	Username string
 	Password string
+	Store    CredentialStore
 }
 
 func (c SOCKS5AuthConfig) RequiresUserPass() bool {
-	return c.Username != "" || c.Password != ""
+	return c.Store != nil || c.Username != "" || c.Password != ""
+}
+
+func (c SOCKS5AuthConfig) credentials() CredentialStore {
+	if c.Store != nil {
+		return c.Store
+	}
+	return NewUserStore([]UserCredential{{Credential: Credential{Username: c.Username}, Password: c.Password}}, "")
+}
+
+// SOCKSUsername is a SOCKS username split into the account name and the
+// routing hints appended to it as "user+tenant=<id>+provider=<name>", plus
+// "+session=<id>" to open or reuse a sticky session, which HTTP proxy
+// usernames may carry too. Unknown hints are ignored.
+type SOCKSUsername struct {
+	User     string
+	TenantID string
+	Provider string
+	Session  string
 }
 
-// SOCKS5ConnectRequest is the parsed destination from a CONNECT request.
+// ParseSOCKSUsername splits the routing hints off username.
+func ParseSOCKSUsername(username string) SOCKSUsername {
+	parts := strings.Split(username, "+")
+	parsed := SOCKSUsername{User: parts[0]}
+	for _, part := range parts[1:] {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "tenant":
+			parsed.TenantID = value
+		case "provider":
+			parsed.Provider = value
+		case "session":
+			parsed.Session = sanitizeHint(value)
+		}
+	}
+	return parsed
+}
+
+// SOCKS5ConnectRequest is the parsed command and destination from a client
+// request. For BIND the destination is the peer expected to connect back;
+// for UDP ASSOCIATE it is the address the client expects to send datagrams
+// from, and is often all zeros. Version is 4 for SOCKS4 and SOCKS4a clients.
+// Username is the SOCKS5 username or the SOCKS4 user ID, hints included.
+// Credential is the account that authenticated, or nil on listeners without
+// authentication.
 type SOCKS5ConnectRequest struct {
-	ATYP   byte
-	Host   string
-	Port   int
-	Target string
+	Version    byte
+	Command    byte
+	ATYP       byte
+	Host       string
+	Port       int
+	Target     string
+	Username   string
+	Credential *Credential
 }
 
-// PerformSOCKS5Handshake negotiates auth and parses a CONNECT request.
-func PerformSOCKS5Handshake(conn net.Conn, auth SOCKS5AuthConfig) (SOCKS5ConnectRequest, error) {
+// IsBind reports whether the client asked to accept an inbound connection.
+func (r SOCKS5ConnectRequest) IsBind() bool {
+	return r.Command == socks5CmdBind
+}
+
+// IsUDPAssociate reports whether the client asked for a UDP relay.
+func (r SOCKS5ConnectRequest) IsUDPAssociate() bool {
+	return r.Command == socks5CmdUDPAssociate
+}
+
+// WriteReply answers the request in the client's protocol version. status is
+// a SOCKS5 reply code; SOCKS4 clients only see granted or rejected.
+func (r SOCKS5ConnectRequest) WriteReply(conn net.Conn, status byte, bindAddr net.Addr) error {
+	if r.Version == socks4Version {
+		return writeSOCKS4Reply(conn, status, bindAddr)
+	}
+	return WriteSOCKS5ConnectReply(conn, status, bindAddr)
+}
+
+// PerformSOCKSHandshake serves SOCKS5 and, told apart by the first byte,
+// SOCKS4 and SOCKS4a clients. SOCKS4 carries no password, so it is refused
+// when auth requires one.
+func PerformSOCKSHandshake(conn net.Conn, auth SOCKS5AuthConfig) (SOCKS5ConnectRequest, error) {
 	reader := bufio.NewReader(conn)
+	version, err := reader.Peek(1)
+	if err != nil {
+		return SOCKS5ConnectRequest{}, err
+	}
+	if version[0] == socks4Version {
+		return performSOCKS4Handshake(reader, conn, auth)
+	}
+	return performSOCKS5Handshake(reader, conn, auth)
+}
+
+// PerformSOCKS5Handshake negotiates auth and parses a CONNECT, BIND, or UDP
+// ASSOCIATE request. Other commands are answered with "command not
+// supported".
+func PerformSOCKS5Handshake(conn net.Conn, auth SOCKS5AuthConfig) (SOCKS5ConnectRequest, error) {
+	return performSOCKS5Handshake(bufio.NewReader(conn), conn, auth)
+}
 
+func performSOCKS5Handshake(reader *bufio.Reader, conn net.Conn, auth SOCKS5AuthConfig) (SOCKS5ConnectRequest, error) {
 	method, err := negotiateSOCKS5Method(reader, conn, auth)
 	if err != nil {
 		return SOCKS5ConnectRequest{}, err
 	}
+	var username string
+	var credential *Credential
 	if method == socks5AuthUserPass {
-		if err := authenticateSOCKS5UserPass(reader, conn, auth); err != nil {
+		if username, credential, err = authenticateSOCKS5UserPass(reader, conn, auth); err != nil {
 			return SOCKS5ConnectRequest{}, err
 		}
 	}
 
 	request, err := readSOCKS5ConnectRequest(reader)
 	if err != nil {
+		if errors.Is(err, errSOCKS5CommandNotSupported) {
+			_ = WriteSOCKS5ConnectReply(conn, SOCKS5ReplyCommandNotSupported, nil)
+		}
 		return SOCKS5ConnectRequest{}, err
 	}
+	request.Username = username
+	request.Credential = credential
 	return request, nil
 }
 
 // WriteSOCKS5ConnectReply writes a reply and bind address to the client.
 func WriteSOCKS5ConnectReply(conn net.Conn, status byte, bindAddr net.Addr) error {
-	atyp := byte(socks5AtypIPv4)
-	addrBytes := []byte{0, 0, 0, 0}
-	portBytes := []byte{0, 0}
-
-	host, port, err := splitHostPort(bindAddr)
-	if err == nil {
-		if ip := net.ParseIP(host); ip != nil {
-			if v4 := ip.To4(); v4 != nil {
-				atyp = socks5AtypIPv4
-				addrBytes = v4
-			} else {
-				atyp = socks5AtypIPv6
-				addrBytes = ip.To16()
-			}
-		} else {
-			atyp = socks5AtypDomain
-			addrBytes = append([]byte{byte(len(host))}, []byte(host)...)
+	head := []byte{socks5Version, status, 0x00}
+	reply := append(head, socks5AtypIPv4, 0, 0, 0, 0, 0, 0)
+	if host, port, err := splitHostPort(bindAddr); err == nil {
+		if encoded, err := appendSOCKS5Address(head, host, port); err == nil {
+			reply = encoded
 		}
-		portBytes = []byte{byte(port >> 8), byte(port)}
 	}
-
-	reply := []byte{socks5Version, status, 0x00, atyp}
-	reply = append(reply, addrBytes...)
-	reply = append(reply, portBytes...)
-	_, err = conn.Write(reply)
+	_, err := conn.Write(reply)
 	return err
 }
 
+// SOCKS5UDPDatagram is a datagram exchanged with a client over a UDP
+// ASSOCIATE relay (RFC 1928, section 7).
+type SOCKS5UDPDatagram struct {
+	Target  string
+	Payload []byte
+}
+
+// ParseSOCKS5UDPDatagram splits a relayed packet into its destination and
+// payload. The payload aliases packet.
+func ParseSOCKS5UDPDatagram(packet []byte) (SOCKS5UDPDatagram, error) {
+	if len(packet) < 4 {
+		return SOCKS5UDPDatagram{}, errors.New("short socks5 udp datagram")
+	}
+	if packet[0] != 0 || packet[1] != 0 {
+		return SOCKS5UDPDatagram{}, errors.New("invalid socks5 udp reserved field")
+	}
+	if packet[2] != 0 {
+		return SOCKS5UDPDatagram{}, ErrSOCKS5UDPFragment
+	}
+	reader := bytes.NewReader(packet[4:])
+	host, err := readSOCKS5Address(reader, packet[3])
+	if err != nil {
+		return SOCKS5UDPDatagram{}, err
+	}
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(reader, portBytes); err != nil {
+		return SOCKS5UDPDatagram{}, err
+	}
+	port := int(portBytes[0])<<8 | int(portBytes[1])
+	payload := packet[len(packet)-reader.Len():]
+	return SOCKS5UDPDatagram{Target: net.JoinHostPort(host, strconv.Itoa(port)), Payload: payload}, nil
+}
+
+// AppendSOCKS5UDPDatagram appends the relay header for a datagram received
+// from source, followed by payload, to dst.
+func AppendSOCKS5UDPDatagram(dst []byte, source string, payload []byte) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(source)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	dst, err = appendSOCKS5Address(append(dst, 0, 0, 0), host, port)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, payload...), nil
+}
+
+// appendSOCKS5Address appends ATYP, address, and port in wire format.
+func appendSOCKS5Address(dst []byte, host string, port int) ([]byte, error) {
+	if port < 0 || port > 0xFFFF {
+		return nil, fmt.Errorf("invalid port %d", port)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if v4 := ip.To4(); v4 != nil {
+			dst = append(dst, socks5AtypIPv4)
+			dst = append(dst, v4...)
+		} else {
+			dst = append(dst, socks5AtypIPv6)
+			dst = append(dst, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("socks5 hostname too long")
+		}
+		dst = append(dst, socks5AtypDomain, byte(len(host)))
+		dst = append(dst, host...)
+	}
+	return append(dst, byte(port>>8), byte(port)), nil
+}
+
 func negotiateSOCKS5Method(reader *bufio.Reader, conn net.Conn, auth SOCKS5AuthConfig) (byte, error) {
 	header := make([]byte, 2)
 	if _, err := io.ReadFull(reader, header); err != nil {
@@ -112,54 +322,70 @@ func negotiateSOCKS5Method(reader *bufio.Reader, conn net.Conn, auth SOCKS5AuthC
 		return 0, err
 	}
 
-	wantMethod := byte(socks5AuthNone)
+	// Without listener auth a username is still accepted, unchecked, from
+	// clients that only offer username/password, so they can pass hints.
+	accepted := []byte{socks5AuthNone, socks5AuthUserPass}
 	if auth.RequiresUserPass() {
-		wantMethod = socks5AuthUserPass
+		accepted = []byte{socks5AuthUserPass}
 	}
 
-	for _, method := range methods {
-		if method == wantMethod {
-			if _, err := conn.Write([]byte{socks5Version, wantMethod}); err != nil {
-				return 0, err
-			}
-			return wantMethod, nil
+	for _, wantMethod := range accepted {
+		if bytes.IndexByte(methods, wantMethod) < 0 {
+			continue
 		}
+		if _, err := conn.Write([]byte{socks5Version, wantMethod}); err != nil {
+			return 0, err
+		}
+		return wantMethod, nil
 	}
 
 	_, _ = conn.Write([]byte{socks5Version, socks5AuthNoMethods})
 	return 0, errors.New("no compatible socks5 auth method")
 }
 
-func authenticateSOCKS5UserPass(reader *bufio.Reader, conn net.Conn, auth SOCKS5AuthConfig) error {
+// authenticateSOCKS5UserPass runs RFC 1929 and returns the username the
+// client sent with the account it authenticated as. Accounts match with or
+// without hints appended to the username.
+func authenticateSOCKS5UserPass(reader *bufio.Reader, conn net.Conn, auth SOCKS5AuthConfig) (string, *Credential, error) {
 	header := make([]byte, 2)
 	if _, err := io.ReadFull(reader, header); err != nil {
-		return err
+		return "", nil, err
 	}
 	if header[0] != 0x01 {
 		_, _ = conn.Write([]byte{0x01, 0x01})
-		return fmt.Errorf("unsupported auth version %d", header[0])
+		return "", nil, fmt.Errorf("unsupported auth version %d", header[0])
 	}
 
 	user := make([]byte, int(header[1]))
 	if _, err := io.ReadFull(reader, user); err != nil {
-		return err
+		return "", nil, err
 	}
 	plen := make([]byte, 1)
 	if _, err := io.ReadFull(reader, plen); err != nil {
-		return err
+		return "", nil, err
 	}
 	pass := make([]byte, int(plen[0]))
 	if _, err := io.ReadFull(reader, pass); err != nil {
-		return err
+		return "", nil, err
 	}
 
-	if string(user) != auth.Username || string(pass) != auth.Password {
-		_, _ = conn.Write([]byte{0x01, 0x01})
-		return errors.New("invalid socks5 username/password")
+	username := string(user)
+	var credential *Credential
+	if auth.RequiresUserPass() {
+		store := auth.credentials()
+		matched, ok := store.Authenticate(username, string(pass))
+		if !ok {
+			matched, ok = store.Authenticate(ParseSOCKSUsername(username).User, string(pass))
+		}
+		if !ok {
+			_, _ = conn.Write([]byte{0x01, 0x01})
+			return "", nil, errors.New("invalid socks5 username/password")
+		}
+		credential = &matched
 	}
 
 	_, err := conn.Write([]byte{0x01, 0x00})
-	return err
+	return username, credential, err
 }
 
 func readSOCKS5ConnectRequest(reader *bufio.Reader) (SOCKS5ConnectRequest, error) {
@@ -170,8 +396,8 @@ func readSOCKS5ConnectRequest(reader *bufio.Reader) (SOCKS5ConnectRequest, error
 	if head[0] != socks5Version {
 		return SOCKS5ConnectRequest{}, fmt.Errorf("unsupported request version %d", head[0])
 	}
-	if head[1] != socks5CmdConnect {
-		return SOCKS5ConnectRequest{}, fmt.Errorf("unsupported socks5 command %d", head[1])
+	if head[1] != socks5CmdConnect && head[1] != socks5CmdBind && head[1] != socks5CmdUDPAssociate {
+		return SOCKS5ConnectRequest{}, fmt.Errorf("%w %d", errSOCKS5CommandNotSupported, head[1])
 	}
 
 	host, err := readSOCKS5Address(reader, head[3])
@@ -185,14 +411,16 @@ func readSOCKS5ConnectRequest(reader *bufio.Reader) (SOCKS5ConnectRequest, error
 	port := int(portBytes[0])<<8 | int(portBytes[1])
 
 	return SOCKS5ConnectRequest{
-		ATYP:   head[3],
-		Host:   host,
-		Port:   port,
-		Target: net.JoinHostPort(host, strconv.Itoa(port)),
+		Version: socks5Version,
+		Command: head[1],
+		ATYP:    head[3],
+		Host:    host,
+		Port:    port,
+		Target:  net.JoinHostPort(host, strconv.Itoa(port)),
 	}, nil
 }
 
-func readSOCKS5Address(reader *bufio.Reader, atyp byte) (string, error) {
+func readSOCKS5Address(reader io.Reader, atyp byte) (string, error) {
 	switch atyp {
 	case socks5AtypIPv4:
 		buf := make([]byte, 4)
@@ -0,0 +1,169 @@
+package listeners
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestSOCKS5UDPDatagram_RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	for _, source := range []string{"192.0.2.1:53", "[2001:db8::1]:5353", "dns.example:53"} {
+		packet, err := AppendSOCKS5UDPDatagram(nil, source, []byte("query"))
+		if err != nil {
+			t.Fatalf("encode %s: %v", source, err)
+		}
+		datagram, err := ParseSOCKS5UDPDatagram(packet)
+		if err != nil {
+			t.Fatalf("parse %s: %v", source, err)
+		}
+		if datagram.Target != source || string(datagram.Payload) != "query" {
+			t.Fatalf("expected %s with payload %q, got %s with %q", source, "query", datagram.Target, datagram.Payload)
+		}
+	}
+}
+
+func TestParseSOCKS5UDPDatagram_Rejects(t *testing.T) {
+	t.Parallel()
+
+	fragment := []byte{0, 0, 1, socks5AtypIPv4, 127, 0, 0, 1, 0, 53, 'x'}
+	if _, err := ParseSOCKS5UDPDatagram(fragment); !errors.Is(err, ErrSOCKS5UDPFragment) {
+		t.Fatalf("expected fragment error, got %v", err)
+	}
+	for name, packet := range map[string][]byte{
+		"short":     {0, 0, 0},
+		"reserved":  {0, 1, 0, socks5AtypIPv4, 127, 0, 0, 1, 0, 53},
+		"atyp":      {0, 0, 0, 0x09, 127, 0, 0, 1, 0, 53},
+		"truncated": {0, 0, 0, socks5AtypIPv6, 0, 0, 0, 0},
+	} {
+		if _, err := ParseSOCKS5UDPDatagram(packet); err == nil {
+			t.Fatalf("%s: expected parse error", name)
+		}
+	}
+}
+
+func TestPerformSOCKS5Handshake_CommandNotSupported(t *testing.T) {
+	t.Parallel()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := PerformSOCKS5Handshake(server, SOCKS5AuthConfig{})
+		errs <- err
+	}()
+
+	_, _ = client.Write([]byte{socks5Version, 1, socks5AuthNone})
+	method := make([]byte, 2)
+	if _, err := client.Read(method); err != nil {
+		t.Fatalf("read method: %v", err)
+	}
+	go func() { _, _ = client.Write([]byte{socks5Version, 0x09, 0, socks5AtypIPv4, 127, 0, 0, 1, 0, 80}) }()
+	reply := make([]byte, 10)
+	if _, err := client.Read(reply); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if reply[1] != SOCKS5ReplyCommandNotSupported {
+		t.Fatalf("expected command not supported reply, got %d", reply[1])
+	}
+	if err := <-errs; err == nil {
+		t.Fatalf("expected handshake error")
+	}
+}
+
+func TestPerformSOCKSHandshake_SOCKS4a(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name    string
+		request []byte
+		want    SOCKS5ConnectRequest
+	}{
+		{
+			name:    "socks4",
+			request: []byte{socks4Version, socks5CmdConnect, 0, 80, 192, 0, 2, 1, 'b', 'o', 'b', 0},
+			want:    SOCKS5ConnectRequest{Version: socks4Version, Command: socks5CmdConnect, ATYP: socks5AtypIPv4, Host: "192.0.2.1", Port: 80, Target: "192.0.2.1:80", Username: "bob"},
+		},
+		{
+			name:    "socks4a",
+			request: append([]byte{socks4Version, socks5CmdBind, 0x1F, 0x90, 0, 0, 0, 1, 0}, "example.com\x00"...),
+			want:    SOCKS5ConnectRequest{Version: socks4Version, Command: socks5CmdBind, ATYP: socks5AtypDomain, Host: "example.com", Port: 8080, Target: "example.com:8080"},
+		},
+	} {
+		client, server := net.Pipe()
+		go func() { _, _ = client.Write(tc.request) }()
+		got, err := PerformSOCKSHandshake(server, SOCKS5AuthConfig{})
+		client.Close()
+		server.Close()
+		if err != nil {
+			t.Fatalf("%s: handshake failed: %v", tc.name, err)
+		}
+		if got != tc.want {
+			t.Fatalf("%s: expected %+v, got %+v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestPerformSOCKSHandshake_SOCKS4RejectedWithAuth(t *testing.T) {
+	t.Parallel()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := PerformSOCKSHandshake(server, SOCKS5AuthConfig{Username: "user", Password: "pass"})
+		errs <- err
+	}()
+	_, _ = client.Write([]byte{socks4Version, socks5CmdConnect, 0, 80, 192, 0, 2, 1, 'u', 's', 'e', 'r', 0})
+	reply := make([]byte, 8)
+	if _, err := client.Read(reply); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if reply[0] != socks4ReplyVersion || reply[1] != socks4ReplyRejected {
+		t.Fatalf("expected SOCKS4 rejection, got %v", reply)
+	}
+	if err := <-errs; err == nil {
+		t.Fatalf("expected handshake error")
+	}
+}
+
+func TestParseSOCKSUsername(t *testing.T) {
+	t.Parallel()
+
+	got := ParseSOCKSUsername("alice+tenant=acme+provider=residential+session=42")
+	want := SOCKSUsername{User: "alice", TenantID: "acme", Provider: "residential", Session: "42"}
+	if got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+	if got := ParseSOCKSUsername("bob"); got != (SOCKSUsername{User: "bob"}) {
+		t.Fatalf("expected plain username without hints, got %+v", got)
+	}
+}
+
+func TestSOCKS5ReplyForError(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		err  error
+		want byte
+	}{
+		{err: &PolicyDeniedError{Decision: PolicyDecision{PolicyName: "deny-all"}}, want: SOCKS5ReplyConnectionNotAllowed},
+		{err: &QuotaError{Provider: "p"}, want: SOCKS5ReplyConnectionNotAllowed},
+		{err: ErrBindUnsupported, want: SOCKS5ReplyCommandNotSupported},
+		{err: &SOCKS5ReplyError{Code: SOCKS5ReplyTTLExpired}, want: SOCKS5ReplyTTLExpired},
+		{err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, want: SOCKS5ReplyConnectionRefused},
+		{err: &net.OpError{Op: "dial", Err: syscall.ENETUNREACH}, want: SOCKS5ReplyNetworkUnreachable},
+		{err: &net.DNSError{Err: "no such host", Name: "missing.example", IsNotFound: true}, want: SOCKS5ReplyHostUnreachable},
+		{err: errors.New("boom"), want: SOCKS5ReplyGeneralFailure},
+	} {
+		if got := SOCKS5ReplyForError(tc.err); got != tc.want {
+			t.Fatalf("%v: expected reply %d, got %d", tc.err, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package listeners
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ResponseHeaderTimeoutError is returned when an upstream did not send
+// response headers within the per-attempt budget.
+type ResponseHeaderTimeoutError struct {
+	After time.Duration
+}
+
+func (e *ResponseHeaderTimeoutError) Error() string {
+	return "timeout awaiting response headers after " + e.After.String()
+}
+
+func (e *ResponseHeaderTimeoutError) Timeout() bool   { return true }
+func (e *ResponseHeaderTimeoutError) Temporary() bool { return true }
+
+// RoundTripWithResponseHeaderTimeout runs req on rt and aborts it when response
+// headers take longer than timeout. Unlike setting
+// http.Transport.ResponseHeaderTimeout it does not require a per-attempt clone
+// of the transport, so keep-alive pools survive between attempts. Once headers
+// arrive the body may take as long as the caller's context allows.
+func RoundTripWithResponseHeaderTimeout(rt http.RoundTripper, req *http.Request, timeout time.Duration) (*http.Response, error) {
+	if timeout <= 0 {
+		return rt.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(timeout, func() {
+		timedOut.Store(true)
+		cancel()
+	})
+
+	resp, err := rt.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() && timedOut.Load() {
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		cancel()
+		return nil, &ResponseHeaderTimeoutError{After: timeout}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnCloseBody releases the attempt context once the body is done.
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func (b *cancelOnCloseBody) Write(p []byte) (int, error) {
+	return writeThrough(b.ReadCloser, p)
+}
@@ -0,0 +1,46 @@
+package listeners
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRoundTripWithResponseHeaderTimeout(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			select {
+			case <-release:
+			case <-req.Context().Done():
+			}
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+
+	slow, _ := http.NewRequest(http.MethodGet, server.URL+"/slow", nil)
+	_, err := RoundTripWithResponseHeaderTimeout(transport, slow, 50*time.Millisecond)
+	var timeoutErr *ResponseHeaderTimeoutError
+	if !errors.As(err, &timeoutErr) || !timeoutErr.Timeout() {
+		t.Fatalf("expected response header timeout, got %v", err)
+	}
+
+	fast, _ := http.NewRequest(http.MethodGet, server.URL+"/fast", nil)
+	resp, err := RoundTripWithResponseHeaderTimeout(transport, fast, time.Second)
+	if err != nil {
+		t.Fatalf("expected fast request to succeed, got %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,256 @@
+package listeners
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TunnelStats summarises a finished CONNECT or SOCKS tunnel. Sent counts
+// bytes from the client to the target, Received bytes from the target back.
+type TunnelStats struct {
+	BytesSent     int64
+	BytesReceived int64
+	Duration      time.Duration
+}
+
+// TunnelLimits bounds how long a tunnel may stay open. Zero disables a limit.
+type TunnelLimits struct {
+	// IdleTimeout closes a tunnel that carried no bytes in either direction
+	// for this long.
+	IdleTimeout time.Duration
+	// MaxLifetime closes a tunnel this long after it opened.
+	MaxLifetime time.Duration
+}
+
+const tunnelLimitsContextKey contextKey = "tunnel-limits"
+
+// WithTunnelLimits applies limits to tunnels opened for requests under ctx.
+func WithTunnelLimits(ctx context.Context, limits TunnelLimits) context.Context {
+	return context.WithValue(ctx, tunnelLimitsContextKey, limits)
+}
+
+func tunnelLimitsFromContext(ctx context.Context) TunnelLimits {
+	limits, _ := ctx.Value(tunnelLimitsContextKey).(TunnelLimits)
+	return limits
+}
+
+// TunnelLimitsMiddleware applies a listener's tunnel limits to its requests.
+func TunnelLimitsMiddleware(limits TunnelLimits, next http.Handler) http.Handler {
+	if limits == (TunnelLimits{}) {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(rw, req.WithContext(WithTunnelLimits(req.Context(), limits)))
+	})
+}
+
+// TunnelMeter accounts the bytes of one open tunnel. While bytes flow, the
+// route's policies are re-evaluated with the running totals as request and
+// response sizes, so size selectors can cut a tunnel short with a deny. The
+// tunnel is also aborted when it outlives the TunnelLimits of its request. A
+// nil meter counts nothing.
+type TunnelMeter struct {
+	handler  *ForwardProxyHandler
+	req      *http.Request
+	route    RouteDecision
+	metadata RequestMetadata
+	abort    func()
+	started  time.Time
+
+	sent         atomic.Int64
+	received     atomic.Int64
+	lastActivity atomic.Int64
+
+	limits    TunnelLimits
+	timerMu   sync.Mutex
+	idleTimer *time.Timer
+	lifeTimer *time.Timer
+	closed    atomic.Bool
+	dropOnce  sync.Once
+
+	policyMu sync.Mutex
+	denied   bool
+	finish   sync.Once
+	stats    TunnelStats
+}
+
+// StartTunnel begins accounting for a tunnel opened for req. abort tears the
+// tunnel down when a policy denies it mid-stream or a limit expires. Finish
+// must be called once the tunnel has closed.
+func (h *ForwardProxyHandler) StartTunnel(req *http.Request, abort func()) *TunnelMeter {
+	metadata, _ := MetadataFromContext(req.Context())
+	route, _ := routeDecisionFromContext(req.Context())
+	meter := &TunnelMeter{
+		handler:  h,
+		req:      req,
+		route:    route,
+		metadata: metadata,
+		abort:    abort,
+		started:  time.Now(),
+		limits:   tunnelLimitsFromContext(req.Context()),
+	}
+	meter.lastActivity.Store(meter.started.UnixNano())
+	if observer, ok := h.Registry.(tunnelObserver); ok {
+		observer.ObserveTunnelOpened(metadata)
+	}
+	meter.timerMu.Lock()
+	defer meter.timerMu.Unlock()
+	if meter.limits.IdleTimeout > 0 {
+		meter.idleTimer = time.AfterFunc(meter.limits.IdleTimeout, meter.checkIdle)
+	}
+	if meter.limits.MaxLifetime > 0 {
+		meter.lifeTimer = time.AfterFunc(meter.limits.MaxLifetime, func() { meter.drop(TunnelDropMaxLifetime) })
+	}
+	return meter
+}
+
+// TargetWriter counts bytes written towards the target.
+func (m *TunnelMeter) TargetWriter(w io.Writer) io.Writer {
+	if m == nil {
+		return w
+	}
+	return meteredWriter{Writer: w, count: m.RecordSent}
+}
+
+// ClientWriter counts bytes written back to the client.
+func (m *TunnelMeter) ClientWriter(w io.Writer) io.Writer {
+	if m == nil {
+		return w
+	}
+	return meteredWriter{Writer: w, count: m.RecordReceived}
+}
+
+// RecordSent adds n bytes carried from the client to the target.
+func (m *TunnelMeter) RecordSent(n int64) {
+	if m == nil || n <= 0 {
+		return
+	}
+	m.sent.Add(n)
+	m.lastActivity.Store(time.Now().UnixNano())
+	m.checkPolicy()
+}
+
+// RecordReceived adds n bytes carried from the target to the client.
+func (m *TunnelMeter) RecordReceived(n int64) {
+	if m == nil || n <= 0 {
+		return
+	}
+	m.received.Add(n)
+	m.lastActivity.Store(time.Now().UnixNano())
+	m.checkPolicy()
+}
+
+// Finish stores the totals as the request and response sizes in the request
+// metadata, reports them to the registry, and returns them.
+func (m *TunnelMeter) Finish() TunnelStats {
+	if m == nil {
+		return TunnelStats{}
+	}
+	m.finish.Do(func() {
+		m.closed.Store(true)
+		m.timerMu.Lock()
+		if m.idleTimer != nil {
+			m.idleTimer.Stop()
+		}
+		if m.lifeTimer != nil {
+			m.lifeTimer.Stop()
+		}
+		m.timerMu.Unlock()
+		m.stats = TunnelStats{
+			BytesSent:     m.sent.Load(),
+			BytesReceived: m.received.Load(),
+			Duration:      time.Since(m.started),
+		}
+		UpdateMetadata(m.req.Context(), func(metadata *RequestMetadata) {
+			metadata.RequestSize = m.stats.BytesSent
+			metadata.ResponseSize = m.stats.BytesReceived
+		})
+		if observer, ok := m.handler.Registry.(tunnelObserver); ok {
+			observer.ObserveTunnelClosed(m.metadata, m.stats)
+		}
+	})
+	return m.stats
+}
+
+// Reasons reported when a tunnel is closed by one of its limits.
+const (
+	TunnelDropIdleTimeout = "tunnel_idle_timeout"
+	TunnelDropMaxLifetime = "max_tunnel_lifetime"
+)
+
+func (m *TunnelMeter) checkIdle() {
+	if m.closed.Load() {
+		return
+	}
+	idle := time.Since(time.Unix(0, m.lastActivity.Load()))
+	if idle < m.limits.IdleTimeout {
+		m.timerMu.Lock()
+		if !m.closed.Load() {
+			m.idleTimer.Reset(m.limits.IdleTimeout - idle)
+		}
+		m.timerMu.Unlock()
+		return
+	}
+	m.drop(TunnelDropIdleTimeout)
+}
+
+// drop aborts a tunnel that hit one of its limits.
+func (m *TunnelMeter) drop(reason string) {
+	if m.closed.Load() {
+		return
+	}
+	m.dropOnce.Do(func() {
+		if observer, ok := m.handler.Registry.(tunnelObserver); ok {
+			observer.ObserveTunnelDropped(m.metadata, reason)
+		}
+		if m.abort != nil {
+			m.abort()
+		}
+	})
+}
+
+func (m *TunnelMeter) checkPolicy() {
+	if m.handler.PolicyEvaluator == nil || m.route.Policy == "" {
+		return
+	}
+	m.policyMu.Lock()
+	defer m.policyMu.Unlock()
+	if m.denied {
+		return
+	}
+	metadata := m.metadata
+	metadata.RequestSize = m.sent.Load()
+	metadata.ResponseSize = m.received.Load()
+	metadata.EvaluationClock = time.Now().UTC()
+	decision := m.handler.PolicyEvaluator.Evaluate(m.req, metadata, m.route)
+	if decision.Action != "deny" {
+		return
+	}
+	m.denied = true
+	m.handler.recordPolicyDecision(m.req.Context(), decision)
+	if m.abort != nil {
+		m.abort()
+	}
+}
+
+// tunnelObserver is implemented by registries that export tunnel metrics.
+type tunnelObserver interface {
+	ObserveTunnelOpened(metadata RequestMetadata)
+	ObserveTunnelClosed(metadata RequestMetadata, stats TunnelStats)
+	ObserveTunnelDropped(metadata RequestMetadata, reason string)
+}
+
+type meteredWriter struct {
+	io.Writer
+	count func(int64)
+}
+
+func (w meteredWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.count(int64(n))
+	return n, err
+}
@@ -0,0 +1,102 @@
+package listeners
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// ErrUDPUnsupported reports an upstream that cannot relay UDP datagrams.
+var ErrUDPUnsupported = errors.New("udp relay not supported")
+
+// UDPAssociation relays datagrams to arbitrary targets on behalf of one
+// client. Targets and sources are host:port strings; hosts may be names.
+type UDPAssociation interface {
+	WriteTo(payload []byte, target string) error
+	ReadFrom(buf []byte) (n int, source string, err error)
+	Close() error
+}
+
+// UDPAssociator is implemented by upstream adapters that can relay UDP, as
+// needed for SOCKS5 UDP ASSOCIATE.
+type UDPAssociator interface {
+	AssociateUDP(ctx context.Context, endpoint *url.URL, dialer *net.Dialer) (UDPAssociation, error)
+}
+
+// AssociateUDP opens a UDP relay through the route selected for req. Routes
+// without endpoints send datagrams straight from a local socket; otherwise
+// only endpoints whose adapters relay UDP are tried. The association keeps
+// its admission slot until it is closed.
+func (h *ForwardProxyHandler) AssociateUDP(req *http.Request) (UDPAssociation, error) {
+	target, err := h.planTunnel(req)
+	if err != nil {
+		return nil, err
+	}
+	if isDirectTarget(target) {
+		return NewDirectUDPAssociation()
+	}
+	var association UDPAssociation
+	release, err := h.openViaEndpoints(req, target, ErrUDPUnsupported, func(ctx context.Context, adapter UpstreamAdapter, endpoint *url.URL) error {
+		associator, ok := adapter.(UDPAssociator)
+		if !ok {
+			return ErrUDPUnsupported
+		}
+		opened, err := associator.AssociateUDP(ctx, endpoint, h.Dialer)
+		association = opened
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	h.observeRequestServed(req.Context())
+	return &releaseOnCloseAssociation{UDPAssociation: association, release: releaseAll(release)}, nil
+}
+
+// NewDirectUDPAssociation relays datagrams from an unconnected local socket.
+func NewDirectUDPAssociation() (UDPAssociation, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &directUDPAssociation{conn: conn}, nil
+}
+
+type directUDPAssociation struct {
+	conn *net.UDPConn
+}
+
+func (a *directUDPAssociation) WriteTo(payload []byte, target string) error {
+	addr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return err
+	}
+	_, err = a.conn.WriteToUDP(payload, addr)
+	return err
+}
+
+func (a *directUDPAssociation) ReadFrom(buf []byte) (int, string, error) {
+	n, addr, err := a.conn.ReadFromUDPAddrPort(buf)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, net.JoinHostPort(addr.Addr().Unmap().String(), strconv.Itoa(int(addr.Port()))), nil
+}
+
+func (a *directUDPAssociation) Close() error {
+	return a.conn.Close()
+}
+
+// releaseOnCloseAssociation returns capacity when the association is closed.
+type releaseOnCloseAssociation struct {
+	UDPAssociation
+	release func()
+}
+
+func (a *releaseOnCloseAssociation) Close() error {
+	err := a.UDPAssociation.Close()
+	a.release()
+	return err
+}
@@ -0,0 +1,110 @@
+package listeners
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// upgradeType returns the requested protocol when headers ask for an HTTP
+// Upgrade (for example WebSocket), or "" otherwise.
+func upgradeType(headers http.Header) string {
+	for _, connectionField := range headers.Values("Connection") {
+		for _, token := range strings.Split(connectionField, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return strings.TrimSpace(headers.Get("Upgrade"))
+			}
+		}
+	}
+	return ""
+}
+
+// finishUpgrade relays a 101 Switching Protocols response to the client and
+// tunnels both directions until either side closes. The upstream connection
+// keeps its admission slot until the tunnel is torn down, like CONNECT.
+// HTTP/2 clients that asked with extended CONNECT get a 200 on their stream.
+func (h *ForwardProxyHandler) finishUpgrade(rw http.ResponseWriter, req *http.Request, resp *http.Response, requested string, policyDecision PolicyDecision) {
+	granted := upgradeType(resp.Header)
+	if requested == "" || !strings.EqualFold(granted, requested) {
+		http.Error(rw, fmt.Sprintf("upstream switched to unexpected protocol %q", granted), http.StatusBadGateway)
+		return
+	}
+	backConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		http.Error(rw, "upstream upgrade is not writable", http.StatusBadGateway)
+		return
+	}
+	if req.ProtoMajor == 2 {
+		h.finishExtendedConnect(rw, req, resp, backConn, policyDecision)
+		return
+	}
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		http.Error(rw, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	clientConn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("hijack failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	removeHopHeaders(resp.Header)
+	if len(policyDecision.ResponseHeadersPatch) > 0 {
+		patchHeaders(resp.Header, policyDecision.ResponseHeadersPatch)
+	}
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", granted)
+
+	var head bytes.Buffer
+	head.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	_ = resp.Header.Write(&head)
+	head.WriteString("\r\n")
+	if _, err := clientConn.Write(head.Bytes()); err != nil {
+		_ = clientConn.Close()
+		_ = backConn.Close()
+		return
+	}
+	if err := flushBuffered(buffered, backConn); err != nil {
+		_ = clientConn.Close()
+		_ = backConn.Close()
+		return
+	}
+
+	tunnel(clientConn, halfCloser{backConn}, nil)
+}
+
+// flushBuffered forwards bytes the client sent before the hijack.
+func flushBuffered(buffered *bufio.ReadWriter, dst io.Writer) error {
+	if buffered == nil || buffered.Reader.Buffered() == 0 {
+		return nil
+	}
+	_, err := io.CopyN(dst, buffered, int64(buffered.Reader.Buffered()))
+	return err
+}
+
+// halfCloser closes an upgraded body completely when the client stops
+// sending, since transport-owned upgrade bodies cannot half-close.
+type halfCloser struct {
+	io.ReadWriteCloser
+}
+
+func (c halfCloser) CloseWrite() error {
+	type closeWriter interface{ CloseWrite() error }
+	if cw, ok := c.ReadWriteCloser.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+// writeThrough keeps the write side of a wrapped 101 response body usable.
+func writeThrough(body io.ReadCloser, p []byte) (int, error) {
+	if w, ok := body.(io.Writer); ok {
+		return w.Write(p)
+	}
+	return 0, errors.ErrUnsupported
+}
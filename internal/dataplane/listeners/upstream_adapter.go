@@ -19,3 +19,26 @@ type UpstreamAdapter interface {
 	RotateIdentity(ctx context.Context) error
 	Capabilities() []string
 }
+
+// UpstreamCredentials replace a provider's configured login for a single
+// request. They are chosen by an upstream_credentials policy.
+type UpstreamCredentials struct {
+	Username string
+	Password string
+}
+
+// UpstreamCredentialsFromContext returns the login a policy chose for the
+// request, which adapters use in place of the provider's own.
+func UpstreamCredentialsFromContext(ctx context.Context) (UpstreamCredentials, bool) {
+	ref, ok := ctx.Value(metadataContextKey).(*metadataRef)
+	if !ok || ref == nil || ref.upstream == nil {
+		return UpstreamCredentials{}, false
+	}
+	return *ref.upstream, true
+}
+
+func setUpstreamCredentials(ctx context.Context, credentials *UpstreamCredentials) {
+	if ref, ok := ctx.Value(metadataContextKey).(*metadataRef); ok && ref != nil {
+		ref.upstream = credentials
+	}
+}
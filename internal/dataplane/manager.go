@@ -2,10 +2,14 @@ package dataplane
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -83,9 +87,13 @@ type serverState struct {
 	cfg      config.ListenerConfig
 	listener net.Listener
 	server   *http.Server
+	limiter  *connLimiter
 
 	connMu sync.Mutex
 	conns  map[net.Conn]struct{}
+	// pending holds connections still waiting for their first request, to
+	// tell read-header timeouts apart from other closes.
+	pending map[net.Conn]time.Time
 }
 
 // NewListenerManager wires the runtime to concrete listener managers.
@@ -93,6 +101,15 @@ func NewListenerManager(cfg *config.Config) ListenerManager {
 	if cfg == nil {
 		return NoopListenerManager{}
 	}
+	return NewListenerManagerWithRuntime(cfg, NewRequestRuntime(cfg))
+}
+
+// NewListenerManagerWithRuntime is NewListenerManager serving runtime, so the
+// caller keeps a handle on the registry its listeners use.
+func NewListenerManagerWithRuntime(cfg *config.Config, runtime listeners.RequestRuntime) ListenerManager {
+	if cfg == nil {
+		return NoopListenerManager{}
+	}
 
 	httpListeners := make([]config.ListenerConfig, 0, len(cfg.Listeners))
 	socks5Listeners := make([]config.ListenerConfig, 0, len(cfg.Listeners))
@@ -109,12 +126,13 @@ func NewListenerManager(cfg *config.Config) ListenerManager {
 	}
 
 	managers := make([]ListenerManager, 0, 2)
-	runtime := NewRequestRuntime(cfg)
 	if len(httpListeners) > 0 {
 		managers = append(managers, NewHTTPListenerManager(httpListeners, defaultDrainTimeout, cfg.Observability.AccessLog.Enabled, runtime))
 	}
 	if len(socks5Listeners) > 0 {
-		managers = append(managers, NewSOCKS5ListenerManager(socks5Listeners, defaultDrainTimeout, runtime))
+		socks5Manager := NewSOCKS5ListenerManager(socks5Listeners, defaultDrainTimeout, runtime)
+		socks5Manager.accessLogEnabled = cfg.Observability.AccessLog.Enabled
+		managers = append(managers, socks5Manager)
 	}
 	if len(managers) == 0 {
 		return NoopListenerManager{}
@@ -128,20 +146,31 @@ func NewHTTPListenerManager(listenerConfigs []config.ListenerConfig, drainTimeou
 	}
 
 	proxyHandler := listeners.NewForwardProxyHandlerWithRuntime(runtime)
+	tenantFilter := runtimeTenantFilter(runtime)
 
 	states := make([]*serverState, 0, len(listenerConfigs))
 	for _, listenerCfg := range listenerConfigs {
-		baseChain := listeners.MetadataMiddleware(observability.HTTPMiddleware(proxyHandler, accessLogEnabled))
-		authChain := listeners.ListenerAuthMiddleware(listenerCfg.AuthType, listenerCfg.Username, listenerCfg.Password, baseChain)
+		clientLimiter, tenantLimiter := listenerRateLimiters(listenerCfg)
+		limitedHandler := rateLimitMiddleware(tenantLimiter, listenerCfg.Type, proxyHandler)
+		tunnelHandler := listeners.TunnelLimitsMiddleware(listenerTunnelLimits(listenerCfg), limitedHandler)
+		aclHandler := clientACLMiddleware(newClientACL(listenerCfg.AllowCIDRs, listenerCfg.DenyCIDRs), tenantFilter, tunnelHandler)
+		baseChain := listeners.ListenerMetadataMiddleware(listenerCfg.Name, observability.HTTPMiddleware(aclHandler, accessLogEnabled))
+		authChain := listeners.ListenerCredentialMiddleware(listenerCfg.AuthType, listenerCredentials(listenerCfg), baseChain)
+		certChain := listeners.ClientCertMiddleware(listenerClientCertMapper(listenerCfg), authChain)
 		server := &http.Server{
-			Addr:    listenerCfg.Address,
-			Handler: authChain,
+			Addr:      listenerCfg.Address,
+			Handler:   rateLimitMiddleware(clientLimiter, listenerCfg.Type, certChain),
+			Protocols: listenerProtocols(listenerCfg),
+
+			ReadHeaderTimeout: time.Duration(listenerCfg.ReadHeaderTimeoutSeconds) * time.Second,
 		}
 
 		state := &serverState{
-			cfg:    listenerCfg,
-			server: server,
-			conns:  make(map[net.Conn]struct{}),
+			cfg:     listenerCfg,
+			server:  server,
+			limiter: newConnLimiter(listenerCfg),
+			conns:   make(map[net.Conn]struct{}),
+			pending: make(map[net.Conn]time.Time),
 		}
 
 		server.ConnState = state.connState
@@ -155,6 +184,98 @@ func NewHTTPListenerManager(listenerConfigs []config.ListenerConfig, drainTimeou
 	}
 }
 
+// listenerCredentials builds the account store for a basic-auth listener from
+// its single username and password, its users, and its htpasswd file. It
+// returns nil when the listener does not authenticate.
+func listenerCredentials(listenerCfg config.ListenerConfig) listeners.CredentialStore {
+	if !strings.EqualFold(strings.TrimSpace(listenerCfg.AuthType), "basic") {
+		return nil
+	}
+	users := make([]listeners.UserCredential, 0, len(listenerCfg.Users)+1)
+	if listenerCfg.Username != "" {
+		users = append(users, listeners.UserCredential{
+			Credential: listeners.Credential{Username: listenerCfg.Username},
+			Password:   listenerCfg.Password,
+		})
+	}
+	for _, user := range listenerCfg.Users {
+		users = append(users, listeners.UserCredential{
+			Credential: listeners.Credential{
+				Username:  strings.TrimSpace(user.Username),
+				TenantID:  strings.TrimSpace(user.TenantID),
+				Provider:  strings.TrimSpace(user.Provider),
+				PolicyRef: strings.Join(user.Policies, ","),
+			},
+			Password: user.Password,
+		})
+	}
+	return listeners.NewUserStore(users, listenerCfg.HtpasswdFile)
+}
+
+// listenerClientCertMapper returns the certificate-to-tenant mapping of an
+// https listener, or nil when it maps none.
+func listenerClientCertMapper(listenerCfg config.ListenerConfig) *listeners.ClientCertMapper {
+	if listenerCfg.TLS == nil || len(listenerCfg.TLS.ClientTenants) == 0 {
+		return nil
+	}
+	rules := make([]listeners.ClientCertRule, 0, len(listenerCfg.TLS.ClientTenants))
+	for _, mapping := range listenerCfg.TLS.ClientTenants {
+		rules = append(rules, listeners.ClientCertRule{
+			SPIFFEID:   strings.TrimSpace(mapping.SPIFFEID),
+			DNSName:    strings.TrimSpace(mapping.DNSName),
+			CommonName: strings.TrimSpace(mapping.CommonName),
+			Credential: listeners.Credential{
+				TenantID:  strings.TrimSpace(mapping.TenantID),
+				Provider:  strings.TrimSpace(mapping.Provider),
+				PolicyRef: strings.Join(mapping.Policies, ","),
+			},
+		})
+	}
+	return listeners.NewClientCertMapper(rules)
+}
+
+// listenerClientAuth loads the client CA bundle of an https listener and
+// returns the TLS settings that verify client certificates, or nil when
+// client_auth is off.
+func listenerClientAuth(tlsCfg *config.TLSConfig) (*tls.Config, error) {
+	if tlsCfg == nil {
+		return nil, nil
+	}
+	var clientAuth tls.ClientAuthType
+	switch strings.ToLower(strings.TrimSpace(tlsCfg.ClientAuth)) {
+	case "optional":
+		clientAuth = tls.VerifyClientCertIfGiven
+	case "required":
+		clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, nil
+	}
+	bundle, err := os.ReadFile(tlsCfg.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("read client ca bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("client ca bundle %s holds no PEM certificates", tlsCfg.ClientCAFile)
+	}
+	return &tls.Config{MinVersion: tls.VersionTLS12, ClientAuth: clientAuth, ClientCAs: pool}, nil
+}
+
+// listenerProtocols keeps listeners on HTTP/1.1 unless http2 is enabled, in
+// which case https listeners negotiate h2 via ALPN and plaintext listeners
+// also accept prior-knowledge h2c.
+func listenerProtocols(listenerCfg config.ListenerConfig) *http.Protocols {
+	protocols := listeners.HTTP1Protocols()
+	if listenerCfg.HTTP2 {
+		if listenerCfg.Type == "https" {
+			protocols.SetHTTP2(true)
+		} else {
+			protocols.SetUnencryptedHTTP2(true)
+		}
+	}
+	return protocols
+}
+
 func (m *HTTPListenerManager) Start(ctx context.Context) error {
 	m.mu.Lock()
 	if m.started {
@@ -165,12 +286,20 @@ func (m *HTTPListenerManager) Start(ctx context.Context) error {
 	m.mu.Unlock()
 
 	for _, state := range m.servers {
+		if state.cfg.Type == "https" {
+			tlsConfig, err := listenerClientAuth(state.cfg.TLS)
+			if err != nil {
+				_ = m.Shutdown(ctx)
+				return fmt.Errorf("listen %s (%s): %w", state.cfg.Name, state.cfg.Address, err)
+			}
+			state.server.TLSConfig = tlsConfig
+		}
 		listener, err := net.Listen("tcp", state.cfg.Address)
 		if err != nil {
 			_ = m.Shutdown(ctx)
 			return fmt.Errorf("listen %s (%s): %w", state.cfg.Name, state.cfg.Address, err)
 		}
-		state.listener = listener
+		state.listener = limitConnections(listener, state.limiter)
 
 		go func(s *serverState) {
 			var serveErr error
@@ -231,10 +360,20 @@ func (s *serverState) connState(conn net.Conn, state http.ConnState) {
 	defer s.connMu.Unlock()
 
 	switch state {
-	case http.StateNew, http.StateActive, http.StateIdle:
+	case http.StateNew:
+		s.conns[conn] = struct{}{}
+		s.pending[conn] = time.Now()
+	case http.StateActive, http.StateIdle:
 		s.conns[conn] = struct{}{}
+		delete(s.pending, conn)
 	case http.StateHijacked, http.StateClosed:
 		delete(s.conns, conn)
+		if accepted, ok := s.pending[conn]; ok {
+			delete(s.pending, conn)
+			if timeout := s.server.ReadHeaderTimeout; state == http.StateClosed && timeout > 0 && time.Since(accepted) >= timeout {
+				observability.RecordConnectionDropped(s.cfg.Name, connDropReadHeaderTimeout)
+			}
+		}
 	}
 }
 
@@ -245,5 +384,6 @@ func (s *serverState) closeTrackedConnections() {
 	for conn := range s.conns {
 		_ = conn.Close()
 		delete(s.conns, conn)
+		delete(s.pending, conn)
 	}
 }
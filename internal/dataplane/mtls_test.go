@@ -0,0 +1,156 @@
+package dataplane
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+// issueClientCert signs a client certificate for spiffeID with the CA from
+// writeTestCA.
+func issueClientCert(t *testing.T, ca *config.TLSConfig, commonName, spiffeID string) tls.Certificate {
+	t.Helper()
+	caPair, err := tls.LoadX509KeyPair(ca.CertFile, ca.KeyFile)
+	if err != nil {
+		t.Fatalf("load CA: %v", err)
+	}
+	caCert, err := x509.ParseCertificate(caPair.Certificate[0])
+	if err != nil {
+		t.Fatalf("parse CA: %v", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	uri, err := url.Parse(spiffeID)
+	if err != nil {
+		t.Fatalf("parse spiffe id: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{uri},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caPair.PrivateKey)
+	if err != nil {
+		t.Fatalf("create client certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestHTTPSListener_ClientCertificatesMapToTenants(t *testing.T) {
+	t.Parallel()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	defer origin.Close()
+
+	certFile, keyFile, serverPool := writeSelfSignedCert(t)
+	ca, _ := writeTestCA(t)
+	cfg := &config.Config{
+		Listeners: []config.ListenerConfig{{
+			Name:    "mtls",
+			Type:    "https",
+			Address: "127.0.0.1:0",
+			TLS: &config.TLSConfig{
+				CertFile:     certFile,
+				KeyFile:      keyFile,
+				ClientCAFile: ca.CertFile,
+				ClientAuth:   "required",
+				ClientTenants: []config.ClientCertTenantConfig{
+					{SPIFFEID: "spiffe://fleet.example/blocked", TenantID: "blocked"},
+					{SPIFFEID: "spiffe://fleet.example/crawler/*", TenantID: "crawlers"},
+				},
+			},
+			Enabled: true,
+		}},
+		Providers: []config.ProviderConfig{
+			{Name: "direct", Type: "direct", Endpoints: []config.ProviderEndpoint{{URL: "http://direct.local", Priority: 1}}},
+		},
+		Routing: config.RoutingConfig{
+			DefaultProvider: "direct",
+			Rules: []config.RoutingRule{
+				{Name: "blocked", Match: map[string]string{"tenant": "blocked"}, Provider: "direct", PolicyRef: "deny-all"},
+			},
+		},
+		Policies: []config.PolicyConfig{{Name: "deny-all", Type: "access", Action: "deny"}},
+	}
+	manager := NewHTTPListenerManager(cfg.Listeners, time.Second, false, NewRequestRuntime(cfg))
+	if err := manager.Start(context.Background()); err != nil {
+		t.Fatalf("start https manager: %v", err)
+	}
+	defer func() { _ = manager.Shutdown(context.Background()) }()
+	proxyURL := &url.URL{Scheme: "https", Host: manager.servers[0].listener.Addr().String()}
+
+	get := func(cert *tls.Certificate, tenant string) (int, error) {
+		tlsConfig := &tls.Config{RootCAs: serverPool}
+		if cert != nil {
+			tlsConfig.Certificates = []tls.Certificate{*cert}
+		}
+		client := &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: tlsConfig},
+			Timeout:   5 * time.Second,
+		}
+		req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+		req.Header.Set("X-Tenant-ID", tenant)
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	crawler := issueClientCert(t, ca, "crawler-1", "spiffe://fleet.example/crawler/1")
+	if code, err := get(&crawler, "blocked"); err != nil || code != http.StatusNoContent {
+		t.Fatalf("expected crawler certificate to bind its own tenant, got %d err=%v", code, err)
+	}
+	blocked := issueClientCert(t, ca, "blocked", "spiffe://fleet.example/blocked")
+	if code, err := get(&blocked, ""); err != nil || code != http.StatusForbidden {
+		t.Fatalf("expected blocked tenant to be denied, got %d err=%v", code, err)
+	}
+	stranger := issueClientCert(t, ca, "stranger", "spiffe://other.example/job")
+	if code, err := get(&stranger, ""); err != nil || code != http.StatusForbidden {
+		t.Fatalf("expected unmapped certificate to be refused, got %d err=%v", code, err)
+	}
+	if _, err := get(nil, ""); err == nil {
+		t.Fatalf("expected handshake without a client certificate to fail")
+	}
+}
+
+func TestHTTPSListener_MissingClientCABundleFailsStart(t *testing.T) {
+	t.Parallel()
+
+	certFile, keyFile, _ := writeSelfSignedCert(t)
+	missing := filepath.Join(t.TempDir(), "clients-ca.pem")
+	listenerCfg := config.ListenerConfig{
+		Name:    "mtls",
+		Type:    "https",
+		Address: "127.0.0.1:0",
+		TLS:     &config.TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: missing, ClientAuth: "optional"},
+		Enabled: true,
+	}
+	manager := NewHTTPListenerManager([]config.ListenerConfig{listenerCfg}, time.Second, false, NewRequestRuntime(&config.Config{}))
+	if err := manager.Start(context.Background()); err == nil {
+		_ = manager.Shutdown(context.Background())
+		t.Fatalf("expected start to fail without the client CA bundle")
+	}
+}
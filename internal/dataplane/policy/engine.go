@@ -21,6 +21,7 @@ const (
 	ActionRewrite              = "rewrite"
 	ActionResponseHeadersPatch = "response_headers_patch"
 	ActionBodyMutationHook     = "body_mutation_hook"
+	ActionUpstreamCredentials  = "upstream_credentials"
 )
 
 type compiledPolicy struct {
@@ -145,6 +146,10 @@ func mergeDecisions(base, current listeners.PolicyDecision) listeners.PolicyDeci
 	base.RewritePathPrefix = valueOrDefault(current.RewritePathPrefix, base.RewritePathPrefix)
 	base.RequestBodyPrefix = valueOrDefault(current.RequestBodyPrefix, base.RequestBodyPrefix)
 	base.ResponseBodyPrefix = valueOrDefault(current.ResponseBodyPrefix, base.ResponseBodyPrefix)
+	// The first matching credentials win, like legacy login rules.
+	if base.UpstreamCredentials == nil {
+		base.UpstreamCredentials = current.UpstreamCredentials
+	}
 	base.HeadersPatch = mergeMap(base.HeadersPatch, current.HeadersPatch)
 	base.ResponseHeadersPatch = mergeMap(base.ResponseHeadersPatch, current.ResponseHeadersPatch)
 	return base
@@ -246,6 +251,16 @@ func applyAction(policy config.PolicyConfig, allowRequestHeaderMutation, allowRe
 		if result.RequestBodyPrefix == "" && result.ResponseBodyPrefix == "" {
 			result.Action = ActionAllow
 		}
+	case ActionUpstreamCredentials:
+		username := policy.Parameters["username"]
+		if strings.TrimSpace(username) == "" {
+			result.Action = ActionAllow
+			break
+		}
+		result.UpstreamCredentials = &listeners.UpstreamCredentials{
+			Username: config.ExpandSessionID(username),
+			Password: policy.Parameters["password"],
+		}
 	case ActionAllow:
 	default:
 		result.Action = ActionAllow
@@ -268,6 +283,10 @@ func matches(policy compiledPolicy, req *http.Request, metadata listeners.Reques
 			if route.Provider != want {
 				return false
 			}
+		case normalized == "client_cidr" || normalized == "ip_range":
+			if !listeners.ClientIPInCIDRs(metadata.ClientIP, want) {
+				return false
+			}
 		case normalized == "method":
 			if req != nil && !strings.EqualFold(req.Method, want) {
 				return false
@@ -3,6 +3,7 @@ package policy
 import (
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -106,6 +107,62 @@ func TestEngineEvaluate_SizeAndTimeSelectors(t *testing.T) {
 	}
 }
 
+func TestEngineEvaluate_ClientCIDRSelector(t *testing.T) {
+	t.Parallel()
+	cfg := &config.Config{Policies: []config.PolicyConfig{{
+		Name:      "office-only",
+		Action:    ActionDeny,
+		Selectors: map[string]string{"client_cidr": "10.0.0.0/8, 2001:db8::/32"},
+	}}}
+	engine := NewEngine(cfg)
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+
+	for clientIP, want := range map[string]string{
+		"10.1.2.3":    ActionDeny,
+		"2001:db8::1": ActionDeny,
+		"192.0.2.1":   ActionAllow,
+		"":            ActionAllow,
+	} {
+		decision := engine.Evaluate(req, listeners.RequestMetadata{ClientIP: clientIP}, listeners.RouteDecision{Policy: "office-only"})
+		if decision.Action != want {
+			t.Fatalf("client %q: expected %q action, got %q", clientIP, want, decision.Action)
+		}
+	}
+}
+
+func TestEngineEvaluate_UpstreamCredentials(t *testing.T) {
+	t.Parallel()
+	cfg := &config.Config{Policies: []config.PolicyConfig{
+		{Name: "lab", Action: ActionUpstreamCredentials, Selectors: map[string]string{"ip_range": "10.1.0.0/16"}, Parameters: map[string]string{"username": "lab-${SESSION_ID}", "password": "lab-pass"}},
+		{Name: "office", Action: ActionUpstreamCredentials, Selectors: map[string]string{"ip_range": "10.0.0.0/8"}, Parameters: map[string]string{"username": "office", "password": "office-pass"}},
+	}}
+	engine := NewEngine(cfg)
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	route := listeners.RouteDecision{Policy: "lab,office"}
+
+	decision := engine.Evaluate(req, listeners.RequestMetadata{ClientIP: "10.1.2.3"}, route)
+	if decision.Action != ActionUpstreamCredentials || decision.UpstreamCredentials == nil {
+		t.Fatalf("expected upstream credentials, got %+v", decision)
+	}
+	if got := decision.UpstreamCredentials; !strings.HasPrefix(got.Username, "lab-session-") || got.Password != "lab-pass" {
+		t.Fatalf("expected first matching rule with expanded session id, got %+v", got)
+	}
+	next := engine.Evaluate(req, listeners.RequestMetadata{ClientIP: "10.1.2.3"}, route)
+	if next.UpstreamCredentials.Username == decision.UpstreamCredentials.Username {
+		t.Fatalf("expected a fresh session id per request, got %q twice", next.UpstreamCredentials.Username)
+	}
+
+	decision = engine.Evaluate(req, listeners.RequestMetadata{ClientIP: "10.9.0.1"}, route)
+	if decision.UpstreamCredentials == nil || decision.UpstreamCredentials.Username != "office" {
+		t.Fatalf("expected office credentials, got %+v", decision.UpstreamCredentials)
+	}
+
+	decision = engine.Evaluate(req, listeners.RequestMetadata{ClientIP: "192.0.2.1"}, route)
+	if decision.Action != ActionAllow || decision.UpstreamCredentials != nil {
+		t.Fatalf("expected no credentials outside the ip ranges, got %+v", decision)
+	}
+}
+
 func TestEngineEvaluate_SafeModeDefaultsSuppressMutations(t *testing.T) {
 	t.Parallel()
 	cfg := &config.Config{
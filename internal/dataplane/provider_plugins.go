@@ -0,0 +1,182 @@
+package dataplane
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/internal/dataplane/providers"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+// pluginProvider is a configured provider whose type is served by a
+// registered providers.Plugin other than a built-in one.
+type pluginProvider struct {
+	plugin   providers.Plugin
+	provider config.ProviderConfig
+}
+
+func lookupPluginProvider(provider config.ProviderConfig) (pluginProvider, bool) {
+	plugin := lookupProviderPlugin(provider)
+	if _, builtin := plugin.(builtinPlugin); builtin {
+		return pluginProvider{}, false
+	}
+	return pluginProvider{plugin: plugin, provider: provider}, true
+}
+
+// endpoint returns the configured endpoint parsed as u.
+func (p pluginProvider) endpoint(u *url.URL) config.ProviderEndpoint {
+	for _, endpoint := range p.provider.Endpoints {
+		if parsed, err := url.Parse(endpoint.URL); err == nil && describeEndpoint(parsed) == describeEndpoint(u) {
+			return endpoint
+		}
+	}
+	return config.ProviderEndpoint{URL: describeEndpoint(u)}
+}
+
+// resolveFirst moves the endpoint the plugin resolves for the request to the
+// front of endpoints. An error, or an endpoint that is not eligible, leaves
+// the order alone.
+func (p pluginProvider) resolveFirst(ctx context.Context, endpoints []listeners.RuntimeEndpoint) {
+	resolved, err := p.plugin.ResolveEndpoint(ctx, p.provider, pluginHints(listeners.UpstreamHintsFromContext(ctx)))
+	if err != nil {
+		slog.Debug("provider plugin did not resolve an endpoint", "provider", p.provider.Name, "error", err)
+		return
+	}
+	if parsed, err := url.Parse(resolved.URL); err == nil {
+		moveEndpointFirst(endpoints, describeEndpoint(parsed))
+	}
+}
+
+func pluginHints(hints listeners.UpstreamHints) map[string]string {
+	values := map[string]string{}
+	if hints.Country != "" {
+		values["country"] = hints.Country
+	}
+	if hints.City != "" {
+		values["city"] = hints.City
+	}
+	if hints.Session != "" {
+		values["session"] = hints.Session
+	}
+	if hints.SessionTTLMinutes > 0 {
+		values["session_ttl"] = strconv.Itoa(hints.SessionTTLMinutes)
+	}
+	return values
+}
+
+// pluginAdapter bridges a provider plugin into the forward-proxy pipeline.
+// CONNECT tunnels and forward requests both go through the plugin's Dial.
+type pluginAdapter struct {
+	pluginProvider
+	transports adapterTransports
+}
+
+func (a pluginAdapter) PrepareRequest(req *http.Request, _ *url.URL) (*http.Request, error) {
+	out := req.Clone(req.Context())
+	if err := a.plugin.PrepareRequest(out.Context(), a.provider, out); err != nil && !errors.Is(err, providers.ErrUnsupported) {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (a pluginAdapter) DialConnect(ctx context.Context, targetAddr string, endpoint *url.URL, _ *net.Dialer) (net.Conn, error) {
+	if endpoint == nil {
+		return nil, errors.New("missing provider plugin endpoint")
+	}
+	return a.plugin.Dial(ctx, a.provider, a.endpoint(endpoint), providers.DialPlan{Network: "tcp", Address: targetAddr})
+}
+
+func (a pluginAdapter) RoundTrip(req *http.Request, endpoint *url.URL, transport *http.Transport, responseHeaderTimeout time.Duration) (*http.Response, error) {
+	if endpoint == nil {
+		return nil, errors.New("missing provider plugin endpoint")
+	}
+	configured := a.endpoint(endpoint)
+	cached := a.transports.get("plugin/"+a.provider.Name, endpoint, transport, func(t *http.Transport) {
+		t.Proxy = nil
+		t.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return a.plugin.Dial(ctx, a.provider, configured, providers.DialPlan{Network: network, Address: address})
+		}
+	})
+	return listeners.RoundTripWithResponseHeaderTimeout(cached, req, responseHeaderTimeout)
+}
+
+// RotateIdentity asks the plugin for a new upstream identity. Plugins that
+// return providers.ErrUnsupported report rotation as unsupported.
+func (a pluginAdapter) RotateIdentity(ctx context.Context) error {
+	result, err := a.plugin.Rotate(ctx, a.provider, listeners.UpstreamHintsFromContext(ctx).Session)
+	if errors.Is(err, providers.ErrUnsupported) {
+		return listeners.ErrRotateIdentityUnsupported
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("upstream session rotated", "provider", a.provider.Name, "reason", "manual", "session", result.SessionID)
+	return nil
+}
+
+func (a pluginAdapter) Capabilities() []string { return []string{"forward", "connect"} }
+
+// pollPluginStatus feeds the plugin's FetchStatus into the health of every
+// endpoint of provider, in place of the HTTP probe, until the registry
+// closes.
+func (r *ProviderRegistry) pollPluginStatus(binding pluginProvider, cfg config.ProviderHealthConfig) {
+	ticker := time.NewTicker(time.Duration(cfg.IntervalSeconds) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.fetchPluginStatus(binding, time.Duration(cfg.TimeoutSeconds)*time.Second)
+		}
+	}
+}
+
+func (r *ProviderRegistry) fetchPluginStatus(binding pluginProvider, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	status, err := binding.plugin.FetchStatus(ctx, binding.provider)
+	cancel()
+	if err != nil {
+		slog.Debug("provider plugin status unavailable", "provider", binding.provider.Name, "error", err)
+		return
+	}
+	var state EndpointHealthState
+	switch strings.ToLower(strings.TrimSpace(status.State)) {
+	case string(EndpointHealthHealthy):
+		state = EndpointHealthHealthy
+	case string(EndpointHealthDegraded):
+		state = EndpointHealthDegraded
+	case string(EndpointHealthUnhealthy):
+		state = EndpointHealthUnhealthy
+	default:
+		return
+	}
+	reason := strings.TrimSpace(status.Reason)
+	if reason == "" {
+		reason = "provider status " + string(state)
+	}
+
+	now := r.now().UTC()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, endpointState := range r.health[binding.provider.Name] {
+		endpointState.lastProbeAt = now
+		if state == EndpointHealthHealthy {
+			endpointState.lastSuccessAt = now
+		} else {
+			endpointState.lastFailureAt = now
+		}
+		// An open circuit stays open until its half-open trial.
+		if endpointState.state != EndpointHealthOpen {
+			endpointState.transition(state, reason, now)
+		}
+	}
+}
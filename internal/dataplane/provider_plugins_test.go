@@ -0,0 +1,312 @@
+package dataplane
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/internal/dataplane/providers"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+// tunnelPlugin dials targets directly and records, per provider, which
+// endpoint each dial went through.
+type tunnelPlugin struct {
+	mu     sync.Mutex
+	dials  map[string][]string
+	status map[string]providers.StatusSnapshot
+}
+
+var testTunnelPlugin = &tunnelPlugin{dials: map[string][]string{}, status: map[string]providers.StatusSnapshot{}}
+
+func init() {
+	providers.Register("test_tunnel", testTunnelPlugin)
+}
+
+func (p *tunnelPlugin) ValidateConfig(provider config.ProviderConfig) error {
+	errs := &config.ValidationErrors{}
+	if provider.Auth.Type != "" && provider.Auth.Type != "none" {
+		errs.Add("auth.type", "must be none for test_tunnel")
+	}
+	return errs.OrNil()
+}
+
+func (p *tunnelPlugin) ResolveEndpoint(_ context.Context, provider config.ProviderConfig, hint map[string]string) (config.ProviderEndpoint, error) {
+	for _, endpoint := range provider.Endpoints {
+		if hint["country"] != "" && strings.Contains(endpoint.URL, hint["country"]+".") {
+			return endpoint, nil
+		}
+	}
+	return config.ProviderEndpoint{}, errors.New("no endpoint for hint")
+}
+
+func (p *tunnelPlugin) PrepareRequest(_ context.Context, provider config.ProviderConfig, req *http.Request) error {
+	req.Header.Set("X-Tunnel-Plugin", provider.Name)
+	return nil
+}
+
+func (p *tunnelPlugin) Dial(ctx context.Context, provider config.ProviderConfig, endpoint config.ProviderEndpoint, plan providers.DialPlan) (net.Conn, error) {
+	p.mu.Lock()
+	p.dials[provider.Name] = append(p.dials[provider.Name], endpoint.URL)
+	p.mu.Unlock()
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, plan.Network, plan.Address)
+}
+
+func (p *tunnelPlugin) Rotate(context.Context, config.ProviderConfig, string) (providers.RotateResult, error) {
+	return providers.RotateResult{}, providers.ErrUnsupported
+}
+
+func (p *tunnelPlugin) FetchStatus(_ context.Context, provider config.ProviderConfig) (providers.StatusSnapshot, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status[provider.Name], nil
+}
+
+func (p *tunnelPlugin) reset(provider string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.dials, provider)
+	delete(p.status, provider)
+}
+
+func (p *tunnelPlugin) dialsFor(provider string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.dials[provider]...)
+}
+
+func (p *tunnelPlugin) setStatus(provider string, status providers.StatusSnapshot) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status[provider] = status
+}
+
+func TestProviderPlugin_ServesForwardAndConnect(t *testing.T) {
+	t.Parallel()
+	testTunnelPlugin.reset("tunnel-forward")
+
+	var pluginHeader string
+	targetHTTP := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		pluginHeader = req.Header.Get("X-Tunnel-Plugin")
+		_, _ = rw.Write([]byte("ok"))
+	}))
+	defer targetHTTP.Close()
+	targetTCP := startPingPongTCPServer(t)
+	defer targetTCP.Close()
+
+	cfg := &config.Config{
+		Providers: []config.ProviderConfig{{
+			Name: "tunnel-forward",
+			Type: "test_tunnel",
+			Endpoints: []config.ProviderEndpoint{
+				{URL: "http://us.tunnel.test:9000", Priority: 1},
+				{URL: "http://de.tunnel.test:9000", Priority: 1},
+			},
+		}},
+		Routing: config.RoutingConfig{DefaultProvider: "tunnel-forward"},
+	}
+	proxy := startRuntimeProxy(t, cfg)
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	req, _ := http.NewRequest(http.MethodGet, targetHTTP.URL, nil)
+	req.Header.Set(listeners.HintCountryHeader, "de")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("forward request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Fatalf("expected 200 ok, got %d %q", resp.StatusCode, body)
+	}
+	if pluginHeader != "tunnel-forward" {
+		t.Fatalf("expected the plugin to prepare the request, got header %q", pluginHeader)
+	}
+
+	if err := assertConnectPingPong(proxy.URL, targetTCP.Addr().String()); err != nil {
+		t.Fatalf("connect through plugin: %v", err)
+	}
+
+	dials := testTunnelPlugin.dialsFor("tunnel-forward")
+	if len(dials) != 2 || dials[0] != "http://de.tunnel.test:9000" {
+		t.Fatalf("expected a forward dial through the resolved de endpoint and a CONNECT dial, got %q", dials)
+	}
+
+	adapter := upstreamAdapterFactory{}.ForProvider(cfg.Providers[0], nil)
+	if err := adapter.RotateIdentity(context.Background()); !errors.Is(err, listeners.ErrRotateIdentityUnsupported) {
+		t.Fatalf("expected unsupported rotation, got %v", err)
+	}
+}
+
+func TestProviderPlugin_StatusFeedsEndpointHealth(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{Providers: []config.ProviderConfig{{
+		Name:      "tunnel-health",
+		Type:      "test_tunnel",
+		Endpoints: []config.ProviderEndpoint{{URL: "http://us.tunnel.test:9000"}},
+		Health:    config.ProviderHealthConfig{Enabled: true, IntervalSeconds: 3600},
+	}}}
+	registry := NewProviderRegistry(cfg)
+	defer registry.Close()
+	binding := registry.plugins["tunnel-health"]
+	selector := NewEndpointSelector(registry)
+	selectable := func() int {
+		provider, _ := registry.Get("tunnel-health")
+		return len(selector.Select(context.Background(), provider, httptest.NewRequest(http.MethodGet, "http://example.com", nil)))
+	}
+
+	testTunnelPlugin.setStatus("tunnel-health", providers.StatusSnapshot{State: "unhealthy", Reason: "vendor maintenance"})
+	registry.fetchPluginStatus(binding, time.Second)
+	health := registry.SnapshotProviderHealth("tunnel-health")[0].Health
+	if health.State != EndpointHealthUnhealthy || health.Reason != "vendor maintenance" {
+		t.Fatalf("expected the plugin status to mark the endpoint unhealthy, got %+v", health)
+	}
+	if n := selectable(); n != 0 {
+		t.Fatalf("expected no selectable endpoints, got %d", n)
+	}
+
+	testTunnelPlugin.setStatus("tunnel-health", providers.StatusSnapshot{State: "healthy"})
+	registry.fetchPluginStatus(binding, time.Second)
+	if n := selectable(); n != 1 {
+		t.Fatalf("expected the endpoint back after a healthy status, got %d", n)
+	}
+
+	testTunnelPlugin.setStatus("tunnel-health", providers.StatusSnapshot{State: "maintenance"})
+	registry.fetchPluginStatus(binding, time.Second)
+	if state := registry.SnapshotProviderHealth("tunnel-health")[0].Health.State; state != EndpointHealthHealthy {
+		t.Fatalf("expected an unknown status to leave health alone, got %q", state)
+	}
+}
+
+func TestProviderPlugin_ValidatesConfig(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		SchemaVersion: "1",
+		Providers: []config.ProviderConfig{{
+			Name:      "tunnel-validate",
+			Type:      "test_tunnel",
+			Auth:      config.ProviderAuthConfig{Type: "basic", Username: "u", Password: "p"},
+			Endpoints: []config.ProviderEndpoint{{URL: "http://us.tunnel.test:9000"}},
+		}},
+	}
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "providers[0].auth.type: must be none for test_tunnel") {
+		t.Fatalf("expected the plugin's field error, got %v", err)
+	}
+}
+
+func TestProviderPlugin_BuiltinTypesDispatchThroughRegistry(t *testing.T) {
+	t.Parallel()
+
+	for _, providerType := range []string{"direct", "http_proxy", "https_proxy", "legacy_upstream_proxy", "socks5_proxy"} {
+		if plugin, ok := providers.Lookup(providerType); !ok {
+			t.Fatalf("expected built-in type %s to be registered", providerType)
+		} else if _, builtin := plugin.(builtinPlugin); !builtin {
+			t.Fatalf("expected %s to be served by a built-in plugin, got %T", providerType, plugin)
+		}
+	}
+
+	factory := upstreamAdapterFactory{}
+	cases := map[string]config.ProviderConfig{
+		"direct": {Name: "a", Type: "vendor_x", Capabilities: []string{"direct"}},
+		"socks5": {Name: "b", Type: "vendor_x", Capabilities: []string{"socks5_proxy"}},
+		"http":   {Name: "c", Type: "vendor_x"},
+		"plugin": {Name: "d", Type: "test_tunnel"},
+		"typed":  {Name: "e", Type: "socks5_proxy", Capabilities: []string{"forward_proxy"}},
+	}
+	expected := map[string]string{
+		"direct": "dataplane.directAdapter",
+		"socks5": "dataplane.socks5ProxyAdapter",
+		"http":   "dataplane.httpProxyAdapter",
+		"plugin": "dataplane.pluginAdapter",
+		"typed":  "dataplane.socks5ProxyAdapter",
+	}
+	for name, provider := range cases {
+		if got := fmt.Sprintf("%T", factory.ForProvider(provider, nil)); got != expected[name] {
+			t.Fatalf("%s: expected %s, got %s", name, expected[name], got)
+		}
+	}
+	if _, ok := lookupPluginProvider(config.ProviderConfig{Type: "http_proxy"}); ok {
+		t.Fatalf("expected built-in providers not to be treated as plugin providers")
+	}
+}
+
+func TestProviderPlugin_BuiltinsActThroughServingRegistry(t *testing.T) {
+	target := startPingPongTCPServer(t)
+	defer target.Close()
+	socksListener := startSOCKS5Proxy(t, "good", "pass")
+	defer socksListener.Close()
+
+	provider := config.ProviderConfig{
+		Name: "builtin-served",
+		Type: "socks5_proxy",
+		Auth: config.ProviderAuthConfig{
+			Type: "basic",
+			Pool: config.ProviderCredentialPoolConfig{
+				Credentials:     []config.ProviderCredential{{Username: "banned", Password: "pass"}, {Username: "good", Password: "pass"}},
+				QuarantineAfter: 1,
+			},
+		},
+		Endpoints: []config.ProviderEndpoint{{URL: "socks5://" + socksListener.Addr().String(), Priority: 1, Country: "de"}},
+	}
+	plugin, _ := providers.Lookup("socks5_proxy")
+	ctx := context.Background()
+	plan := providers.DialPlan{Network: "tcp", Address: target.Addr().String()}
+	if _, err := plugin.Dial(ctx, provider, provider.Endpoints[0], plan); !errors.Is(err, errBuiltinNotServed) {
+		t.Fatalf("expected a provider no data plane serves to be refused, got %v", err)
+	}
+
+	runtime := NewRequestRuntime(&config.Config{Providers: []config.ProviderConfig{provider}})
+	registry := runtime.Registry.(*ProviderRegistry)
+	defer registry.Close()
+
+	var served int
+	for range 3 {
+		conn, err := plugin.Dial(ctx, provider, provider.Endpoints[0], plan)
+		if err != nil {
+			continue
+		}
+		_, _ = conn.Write([]byte("ping"))
+		reply := make([]byte, 4)
+		if _, err := io.ReadFull(conn, reply); err == nil && string(reply) == "pong" {
+			served++
+		}
+		conn.Close()
+	}
+	if served == 0 {
+		t.Fatalf("expected dials through the built-in plugin to reach the target")
+	}
+	for _, usage := range registry.SnapshotProviderCredentials(provider.Name) {
+		if usage.Username == "banned" && !usage.Quarantined {
+			t.Fatalf("expected plugin dials to use the serving credential pool, got %+v", usage)
+		}
+	}
+
+	endpoint, err := plugin.ResolveEndpoint(ctx, provider, map[string]string{"country": "de"})
+	if err != nil || endpoint.URL != provider.Endpoints[0].URL {
+		t.Fatalf("expected the served endpoint, got %+v, %v", endpoint, err)
+	}
+	if status, err := plugin.FetchStatus(ctx, provider); err != nil || status.State != "healthy" {
+		t.Fatalf("expected a healthy status, got %+v, %v", status, err)
+	}
+
+	registry.Close()
+	if _, err := plugin.FetchStatus(ctx, provider); !errors.Is(err, errBuiltinNotServed) {
+		t.Fatalf("expected a closed registry to stop serving plugin calls, got %v", err)
+	}
+}
@@ -0,0 +1,599 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+// ErrPluginUnavailable is returned by calls to an external plugin that is not
+// running: it failed to start or handshake, or it exited and is waiting out
+// its restart backoff.
+var ErrPluginUnavailable = errors.New("provider plugin unavailable")
+
+const (
+	defaultPluginCallTimeout       = 5 * time.Second
+	defaultPluginRestartBackoff    = 500 * time.Millisecond
+	defaultPluginMaxRestartBackoff = 30 * time.Second
+
+	// pluginStableAfter is how long a plugin process runs before its exit
+	// no longer grows the restart backoff.
+	pluginStableAfter = time.Minute
+	// pluginStopGrace is how long a stopping plugin gets to exit on stdin
+	// EOF before it is killed.
+	pluginStopGrace = 2 * time.Second
+)
+
+// ExternalPlugin is a Plugin served by an external binary over the stdio
+// plugin protocol. The process starts on the first call; when it exits it is
+// restarted after an exponential backoff, during which calls fail with
+// ErrPluginUnavailable. Every call is bounded by the configured call timeout.
+type ExternalPlugin struct {
+	mu       sync.Mutex
+	cfg      config.ProviderPluginConfig
+	proc     *pluginProcess
+	starting chan struct{} // closed when the start in progress finishes
+	failures int
+	retryAt  time.Time
+	restart  *time.Timer
+	closed   bool
+	// generation counts reconfigurations that restart the process, so a
+	// start that raced one is discarded.
+	generation int
+}
+
+func NewExternalPlugin(cfg config.ProviderPluginConfig) *ExternalPlugin {
+	return &ExternalPlugin{cfg: cfg}
+}
+
+// RegisterExternal serves cfg.Type with the external plugin cfg describes.
+// Registering a type again reconfigures its plugin, restarting the process
+// when the command changes. A type served by an in-process plugin cannot be
+// replaced.
+func RegisterExternal(cfg config.ProviderPluginConfig) error {
+	key := normalizeType(cfg.Type)
+	if key == "" || cfg.Command == "" {
+		return errors.New("provider plugin needs a type and a command")
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if existing, exists := registry.byType[key]; exists {
+		external, ok := existing.(*ExternalPlugin)
+		if !ok {
+			return fmt.Errorf("provider type %q is served by an in-process plugin", key)
+		}
+		external.reconfigure(cfg)
+		return nil
+	}
+	external := NewExternalPlugin(cfg)
+	registry.byType[key] = external
+	config.RegisterProviderValidator(key, external.ValidateConfig)
+	return nil
+}
+
+// SyncExternal makes the registered external plugins match cfgs: it
+// registers or reconfigures every configured type, then stops and
+// unregisters the external plugins cfgs no longer names. In-process plugins
+// are left alone.
+func SyncExternal(cfgs []config.ProviderPluginConfig) error {
+	var errs []error
+	configured := map[string]bool{}
+	for _, cfg := range cfgs {
+		if err := RegisterExternal(cfg); err != nil {
+			errs = append(errs, fmt.Errorf("provider plugin %q: %w", cfg.Type, err))
+			continue
+		}
+		configured[normalizeType(cfg.Type)] = true
+	}
+
+	var removed []*ExternalPlugin
+	registry.Lock()
+	for key, plugin := range registry.byType {
+		if external, ok := plugin.(*ExternalPlugin); ok && !configured[key] {
+			delete(registry.byType, key)
+			config.RegisterProviderValidator(key, nil)
+			removed = append(removed, external)
+		}
+	}
+	registry.Unlock()
+	for _, external := range removed {
+		external.Close()
+	}
+	return errors.Join(errs...)
+}
+
+// StopExternal stops the processes of every registered external plugin. The
+// processes are shared by every ProviderRegistry, so the binary that
+// registered them stops them on shutdown.
+func StopExternal() {
+	registry.RLock()
+	defer registry.RUnlock()
+	for _, plugin := range registry.byType {
+		if external, ok := plugin.(*ExternalPlugin); ok {
+			external.Close()
+		}
+	}
+}
+
+// ValidateConfig is bounded by the call timeout, which covers starting the
+// process too, so config validation cannot hang on a stuck plugin.
+func (p *ExternalPlugin) ValidateConfig(provider config.ProviderConfig) error {
+	return p.call(context.Background(), MethodValidateConfig, nil, ConfigureParams{Provider: provider}, nil)
+}
+
+func (p *ExternalPlugin) ResolveEndpoint(ctx context.Context, provider config.ProviderConfig, hint map[string]string) (config.ProviderEndpoint, error) {
+	var endpoint config.ProviderEndpoint
+	err := p.call(ctx, MethodResolveEndpoint, &provider, CallParams{Provider: provider.Name, Hint: hint}, &endpoint)
+	return endpoint, err
+}
+
+// PrepareRequest replaces the request's header with the set the plugin
+// returns.
+func (p *ExternalPlugin) PrepareRequest(ctx context.Context, provider config.ProviderConfig, req *http.Request) error {
+	view := &RequestView{Method: req.Method, URL: req.URL.String(), Header: req.Header}
+	var prepared RequestView
+	if err := p.call(ctx, MethodPrepareRequest, &provider, CallParams{Provider: provider.Name, Request: view}, &prepared); err != nil {
+		return err
+	}
+	if prepared.Header == nil {
+		prepared.Header = http.Header{}
+	}
+	req.Header = prepared.Header
+	return nil
+}
+
+// Dial asks the plugin where to connect for plan and opens that connection.
+func (p *ExternalPlugin) Dial(ctx context.Context, provider config.ProviderConfig, endpoint config.ProviderEndpoint, plan DialPlan) (net.Conn, error) {
+	var target DialPlan
+	if err := p.call(ctx, MethodDial, &provider, CallParams{Provider: provider.Name, Endpoint: &endpoint, Plan: &plan}, &target); err != nil {
+		return nil, err
+	}
+	if target.Address == "" {
+		return nil, fmt.Errorf("provider plugin %s planned no dial address", p.pluginType())
+	}
+	if target.Network == "" {
+		target.Network = plan.Network
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, target.Network, target.Address)
+}
+
+func (p *ExternalPlugin) Rotate(ctx context.Context, provider config.ProviderConfig, sessionID string) (RotateResult, error) {
+	var result RotateResult
+	err := p.call(ctx, MethodRotate, &provider, CallParams{Provider: provider.Name, SessionID: sessionID}, &result)
+	return result, err
+}
+
+func (p *ExternalPlugin) FetchStatus(ctx context.Context, provider config.ProviderConfig) (StatusSnapshot, error) {
+	var status StatusSnapshot
+	err := p.call(ctx, MethodFetchStatus, &provider, CallParams{Provider: provider.Name}, &status)
+	return status, err
+}
+
+// Close stops the plugin process and any pending restart. Later calls fail
+// with ErrPluginUnavailable until the type is registered again.
+func (p *ExternalPlugin) Close() {
+	p.mu.Lock()
+	p.closed = true
+	if p.restart != nil {
+		p.restart.Stop()
+	}
+	proc := p.proc
+	p.proc = nil
+	p.mu.Unlock()
+	if proc != nil {
+		proc.stop(pluginStopGrace)
+	}
+}
+
+// call bounds starting the process and the call itself by one call timeout.
+// Calls for provider first configure it in the process when they are the
+// first for that config.
+func (p *ExternalPlugin) call(ctx context.Context, method string, provider *config.ProviderConfig, params, result any) error {
+	callCtx, cancel := context.WithTimeout(ctx, p.callTimeout())
+	defer cancel()
+	proc, err := p.process(callCtx)
+	if err == nil {
+		err = proc.callFor(callCtx, method, provider, params, result)
+	}
+	if err != nil {
+		return fmt.Errorf("provider plugin %s: %s: %w", p.pluginType(), method, err)
+	}
+	return nil
+}
+
+// process returns the running plugin process, starting it unless the
+// plugin is waiting out its restart backoff. The process is spawned and
+// handshaken outside p.mu; concurrent callers wait for that start, bounded by
+// ctx, instead of starting their own.
+func (p *ExternalPlugin) process(ctx context.Context) (*pluginProcess, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, fmt.Errorf("%w: closed", ErrPluginUnavailable)
+		}
+		if p.proc != nil {
+			proc := p.proc
+			p.mu.Unlock()
+			return proc, nil
+		}
+		if starting := p.starting; starting != nil {
+			p.mu.Unlock()
+			select {
+			case <-starting:
+				continue
+			case <-ctx.Done():
+				return nil, fmt.Errorf("%w: waiting for start: %v", ErrPluginUnavailable, ctx.Err())
+			}
+		}
+		if wait := time.Until(p.retryAt); wait > 0 {
+			p.mu.Unlock()
+			return nil, fmt.Errorf("%w: restarting in %s", ErrPluginUnavailable, wait.Round(time.Millisecond))
+		}
+		starting := make(chan struct{})
+		p.starting = starting
+		cfg, generation := p.cfg, p.generation
+		p.mu.Unlock()
+
+		proc, err := p.start(cfg)
+
+		p.mu.Lock()
+		p.starting = nil
+		close(starting)
+		switch {
+		case p.closed || p.generation != generation:
+			// Closed or reconfigured meanwhile: drop this process and
+			// let the loop report the closure or start the new command.
+			p.mu.Unlock()
+			if proc != nil {
+				go proc.stop(pluginStopGrace)
+			}
+			continue
+		case err != nil:
+			p.failedLocked(err)
+			p.mu.Unlock()
+			return nil, err
+		}
+		select {
+		case <-proc.done:
+			// It exited before being published, so exited ignored it.
+			err = fmt.Errorf("%w: %v", ErrPluginUnavailable, proc.exitErr())
+			p.failedLocked(err)
+			p.mu.Unlock()
+			return nil, err
+		default:
+		}
+		p.proc = proc
+		p.mu.Unlock()
+		return proc, nil
+	}
+}
+
+// start spawns the binary cfg describes and completes the handshake.
+func (p *ExternalPlugin) start(cfg config.ProviderPluginConfig) (*pluginProcess, error) {
+	cmd := exec.Command(cfg.Command, cfg.Args...)
+	cmd.Env = os.Environ()
+	for _, key := range slices.Sorted(maps.Keys(cfg.Env)) {
+		cmd.Env = append(cmd.Env, key+"="+cfg.Env[key])
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPluginUnavailable, err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPluginUnavailable, err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPluginUnavailable, err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%w: start %s: %v", ErrPluginUnavailable, cfg.Command, err)
+	}
+
+	proc := &pluginProcess{
+		pluginType: cfg.Type,
+		cmd:        cmd,
+		stdin:      stdin,
+		startedAt:  time.Now(),
+		pending:    map[uint64]chan rpcMessage{},
+		done:       make(chan struct{}),
+
+		unimplemented: map[string]bool{},
+		configured:    map[string]config.ProviderConfig{},
+	}
+	go proc.run(stdout, stderr, func() { p.exited(proc) })
+
+	// The handshake gets its own timeout: a caller giving up must not fail
+	// the start for everyone waiting on it.
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeoutOf(cfg))
+	defer cancel()
+	var hello HandshakeResult
+	err = proc.call(ctx, MethodHandshake, HandshakeParams{ProtocolVersions: []int{ProtocolVersion}}, &hello)
+	if err == nil && hello.ProtocolVersion != ProtocolVersion {
+		err = fmt.Errorf("plugin speaks protocol version %d, want %d", hello.ProtocolVersion, ProtocolVersion)
+	}
+	if err != nil {
+		proc.kill()
+		return nil, fmt.Errorf("%w: handshake: %v", ErrPluginUnavailable, err)
+	}
+	for _, method := range hello.Unimplemented {
+		proc.unimplemented[method] = true
+	}
+	slog.Info("provider plugin started", "type", cfg.Type, "pid", cmd.Process.Pid, "protocol_version", hello.ProtocolVersion)
+	return proc, nil
+}
+
+// exited schedules a restart after proc, the running process, exits.
+func (p *ExternalPlugin) exited(proc *pluginProcess) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.proc != proc {
+		return
+	}
+	p.proc = nil
+	if p.closed {
+		return
+	}
+	if time.Since(proc.startedAt) >= pluginStableAfter {
+		p.failures = 0
+	}
+	p.failedLocked(proc.exitErr())
+}
+
+// failedLocked backs off restarts exponentially with consecutive failures
+// and restarts the process once the backoff elapses.
+func (p *ExternalPlugin) failedLocked(err error) {
+	backoff := time.Duration(p.cfg.RestartBackoffMillis) * time.Millisecond
+	if backoff <= 0 {
+		backoff = defaultPluginRestartBackoff
+	}
+	maxBackoff := time.Duration(p.cfg.MaxRestartBackoffMillis) * time.Millisecond
+	if maxBackoff <= 0 {
+		maxBackoff = defaultPluginMaxRestartBackoff
+	}
+	for range p.failures {
+		if backoff >= maxBackoff {
+			break
+		}
+		backoff *= 2
+	}
+	backoff = min(backoff, maxBackoff)
+	p.failures++
+	p.retryAt = time.Now().Add(backoff)
+	if p.restart != nil {
+		p.restart.Stop()
+	}
+	p.restart = time.AfterFunc(backoff, func() { _, _ = p.process(context.Background()) })
+	slog.Warn("provider plugin unavailable", "type", p.cfg.Type, "error", err, "restart_in", backoff)
+}
+
+func (p *ExternalPlugin) reconfigure(cfg config.ProviderPluginConfig) {
+	p.mu.Lock()
+	restart := cfg.Command != p.cfg.Command || !slices.Equal(cfg.Args, p.cfg.Args) || !maps.Equal(cfg.Env, p.cfg.Env)
+	p.cfg = cfg
+	p.closed = false
+	var proc *pluginProcess
+	if restart {
+		p.generation++
+		proc = p.proc
+		p.proc = nil
+		p.failures = 0
+		p.retryAt = time.Time{}
+		if p.restart != nil {
+			p.restart.Stop()
+		}
+	}
+	p.mu.Unlock()
+	if proc != nil {
+		go proc.stop(pluginStopGrace)
+	}
+}
+
+func (p *ExternalPlugin) pluginType() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cfg.Type
+}
+
+func (p *ExternalPlugin) callTimeout() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return callTimeoutOf(p.cfg)
+}
+
+func callTimeoutOf(cfg config.ProviderPluginConfig) time.Duration {
+	if cfg.CallTimeoutMillis > 0 {
+		return time.Duration(cfg.CallTimeoutMillis) * time.Millisecond
+	}
+	return defaultPluginCallTimeout
+}
+
+// pluginProcess is one run of a plugin binary and its in-flight calls.
+type pluginProcess struct {
+	pluginType string
+	cmd        *exec.Cmd
+	stdin      io.WriteCloser
+	startedAt  time.Time
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan rpcMessage // nil once the process exited
+	err     error
+	done    chan struct{}
+
+	// unimplemented holds the methods the handshake declared unimplemented;
+	// it is not written once the process is published.
+	unimplemented map[string]bool
+	// configured holds the provider configs sent to the process, by name.
+	configured map[string]config.ProviderConfig
+}
+
+// run delivers responses to their calls and logs stderr until the process
+// closes stdout, then reaps it and calls exited.
+func (proc *pluginProcess) run(stdout, stderr io.Reader, exited func()) {
+	var logs sync.WaitGroup
+	logs.Add(1)
+	go func() {
+		defer logs.Done()
+		lines := newLineScanner(stderr)
+		for lines.Scan() {
+			slog.Info("provider plugin output", "type", proc.pluginType, "line", lines.Text())
+		}
+	}()
+
+	responses := newLineScanner(stdout)
+	for responses.Scan() {
+		var msg rpcMessage
+		if err := json.Unmarshal(responses.Bytes(), &msg); err != nil {
+			slog.Warn("provider plugin sent an invalid message", "type", proc.pluginType, "error", err)
+			continue
+		}
+		proc.mu.Lock()
+		reply, ok := proc.pending[msg.ID]
+		delete(proc.pending, msg.ID)
+		proc.mu.Unlock()
+		if ok {
+			reply <- msg
+		}
+	}
+
+	// A plugin that closes stdout cannot answer anymore; make sure it is gone.
+	proc.kill()
+	logs.Wait()
+	err := errors.New("plugin exited")
+	if waitErr := proc.cmd.Wait(); waitErr != nil {
+		err = fmt.Errorf("plugin exited: %v", waitErr)
+	}
+	proc.mu.Lock()
+	proc.pending = nil
+	proc.err = err
+	proc.mu.Unlock()
+	close(proc.done)
+	exited()
+}
+
+// callFor makes a call for provider, or for no provider when it is nil,
+// configuring the provider first when the process has not seen its config.
+// Methods the plugin declared unimplemented fail with ErrUnsupported without
+// a round trip.
+func (proc *pluginProcess) callFor(ctx context.Context, method string, provider *config.ProviderConfig, params, result any) error {
+	if proc.unimplemented[method] {
+		return ErrUnsupported
+	}
+	if provider != nil {
+		if err := proc.configure(ctx, *provider); err != nil {
+			return err
+		}
+	}
+	return proc.call(ctx, method, params, result)
+}
+
+func (proc *pluginProcess) configure(ctx context.Context, provider config.ProviderConfig) error {
+	proc.mu.Lock()
+	sent, ok := proc.configured[provider.Name]
+	proc.mu.Unlock()
+	if ok && reflect.DeepEqual(sent, provider) {
+		return nil
+	}
+	if err := proc.call(ctx, MethodConfigure, ConfigureParams{Provider: provider}, nil); err != nil {
+		return err
+	}
+	proc.mu.Lock()
+	proc.configured[provider.Name] = provider
+	proc.mu.Unlock()
+	return nil
+}
+
+func (proc *pluginProcess) call(ctx context.Context, method string, params, result any) error {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	proc.mu.Lock()
+	if proc.pending == nil {
+		proc.mu.Unlock()
+		return fmt.Errorf("%w: %v", ErrPluginUnavailable, proc.exitErr())
+	}
+	proc.nextID++
+	id := proc.nextID
+	reply := make(chan rpcMessage, 1)
+	proc.pending[id] = reply
+	proc.mu.Unlock()
+
+	line, err := json.Marshal(rpcMessage{JSONRPC: "2.0", ID: id, Method: method, Params: raw})
+	if err == nil {
+		proc.writeMu.Lock()
+		_, err = proc.stdin.Write(append(line, '\n'))
+		proc.writeMu.Unlock()
+	}
+	if err != nil {
+		proc.forget(id)
+		return fmt.Errorf("%w: %v", ErrPluginUnavailable, err)
+	}
+
+	select {
+	case msg := <-reply:
+		if msg.Error != nil {
+			return callError(msg.Error)
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(msg.Result, result)
+	case <-proc.done:
+		return fmt.Errorf("%w: %v", ErrPluginUnavailable, proc.exitErr())
+	case <-ctx.Done():
+		proc.forget(id)
+		return fmt.Errorf("call timed out: %w", ctx.Err())
+	}
+}
+
+func (proc *pluginProcess) forget(id uint64) {
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+	delete(proc.pending, id)
+}
+
+func (proc *pluginProcess) exitErr() error {
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+	if proc.err == nil {
+		return errors.New("plugin exited")
+	}
+	return proc.err
+}
+
+func (proc *pluginProcess) kill() {
+	_ = proc.cmd.Process.Kill()
+}
+
+// stop closes the plugin's stdin, which asks it to exit, and kills it when
+// it has not exited after grace.
+func (proc *pluginProcess) stop(grace time.Duration) {
+	_ = proc.stdin.Close()
+	select {
+	case <-proc.done:
+	case <-time.After(grace):
+		proc.kill()
+		<-proc.done
+	}
+}
@@ -0,0 +1,407 @@
+package providers
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+// helperPluginEnv makes the test binary serve a plugin instead of running
+// tests, so the tests can spawn it as an external plugin.
+const helperPluginEnv = "PROVIDERS_TEST_PLUGIN"
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(helperPluginEnv) {
+	case "":
+		os.Exit(m.Run())
+	case "v2":
+		serveProtocolV2()
+	case "partial":
+		_ = Serve(partialHelperPlugin{}, os.Stdin, os.Stdout)
+	case "slow_start":
+		time.Sleep(300 * time.Millisecond)
+		_ = Serve(helperPlugin{}, os.Stdin, os.Stdout)
+	default:
+		_ = Serve(helperPlugin{}, os.Stdin, os.Stdout)
+	}
+	os.Exit(0)
+}
+
+// helperPlugin reports its pid as status and acts on the session IDs passed
+// to Rotate: slow stalls the call and crash exits the process.
+type helperPlugin struct{}
+
+func (helperPlugin) ValidateConfig(provider config.ProviderConfig) error {
+	errs := &config.ValidationErrors{}
+	if provider.Auth.Type == "basic" {
+		errs.Add("auth.type", "must be none for the helper plugin")
+	}
+	return errs.OrNil()
+}
+
+func (helperPlugin) ResolveEndpoint(context.Context, config.ProviderConfig, map[string]string) (config.ProviderEndpoint, error) {
+	return config.ProviderEndpoint{}, ErrUnsupported
+}
+
+func (helperPlugin) PrepareRequest(_ context.Context, provider config.ProviderConfig, req *http.Request) error {
+	req.Header.Del("X-Drop")
+	req.Header.Set("X-Helper-Provider", provider.Name)
+	req.Header.Set("X-Helper-Auth", provider.Auth.Type)
+	return nil
+}
+
+func (helperPlugin) PlanDial(_ context.Context, _ config.ProviderConfig, _ config.ProviderEndpoint, plan DialPlan) (DialPlan, error) {
+	return plan, nil
+}
+
+func (helperPlugin) Rotate(_ context.Context, _ config.ProviderConfig, sessionID string) (RotateResult, error) {
+	switch sessionID {
+	case "slow":
+		time.Sleep(500 * time.Millisecond)
+	case "crash":
+		os.Exit(3)
+	}
+	return RotateResult{SessionID: sessionID + "-next"}, nil
+}
+
+func (helperPlugin) FetchStatus(context.Context, config.ProviderConfig) (StatusSnapshot, error) {
+	return StatusSnapshot{State: "healthy", Reason: strconv.Itoa(os.Getpid())}, nil
+}
+
+// partialHelperPlugin is helperPlugin without prepare_request.
+type partialHelperPlugin struct{ helperPlugin }
+
+func (partialHelperPlugin) UnimplementedMethods() []string {
+	return []string{MethodPrepareRequest}
+}
+
+// serveProtocolV2 answers the handshake with a version this build does not
+// speak.
+func serveProtocolV2() {
+	lines := bufio.NewScanner(os.Stdin)
+	for lines.Scan() {
+		fmt.Println(`{"jsonrpc":"2.0","id":1,"result":{"protocol_version":2}}`)
+	}
+}
+
+func helperPluginConfig(mode string) config.ProviderPluginConfig {
+	return config.ProviderPluginConfig{
+		Type:                 "helper_" + mode,
+		Command:              os.Args[0],
+		Env:                  map[string]string{helperPluginEnv: mode},
+		CallTimeoutMillis:    1000,
+		RestartBackoffMillis: 200,
+	}
+}
+
+func TestExternalPlugin_HandshakeAndCalls(t *testing.T) {
+	t.Parallel()
+	plugin := NewExternalPlugin(helperPluginConfig("calls"))
+	defer plugin.Close()
+	provider := config.ProviderConfig{Name: "vendor", Auth: config.ProviderAuthConfig{Type: "basic"}}
+	ctx := context.Background()
+
+	var fieldErrs *config.ValidationErrors
+	if err := plugin.ValidateConfig(provider); !errors.As(err, &fieldErrs) || fieldErrs.Errors[0].Field != "auth.type" {
+		t.Fatalf("expected the plugin's field error, got %v", err)
+	}
+	if _, err := plugin.ResolveEndpoint(ctx, provider, nil); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected an unsupported resolve, got %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	req.Header.Set("X-Drop", "1")
+	req.Header.Set("X-Keep", "1")
+	if err := plugin.PrepareRequest(ctx, provider, req); err != nil {
+		t.Fatalf("prepare request: %v", err)
+	}
+	if req.Header.Get("X-Drop") != "" || req.Header.Get("X-Keep") != "1" || req.Header.Get("X-Helper-Provider") != "vendor" {
+		t.Fatalf("expected the plugin's header set, got %v", req.Header)
+	}
+
+	rotated, err := plugin.Rotate(ctx, provider, "s1")
+	if err != nil || rotated.SessionID != "s1-next" {
+		t.Fatalf("expected session s1-next, got %+v, %v", rotated, err)
+	}
+	status, err := plugin.FetchStatus(ctx, provider)
+	if err != nil || status.State != "healthy" {
+		t.Fatalf("expected a healthy status, got %+v, %v", status, err)
+	}
+}
+
+func TestExternalPlugin_ConfiguresProvidersOnce(t *testing.T) {
+	t.Parallel()
+	plugin := NewExternalPlugin(helperPluginConfig("configure"))
+	defer plugin.Close()
+	provider := config.ProviderConfig{Name: "vendor", Auth: config.ProviderAuthConfig{Type: "none"}}
+	ctx := context.Background()
+	prepare := func() string {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		if err := plugin.PrepareRequest(ctx, provider, req); err != nil {
+			t.Fatalf("prepare request: %v", err)
+		}
+		return req.Header.Get("X-Helper-Auth")
+	}
+
+	if got := prepare(); got != "none" {
+		t.Fatalf("expected the configured provider, got auth %q", got)
+	}
+	plugin.mu.Lock()
+	proc := plugin.proc
+	plugin.mu.Unlock()
+	proc.mu.Lock()
+	before := proc.nextID
+	proc.mu.Unlock()
+	prepare()
+	proc.mu.Lock()
+	calls := proc.nextID - before
+	proc.mu.Unlock()
+	if calls != 1 {
+		t.Fatalf("expected an unchanged provider to be called without configuring it again, got %d calls", calls)
+	}
+
+	provider.Auth.Type = "bearer"
+	if got := prepare(); got != "bearer" {
+		t.Fatalf("expected a changed config to be sent again, got auth %q", got)
+	}
+}
+
+func TestExternalPlugin_SkipsUnimplementedMethods(t *testing.T) {
+	t.Parallel()
+	plugin := NewExternalPlugin(helperPluginConfig("partial"))
+	defer plugin.Close()
+	provider := config.ProviderConfig{Name: "vendor"}
+	ctx := context.Background()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err := plugin.PrepareRequest(ctx, provider, req); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected an unimplemented prepare_request to be unsupported, got %v", err)
+	}
+	if req.Header.Get("X-Helper-Provider") != "" {
+		t.Fatalf("expected the request to be left alone, got %v", req.Header)
+	}
+	if status, err := plugin.FetchStatus(ctx, provider); err != nil || status.State != "healthy" {
+		t.Fatalf("expected implemented methods to be served, got %+v, %v", status, err)
+	}
+}
+
+func TestExternalPlugin_CallTimeout(t *testing.T) {
+	t.Parallel()
+	cfg := helperPluginConfig("timeout")
+	cfg.CallTimeoutMillis = 100
+	plugin := NewExternalPlugin(cfg)
+	defer plugin.Close()
+	ctx := context.Background()
+
+	before, err := plugin.FetchStatus(ctx, config.ProviderConfig{})
+	if err != nil {
+		t.Fatalf("fetch status: %v", err)
+	}
+	if _, err := plugin.Rotate(ctx, config.ProviderConfig{}, "slow"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the slow call to time out, got %v", err)
+	}
+	after, err := plugin.FetchStatus(ctx, config.ProviderConfig{})
+	if err != nil || after.Reason != before.Reason {
+		t.Fatalf("expected the same process to keep serving, got %+v, %v (was %+v)", after, err, before)
+	}
+}
+
+func TestExternalPlugin_RejectsProtocolVersion(t *testing.T) {
+	t.Parallel()
+	plugin := NewExternalPlugin(helperPluginConfig("v2"))
+	defer plugin.Close()
+
+	_, err := plugin.FetchStatus(context.Background(), config.ProviderConfig{})
+	if !errors.Is(err, ErrPluginUnavailable) || !strings.Contains(err.Error(), "protocol version 2") {
+		t.Fatalf("expected the handshake to reject version 2, got %v", err)
+	}
+}
+
+func TestExternalPlugin_StartsOutsideTheLock(t *testing.T) {
+	t.Parallel()
+	plugin := NewExternalPlugin(helperPluginConfig("slow_start"))
+	defer plugin.Close()
+	ctx := context.Background()
+
+	first := make(chan error, 1)
+	go func() {
+		_, err := plugin.FetchStatus(ctx, config.ProviderConfig{})
+		first <- err
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		plugin.mu.Lock()
+		starting := plugin.starting != nil
+		plugin.mu.Unlock()
+		if starting {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the plugin to start")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := plugin.Rotate(waitCtx, config.ProviderConfig{}, "s1"); !errors.Is(err, ErrPluginUnavailable) || !strings.Contains(err.Error(), "waiting for start") {
+		t.Fatalf("expected a caller to give up waiting for the start, got %v", err)
+	}
+	if err := <-first; err != nil {
+		t.Fatalf("expected the first call to be served once started, got %v", err)
+	}
+	if _, err := plugin.Rotate(ctx, config.ProviderConfig{}, "s1"); err != nil {
+		t.Fatalf("expected the started process to serve later calls, got %v", err)
+	}
+}
+
+func TestExternalPlugin_RestartsAfterCrashWithBackoff(t *testing.T) {
+	t.Parallel()
+	plugin := NewExternalPlugin(helperPluginConfig("crash"))
+	defer plugin.Close()
+	ctx := context.Background()
+	pid := func() (string, error) {
+		status, err := plugin.FetchStatus(ctx, config.ProviderConfig{})
+		return status.Reason, err
+	}
+	waitForRestart := func() string {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if current, err := pid(); err == nil {
+				return current
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatalf("expected the plugin to restart")
+		return ""
+	}
+
+	first, err := pid()
+	if err != nil {
+		t.Fatalf("fetch status: %v", err)
+	}
+	if _, err := plugin.Rotate(ctx, config.ProviderConfig{}, "crash"); !errors.Is(err, ErrPluginUnavailable) {
+		t.Fatalf("expected the crash to fail the call, got %v", err)
+	}
+	if _, err := pid(); !errors.Is(err, ErrPluginUnavailable) || !strings.Contains(err.Error(), "restarting in") {
+		t.Fatalf("expected calls to fail fast during the backoff, got %v", err)
+	}
+	second := waitForRestart()
+	if second == first {
+		t.Fatalf("expected a new plugin process, got pid %s again", second)
+	}
+
+	_, _ = plugin.Rotate(ctx, config.ProviderConfig{}, "crash")
+	var failures int
+	var wait time.Duration
+	for range 100 {
+		plugin.mu.Lock()
+		failures, wait = plugin.failures, time.Until(plugin.retryAt)
+		plugin.mu.Unlock()
+		if failures == 2 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if failures != 2 || wait <= 200*time.Millisecond {
+		t.Fatalf("expected the second crash to double the backoff, got %d failures and %s left", failures, wait)
+	}
+	if third := waitForRestart(); third == second {
+		t.Fatalf("expected a new plugin process, got pid %s again", third)
+	}
+}
+
+func TestRegisterExternal(t *testing.T) {
+	if err := RegisterExternal(config.ProviderPluginConfig{Type: "registry_test", Command: os.Args[0]}); err == nil {
+		t.Fatalf("expected an in-process type not to be replaced")
+	}
+
+	cfg := helperPluginConfig("registered")
+	if err := RegisterExternal(cfg); err != nil {
+		t.Fatalf("register external plugin: %v", err)
+	}
+	plugin, ok := Lookup("helper_registered")
+	if !ok {
+		t.Fatalf("expected the external plugin to be registered")
+	}
+	cfg.CallTimeoutMillis = 50
+	if err := RegisterExternal(cfg); err != nil {
+		t.Fatalf("re-register external plugin: %v", err)
+	}
+	if again, _ := Lookup("helper_registered"); again != plugin || plugin.(*ExternalPlugin).callTimeout() != 50*time.Millisecond {
+		t.Fatalf("expected registering again to reconfigure the plugin")
+	}
+
+	providerCfg := &config.Config{
+		SchemaVersion: "1",
+		Providers: []config.ProviderConfig{{
+			Name:      "vendor",
+			Type:      "helper_registered",
+			Auth:      config.ProviderAuthConfig{Type: "basic", Username: "u", Password: "p"},
+			Endpoints: []config.ProviderEndpoint{{URL: "http://vendor.local:3128"}},
+		}},
+	}
+	cfg.CallTimeoutMillis = 1000
+	_ = RegisterExternal(cfg)
+	err := providerCfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "providers[0].auth.type: must be none for the helper plugin") {
+		t.Fatalf("expected the external plugin's field error, got %v", err)
+	}
+	StopExternal()
+	if _, err := plugin.FetchStatus(context.Background(), config.ProviderConfig{}); !errors.Is(err, ErrPluginUnavailable) {
+		t.Fatalf("expected a stopped plugin to be unavailable, got %v", err)
+	}
+}
+
+func TestSyncExternal(t *testing.T) {
+	kept, dropped := helperPluginConfig("kept"), helperPluginConfig("dropped")
+	if err := SyncExternal([]config.ProviderPluginConfig{kept, dropped}); err != nil {
+		t.Fatalf("sync external plugins: %v", err)
+	}
+	defer StopExternal()
+	droppedPlugin, ok := Lookup("helper_dropped")
+	if !ok {
+		t.Fatalf("expected the configured plugin to be registered")
+	}
+	if _, err := droppedPlugin.FetchStatus(context.Background(), config.ProviderConfig{}); err != nil {
+		t.Fatalf("fetch status: %v", err)
+	}
+
+	if err := SyncExternal([]config.ProviderPluginConfig{kept}); err != nil {
+		t.Fatalf("sync external plugins: %v", err)
+	}
+	if _, ok := Lookup("helper_kept"); !ok {
+		t.Fatalf("expected the still configured plugin to stay registered")
+	}
+	if _, ok := Lookup("helper_dropped"); ok {
+		t.Fatalf("expected the removed plugin to be unregistered")
+	}
+	if _, ok := Lookup("registry_test"); !ok {
+		t.Fatalf("expected in-process plugins to stay registered")
+	}
+	if _, err := droppedPlugin.FetchStatus(context.Background(), config.ProviderConfig{}); !errors.Is(err, ErrPluginUnavailable) {
+		t.Fatalf("expected the removed plugin to be stopped, got %v", err)
+	}
+	providerCfg := config.ProviderConfig{
+		Name:      "vendor",
+		Type:      "helper_dropped",
+		Auth:      config.ProviderAuthConfig{Type: "basic", Username: "u", Password: "p"},
+		Endpoints: []config.ProviderEndpoint{{URL: "http://vendor.local:3128"}},
+	}
+	if errs := providerCfg.Validate("providers[0]"); errs.OrNil() != nil {
+		t.Fatalf("expected the removed plugin's validator to be gone, got %v", errs)
+	}
+
+	if err := SyncExternal([]config.ProviderPluginConfig{{Type: "registry_test", Command: os.Args[0]}}); err == nil {
+		t.Fatalf("expected syncing over an in-process type to fail")
+	}
+}
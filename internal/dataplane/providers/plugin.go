@@ -2,29 +2,52 @@ package providers
 
 import (
 	"context"
+	"errors"
 	"net"
 	"net/http"
 
 	"github.com/pzaino/microproxy/pkg/config"
 )
 
+// ErrUnsupported is returned by plugin methods a provider type does not
+// implement, such as Rotate for a provider without sessions.
+var ErrUnsupported = errors.New("not supported by provider plugin")
+
+// DialPlan is the connection a request needs through the provider: the
+// CONNECT or origin address, and its network.
 type DialPlan struct {
-	Network string
-	Address string
+	Network string `json:"network"`
+	Address string `json:"address"`
 }
 
-type RotateResult struct{ SessionID string }
+type RotateResult struct {
+	SessionID string `json:"session_id"`
+}
 
+// StatusSnapshot is a provider's own view of its health. State is healthy,
+// degraded or unhealthy; other states leave endpoint health unchanged.
 type StatusSnapshot struct {
-	State  string
-	Reason string
+	State  string `json:"state"`
+	Reason string `json:"reason,omitempty"`
 }
 
+// Plugin implements a provider type. The data plane calls it for every
+// provider whose type it is registered under:
+//
+//   - ValidateConfig runs during config validation.
+//   - ResolveEndpoint picks the configured endpoint to try first; hint holds
+//     the request's country, city, session and session_ttl hints.
+//   - PrepareRequest adjusts a forward request before it is sent upstream;
+//     ErrUnsupported sends it as it is.
+//   - Dial opens the connection plan names through endpoint, for CONNECT
+//     tunnels and forward requests alike.
+//   - Rotate moves the provider, or sessionID when set, to a new identity.
+//   - FetchStatus is polled to feed endpoint health.
 type Plugin interface {
 	ValidateConfig(provider config.ProviderConfig) error
 	ResolveEndpoint(ctx context.Context, provider config.ProviderConfig, hint map[string]string) (config.ProviderEndpoint, error)
 	PrepareRequest(ctx context.Context, provider config.ProviderConfig, req *http.Request) error
-	Dial(ctx context.Context, provider config.ProviderConfig, endpoint config.ProviderEndpoint) (net.Conn, error)
+	Dial(ctx context.Context, provider config.ProviderConfig, endpoint config.ProviderEndpoint, plan DialPlan) (net.Conn, error)
 	Rotate(ctx context.Context, provider config.ProviderConfig, sessionID string) (RotateResult, error)
 	FetchStatus(ctx context.Context, provider config.ProviderConfig) (StatusSnapshot, error)
 }
@@ -0,0 +1,320 @@
+package providers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+// The stdio plugin protocol connects the data plane to an external plugin
+// binary. The data plane writes JSON-RPC 2.0 requests to the plugin's stdin
+// and reads responses from its stdout, one JSON object per line; the
+// plugin's stderr is logged. Calls may be answered in any order.
+//
+// The first call is always handshake, whose params offer the protocol
+// versions the data plane speaks. The plugin answers with the version it
+// picked or, when it speaks none of them, a CodeVersionMismatch error, and
+// lists the methods it does not implement so the data plane skips them.
+//
+// Provider configs, credentials included, cross the pipe only in configure
+// and validate_config calls, which take ConfigureParams. The data plane
+// configures a provider before its first call and again whenever its config
+// changes; the other calls take CallParams naming the provider and return
+// the JSON form of the matching Plugin result. A plugin exits when its stdin
+// closes.
+
+// ProtocolVersion is the stdio plugin protocol version this build speaks.
+const ProtocolVersion = 1
+
+// Methods of the stdio plugin protocol.
+const (
+	MethodHandshake       = "handshake"
+	MethodConfigure       = "configure"        // result: {}
+	MethodValidateConfig  = "validate_config"  // result: {}
+	MethodResolveEndpoint = "resolve_endpoint" // result: config.ProviderEndpoint
+	MethodPrepareRequest  = "prepare_request"  // result: RequestView
+	MethodDial            = "dial"             // result: DialPlan
+	MethodRotate          = "rotate"           // result: RotateResult
+	MethodFetchStatus     = "fetch_status"     // result: StatusSnapshot
+)
+
+// Error codes of the stdio plugin protocol, next to JSON-RPC's own.
+const (
+	CodeParseError      = -32700
+	CodeMethodNotFound  = -32601 // treated as CodeUnsupported
+	CodeInvalidParams   = -32602
+	CodeFailed          = -32000
+	CodeUnsupported     = -32001 // the call returns ErrUnsupported
+	CodeInvalidConfig   = -32002 // data holds a list of config.FieldValidationError
+	CodeVersionMismatch = -32003
+	CodeUnknownProvider = -32004 // the named provider was never configured
+)
+
+// maxPluginMessageBytes bounds one protocol line.
+const maxPluginMessageBytes = 4 << 20
+
+// rpcMessage is a JSON-RPC 2.0 request or response.
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      uint64          `json:"id"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+// RPCError is the error object of a failed call.
+type RPCError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// callError maps the error of a failed call back onto the Plugin contract.
+func callError(e *RPCError) error {
+	switch e.Code {
+	case CodeUnsupported, CodeMethodNotFound:
+		return ErrUnsupported
+	case CodeInvalidConfig:
+		var fields []config.FieldValidationError
+		if err := json.Unmarshal(e.Data, &fields); err != nil || len(fields) == 0 {
+			return errors.New(e.Message)
+		}
+		errs := &config.ValidationErrors{}
+		for _, field := range fields {
+			errs.Add(field.Field, field.Message)
+		}
+		return errs
+	}
+	return e
+}
+
+type HandshakeParams struct {
+	ProtocolVersions []int `json:"protocol_versions"`
+}
+
+type HandshakeResult struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	Unimplemented   []string `json:"unimplemented,omitempty"`
+}
+
+// ConfigureParams are the params of configure and validate_config.
+type ConfigureParams struct {
+	Provider config.ProviderConfig `json:"provider"`
+}
+
+// CallParams are the params of the calls naming a configured provider. Each
+// method reads the fields it needs: hint for resolve_endpoint, request for
+// prepare_request, endpoint and plan for dial, and session_id for rotate.
+type CallParams struct {
+	Provider  string                   `json:"provider"`
+	Hint      map[string]string        `json:"hint,omitempty"`
+	Request   *RequestView             `json:"request,omitempty"`
+	Endpoint  *config.ProviderEndpoint `json:"endpoint,omitempty"`
+	Plan      *DialPlan                `json:"plan,omitempty"`
+	SessionID string                   `json:"session_id,omitempty"`
+}
+
+// RequestView is the forward request prepare_request adjusts. The plugin
+// answers with the full header set to send upstream; method and URL are
+// informational.
+type RequestView struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+}
+
+// RemotePlugin is a Plugin served out of process by Serve. Connections cannot
+// cross the pipe, so in place of Dial it plans the connection the data plane
+// opens for plan through endpoint: a vendor gateway address, or plan itself
+// for a plugin that egresses directly.
+type RemotePlugin interface {
+	ValidateConfig(provider config.ProviderConfig) error
+	ResolveEndpoint(ctx context.Context, provider config.ProviderConfig, hint map[string]string) (config.ProviderEndpoint, error)
+	PrepareRequest(ctx context.Context, provider config.ProviderConfig, req *http.Request) error
+	PlanDial(ctx context.Context, provider config.ProviderConfig, endpoint config.ProviderEndpoint, plan DialPlan) (DialPlan, error)
+	Rotate(ctx context.Context, provider config.ProviderConfig, sessionID string) (RotateResult, error)
+	FetchStatus(ctx context.Context, provider config.ProviderConfig) (StatusSnapshot, error)
+}
+
+// PartialPlugin is a RemotePlugin that does not implement some methods, such
+// as MethodPrepareRequest for a plugin that leaves forward requests alone.
+// Serve reports them in the handshake and the data plane does not call them,
+// saving a round trip per request.
+type PartialPlugin interface {
+	RemotePlugin
+	UnimplementedMethods() []string
+}
+
+// Serve answers the stdio plugin protocol for plugin, reading requests from
+// in and writing responses to out until in is closed. Calls are served
+// concurrently, except configure, which is applied before later calls are
+// read. Plugin binaries call it with os.Stdin and os.Stdout.
+func Serve(plugin RemotePlugin, in io.Reader, out io.Writer) error {
+	var (
+		writeMu sync.Mutex
+		calls   sync.WaitGroup
+	)
+	srv := &server{plugin: plugin, providers: map[string]config.ProviderConfig{}}
+	encoder := json.NewEncoder(out)
+	respond := func(msg rpcMessage) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		_ = encoder.Encode(msg)
+	}
+
+	scanner := newLineScanner(in)
+	for scanner.Scan() {
+		var req rpcMessage
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			respond(rpcMessage{JSONRPC: "2.0", Error: &RPCError{Code: CodeParseError, Message: "invalid JSON-RPC message"}})
+			continue
+		}
+		if req.Method == MethodConfigure {
+			result, err := srv.serveCall(context.Background(), req)
+			respond(callResponse(req.ID, result, err))
+			continue
+		}
+		calls.Add(1)
+		go func() {
+			defer calls.Done()
+			result, err := srv.serveCall(context.Background(), req)
+			respond(callResponse(req.ID, result, err))
+		}()
+	}
+	calls.Wait()
+	return scanner.Err()
+}
+
+// server is the plugin side of one Serve: the plugin and the provider
+// configs the data plane sent it.
+type server struct {
+	plugin RemotePlugin
+
+	mu        sync.RWMutex
+	providers map[string]config.ProviderConfig
+}
+
+func (s *server) provider(name string) (config.ProviderConfig, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	provider, ok := s.providers[name]
+	if !ok {
+		return config.ProviderConfig{}, &RPCError{Code: CodeUnknownProvider, Message: "unknown provider: " + name}
+	}
+	return provider, nil
+}
+
+func (s *server) serveCall(ctx context.Context, req rpcMessage) (any, error) {
+	switch req.Method {
+	case MethodHandshake:
+		var params HandshakeParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, &RPCError{Code: CodeInvalidParams, Message: "invalid params: " + err.Error()}
+		}
+		if !slices.Contains(params.ProtocolVersions, ProtocolVersion) {
+			return nil, &RPCError{Code: CodeVersionMismatch, Message: fmt.Sprintf("protocol version %d not offered", ProtocolVersion)}
+		}
+		hello := HandshakeResult{ProtocolVersion: ProtocolVersion}
+		if partial, ok := s.plugin.(PartialPlugin); ok {
+			hello.Unimplemented = partial.UnimplementedMethods()
+		}
+		return hello, nil
+	case MethodConfigure, MethodValidateConfig:
+		var params ConfigureParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, &RPCError{Code: CodeInvalidParams, Message: "invalid params: " + err.Error()}
+		}
+		if req.Method == MethodValidateConfig {
+			return struct{}{}, s.plugin.ValidateConfig(params.Provider)
+		}
+		s.mu.Lock()
+		s.providers[params.Provider.Name] = params.Provider
+		s.mu.Unlock()
+		return struct{}{}, nil
+	}
+
+	var params CallParams
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		return nil, &RPCError{Code: CodeInvalidParams, Message: "invalid params: " + err.Error()}
+	}
+	provider, err := s.provider(params.Provider)
+	if err != nil {
+		return nil, err
+	}
+	plugin := s.plugin
+	switch req.Method {
+	case MethodResolveEndpoint:
+		return plugin.ResolveEndpoint(ctx, provider, params.Hint)
+	case MethodPrepareRequest:
+		if params.Request == nil {
+			return nil, &RPCError{Code: CodeInvalidParams, Message: "request is required"}
+		}
+		httpReq, err := http.NewRequestWithContext(ctx, params.Request.Method, params.Request.URL, nil)
+		if err != nil {
+			return nil, &RPCError{Code: CodeInvalidParams, Message: "invalid request: " + err.Error()}
+		}
+		if params.Request.Header != nil {
+			httpReq.Header = params.Request.Header
+		}
+		if err := plugin.PrepareRequest(ctx, provider, httpReq); err != nil {
+			return nil, err
+		}
+		return RequestView{Method: httpReq.Method, URL: httpReq.URL.String(), Header: httpReq.Header}, nil
+	case MethodDial:
+		if params.Endpoint == nil || params.Plan == nil {
+			return nil, &RPCError{Code: CodeInvalidParams, Message: "endpoint and plan are required"}
+		}
+		return plugin.PlanDial(ctx, provider, *params.Endpoint, *params.Plan)
+	case MethodRotate:
+		return plugin.Rotate(ctx, provider, params.SessionID)
+	case MethodFetchStatus:
+		return plugin.FetchStatus(ctx, provider)
+	}
+	return nil, &RPCError{Code: CodeMethodNotFound, Message: "method not found: " + req.Method}
+}
+
+func callResponse(id uint64, result any, err error) rpcMessage {
+	msg := rpcMessage{JSONRPC: "2.0", ID: id}
+	if err == nil {
+		raw, marshalErr := json.Marshal(result)
+		if marshalErr == nil {
+			msg.Result = raw
+			return msg
+		}
+		err = marshalErr
+	}
+
+	var rpcErr *RPCError
+	var fieldErrs *config.ValidationErrors
+	switch {
+	case errors.As(err, &rpcErr):
+		msg.Error = rpcErr
+	case errors.Is(err, ErrUnsupported):
+		msg.Error = &RPCError{Code: CodeUnsupported, Message: err.Error()}
+	case errors.As(err, &fieldErrs):
+		data, _ := json.Marshal(fieldErrs.Errors)
+		msg.Error = &RPCError{Code: CodeInvalidConfig, Message: err.Error(), Data: data}
+	default:
+		msg.Error = &RPCError{Code: CodeFailed, Message: err.Error()}
+	}
+	return msg
+}
+
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxPluginMessageBytes)
+	return scanner
+}
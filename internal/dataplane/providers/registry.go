@@ -0,0 +1,56 @@
+package providers
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+var registry = struct {
+	sync.RWMutex
+	byType map[string]Plugin
+}{byType: map[string]Plugin{}}
+
+// Register makes plugin the implementation of providerType and validates
+// providers of that type with its ValidateConfig. The data plane registers
+// its built-in types here too. Register panics when providerType is empty or
+// already taken, like other init-time registries.
+func Register(providerType string, plugin Plugin) {
+	key := normalizeType(providerType)
+	if key == "" || plugin == nil {
+		panic("providers: Register needs a provider type and a plugin")
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if _, exists := registry.byType[key]; exists {
+		panic("providers: Register called twice for type " + key)
+	}
+	registry.byType[key] = plugin
+	config.RegisterProviderValidator(key, plugin.ValidateConfig)
+}
+
+// Lookup returns the plugin registered for providerType.
+func Lookup(providerType string) (Plugin, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	plugin, ok := registry.byType[normalizeType(providerType)]
+	return plugin, ok
+}
+
+// Types returns the registered provider types in order.
+func Types() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	types := make([]string, 0, len(registry.byType))
+	for key := range registry.byType {
+		types = append(types, key)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func normalizeType(providerType string) string {
+	return strings.ToLower(strings.TrimSpace(providerType))
+}
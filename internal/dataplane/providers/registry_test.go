@@ -0,0 +1,78 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+type nopPlugin struct{ err error }
+
+func (p nopPlugin) ValidateConfig(config.ProviderConfig) error { return p.err }
+func (nopPlugin) ResolveEndpoint(context.Context, config.ProviderConfig, map[string]string) (config.ProviderEndpoint, error) {
+	return config.ProviderEndpoint{}, ErrUnsupported
+}
+func (nopPlugin) PrepareRequest(context.Context, config.ProviderConfig, *http.Request) error {
+	return nil
+}
+func (nopPlugin) Dial(context.Context, config.ProviderConfig, config.ProviderEndpoint, DialPlan) (net.Conn, error) {
+	return nil, ErrUnsupported
+}
+func (nopPlugin) Rotate(context.Context, config.ProviderConfig, string) (RotateResult, error) {
+	return RotateResult{}, ErrUnsupported
+}
+func (nopPlugin) FetchStatus(context.Context, config.ProviderConfig) (StatusSnapshot, error) {
+	return StatusSnapshot{}, ErrUnsupported
+}
+
+func init() {
+	Register("Registry_Test", nopPlugin{})
+	Register("registry_validate_test", nopPlugin{err: errors.New("needs a region")})
+}
+
+func TestRegister_LookupAndDuplicates(t *testing.T) {
+	if _, ok := Lookup(" registry_test "); !ok {
+		t.Fatalf("expected lookup to ignore case and spaces")
+	}
+	if _, ok := Lookup("registry_missing"); ok {
+		t.Fatalf("expected no plugin for an unregistered type")
+	}
+	found := false
+	for _, providerType := range Types() {
+		found = found || providerType == "registry_test"
+	}
+	if !found {
+		t.Fatalf("expected registry_test in %v", Types())
+	}
+
+	for _, providerType := range []string{"registry_test", " "} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected Register(%q) to panic", providerType)
+				}
+			}()
+			Register(providerType, nopPlugin{})
+		}()
+	}
+}
+
+func TestRegister_ValidatesProviderConfig(t *testing.T) {
+	cfg := &config.Config{
+		SchemaVersion: "1",
+		Providers: []config.ProviderConfig{{
+			Name:      "vendor",
+			Type:      "registry_validate_test",
+			Endpoints: []config.ProviderEndpoint{{URL: "http://vendor.local:3128"}},
+		}},
+	}
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "providers[0]: needs a region") {
+		t.Fatalf("expected the plugin's validation error, got %v", err)
+	}
+}
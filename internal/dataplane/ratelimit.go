@@ -0,0 +1,167 @@
+package dataplane
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/internal/observability"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+const (
+	rateLimitKeyListener = "listener"
+	rateLimitKeyClientIP = "client_ip"
+	rateLimitKeyTenant   = "tenant"
+
+	rateLimitSweepInterval = time.Minute
+)
+
+// rateLimiter is a token bucket limiter for a single listener, optionally
+// partitioned by client IP or tenant.
+type rateLimiter struct {
+	listener string
+	keyMode  string
+	rate     float64
+	burst    float64
+	now      func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns nil when the listener has no rate limit configured.
+func newRateLimiter(cfg config.ListenerConfig) *rateLimiter {
+	if cfg.RateLimit <= 0 {
+		return nil
+	}
+	burst := cfg.RateLimitBurst
+	if burst <= 0 {
+		burst = cfg.RateLimit
+	}
+	keyMode := strings.ToLower(strings.TrimSpace(cfg.RateLimitKey))
+	if keyMode == "" {
+		keyMode = rateLimitKeyListener
+	}
+	return newBucketLimiter(cfg.Name, keyMode, float64(cfg.RateLimit), float64(burst))
+}
+
+// listenerRateLimiters splits a listener's rate limit around authentication.
+// The first limiter runs before credentials are checked, so a flood of bad
+// logins spends a client's budget too. A tenant-keyed limit needs the
+// authenticated tenant: it is returned second, to run after authentication,
+// with a per-client-IP limit of the same rate in front of it.
+func listenerRateLimiters(cfg config.ListenerConfig) (beforeAuth, afterAuth *rateLimiter) {
+	limiter := newRateLimiter(cfg)
+	if limiter == nil || limiter.keyMode != rateLimitKeyTenant {
+		return limiter, nil
+	}
+	return newBucketLimiter(cfg.Name, rateLimitKeyClientIP, limiter.rate, limiter.burst), limiter
+}
+
+// newBucketLimiter builds a limiter refilling rate tokens per second up to burst.
+func newBucketLimiter(name, keyMode string, rate, burst float64) *rateLimiter {
+	return &rateLimiter{
+		listener: name,
+		keyMode:  keyMode,
+		rate:     rate,
+		burst:    burst,
+		now:      time.Now,
+		buckets:  map[string]*tokenBucket{},
+	}
+}
+
+// allow consumes one token for key. When the bucket is empty it reports how
+// long the caller should wait before a token becomes available.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	} else if elapsed := now.Sub(bucket.last).Seconds(); elapsed > 0 {
+		bucket.tokens = math.Min(l.burst, bucket.tokens+elapsed*l.rate)
+		bucket.last = now
+	}
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep drops buckets that have been idle long enough to be full again.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.last) > refill {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// keyFor derives the bucket key for a connection or request.
+func (l *rateLimiter) keyFor(remoteAddr, tenant string) string {
+	switch l.keyMode {
+	case rateLimitKeyClientIP:
+		return listeners.ClientIPFromAddr(remoteAddr)
+	case rateLimitKeyTenant:
+		return tenant
+	default:
+		return ""
+	}
+}
+
+// rateLimitMiddleware rejects requests over the listener budget with a 429 JSON error.
+func rateLimitMiddleware(limiter *rateLimiter, protocol string, next http.Handler) http.Handler {
+	if limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		metadata, _ := listeners.MetadataFromContext(req.Context())
+		allowed, retryAfter := limiter.allow(limiter.keyFor(req.RemoteAddr, metadata.TenantID))
+		if allowed {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		observability.RecordRateLimitRejection(limiter.listener, protocol)
+		listeners.UpdateMetadata(req.Context(), func(metadata *listeners.RequestMetadata) {
+			metadata.PolicyAction = "deny"
+			metadata.PolicyReason = "rate_limited"
+			metadata.PolicyCategory = "quota"
+		})
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		rw.WriteHeader(http.StatusTooManyRequests)
+		_ = json.NewEncoder(rw).Encode(map[string]any{
+			"error": map[string]string{
+				"code":     "rate_limited",
+				"message":  "listener rate limit exceeded",
+				"category": "quota",
+			},
+		})
+	})
+}
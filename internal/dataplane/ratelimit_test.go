@@ -0,0 +1,214 @@
+package dataplane
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+func TestRateLimiter_TokenBucketRefill(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+	limiter := newRateLimiter(config.ListenerConfig{Name: "http", RateLimit: 2, RateLimitBurst: 3})
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := limiter.allow(""); !allowed {
+			t.Fatalf("expected request %d within burst to be allowed", i)
+		}
+	}
+	allowed, retryAfter := limiter.allow("")
+	if allowed {
+		t.Fatalf("expected request beyond burst to be rejected")
+	}
+	if retryAfter != 500*time.Millisecond {
+		t.Fatalf("expected retry after 500ms, got %s", retryAfter)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if allowed, _ := limiter.allow(""); !allowed {
+		t.Fatalf("expected refilled token to be available")
+	}
+	if allowed, _ := limiter.allow(""); allowed {
+		t.Fatalf("expected bucket to be empty again")
+	}
+}
+
+func TestRateLimiter_DisabledWithoutRate(t *testing.T) {
+	t.Parallel()
+
+	if limiter := newRateLimiter(config.ListenerConfig{Name: "http"}); limiter != nil {
+		t.Fatalf("expected nil limiter when rate_limit is unset")
+	}
+}
+
+func TestRateLimitMiddleware_KeyedByClientIP(t *testing.T) {
+	t.Parallel()
+
+	limiter := newRateLimiter(config.ListenerConfig{Name: "http", RateLimit: 1, RateLimitKey: "client_ip"})
+	limiter.now = func() time.Time { return time.Unix(1700000000, 0) }
+	handler := listeners.MetadataMiddleware(rateLimitMiddleware(limiter, "http", http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	})))
+
+	serve := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := serve("10.0.0.1:1000"); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected first request to pass, got %d", rr.Code)
+	}
+	if rr := serve("10.0.0.2:1000"); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected other client to have its own bucket, got %d", rr.Code)
+	}
+
+	rr := serve("10.0.0.1:2000")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "1" {
+		t.Fatalf("expected Retry-After=1, got %q", got)
+	}
+	var payload struct {
+		Error struct {
+			Code     string `json:"code"`
+			Category string `json:"category"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&payload); err != nil {
+		t.Fatalf("decode error payload: %v", err)
+	}
+	if payload.Error.Code != "rate_limited" || payload.Error.Category != "quota" {
+		t.Fatalf("unexpected error payload: %+v", payload.Error)
+	}
+}
+
+func TestHTTPListenerManager_RateLimitsBadCredentialsPerClientIP(t *testing.T) {
+	t.Parallel()
+
+	for _, key := range []string{"listener", "client_ip", "tenant"} {
+		cfg := &config.Config{Listeners: []config.ListenerConfig{{
+			Name: "http", Type: "http", Address: "127.0.0.1:0", Enabled: true,
+			AuthType: "basic", Username: "alice", Password: "secret",
+			RateLimit: 1, RateLimitKey: key,
+		}}}
+		mgr := NewHTTPListenerManager(cfg.Listeners, time.Second, false, NewRequestRuntime(cfg))
+		handler := mgr.servers[0].server.Handler
+
+		serve := func(remoteAddr string) int {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.RemoteAddr = remoteAddr
+			req.Header.Set("Proxy-Authorization", "Basic YWxpY2U6d3Jvbmc=")
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			return rr.Code
+		}
+		if code := serve("10.0.0.1:1000"); code != http.StatusProxyAuthRequired {
+			t.Fatalf("%s: expected the first bad login to be refused, got %d", key, code)
+		}
+		if code := serve("10.0.0.1:2000"); code != http.StatusTooManyRequests {
+			t.Fatalf("%s: expected the next bad login to be rate limited, got %d", key, code)
+		}
+	}
+}
+
+func TestSOCKS5ListenerManager_RateLimitRejectsConnect(t *testing.T) {
+	t.Parallel()
+
+	target := startPingPongTCPServer(t)
+	defer target.Close()
+
+	cfg := &config.Config{Listeners: []config.ListenerConfig{{Name: "socks", Type: "socks5", Address: "127.0.0.1:0", Enabled: true, RateLimit: 1}}}
+	mgr := NewSOCKS5ListenerManager(cfg.Listeners, time.Second, NewRequestRuntime(cfg))
+	if err := mgr.Start(context.Background()); err != nil {
+		t.Fatalf("start socks5 manager: %v", err)
+	}
+	defer func() {
+		_ = mgr.Shutdown(context.Background())
+	}()
+
+	proxyAddr := mgr.servers[0].listener.Addr().String()
+	host, port := splitAddr(t, target.Addr().String())
+	assertSOCKS5PingPong(t, proxyAddr, host, port, "", "")
+
+	conn, err := net.DialTimeout("tcp", proxyAddr, time.Second)
+	if err != nil {
+		t.Fatalf("dial socks listener: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	atyp, addrBytes := encodeSOCKS5Addr(t, host)
+	request := []byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, atyp}
+	request = append(request, addrBytes...)
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		t.Fatalf("write socks request: %v", err)
+	}
+	reply := make([]byte, 6)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("read socks reply: %v", err)
+	}
+	if reply[3] != listeners.SOCKS5ReplyConnectionNotAllowed {
+		t.Fatalf("expected connection not allowed reply, got %d", reply[3])
+	}
+}
+
+func TestSOCKS5ListenerManager_RateLimitKeyedByTenant(t *testing.T) {
+	t.Parallel()
+
+	target := startPingPongTCPServer(t)
+	defer target.Close()
+
+	cfg := &config.Config{Listeners: []config.ListenerConfig{{Name: "socks", Type: "socks5", Address: "127.0.0.1:0", Enabled: true, RateLimit: 1, RateLimitKey: "tenant"}}}
+	mgr := NewSOCKS5ListenerManager(cfg.Listeners, time.Second, NewRequestRuntime(cfg))
+	if err := mgr.Start(context.Background()); err != nil {
+		t.Fatalf("start socks5 manager: %v", err)
+	}
+	defer func() {
+		_ = mgr.Shutdown(context.Background())
+	}()
+
+	proxyAddr := mgr.servers[0].listener.Addr().String()
+	host, port := splitAddr(t, target.Addr().String())
+	assertSOCKS5PingPong(t, proxyAddr, host, port, "alice+tenant=acme", "x")
+	assertSOCKS5PingPong(t, proxyAddr, host, port, "bob+tenant=globex", "x")
+
+	conn, err := net.DialTimeout("tcp", proxyAddr, time.Second)
+	if err != nil {
+		t.Fatalf("dial socks listener: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	user := "carol+tenant=acme"
+	atyp, addrBytes := encodeSOCKS5Addr(t, host)
+	request := []byte{0x05, 0x01, 0x02, 0x01, byte(len(user))}
+	request = append(request, user...)
+	request = append(request, 1, 'x', 0x05, 0x01, 0x00, atyp)
+	request = append(request, addrBytes...)
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		t.Fatalf("write socks request: %v", err)
+	}
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("read socks reply: %v", err)
+	}
+	if reply[5] != listeners.SOCKS5ReplyConnectionNotAllowed {
+		t.Fatalf("expected the second acme connect to be rate limited, got reply %d", reply[5])
+	}
+}
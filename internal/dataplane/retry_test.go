@@ -0,0 +1,225 @@
+package dataplane
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+func startEchoTarget(t *testing.T) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		payload, _ := io.ReadAll(req.Body)
+		_, _ = rw.Write(payload)
+	}))
+}
+
+// startForwardingUpstream forwards absolute-form requests, like an HTTP proxy.
+func startForwardingUpstream(t *testing.T, hits *atomic.Int64) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if hits != nil {
+			hits.Add(1)
+		}
+		outReq, _ := http.NewRequest(req.Method, req.URL.String(), req.Body)
+		rsp, err := http.DefaultTransport.RoundTrip(outReq)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer rsp.Body.Close()
+		rw.WriteHeader(rsp.StatusCode)
+		_, _ = io.Copy(rw, rsp.Body)
+	}))
+}
+
+// startBrokenUpstream consumes the request body and drops the connection.
+func startBrokenUpstream(t *testing.T, hits *atomic.Int64) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		hits.Add(1)
+		_, _ = io.Copy(io.Discard, req.Body)
+		conn, _, err := rw.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+}
+
+func startStatusUpstream(t *testing.T, status int, hits *atomic.Int64) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		hits.Add(1)
+		_, _ = io.Copy(io.Discard, req.Body)
+		rw.WriteHeader(status)
+	}))
+}
+
+func retryProviderConfig(retry config.ProviderRetryConfig, endpoints ...string) *config.Config {
+	providerEndpoints := make([]config.ProviderEndpoint, 0, len(endpoints))
+	for i, endpoint := range endpoints {
+		providerEndpoints = append(providerEndpoints, config.ProviderEndpoint{URL: endpoint, Priority: i + 1})
+	}
+	return &config.Config{
+		Providers: []config.ProviderConfig{{
+			Name:      "provider-retry",
+			Type:      "http_proxy",
+			Endpoints: providerEndpoints,
+			Retry:     retry,
+		}},
+		Routing: config.RoutingConfig{DefaultProvider: "provider-retry"},
+	}
+}
+
+func doProxyRequest(t *testing.T, proxyURL, method, target string, body []byte) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest(method, target, bytes.NewReader(body))
+	resp, err := proxyClient(t, proxyURL).Do(req)
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	payload, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(payload)
+}
+
+func TestForwardProxy_ReplaysBodyAcrossEndpoints(t *testing.T) {
+	t.Parallel()
+
+	target := startEchoTarget(t)
+	defer target.Close()
+	var brokenHits atomic.Int64
+	broken := startBrokenUpstream(t, &brokenHits)
+	defer broken.Close()
+	healthy := startForwardingUpstream(t, nil)
+	defer healthy.Close()
+
+	// A tiny memory budget forces the body through the temp file path.
+	proxy := startRuntimeProxy(t, retryProviderConfig(config.ProviderRetryConfig{BodyMemoryBytes: 8}, broken.URL, healthy.URL))
+	defer proxy.Close()
+
+	body := strings.Repeat("payload-", 512)
+	status, got := doProxyRequest(t, proxy.URL, http.MethodPut, target.URL, []byte(body))
+	if status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	if got != body {
+		t.Fatalf("expected replayed body of %d bytes, got %d bytes", len(body), len(got))
+	}
+	if brokenHits.Load() != 1 {
+		t.Fatalf("expected first endpoint to be attempted once, got %d", brokenHits.Load())
+	}
+}
+
+func TestForwardProxy_DoesNotRetryNonIdempotentAfterSend(t *testing.T) {
+	t.Parallel()
+
+	target := startEchoTarget(t)
+	defer target.Close()
+	var brokenHits, healthyHits atomic.Int64
+	broken := startBrokenUpstream(t, &brokenHits)
+	defer broken.Close()
+	healthy := startForwardingUpstream(t, &healthyHits)
+	defer healthy.Close()
+
+	proxy := startRuntimeProxy(t, retryProviderConfig(config.ProviderRetryConfig{}, broken.URL, healthy.URL))
+	defer proxy.Close()
+
+	status, _ := doProxyRequest(t, proxy.URL, http.MethodPost, target.URL, []byte("order"))
+	if status != http.StatusBadGateway {
+		t.Fatalf("expected 502 for failed POST, got %d", status)
+	}
+	if healthyHits.Load() != 0 {
+		t.Fatalf("expected POST not to be retried on another endpoint")
+	}
+}
+
+func TestForwardProxy_RetriesNonIdempotentOnDialFailure(t *testing.T) {
+	t.Parallel()
+
+	target := startEchoTarget(t)
+	defer target.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	closedURL := "http://" + closed.Addr().String()
+	closed.Close()
+	healthy := startForwardingUpstream(t, nil)
+	defer healthy.Close()
+
+	proxy := startRuntimeProxy(t, retryProviderConfig(config.ProviderRetryConfig{}, closedURL, healthy.URL))
+	defer proxy.Close()
+
+	status, got := doProxyRequest(t, proxy.URL, http.MethodPost, target.URL, []byte("order"))
+	if status != http.StatusOK || got != "order" {
+		t.Fatalf("expected POST to fail over after dial error, got %d %q", status, got)
+	}
+}
+
+func TestForwardProxy_RetriesOnConfiguredStatus(t *testing.T) {
+	t.Parallel()
+
+	target := startEchoTarget(t)
+	defer target.Close()
+	var unavailableHits atomic.Int64
+	unavailable := startStatusUpstream(t, http.StatusServiceUnavailable, &unavailableHits)
+	defer unavailable.Close()
+	healthy := startForwardingUpstream(t, nil)
+	defer healthy.Close()
+
+	retry := config.ProviderRetryConfig{RetryOnStatus: []int{http.StatusServiceUnavailable}}
+	proxy := startRuntimeProxy(t, retryProviderConfig(retry, unavailable.URL, healthy.URL))
+	defer proxy.Close()
+
+	if status, got := doProxyRequest(t, proxy.URL, http.MethodGet, target.URL, nil); status != http.StatusOK || got != "" {
+		t.Fatalf("expected retry past 503, got %d %q", status, got)
+	}
+
+	limited := startRuntimeProxy(t, retryProviderConfig(config.ProviderRetryConfig{MaxAttempts: 1, RetryOnStatus: []int{http.StatusServiceUnavailable}}, unavailable.URL, healthy.URL))
+	defer limited.Close()
+	if status, _ := doProxyRequest(t, limited.URL, http.MethodGet, target.URL, nil); status != http.StatusServiceUnavailable {
+		t.Fatalf("expected last upstream status when attempts are exhausted, got %d", status)
+	}
+
+	other := startStatusUpstream(t, http.StatusServiceUnavailable, &unavailableHits)
+	defer other.Close()
+	exhausted := startRuntimeProxy(t, retryProviderConfig(retry, unavailable.URL, other.URL))
+	defer exhausted.Close()
+	if status, _ := doProxyRequest(t, exhausted.URL, http.MethodGet, target.URL, nil); status != http.StatusServiceUnavailable {
+		t.Fatalf("expected last upstream status when every endpoint refused, got %d", status)
+	}
+}
+
+func TestForwardProxy_ReportsBodyTooLargeToRetry(t *testing.T) {
+	t.Parallel()
+
+	target := startEchoTarget(t)
+	defer target.Close()
+	var brokenHits, healthyHits atomic.Int64
+	broken := startBrokenUpstream(t, &brokenHits)
+	defer broken.Close()
+	healthy := startForwardingUpstream(t, &healthyHits)
+	defer healthy.Close()
+
+	proxy := startRuntimeProxy(t, retryProviderConfig(config.ProviderRetryConfig{MaxBodyBytes: 16}, broken.URL, healthy.URL))
+	defer proxy.Close()
+
+	status, got := doProxyRequest(t, proxy.URL, http.MethodPut, target.URL, []byte(strings.Repeat("x", 64)))
+	if status != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d", status)
+	}
+	if !strings.Contains(got, "request body too large to retry") {
+		t.Fatalf("expected body size error, got %q", got)
+	}
+	if healthyHits.Load() != 0 {
+		t.Fatalf("expected oversized body not to be replayed")
+	}
+}
@@ -3,6 +3,8 @@ package dataplane
 import (
 	"context"
 	"errors"
+	"fmt"
+	"math/rand/v2"
 	"net/http"
 	"net/url"
 	"sort"
@@ -12,6 +14,7 @@ import (
 
 	"github.com/pzaino/microproxy/internal/dataplane/listeners"
 	"github.com/pzaino/microproxy/internal/dataplane/policy"
+	"github.com/pzaino/microproxy/internal/observability"
 	"github.com/pzaino/microproxy/pkg/config"
 )
 
@@ -26,15 +29,24 @@ type RouteDecision struct {
 type RuntimeProvider struct {
 	Name      string
 	Endpoints []RuntimeEndpoint
+
+	Admission        *admissionGate
+	QuotaStrategy    string
+	QueueTimeout     time.Duration
+	FallbackProvider string
+
+	Retry      listeners.RetryPolicy
+	HedgeDelay time.Duration
 }
 
 // RuntimeEndpoint is a single dialable upstream endpoint.
 type RuntimeEndpoint struct {
-	URL      *url.URL
-	Priority int
-	Weight   int
-	Adapter  listeners.UpstreamAdapter
-	Health   EndpointHealthSnapshot
+	URL       *url.URL
+	Priority  int
+	Weight    int
+	Adapter   listeners.UpstreamAdapter
+	Health    EndpointHealthSnapshot
+	Admission *endpointTracker
 }
 
 type EndpointHealthState string
@@ -68,33 +80,67 @@ const (
 
 func NewRequestRuntime(cfg *config.Config) listeners.RequestRuntime {
 	registry := NewProviderRegistry(cfg)
-	return listeners.RequestRuntime{
+	servingRegistry.Store(registry)
+	runtime := listeners.RequestRuntime{
 		Resolver:          NewRouteResolver(cfg),
 		Registry:          registry,
 		Selector:          NewEndpointSelector(registry),
 		ClassifyTimeoutFn: ClassifyTimeout,
 		PolicyEvaluator:   policy.NewEngine(cfg),
 	}
+	if interceptor := newTLSInterceptor(cfg); interceptor != nil {
+		runtime.Interceptor = interceptor
+	}
+	return runtime
 }
 
 // RouteResolver resolves tenant/provider from metadata and routing rules.
 type RouteResolver struct {
 	defaultProvider string
+	defaultPolicy   string
 	rules           []config.RoutingRule
+	tenantACLs      map[string]*clientACL
 }
 
 func NewRouteResolver(cfg *config.Config) *RouteResolver {
 	if cfg == nil {
 		return &RouteResolver{}
 	}
-	return &RouteResolver{defaultProvider: strings.TrimSpace(cfg.Routing.DefaultProvider), rules: append([]config.RoutingRule{}, cfg.Routing.Rules...)}
+	return &RouteResolver{
+		defaultProvider: strings.TrimSpace(cfg.Routing.DefaultProvider),
+		defaultPolicy:   joinPolicyRefs(strings.Split(cfg.Routing.DefaultPolicyRef, ",")...),
+		rules:           append([]config.RoutingRule{}, cfg.Routing.Rules...),
+		tenantACLs:      newTenantACLs(cfg.Tenants),
+	}
 }
 
+// Resolve picks the provider and policies for a request. Policies bound to
+// the authenticated account run after those of the matched rule, or after
+// routing.default_policy_ref when no rule names a policy.
 func (r *RouteResolver) Resolve(_ *http.Request, metadata listeners.RequestMetadata) (listeners.RouteDecision, error) {
+	decision := r.resolve(metadata)
+	if decision.Policy == "" {
+		decision.Policy = r.defaultPolicy
+	}
+	decision.Policy = joinPolicyRefs(decision.Policy, metadata.IdentityPolicy)
+	return decision, nil
+}
+
+func joinPolicyRefs(refs ...string) string {
+	joined := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		if ref = strings.TrimSpace(ref); ref != "" {
+			joined = append(joined, ref)
+		}
+	}
+	return strings.Join(joined, ",")
+}
+
+func (r *RouteResolver) resolve(metadata listeners.RequestMetadata) listeners.RouteDecision {
 	decision := listeners.RouteDecision{TenantID: metadata.TenantID}
 	if provider := strings.TrimSpace(metadata.Provider); provider != "" {
 		decision.Provider = provider
-		return decision, nil
+		return decision
 	}
 
 	for _, rule := range r.rules {
@@ -102,16 +148,13 @@ func (r *RouteResolver) Resolve(_ *http.Request, metadata listeners.RequestMetad
 			decision.Provider = rule.Provider
 			decision.Policy = rule.PolicyRef
 			if decision.Provider != "" {
-				return decision, nil
+				return decision
 			}
 		}
 	}
 
 	decision.Provider = r.defaultProvider
-	if decision.Provider == "" {
-		return decision, nil
-	}
-	return decision, nil
+	return decision
 }
 
 func matchesRule(match map[string]string, metadata listeners.RequestMetadata) bool {
@@ -128,6 +171,10 @@ func matchesRule(match map[string]string, metadata listeners.RequestMetadata) bo
 			if metadata.Provider != value {
 				return false
 			}
+		case "client_cidr":
+			if !listeners.ClientIPInCIDRs(metadata.ClientIP, value) {
+				return false
+			}
 		default:
 			return false
 		}
@@ -140,26 +187,71 @@ type ProviderRegistry struct {
 	mu        sync.RWMutex
 	providers map[string]RuntimeProvider
 	health    map[string]map[string]*endpointHealthState
-	probe     probeDialer
-	now       func() time.Time
+	selection map[string]*providerSelection
+	// credentials holds each provider's credential pool; nil entries mean a
+	// single configured login.
+	credentials map[string]*credentialPool
+	sessions    *SessionManager
+	// plugins holds the providers whose type a registered plugin serves.
+	plugins map[string]pluginProvider
+	probe   probeDialer
+	now     func() time.Time
+
+	transports *transportCache
+	stop       chan struct{}
+	closeOnce  sync.Once
 }
 
 func NewProviderRegistry(cfg *config.Config) *ProviderRegistry {
 	registry := &ProviderRegistry{
-		providers: map[string]RuntimeProvider{},
-		health:    map[string]map[string]*endpointHealthState{},
-		probe:     &httpProbeDialer{},
-		now:       time.Now,
+		providers:   map[string]RuntimeProvider{},
+		health:      map[string]map[string]*endpointHealthState{},
+		selection:   map[string]*providerSelection{},
+		credentials: map[string]*credentialPool{},
+		sessions:    newSessionManager(cfg),
+		plugins:     map[string]pluginProvider{},
+		probe:       &httpProbeDialer{},
+		now:         time.Now,
+
+		transports: newTransportCache(defaultTransportCacheSize),
+		stop:       make(chan struct{}),
 	}
 	if cfg == nil {
 		return registry
 	}
-	adapterFactory := upstreamAdapterFactory{}
+	adapterFactory := upstreamAdapterFactory{transports: registry.transports, sessions: registry.sessions}
+	if len(registry.sessions.policies) > 0 {
+		go registry.sessions.sweep(registry.stop)
+	}
 
 	for _, provider := range cfg.Providers {
-		runtimeProvider := RuntimeProvider{Name: provider.Name}
-		adapter := adapterFactory.ForProvider(provider)
+		strategy, queueTimeout := normalizeQuotaStrategy(provider.Limits)
+		runtimeProvider := RuntimeProvider{
+			Name:             provider.Name,
+			Admission:        newAdmissionGate(provider.Name, provider.Limits.MaxRequestsPerMinute, provider.Limits.Concurrency),
+			QuotaStrategy:    strategy,
+			QueueTimeout:     queueTimeout,
+			FallbackProvider: strings.TrimSpace(provider.Limits.FallbackProvider),
+			Retry: listeners.RetryPolicy{
+				MaxAttempts:     provider.Retry.MaxAttempts,
+				Methods:         append([]string(nil), provider.Retry.Methods...),
+				RetryOnStatus:   append([]int(nil), provider.Retry.RetryOnStatus...),
+				BodyMemoryBytes: provider.Retry.BodyMemoryBytes,
+				MaxBodyBytes:    provider.Retry.MaxBodyBytes,
+			},
+			HedgeDelay: time.Duration(provider.Hedging.DelayMillis) * time.Millisecond,
+		}
+		credentials := newCredentialPool(provider, providerSessions{manager: registry.sessions, provider: provider.Name})
+		registry.credentials[provider.Name] = credentials
+		adapter := adapterFactory.ForProvider(provider, credentials)
+		plugin, isPlugin := lookupPluginProvider(provider)
+		if isPlugin {
+			registry.plugins[provider.Name] = plugin
+		}
 		providerHealth := normalizeHealthConfig(provider.Health)
+		selection := newProviderSelection(provider.Selection.Strategy)
+		selection.affinity = newEndpointAffinity(provider.Affinity)
+		registry.selection[provider.Name] = selection
 		registry.health[provider.Name] = map[string]*endpointHealthState{}
 		for _, endpoint := range provider.Endpoints {
 			parsed, err := url.Parse(endpoint.URL)
@@ -176,16 +268,40 @@ func NewProviderRegistry(cfg *config.Config) *ProviderRegistry {
 				Health: EndpointHealthSnapshot{
 					State: endpointState.state,
 				},
+				Admission: &endpointTracker{
+					gate:  newAdmissionGate(provider.Name+" "+parsed.Redacted(), endpoint.MaxRequestsPerMinute, endpoint.Concurrency),
+					state: selection.stateFor(describeEndpoint(parsed)),
+				},
 			})
-			if providerHealth.Enabled {
+			if providerHealth.Enabled && !isPlugin {
 				go registry.startActiveProbe(provider.Name, parsed, providerHealth)
 			}
 		}
+		if providerHealth.Enabled && isPlugin {
+			go registry.pollPluginStatus(plugin, providerHealth)
+		}
 		registry.providers[provider.Name] = runtimeProvider
 	}
 	return registry
 }
 
+// Close stops active health probes and evicts cached upstream transports.
+// It is called when a rebuilt registry replaces this one; requests still in
+// flight finish on their current connections.
+func (r *ProviderRegistry) Close() {
+	r.closeOnce.Do(func() {
+		servingRegistry.CompareAndSwap(r, nil)
+		close(r.stop)
+		r.transports.closeAll()
+	})
+}
+
+// CloseIdleConnections closes idle upstream connections without evicting the
+// cached transports.
+func (r *ProviderRegistry) CloseIdleConnections() {
+	r.transports.closeIdleConnections()
+}
+
 func (r *ProviderRegistry) Get(provider string) (listeners.RuntimeProvider, bool) {
 	providerName := strings.TrimSpace(provider)
 	r.mu.RLock()
@@ -201,9 +317,10 @@ func (r *ProviderRegistry) Get(provider string) (listeners.RuntimeProvider, bool
 		if endpointState := r.health[providerName][key]; endpointState != nil {
 			snapshot = endpointState.snapshot()
 		}
-		endpoints = append(endpoints, listeners.RuntimeEndpoint{
+		runtimeEndpoint := listeners.RuntimeEndpoint{
 			URL:      ep.URL,
 			Priority: ep.Priority,
+			Weight:   ep.Weight,
 			Adapter:  ep.Adapter,
 			Health: listeners.EndpointHealthSnapshot{
 				State:         string(snapshot.State),
@@ -213,10 +330,26 @@ func (r *ProviderRegistry) Get(provider string) (listeners.RuntimeProvider, bool
 				LastFailureAt: snapshot.LastFailureAt,
 				LastProbeAt:   snapshot.LastProbeAt,
 			},
-		})
+		}
+		if ep.Admission != nil {
+			runtimeEndpoint.Admission = ep.Admission
+		}
+		endpoints = append(endpoints, runtimeEndpoint)
 	}
 	r.mu.RUnlock()
-	return listeners.RuntimeProvider{Name: p.Name, Endpoints: endpoints}, true
+	runtimeProvider := listeners.RuntimeProvider{
+		Name:             p.Name,
+		Endpoints:        endpoints,
+		QuotaStrategy:    p.QuotaStrategy,
+		QueueTimeout:     p.QueueTimeout,
+		FallbackProvider: p.FallbackProvider,
+		Retry:            p.Retry,
+		HedgeDelay:       p.HedgeDelay,
+	}
+	if p.Admission != nil {
+		runtimeProvider.Admission = p.Admission
+	}
+	return runtimeProvider, true
 }
 
 func (r *ProviderRegistry) SnapshotProviderHealth(provider string) []EndpointRuntimeHealth {
@@ -243,6 +376,49 @@ func (r *ProviderRegistry) SnapshotProviderHealth(provider string) []EndpointRun
 	return items
 }
 
+// SnapshotProviderCredentials returns the usage of each credential in the
+// provider's pool, or nil when it has no pool.
+func (r *ProviderRegistry) SnapshotProviderCredentials(provider string) []CredentialUsage {
+	r.mu.RLock()
+	pool := r.credentials[strings.TrimSpace(provider)]
+	r.mu.RUnlock()
+	return pool.snapshot()
+}
+
+// RotateIdentity asks the provider's adapter for a new upstream identity. It
+// returns listeners.ErrRotateIdentityUnsupported when the provider has no
+// rotation, and an error when the provider does not exist.
+func (r *ProviderRegistry) RotateIdentity(ctx context.Context, provider string) error {
+	r.mu.RLock()
+	runtimeProvider, ok := r.providers[strings.TrimSpace(provider)]
+	r.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("provider %q not found", provider)
+	}
+	if len(runtimeProvider.Endpoints) == 0 {
+		return listeners.ErrRotateIdentityUnsupported
+	}
+	// Every endpoint shares the provider's adapter.
+	return runtimeProvider.Endpoints[0].Adapter.RotateIdentity(ctx)
+}
+
+// ObserveRequestServed counts a request served on the sticky session it
+// names.
+func (r *ProviderRegistry) ObserveRequestServed(ctx context.Context) {
+	r.sessions.served(ctx)
+}
+
+// Sessions returns the registry's sticky sessions.
+func (r *ProviderRegistry) Sessions() *SessionManager {
+	return r.sessions
+}
+
+// SessionProvider returns the provider the request's sticky session is
+// pinned to, or "" when it names no open session.
+func (r *ProviderRegistry) SessionProvider(ctx context.Context) string {
+	return r.sessions.pinnedProvider(ctx)
+}
+
 func (r *ProviderRegistry) ObserveEndpointOutcome(provider string, endpoint *url.URL, err error, _ listeners.TimeoutClassification) {
 	if endpoint == nil {
 		return
@@ -270,6 +446,26 @@ func (r *ProviderRegistry) ObserveEndpointOutcome(provider string, endpoint *url
 	state.transition(EndpointHealthDegraded, "request failures observed", now)
 }
 
+// ObserveHedge records which attempt of a hedged request won.
+func (r *ProviderRegistry) ObserveHedge(provider, outcome string) {
+	observability.RecordHedgedRequest(provider, outcome)
+}
+
+// ObserveTunnelOpened counts a CONNECT or SOCKS tunnel as active.
+func (r *ProviderRegistry) ObserveTunnelOpened(metadata listeners.RequestMetadata) {
+	observability.RecordTunnelOpened(metadata.TenantID, metadata.Provider, metadata.Listener)
+}
+
+// ObserveTunnelClosed records the bytes and duration of a finished tunnel.
+func (r *ProviderRegistry) ObserveTunnelClosed(metadata listeners.RequestMetadata, stats listeners.TunnelStats) {
+	observability.RecordTunnelClosed(metadata.TenantID, metadata.Provider, metadata.Listener, stats)
+}
+
+// ObserveTunnelDropped counts a tunnel closed by its idle or lifetime limit.
+func (r *ProviderRegistry) ObserveTunnelDropped(metadata listeners.RequestMetadata, reason string) {
+	observability.RecordConnectionDropped(metadata.Listener, reason)
+}
+
 func (r *ProviderRegistry) allowEndpoint(provider string, endpoint *url.URL, now time.Time) bool {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -296,13 +492,14 @@ func (r *ProviderRegistry) allowEndpoint(provider string, endpoint *url.URL, now
 
 type EndpointSelector struct {
 	registry *ProviderRegistry
+	random   func() float64
 }
 
 func NewEndpointSelector(registry *ProviderRegistry) *EndpointSelector {
-	return &EndpointSelector{registry: registry}
+	return &EndpointSelector{registry: registry, random: rand.Float64}
 }
 
-func (s *EndpointSelector) Select(_ context.Context, provider listeners.RuntimeProvider, _ *http.Request) []listeners.RuntimeEndpoint {
+func (s *EndpointSelector) Select(ctx context.Context, provider listeners.RuntimeProvider, req *http.Request) []listeners.RuntimeEndpoint {
 	ordered := append([]listeners.RuntimeEndpoint{}, provider.Endpoints...)
 	sort.SliceStable(ordered, func(i, j int) bool {
 		left := providerPriority(provider, ordered[i])
@@ -321,9 +518,45 @@ func (s *EndpointSelector) Select(_ context.Context, provider listeners.RuntimeP
 			filtered = append(filtered, endpoint)
 		}
 	}
+
+	s.registry.mu.RLock()
+	selection := s.registry.selection[provider.Name]
+	plugin, isPlugin := s.registry.plugins[provider.Name]
+	s.registry.mu.RUnlock()
+	if selection != nil && selection.strategy != SelectionPriority {
+		for start := 0; start < len(filtered); {
+			end := start + 1
+			tierPriority := providerPriority(provider, filtered[start])
+			for end < len(filtered) && providerPriority(provider, filtered[end]) == tierPriority {
+				end++
+			}
+			selection.orderTier(filtered[start:end], s.random)
+			start = end
+		}
+	}
+	if selection != nil && selection.affinity != nil {
+		selection.affinity.pin(provider, filtered, selection.affinity.keyFor(req))
+	}
+	if isPlugin && len(filtered) > 0 {
+		plugin.resolveFirst(ctx, filtered)
+	}
+	s.registry.sessions.bind(ctx, provider.Name, filtered)
 	return filtered
 }
 
+// moveEndpointFirst moves the endpoint described by key to the front of
+// endpoints, keeping the order of the rest. It reports whether key was found.
+func moveEndpointFirst(endpoints []listeners.RuntimeEndpoint, key string) bool {
+	for i, endpoint := range endpoints {
+		if describeEndpoint(endpoint.URL) == key {
+			copy(endpoints[1:i+1], endpoints[:i])
+			endpoints[0] = endpoint
+			return true
+		}
+	}
+	return false
+}
+
 func providerPriority(provider listeners.RuntimeProvider, endpoint listeners.RuntimeEndpoint) int {
 	for _, ep := range provider.Endpoints {
 		if describeEndpoint(ep.URL) == describeEndpoint(endpoint.URL) {
@@ -431,8 +664,13 @@ func normalizeHealthConfig(cfg config.ProviderHealthConfig) config.ProviderHealt
 func (r *ProviderRegistry) startActiveProbe(provider string, endpoint *url.URL, cfg config.ProviderHealthConfig) {
 	ticker := time.NewTicker(time.Duration(cfg.IntervalSeconds) * time.Second)
 	defer ticker.Stop()
-	for range ticker.C {
-		r.probeOnce(provider, endpoint, cfg)
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.probeOnce(provider, endpoint, cfg)
+		}
 	}
 }
 
@@ -281,7 +281,7 @@ func TestForwardProxy_PolicyHeadersPatchAllowsFlow(t *testing.T) {
 	}
 }
 
-func startRuntimeProxy(t *testing.T, cfg *config.Config) *httptest.Server {
+func startRuntimeProxy(t testing.TB, cfg *config.Config) *httptest.Server {
 	t.Helper()
 	handler := listeners.MetadataMiddleware(observability.HTTPMiddleware(listeners.NewForwardProxyHandlerWithRuntime(NewRequestRuntime(cfg)), false))
 	return httptest.NewServer(handler)
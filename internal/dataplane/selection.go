@@ -0,0 +1,208 @@
+package dataplane
+
+import (
+	"context"
+	"math"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+)
+
+// Endpoint selection strategies. Every strategy orders endpoints inside a
+// priority tier only; lower priority tiers are always attempted first.
+const (
+	SelectionPriority           = "priority"
+	SelectionWeightedRoundRobin = "weighted_round_robin"
+	SelectionRandomWeighted     = "random_weighted"
+	SelectionLeastOutstanding   = "least_outstanding"
+	SelectionLatencyEWMA        = "latency_ewma"
+)
+
+const latencyEWMAAlpha = 0.3
+
+// providerSelection keeps per-provider selection state shared by all requests.
+type providerSelection struct {
+	strategy string
+	affinity *endpointAffinity
+
+	mu        sync.Mutex
+	endpoints map[string]*endpointSelectionState
+}
+
+type endpointSelectionState struct {
+	currentWeight int
+	latencyEWMA   float64
+	hasLatency    bool
+	outstanding   atomic.Int64
+}
+
+func newProviderSelection(strategy string) *providerSelection {
+	strategy = strings.ToLower(strings.TrimSpace(strategy))
+	switch strategy {
+	case SelectionWeightedRoundRobin, SelectionRandomWeighted, SelectionLeastOutstanding, SelectionLatencyEWMA:
+	default:
+		strategy = SelectionPriority
+	}
+	return &providerSelection{strategy: strategy, endpoints: map[string]*endpointSelectionState{}}
+}
+
+func (p *providerSelection) stateFor(key string) *endpointSelectionState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stateForLocked(key)
+}
+
+func (p *providerSelection) stateForLocked(key string) *endpointSelectionState {
+	state, ok := p.endpoints[key]
+	if !ok {
+		state = &endpointSelectionState{}
+		p.endpoints[key] = state
+	}
+	return state
+}
+
+func (p *providerSelection) observeLatency(key string, latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state := p.stateForLocked(key)
+	sample := latency.Seconds()
+	if !state.hasLatency {
+		state.latencyEWMA = sample
+		state.hasLatency = true
+		return
+	}
+	state.latencyEWMA = latencyEWMAAlpha*sample + (1-latencyEWMAAlpha)*state.latencyEWMA
+}
+
+// orderTier orders endpoints that share a priority according to the strategy.
+func (p *providerSelection) orderTier(tier []listeners.RuntimeEndpoint, random func() float64) {
+	if len(tier) < 2 {
+		return
+	}
+	switch p.strategy {
+	case SelectionWeightedRoundRobin:
+		p.orderSmoothWeighted(tier)
+	case SelectionRandomWeighted:
+		orderRandomWeighted(tier, random)
+	case SelectionLeastOutstanding:
+		outstanding := make(map[string]int64, len(tier))
+		for _, endpoint := range tier {
+			outstanding[describeEndpoint(endpoint.URL)] = p.stateFor(describeEndpoint(endpoint.URL)).outstanding.Load()
+		}
+		sort.SliceStable(tier, func(i, j int) bool {
+			return outstanding[describeEndpoint(tier[i].URL)] < outstanding[describeEndpoint(tier[j].URL)]
+		})
+	case SelectionLatencyEWMA:
+		p.mu.Lock()
+		latency := make(map[string]float64, len(tier))
+		for _, endpoint := range tier {
+			key := describeEndpoint(endpoint.URL)
+			// Endpoints without samples sort first so they get measured.
+			if state := p.stateForLocked(key); state.hasLatency {
+				latency[key] = state.latencyEWMA
+			}
+		}
+		p.mu.Unlock()
+		sort.SliceStable(tier, func(i, j int) bool {
+			return latency[describeEndpoint(tier[i].URL)] < latency[describeEndpoint(tier[j].URL)]
+		})
+	}
+}
+
+// orderSmoothWeighted picks the leading endpoint with nginx-style smooth
+// weighted round-robin; the remaining endpoints follow by current weight.
+func (p *providerSelection) orderSmoothWeighted(tier []listeners.RuntimeEndpoint) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	total := 0
+	states := make(map[string]*endpointSelectionState, len(tier))
+	for _, endpoint := range tier {
+		key := describeEndpoint(endpoint.URL)
+		state := p.stateForLocked(key)
+		weight := effectiveWeight(endpoint.Weight)
+		state.currentWeight += weight
+		total += weight
+		states[key] = state
+	}
+	sort.SliceStable(tier, func(i, j int) bool {
+		return states[describeEndpoint(tier[i].URL)].currentWeight > states[describeEndpoint(tier[j].URL)].currentWeight
+	})
+	states[describeEndpoint(tier[0].URL)].currentWeight -= total
+}
+
+// orderRandomWeighted draws a weighted random permutation (Efraimidis-Spirakis).
+func orderRandomWeighted(tier []listeners.RuntimeEndpoint, random func() float64) {
+	keys := make(map[string]float64, len(tier))
+	for _, endpoint := range tier {
+		keys[describeEndpoint(endpoint.URL)] = math.Pow(random(), 1/float64(effectiveWeight(endpoint.Weight)))
+	}
+	sort.SliceStable(tier, func(i, j int) bool {
+		return keys[describeEndpoint(tier[i].URL)] > keys[describeEndpoint(tier[j].URL)]
+	})
+}
+
+func effectiveWeight(weight int) int {
+	if weight <= 0 {
+		return 1
+	}
+	return weight
+}
+
+var _ listeners.Admission = (*endpointTracker)(nil)
+
+// endpointTracker counts in-flight requests for least_outstanding selection
+// and applies the endpoint admission gate, if any.
+type endpointTracker struct {
+	gate  *admissionGate
+	state *endpointSelectionState
+}
+
+func (t *endpointTracker) TryAcquire() (func(), bool) {
+	release := func() {}
+	if t.gate != nil {
+		var ok bool
+		if release, ok = t.gate.TryAcquire(); !ok {
+			return nil, false
+		}
+	}
+	return t.track(release), true
+}
+
+func (t *endpointTracker) Acquire(ctx context.Context) (func(), error) {
+	release := func() {}
+	if t.gate != nil {
+		var err error
+		if release, err = t.gate.Acquire(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return t.track(release), nil
+}
+
+func (t *endpointTracker) track(release func()) func() {
+	t.state.outstanding.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.state.outstanding.Add(-1)
+			release()
+		})
+	}
+}
+
+// ObserveEndpointLatency feeds the latency_ewma strategy.
+func (r *ProviderRegistry) ObserveEndpointLatency(provider string, endpoint *url.URL, latency time.Duration) {
+	r.mu.RLock()
+	selection := r.selection[strings.TrimSpace(provider)]
+	r.mu.RUnlock()
+	if selection == nil || endpoint == nil {
+		return
+	}
+	selection.observeLatency(describeEndpoint(endpoint), latency)
+}
@@ -0,0 +1,138 @@
+package dataplane
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+func newSelectionTestRegistry(strategy string) *ProviderRegistry {
+	return NewProviderRegistry(&config.Config{Providers: []config.ProviderConfig{{
+		Name: "provider-a",
+		Type: "direct",
+		Endpoints: []config.ProviderEndpoint{
+			{URL: "http://a.example", Priority: 1, Weight: 5},
+			{URL: "http://b.example", Priority: 1, Weight: 1},
+			{URL: "http://c.example", Priority: 1, Weight: 1},
+			{URL: "http://backup.example", Priority: 2, Weight: 10},
+		},
+		Selection: config.ProviderSelectionConfig{Strategy: strategy},
+	}}})
+}
+
+func selectOrder(t *testing.T, registry *ProviderRegistry, selector *EndpointSelector) []string {
+	t.Helper()
+	provider, ok := registry.Get("provider-a")
+	if !ok {
+		t.Fatalf("expected provider in registry")
+	}
+	selected := selector.Select(t.Context(), provider, &http.Request{})
+	order := make([]string, 0, len(selected))
+	for _, endpoint := range selected {
+		order = append(order, endpoint.URL.Host)
+	}
+	return order
+}
+
+func TestEndpointSelector_SmoothWeightedRoundRobinWithinTier(t *testing.T) {
+	t.Parallel()
+
+	registry := newSelectionTestRegistry("weighted_round_robin")
+	selector := NewEndpointSelector(registry)
+
+	var leaders []string
+	for i := 0; i < 7; i++ {
+		order := selectOrder(t, registry, selector)
+		if len(order) != 4 || order[3] != "backup.example" {
+			t.Fatalf("expected lower priority tier to stay last, got %v", order)
+		}
+		leaders = append(leaders, order[0])
+	}
+
+	expected := []string{"a.example", "a.example", "b.example", "a.example", "c.example", "a.example", "a.example"}
+	for i := range expected {
+		if leaders[i] != expected[i] {
+			t.Fatalf("expected smooth weighted sequence %v, got %v", expected, leaders)
+		}
+	}
+}
+
+func TestEndpointSelector_RandomWeighted(t *testing.T) {
+	t.Parallel()
+
+	registry := newSelectionTestRegistry("random_weighted")
+	selector := NewEndpointSelector(registry)
+	draws := []float64{0.1, 0.9, 0.5}
+	next := 0
+	selector.random = func() float64 {
+		value := draws[next%len(draws)]
+		next++
+		return value
+	}
+
+	order := selectOrder(t, registry, selector)
+	// keys: a=0.1^(1/5)=0.63, b=0.9, c=0.5
+	expected := []string{"b.example", "a.example", "c.example", "backup.example"}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, order)
+		}
+	}
+}
+
+func TestEndpointSelector_LeastOutstanding(t *testing.T) {
+	t.Parallel()
+
+	registry := newSelectionTestRegistry("least_outstanding")
+	selector := NewEndpointSelector(registry)
+
+	provider, _ := registry.Get("provider-a")
+	var releases []func()
+	for _, endpoint := range provider.Endpoints {
+		if endpoint.URL.Host == "a.example" || endpoint.URL.Host == "b.example" {
+			release, ok := endpoint.Admission.TryAcquire()
+			if !ok {
+				t.Fatalf("expected admission for %s", endpoint.URL.Host)
+			}
+			releases = append(releases, release)
+		}
+	}
+
+	if order := selectOrder(t, registry, selector); order[0] != "c.example" {
+		t.Fatalf("expected idle endpoint first, got %v", order)
+	}
+	for _, release := range releases {
+		release()
+	}
+	if order := selectOrder(t, registry, selector); order[0] != "a.example" {
+		t.Fatalf("expected URL order once all endpoints are idle, got %v", order)
+	}
+}
+
+func TestEndpointSelector_LatencyEWMA(t *testing.T) {
+	t.Parallel()
+
+	registry := newSelectionTestRegistry("latency_ewma")
+	selector := NewEndpointSelector(registry)
+
+	observe := func(host string, latency time.Duration) {
+		registry.ObserveEndpointLatency("provider-a", &url.URL{Scheme: "http", Host: host}, latency)
+	}
+	observe("a.example", 200*time.Millisecond)
+	observe("b.example", 20*time.Millisecond)
+
+	if order := selectOrder(t, registry, selector); order[0] != "c.example" || order[1] != "b.example" {
+		t.Fatalf("expected unmeasured endpoint then fastest endpoint, got %v", order)
+	}
+
+	observe("c.example", 500*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		observe("b.example", time.Second)
+	}
+	if order := selectOrder(t, registry, selector); order[0] != "a.example" {
+		t.Fatalf("expected EWMA to follow degraded latency, got %v", order)
+	}
+}
@@ -0,0 +1,388 @@
+package dataplane
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/internal/observability"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+const (
+	defaultSessionIdleTTL     = 10 * time.Minute
+	defaultSessionMaxLifetime = time.Hour
+	sessionSweepInterval      = 30 * time.Second
+)
+
+// Reasons a sticky session ends.
+const (
+	SessionClosedIdle     = "idle_timeout"
+	SessionClosedLifetime = "max_lifetime"
+	SessionClosedKilled   = "killed"
+	SessionClosedShutdown = "shutdown"
+)
+
+var (
+	ErrSessionNotFound           = errors.New("session not found")
+	ErrSessionRefreshUnsupported = errors.New("session refresh not supported")
+)
+
+// SessionManager keeps the sticky sessions clients open by naming a session
+// in the X-Microproxy-Session header or a "+session=<id>" username hint. A
+// session pins the provider, endpoint, pooled credential and vendor session
+// ID of its first request, so later requests reuse the same upstream
+// identity until the session idles out or reaches its lifetime.
+type SessionManager struct {
+	now func() time.Time
+
+	mu       sync.Mutex
+	policies map[string]sessionPolicy
+	sessions map[string]*stickySession
+}
+
+type sessionPolicy struct {
+	idleTTL     time.Duration
+	maxLifetime time.Duration
+	refresh     bool
+}
+
+type stickySession struct {
+	id         string
+	tenant     string
+	provider   string
+	endpoint   string
+	credential string
+	vendorID   string
+	createdAt  time.Time
+	lastUsedAt time.Time
+	requests   uint64
+}
+
+// SessionInfo is a point-in-time view of a sticky session.
+type SessionInfo struct {
+	ID              string
+	TenantID        string
+	Provider        string
+	Endpoint        string
+	Credential      string
+	VendorSessionID string
+	CreatedAt       time.Time
+	LastUsedAt      time.Time
+	ExpiresAt       time.Time
+	Requests        uint64
+}
+
+// newSessionManager manages sessions for the providers in cfg that support
+// them.
+func newSessionManager(cfg *config.Config) *SessionManager {
+	m := &SessionManager{now: time.Now, policies: map[string]sessionPolicy{}, sessions: map[string]*stickySession{}}
+	if cfg == nil {
+		return m
+	}
+	for _, provider := range cfg.Providers {
+		if !provider.Session.Supported {
+			continue
+		}
+		policy := sessionPolicy{
+			idleTTL:     time.Duration(provider.Session.IdleTTLSeconds) * time.Second,
+			maxLifetime: time.Duration(provider.Session.MaxLifetimeSeconds) * time.Second,
+			refresh:     provider.Session.RefreshSupported,
+		}
+		if policy.idleTTL <= 0 {
+			policy.idleTTL = defaultSessionIdleTTL
+		}
+		if policy.maxLifetime <= 0 {
+			policy.maxLifetime = defaultSessionMaxLifetime
+		}
+		m.policies[provider.Name] = policy
+	}
+	return m
+}
+
+// sessionKey returns the tenant and session the request under ctx names.
+func sessionKey(ctx context.Context) (string, string) {
+	session := listeners.UpstreamHintsFromContext(ctx).Session
+	if session == "" {
+		return "", ""
+	}
+	metadata, _ := listeners.MetadataFromContext(ctx)
+	return metadata.TenantID, session
+}
+
+// activeLocked returns the live session the request under ctx names, closing
+// it first when it has expired. A session named by another tenant is not
+// returned.
+func (m *SessionManager) activeLocked(ctx context.Context, now time.Time) *stickySession {
+	tenant, id := sessionKey(ctx)
+	if id == "" {
+		return nil
+	}
+	session := m.sessions[id]
+	if session == nil || session.tenant != tenant {
+		return nil
+	}
+	if reason := m.expiredLocked(session, now); reason != "" {
+		m.closeLocked(session, reason)
+		return nil
+	}
+	return session
+}
+
+func (m *SessionManager) expiredLocked(session *stickySession, now time.Time) string {
+	policy := m.policies[session.provider]
+	switch {
+	case now.Sub(session.createdAt) >= policy.maxLifetime:
+		return SessionClosedLifetime
+	case now.Sub(session.lastUsedAt) >= policy.idleTTL:
+		return SessionClosedIdle
+	}
+	return ""
+}
+
+func (m *SessionManager) closeLocked(session *stickySession, reason string) {
+	delete(m.sessions, session.id)
+	observability.RecordSessionClosed(session.provider, reason)
+}
+
+// pinnedProvider returns the provider of the session the request names.
+func (m *SessionManager) pinnedProvider(ctx context.Context) string {
+	if m == nil {
+		return ""
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if session := m.activeLocked(ctx, m.now()); session != nil {
+		return session.provider
+	}
+	return ""
+}
+
+// bind opens the session the request names on provider and moves its pinned
+// endpoint to the front of endpoints. A session whose endpoint is no longer
+// eligible is pinned to the first remaining one. Selection runs again for
+// fallbacks, retries and hedges, so bind leaves the session's use to served.
+func (m *SessionManager) bind(ctx context.Context, provider string, endpoints []listeners.RuntimeEndpoint) {
+	if m == nil || len(endpoints) == 0 {
+		return
+	}
+	tenant, id := sessionKey(ctx)
+	if id == "" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.policies[provider]; !ok {
+		return
+	}
+	now := m.now()
+	session := m.activeLocked(ctx, now)
+	if session == nil {
+		if existing := m.sessions[id]; existing != nil {
+			// The ID belongs to another tenant's session.
+			return
+		}
+		// The client's session ID goes upstream until a refresh replaces it.
+		session = &stickySession{id: id, tenant: tenant, provider: provider, vendorID: id, createdAt: now, lastUsedAt: now}
+		m.sessions[id] = session
+		observability.RecordSessionOpened(provider)
+	}
+	if session.provider != provider {
+		return
+	}
+
+	if !moveEndpointFirst(endpoints, session.endpoint) {
+		session.endpoint = describeEndpoint(endpoints[0].URL)
+	}
+}
+
+// served counts a request served on the session it names and restarts the
+// session's idle timer. The data plane calls it once per request, after the
+// request went through.
+func (m *SessionManager) served(ctx context.Context) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	if session := m.activeLocked(ctx, now); session != nil {
+		session.lastUsedAt = now
+		session.requests++
+	}
+}
+
+// providerSessions is the session manager as seen by one provider.
+type providerSessions struct {
+	manager  *SessionManager
+	provider string
+}
+
+func (s providerSessions) sessionLocked(ctx context.Context) *stickySession {
+	session := s.manager.activeLocked(ctx, s.manager.now())
+	if session == nil || session.provider != s.provider {
+		return nil
+	}
+	return session
+}
+
+// vendorSession returns the session ID sent upstream for the request's
+// session.
+func (s providerSessions) vendorSession(ctx context.Context) (string, bool) {
+	if s.manager == nil {
+		return "", false
+	}
+	s.manager.mu.Lock()
+	defer s.manager.mu.Unlock()
+	if session := s.sessionLocked(ctx); session != nil {
+		return session.vendorID, true
+	}
+	return "", false
+}
+
+// credential returns the pooled credential the request's session is pinned
+// to, or "" when it has none yet.
+func (s providerSessions) credential(ctx context.Context) string {
+	if s.manager == nil {
+		return ""
+	}
+	s.manager.mu.Lock()
+	defer s.manager.mu.Unlock()
+	if session := s.sessionLocked(ctx); session != nil {
+		return session.credential
+	}
+	return ""
+}
+
+// pinCredential records the pooled credential the request's session uses.
+func (s providerSessions) pinCredential(ctx context.Context, username string) {
+	if s.manager == nil {
+		return
+	}
+	s.manager.mu.Lock()
+	defer s.manager.mu.Unlock()
+	if session := s.sessionLocked(ctx); session != nil {
+		session.credential = username
+	}
+}
+
+// List returns the live sessions ordered by ID.
+func (m *SessionManager) List() []SessionInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweepLocked(m.now())
+	items := make([]SessionInfo, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		items = append(items, m.infoLocked(session))
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+	return items
+}
+
+// Get returns the live session with id.
+func (m *SessionManager) Get(id string) (SessionInfo, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.liveLocked(strings.TrimSpace(id))
+	if !ok {
+		return SessionInfo{}, false
+	}
+	return m.infoLocked(session), true
+}
+
+// Refresh gives the session a new vendor session ID, so the provider moves
+// it to a new exit, and restarts its idle timer. The provider must support
+// session refresh.
+func (m *SessionManager) Refresh(id string) (SessionInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.liveLocked(strings.TrimSpace(id))
+	if !ok {
+		return SessionInfo{}, ErrSessionNotFound
+	}
+	if !m.policies[session.provider].refresh {
+		return SessionInfo{}, ErrSessionRefreshUnsupported
+	}
+	session.vendorID = newSessionToken()
+	session.lastUsedAt = m.now()
+	observability.RecordSessionRefreshed(session.provider)
+	return m.infoLocked(session), nil
+}
+
+// Kill ends the session; the next request naming it opens a new one.
+func (m *SessionManager) Kill(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.liveLocked(strings.TrimSpace(id))
+	if !ok {
+		return ErrSessionNotFound
+	}
+	m.closeLocked(session, SessionClosedKilled)
+	return nil
+}
+
+func (m *SessionManager) liveLocked(id string) (*stickySession, bool) {
+	session := m.sessions[id]
+	if session == nil {
+		return nil, false
+	}
+	if reason := m.expiredLocked(session, m.now()); reason != "" {
+		m.closeLocked(session, reason)
+		return nil, false
+	}
+	return session, true
+}
+
+func (m *SessionManager) sweepLocked(now time.Time) {
+	for _, session := range m.sessions {
+		if reason := m.expiredLocked(session, now); reason != "" {
+			m.closeLocked(session, reason)
+		}
+	}
+}
+
+func (m *SessionManager) infoLocked(session *stickySession) SessionInfo {
+	policy := m.policies[session.provider]
+	expiresAt := session.lastUsedAt.Add(policy.idleTTL)
+	if lifetimeEnd := session.createdAt.Add(policy.maxLifetime); lifetimeEnd.Before(expiresAt) {
+		expiresAt = lifetimeEnd
+	}
+	return SessionInfo{
+		ID:              session.id,
+		TenantID:        session.tenant,
+		Provider:        session.provider,
+		Endpoint:        session.endpoint,
+		Credential:      session.credential,
+		VendorSessionID: session.vendorID,
+		CreatedAt:       session.createdAt,
+		LastUsedAt:      session.lastUsedAt,
+		ExpiresAt:       expiresAt,
+		Requests:        session.requests,
+	}
+}
+
+// sweep closes expired sessions every sessionSweepInterval until stop is
+// closed, then closes the rest.
+func (m *SessionManager) sweep(stop <-chan struct{}) {
+	ticker := time.NewTicker(sessionSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			m.mu.Lock()
+			for _, session := range m.sessions {
+				m.closeLocked(session, SessionClosedShutdown)
+			}
+			m.mu.Unlock()
+			return
+		case <-ticker.C:
+			m.mu.Lock()
+			m.sweepLocked(m.now())
+			m.mu.Unlock()
+		}
+	}
+}
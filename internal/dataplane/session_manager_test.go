@@ -0,0 +1,225 @@
+package dataplane
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/internal/observability"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+func testSessionManager(refresh bool) (*SessionManager, *time.Time) {
+	now := time.Unix(1_700_000_000, 0)
+	manager := newSessionManager(&config.Config{Providers: []config.ProviderConfig{{
+		Name:    "residential",
+		Session: config.ProviderSessionConfig{Supported: true, RefreshSupported: refresh, IdleTTLSeconds: 60, MaxLifetimeSeconds: 300},
+	}}})
+	manager.now = func() time.Time { return now }
+	return manager, &now
+}
+
+func sessionContext(tenant, session string) context.Context {
+	ctx := listeners.WithMetadata(context.Background(), listeners.RequestMetadata{TenantID: tenant})
+	return listeners.WithUpstreamHints(ctx, listeners.UpstreamHints{Session: session})
+}
+
+func testEndpoints(hosts ...string) []listeners.RuntimeEndpoint {
+	endpoints := make([]listeners.RuntimeEndpoint, 0, len(hosts))
+	for _, host := range hosts {
+		endpoints = append(endpoints, listeners.RuntimeEndpoint{URL: &url.URL{Scheme: "http", Host: host}})
+	}
+	return endpoints
+}
+
+func TestSessionManager_PinsEndpointUntilExpiry(t *testing.T) {
+	t.Parallel()
+
+	manager, now := testSessionManager(false)
+	ctx := sessionContext("tenant-a", "s1")
+	manager.bind(ctx, "residential", testEndpoints("a:1", "b:1"))
+
+	endpoints := testEndpoints("b:1", "a:1")
+	manager.bind(ctx, "residential", endpoints)
+	if endpoints[0].URL.Host != "a:1" {
+		t.Fatalf("expected the session to keep endpoint a:1, got %s", endpoints[0].URL.Host)
+	}
+	manager.served(ctx)
+	info, ok := manager.Get("s1")
+	if !ok || info.Requests != 1 || info.TenantID != "tenant-a" || info.VendorSessionID != "s1" {
+		t.Fatalf("expected an open session with 1 request, got %+v (found %v)", info, ok)
+	}
+	if want := now.Add(60 * time.Second); !info.ExpiresAt.Equal(want) {
+		t.Fatalf("expected the session to expire at %s, got %s", want, info.ExpiresAt)
+	}
+
+	*now = now.Add(61 * time.Second)
+	if _, ok := manager.Get("s1"); ok {
+		t.Fatalf("expected the idle session to expire")
+	}
+
+	manager.bind(ctx, "residential", testEndpoints("a:1"))
+	manager.served(ctx)
+	for range 6 {
+		*now = now.Add(50 * time.Second)
+		manager.bind(ctx, "residential", testEndpoints("a:1"))
+		manager.served(ctx)
+	}
+	if info, _ := manager.Get("s1"); info.Requests != 1 {
+		t.Fatalf("expected the session to reopen after its max lifetime, got %+v", info)
+	}
+}
+
+func TestEndpointSelector_CountsSessionRequestsOncePerServedRequest(t *testing.T) {
+	t.Parallel()
+
+	registry := NewProviderRegistry(&config.Config{Providers: []config.ProviderConfig{{
+		Name:      "residential",
+		Type:      "http_proxy",
+		Endpoints: []config.ProviderEndpoint{{URL: "http://a.example:8080", Priority: 1}},
+		Session:   config.ProviderSessionConfig{Supported: true},
+	}}})
+	defer registry.Close()
+	selector := NewEndpointSelector(registry)
+	provider, _ := registry.Get("residential")
+	ctx := sessionContext("tenant-a", "s1")
+
+	// A retry, a hedge and a fallback tier each select again for one request.
+	for range 3 {
+		selector.Select(ctx, provider, &http.Request{})
+	}
+	if info, ok := registry.Sessions().Get("s1"); !ok || info.Requests != 0 {
+		t.Fatalf("expected an open session with no served requests, got %+v (found %v)", info, ok)
+	}
+	registry.ObserveRequestServed(ctx)
+	if info, _ := registry.Sessions().Get("s1"); info.Requests != 1 {
+		t.Fatalf("expected 1 served request, got %+v", info)
+	}
+}
+
+func TestSessionManager_RefreshAndKill(t *testing.T) {
+	t.Parallel()
+
+	manager, _ := testSessionManager(true)
+	ctx := sessionContext("tenant-a", "s1")
+	manager.bind(ctx, "residential", testEndpoints("a:1"))
+	sessions := providerSessions{manager: manager, provider: "residential"}
+
+	refreshed, err := manager.Refresh("s1")
+	if err != nil || refreshed.VendorSessionID == "s1" {
+		t.Fatalf("expected refresh to replace the vendor session, got %+v, %v", refreshed, err)
+	}
+	if vendorID, _ := sessions.vendorSession(ctx); vendorID != refreshed.VendorSessionID {
+		t.Fatalf("expected requests to use vendor session %s, got %s", refreshed.VendorSessionID, vendorID)
+	}
+	if vendorID, ok := sessions.vendorSession(sessionContext("tenant-b", "s1")); ok {
+		t.Fatalf("expected another tenant not to reach the session, got %s", vendorID)
+	}
+
+	if err := manager.Kill("s1"); err != nil {
+		t.Fatalf("kill session: %v", err)
+	}
+	if err := manager.Kill("s1"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected a killed session to be gone, got %v", err)
+	}
+
+	fixed, _ := testSessionManager(false)
+	fixed.bind(ctx, "residential", testEndpoints("a:1"))
+	if _, err := fixed.Refresh("s1"); !errors.Is(err, ErrSessionRefreshUnsupported) {
+		t.Fatalf("expected refresh to be unsupported, got %v", err)
+	}
+	fixed.bind(sessionContext("", "s2"), "other", testEndpoints("a:1"))
+	if items := fixed.List(); len(items) != 1 {
+		t.Fatalf("expected no session on a provider without sessions, got %+v", items)
+	}
+}
+
+func TestForwardProxy_StickySessionHoldsUpstreamSession(t *testing.T) {
+	t.Parallel()
+
+	targetHTTP := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte("ok"))
+	}))
+	defer targetHTTP.Close()
+
+	var mu sync.Mutex
+	var usernames []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		decoded, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(req.Header.Get("Proxy-Authorization"), "Basic "))
+		username, _, _ := strings.Cut(string(decoded), ":")
+		mu.Lock()
+		usernames = append(usernames, username)
+		mu.Unlock()
+		rsp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer rsp.Body.Close()
+		rw.WriteHeader(rsp.StatusCode)
+		_, _ = io.Copy(rw, rsp.Body)
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		Providers: []config.ProviderConfig{{
+			Name:      "residential",
+			Type:      "http_proxy",
+			Auth:      config.ProviderAuthConfig{Type: "basic", Username: "acme", Password: "secret", UsernameTemplate: "{username}[-session-{session}]"},
+			Endpoints: []config.ProviderEndpoint{{URL: upstream.URL, Priority: 1}},
+			Session:   config.ProviderSessionConfig{Supported: true, RefreshSupported: true},
+		}},
+		Routing: config.RoutingConfig{DefaultProvider: "residential"},
+	}
+	runtime := NewRequestRuntime(cfg)
+	registry := runtime.Registry.(*ProviderRegistry)
+	defer registry.Close()
+	proxy := httptest.NewServer(listeners.MetadataMiddleware(observability.HTTPMiddleware(listeners.NewForwardProxyHandlerWithRuntime(runtime), false)))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	headerClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	proxyURL.User = url.UserPassword("client+session=s1", "x")
+	usernameClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	get := func(client *http.Client, header string) {
+		req, _ := http.NewRequest(http.MethodGet, targetHTTP.URL, nil)
+		if header != "" {
+			req.Header.Set(listeners.HintSessionHeader, header)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("forward request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+	}
+	get(headerClient, "s1")
+	get(usernameClient, "")
+	refreshed, err := registry.Sessions().Refresh("s1")
+	if err != nil {
+		t.Fatalf("refresh session: %v", err)
+	}
+	get(usernameClient, "")
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"acme-session-s1", "acme-session-s1", "acme-session-" + refreshed.VendorSessionID}
+	if strings.Join(usernames, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected upstream logins %q, got %q", want, usernames)
+	}
+	info, ok := registry.Sessions().Get("s1")
+	if !ok || info.Requests != 3 || info.Endpoint != upstream.URL {
+		t.Fatalf("expected the session pinned to %s after 3 requests, got %+v", upstream.URL, info)
+	}
+}
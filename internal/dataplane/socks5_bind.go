@@ -0,0 +1,91 @@
+package dataplane
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+)
+
+// socks5BindAcceptTimeout bounds how long a BIND waits for its peer.
+const socks5BindAcceptTimeout = 2 * time.Minute
+
+// handleBind serves SOCKS BIND: the first reply tells the client where the
+// peer should connect, the second reports the peer once it has connected,
+// and the two connections are then tunnelled. Hanging up the control
+// connection cancels the wait.
+func (m *SOCKS5ListenerManager) handleBind(httpReq *http.Request, clientConn net.Conn, req listeners.SOCKS5ConnectRequest) {
+	binding, err := m.handler.BindTarget(httpReq, req.Target)
+	if err != nil {
+		_ = req.WriteReply(clientConn, listeners.SOCKS5ReplyForError(err), nil)
+		return
+	}
+	defer binding.Close()
+
+	if err := req.WriteReply(clientConn, listeners.SOCKS5ReplySucceeded, bindReplyAddr(binding.Addr(), clientConn)); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(httpReq.Context(), socks5BindAcceptTimeout)
+	defer cancel()
+	watched := make(chan error, 1)
+	early := make([]byte, 1)
+	var earlyN int
+	go func() {
+		var err error
+		earlyN, err = clientConn.Read(early)
+		if err != nil {
+			cancel()
+		}
+		watched <- err
+	}()
+
+	peerConn, peerAddr, acceptErr := binding.Accept(ctx)
+	// Stop watching the control connection before it becomes a tunnel end.
+	_ = clientConn.SetReadDeadline(time.Now())
+	watchErr := <-watched
+	_ = clientConn.SetReadDeadline(time.Time{})
+
+	if acceptErr != nil {
+		if watchErr == nil || isTimeoutError(watchErr) {
+			_ = req.WriteReply(clientConn, listeners.SOCKS5ReplyGeneralFailure, nil)
+		}
+		return
+	}
+	defer peerConn.Close()
+	if watchErr != nil && !isTimeoutError(watchErr) {
+		return
+	}
+
+	if err := req.WriteReply(clientConn, listeners.SOCKS5ReplySucceeded, peerAddr); err != nil {
+		return
+	}
+	if earlyN > 0 {
+		if _, err := peerConn.Write(early[:earlyN]); err != nil {
+			return
+		}
+	}
+	m.relay(httpReq, req, clientConn, peerConn)
+}
+
+// bindReplyAddr reports a binding on every local address as the address the
+// client reached this listener on.
+func bindReplyAddr(addr net.Addr, clientConn net.Conn) net.Addr {
+	bound, ok := addr.(*net.TCPAddr)
+	if !ok || !bound.IP.IsUnspecified() {
+		return addr
+	}
+	local, ok := clientConn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return addr
+	}
+	return &net.TCPAddr{IP: local.IP, Port: bound.Port}
+}
+
+func isTimeoutError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,170 @@
+package dataplane
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+// socks5Bind sends BIND for peerHost and returns the control connection with
+// the address from the first reply.
+func socks5Bind(t *testing.T, proxyAddr, peerHost string) (net.Conn, string) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", proxyAddr, time.Second)
+	if err != nil {
+		t.Fatalf("dial socks listener: %v", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		t.Fatalf("write greeting: %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatalf("read method select: %v", err)
+	}
+	atyp, addrBytes := encodeSOCKS5Addr(t, peerHost)
+	bindReq := append([]byte{0x05, 0x02, 0x00, atyp}, addrBytes...)
+	if _, err := conn.Write(append(bindReq, 0, 0)); err != nil {
+		t.Fatalf("write bind request: %v", err)
+	}
+	return conn, readSOCKS5ReplyAddr(t, conn)
+}
+
+func readSOCKS5ReplyAddr(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("read bind reply: %v", err)
+	}
+	if reply[1] != 0x00 || reply[3] != 0x01 {
+		t.Fatalf("unexpected bind reply %v", reply)
+	}
+	port := int(reply[8])<<8 | int(reply[9])
+	return (&net.TCPAddr{IP: net.IP(reply[4:8]), Port: port}).String()
+}
+
+func TestSOCKS5ListenerManager_Bind(t *testing.T) {
+	t.Parallel()
+
+	upstreamAddr := startSOCKS5Listener(t, &config.Config{})
+	for _, tc := range []struct {
+		name string
+		cfg  *config.Config
+	}{
+		{name: "direct", cfg: &config.Config{}},
+		{name: "socks5_upstream", cfg: &config.Config{
+			Providers: []config.ProviderConfig{{
+				Name: "upstream", Type: "socks5_proxy",
+				Endpoints: []config.ProviderEndpoint{{URL: "socks5://" + upstreamAddr, Priority: 1}},
+			}},
+			Routing: config.RoutingConfig{DefaultProvider: "upstream"},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			proxyAddr := startSOCKS5Listener(t, tc.cfg)
+			control, bindAddr := socks5Bind(t, proxyAddr, "127.0.0.1")
+			defer control.Close()
+
+			peer, err := net.DialTimeout("tcp", bindAddr, time.Second)
+			if err != nil {
+				t.Fatalf("dial bind address %s: %v", bindAddr, err)
+			}
+			defer peer.Close()
+			if got := readSOCKS5ReplyAddr(t, control); got != peer.LocalAddr().String() {
+				t.Fatalf("expected second reply to name peer %s, got %s", peer.LocalAddr(), got)
+			}
+
+			if _, err := control.Write([]byte("ping")); err != nil {
+				t.Fatalf("write through bind: %v", err)
+			}
+			buf := make([]byte, 4)
+			_ = peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "ping" {
+				t.Fatalf("expected ping at peer, got %q err=%v", buf, err)
+			}
+			if _, err := peer.Write([]byte("pong")); err != nil {
+				t.Fatalf("write from peer: %v", err)
+			}
+			if _, err := io.ReadFull(control, buf); err != nil || string(buf) != "pong" {
+				t.Fatalf("expected pong at client, got %q err=%v", buf, err)
+			}
+		})
+	}
+}
+
+func TestSOCKS5ListenerManager_BindRefusesOtherPeers(t *testing.T) {
+	t.Parallel()
+
+	proxyAddr := startSOCKS5Listener(t, &config.Config{})
+	control, bindAddr := socks5Bind(t, proxyAddr, "192.0.2.1")
+	defer control.Close()
+
+	peer, err := net.DialTimeout("tcp", bindAddr, time.Second)
+	if err != nil {
+		t.Fatalf("dial bind address: %v", err)
+	}
+	defer peer.Close()
+	_ = peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected connection from an unexpected peer to be closed")
+	}
+}
+
+func TestSOCKS4ListenerManager_ConnectAndBind(t *testing.T) {
+	t.Parallel()
+
+	target := startPingPongTCPServer(t)
+	defer target.Close()
+	proxyAddr := startSOCKS5Listener(t, &config.Config{})
+	_, port := splitAddr(t, target.Addr().String())
+
+	// SOCKS4a: 0.0.0.1 defers name resolution to the proxy.
+	conn, err := net.DialTimeout("tcp", proxyAddr, time.Second)
+	if err != nil {
+		t.Fatalf("dial socks listener: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	request := []byte{0x04, 0x01, byte(port >> 8), byte(port), 0, 0, 0, 1, 'l', 'e', 'g', 'a', 'c', 'y', 0}
+	if _, err := conn.Write(append(request, "localhost\x00"...)); err != nil {
+		t.Fatalf("write socks4a request: %v", err)
+	}
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[0] != 0x00 || reply[1] != 0x5A {
+		t.Fatalf("expected SOCKS4 grant, got %v err=%v", reply, err)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write ping: %v", err)
+	}
+	pong := make([]byte, 4)
+	if _, err := io.ReadFull(conn, pong); err != nil || string(pong) != "pong" {
+		t.Fatalf("expected pong through SOCKS4a tunnel, got %q err=%v", pong, err)
+	}
+
+	bind, err := net.DialTimeout("tcp", proxyAddr, time.Second)
+	if err != nil {
+		t.Fatalf("dial socks listener: %v", err)
+	}
+	defer bind.Close()
+	_ = bind.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := bind.Write([]byte{0x04, 0x02, 0, 0, 127, 0, 0, 1, 0}); err != nil {
+		t.Fatalf("write socks4 bind: %v", err)
+	}
+	if _, err := io.ReadFull(bind, reply); err != nil || reply[1] != 0x5A {
+		t.Fatalf("expected SOCKS4 bind grant, got %v err=%v", reply, err)
+	}
+	bindAddr := &net.TCPAddr{IP: net.IP(reply[4:8]), Port: int(reply[2])<<8 | int(reply[3])}
+	peer, err := net.DialTimeout("tcp", bindAddr.String(), time.Second)
+	if err != nil {
+		t.Fatalf("dial SOCKS4 bind address %s: %v", bindAddr, err)
+	}
+	defer peer.Close()
+	if _, err := io.ReadFull(bind, reply); err != nil || reply[1] != 0x5A {
+		t.Fatalf("expected second SOCKS4 bind reply, got %v err=%v", reply, err)
+	}
+	if got := (&net.TCPAddr{IP: net.IP(reply[4:8]), Port: int(reply[2])<<8 | int(reply[3])}).String(); got != peer.LocalAddr().String() {
+		t.Fatalf("expected second reply to name peer %s, got %s", peer.LocalAddr(), got)
+	}
+}
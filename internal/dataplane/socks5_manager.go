@@ -8,11 +8,11 @@ import (
 	"net"
 	"net/http"
 	"net/url"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/internal/observability"
 	"github.com/pzaino/microproxy/pkg/config"
 )
 
@@ -20,16 +20,27 @@ import (
 type SOCKS5ListenerManager struct {
 	drainTimeout time.Duration
 	runtime      listeners.RequestRuntime
+	tenantFilter tenantClientFilter
 	dialer       *net.Dialer
+	handler      *listeners.ForwardProxyHandler
+	// accessLogEnabled emits an access log line when a session ends.
+	accessLogEnabled bool
 
 	mu      sync.Mutex
 	started bool
 	servers []*socks5ServerState
+	// ctx is cancelled on shutdown and parents every SOCKS request.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 type socks5ServerState struct {
-	cfg      config.ListenerConfig
-	listener net.Listener
+	cfg         config.ListenerConfig
+	listener    net.Listener
+	limiter     *rateLimiter
+	connLimiter *connLimiter
+	credentials listeners.CredentialStore
+	clientACL   *clientACL
 
 	connMu sync.Mutex
 	conns  map[net.Conn]struct{}
@@ -42,12 +53,24 @@ func NewSOCKS5ListenerManager(listenerConfigs []config.ListenerConfig, drainTime
 	}
 	states := make([]*socks5ServerState, 0, len(listenerConfigs))
 	for _, listenerCfg := range listenerConfigs {
-		states = append(states, &socks5ServerState{cfg: listenerCfg, conns: make(map[net.Conn]struct{})})
+		states = append(states, &socks5ServerState{
+			cfg:         listenerCfg,
+			limiter:     newRateLimiter(listenerCfg),
+			connLimiter: newConnLimiter(listenerCfg),
+			credentials: listenerCredentials(listenerCfg),
+			clientACL:   newClientACL(listenerCfg.AllowCIDRs, listenerCfg.DenyCIDRs),
+			conns:       make(map[net.Conn]struct{}),
+		})
 	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	handler := listeners.NewForwardProxyHandlerWithRuntime(runtime)
+	handler.Dialer = dialer
 	return &SOCKS5ListenerManager{
 		drainTimeout: drainTimeout,
 		runtime:      runtime,
-		dialer:       &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second},
+		tenantFilter: runtimeTenantFilter(runtime),
+		dialer:       dialer,
+		handler:      handler,
 		servers:      states,
 	}
 }
@@ -59,6 +82,7 @@ func (m *SOCKS5ListenerManager) Start(ctx context.Context) error {
 		return nil
 	}
 	m.started = true
+	m.ctx, m.cancel = context.WithCancel(context.Background())
 	m.mu.Unlock()
 
 	for _, state := range m.servers {
@@ -67,7 +91,7 @@ func (m *SOCKS5ListenerManager) Start(ctx context.Context) error {
 			_ = m.Shutdown(ctx)
 			return fmt.Errorf("listen %s (%s): %w", state.cfg.Name, state.cfg.Address, err)
 		}
-		state.listener = listener
+		state.listener = limitConnections(filterClients(listener, state.cfg.Name, state.clientACL), state.connLimiter)
 		go m.serveListener(state)
 	}
 
@@ -89,79 +113,129 @@ func (m *SOCKS5ListenerManager) serveListener(state *socks5ServerState) {
 			defer state.wg.Done()
 			defer state.untrackConn(clientConn)
 			defer clientConn.Close()
-			m.handleSOCKS5Connection(clientConn, state.cfg)
+			m.handleSOCKS5Connection(clientConn, state)
 		}(conn)
 	}
 }
 
-func (m *SOCKS5ListenerManager) handleSOCKS5Connection(clientConn net.Conn, listenerCfg config.ListenerConfig) {
-	authCfg := listeners.SOCKS5AuthConfig{}
-	if strings.EqualFold(strings.TrimSpace(listenerCfg.AuthType), "basic") {
-		authCfg.Username = listenerCfg.Username
-		authCfg.Password = listenerCfg.Password
-	}
+func (m *SOCKS5ListenerManager) handleSOCKS5Connection(clientConn net.Conn, state *socks5ServerState) {
+	listenerCfg := state.cfg
+	authCfg := listeners.SOCKS5AuthConfig{Store: state.credentials}
 
-	req, err := listeners.PerformSOCKS5Handshake(clientConn, authCfg)
+	// read_header_timeout bounds the handshake, up to the request.
+	if timeout := time.Duration(listenerCfg.ReadHeaderTimeoutSeconds) * time.Second; timeout > 0 {
+		_ = clientConn.SetDeadline(time.Now().Add(timeout))
+	}
+	req, err := listeners.PerformSOCKSHandshake(clientConn, authCfg)
 	if err != nil {
+		if isTimeoutError(err) {
+			observability.RecordConnectionDropped(listenerCfg.Name, connDropReadHeaderTimeout)
+		}
+		return
+	}
+	_ = clientConn.SetDeadline(time.Time{})
+
+	tenantID := socksMetadata(req).TenantID
+	if m.tenantFilter != nil && !m.tenantFilter.allowsTenantClient(tenantID, clientConn.RemoteAddr().String()) {
+		observability.RecordConnectionDropped(listenerCfg.Name, connDropClientIP)
+		_ = req.WriteReply(clientConn, listeners.SOCKS5ReplyConnectionNotAllowed, nil)
+		return
+	}
+	if state.limiter != nil {
+		if allowed, _ := state.limiter.allow(state.limiter.keyFor(clientConn.RemoteAddr().String(), tenantID)); !allowed {
+			observability.RecordRateLimitRejection(listenerCfg.Name, "socks5")
+			_ = req.WriteReply(clientConn, listeners.SOCKS5ReplyConnectionNotAllowed, nil)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithCancel(m.ctx)
+	defer cancel()
+	httpReq := m.socks5Request(ctx, state, clientConn, req)
+	switch {
+	case req.IsBind():
+		m.handleBind(httpReq, clientConn, req)
+		return
+	case req.IsUDPAssociate():
+		m.handleUDPAssociate(httpReq, clientConn, req)
 		return
 	}
 
-	targetConn, err := m.dialSOCKS5Target(clientConn, req.Target)
+	targetConn, err := m.handler.ConnectTarget(httpReq, req.Target)
 	if err != nil {
-		_ = listeners.WriteSOCKS5ConnectReply(clientConn, 0x05, nil)
+		_ = req.WriteReply(clientConn, listeners.SOCKS5ReplyForError(err), nil)
 		return
 	}
 	defer targetConn.Close()
 
-	if err := listeners.WriteSOCKS5ConnectReply(clientConn, 0x00, targetConn.LocalAddr()); err != nil {
+	if err := req.WriteReply(clientConn, listeners.SOCKS5ReplySucceeded, targetConn.LocalAddr()); err != nil {
 		return
 	}
 
-	tunnelConns(clientConn, targetConn)
+	m.relay(httpReq, req, clientConn, targetConn)
 }
 
-func (m *SOCKS5ListenerManager) dialSOCKS5Target(clientConn net.Conn, targetAddr string) (net.Conn, error) {
-	ctx := context.Background()
-	if m.runtime.Resolver == nil {
-		return m.dialer.DialContext(ctx, "tcp", targetAddr)
-	}
+// relay tunnels an established SOCKS session and reports its byte counts.
+func (m *SOCKS5ListenerManager) relay(httpReq *http.Request, req listeners.SOCKS5ConnectRequest, clientConn, targetConn net.Conn) {
+	meter := m.handler.StartTunnel(httpReq, func() {
+		_ = clientConn.Close()
+		_ = targetConn.Close()
+	})
+	tunnelConns(clientConn, targetConn, meter)
+	m.logTunnel(httpReq, req, meter.Finish())
+}
 
-	req := (&http.Request{Method: http.MethodConnect, Host: targetAddr, URL: &url.URL{Host: targetAddr}}).WithContext(ctx)
-	metadata := listeners.RequestMetadata{}
-	decision, err := m.runtime.Resolver.Resolve(req, metadata)
-	if err != nil {
-		return nil, err
-	}
-	if decision.Provider == "" || m.runtime.Registry == nil {
-		return m.dialer.DialContext(ctx, "tcp", targetAddr)
+func (m *SOCKS5ListenerManager) logTunnel(httpReq *http.Request, req listeners.SOCKS5ConnectRequest, stats listeners.TunnelStats) {
+	if !m.accessLogEnabled {
+		return
 	}
+	metadata, _ := listeners.MetadataFromContext(httpReq.Context())
+	observability.TunnelAccessLog(metadata, socksCommandName(req), req.Target, stats)
+}
 
-	provider, ok := m.runtime.Registry.Get(decision.Provider)
-	if !ok {
-		return nil, fmt.Errorf("provider %q not found", decision.Provider)
+func socksCommandName(req listeners.SOCKS5ConnectRequest) string {
+	switch {
+	case req.IsBind():
+		return "BIND"
+	case req.IsUDPAssociate():
+		return "UDP ASSOCIATE"
+	default:
+		return "CONNECT"
 	}
+}
 
-	endpoints := provider.Endpoints
-	if m.runtime.Selector != nil {
-		endpoints = m.runtime.Selector.Select(ctx, provider, req)
-	}
-	if len(endpoints) == 0 {
-		return m.dialer.DialContext(ctx, "tcp", targetAddr)
+// socks5Request presents a SOCKS request to the forward-proxy pipeline as an
+// HTTP CONNECT to its target, so routing rules and policies apply as they do
+// to HTTP CONNECT.
+func (m *SOCKS5ListenerManager) socks5Request(ctx context.Context, state *socks5ServerState, clientConn net.Conn, req listeners.SOCKS5ConnectRequest) *http.Request {
+	metadata := socksMetadata(req)
+	metadata.RequestID = listeners.NewRequestID()
+	metadata.Listener = state.cfg.Name
+	metadata.ClientIP = listeners.ClientIPFromAddr(clientConn.RemoteAddr().String())
+	ctx = listeners.WithTunnelLimits(ctx, listenerTunnelLimits(state.cfg))
+	ctx = listeners.WithMetadata(ctx, metadata)
+	if session := listeners.ParseSOCKSUsername(req.Username).Session; session != "" {
+		ctx = listeners.WithUpstreamHints(ctx, listeners.UpstreamHints{Session: session})
 	}
+	return (&http.Request{
+		Method:     http.MethodConnect,
+		Host:       req.Target,
+		URL:        &url.URL{Host: req.Target},
+		Header:     http.Header{},
+		RemoteAddr: clientConn.RemoteAddr().String(),
+	}).WithContext(ctx)
+}
 
-	var errs []error
-	for _, endpoint := range endpoints {
-		adapter := endpoint.Adapter
-		if adapter == nil {
-			adapter = directAdapter{}
-		}
-		conn, err := adapter.DialConnect(ctx, targetAddr, endpoint.URL, m.dialer)
-		if err == nil {
-			return conn, nil
-		}
-		errs = append(errs, err)
+// socksMetadata takes tenant and provider from hints in the SOCKS username.
+// An authenticated account overrides the tenant hint, and the provider hint
+// when the account has a provider.
+func socksMetadata(req listeners.SOCKS5ConnectRequest) listeners.RequestMetadata {
+	hints := listeners.ParseSOCKSUsername(req.Username)
+	metadata := listeners.RequestMetadata{TenantID: hints.TenantID, Provider: hints.Provider}
+	if req.Credential != nil {
+		metadata.ApplyCredential(*req.Credential)
 	}
-	return nil, errors.Join(errs...)
+	return metadata
 }
 
 func (m *SOCKS5ListenerManager) Shutdown(ctx context.Context) error {
@@ -171,6 +245,7 @@ func (m *SOCKS5ListenerManager) Shutdown(ctx context.Context) error {
 		return nil
 	}
 	m.started = false
+	m.cancel()
 	m.mu.Unlock()
 
 	var errs []error
@@ -222,17 +297,19 @@ func (s *socks5ServerState) closeTrackedConnections() {
 	}
 }
 
-func tunnelConns(left, right net.Conn) {
+// tunnelConns relays between the SOCKS client on left and the target on
+// right until either side stops, counting bytes on meter.
+func tunnelConns(left, right net.Conn, meter *listeners.TunnelMeter) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		_, _ = io.Copy(left, right)
+		_, _ = io.Copy(meter.ClientWriter(left), right)
 		_ = left.SetDeadline(time.Now())
 	}()
 	go func() {
 		defer wg.Done()
-		_, _ = io.Copy(right, left)
+		_, _ = io.Copy(meter.TargetWriter(right), left)
 		_ = right.SetDeadline(time.Now())
 	}()
 	wg.Wait()
@@ -0,0 +1,132 @@
+package dataplane
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+// socks5ConnectAs offers only username/password auth so the username can
+// carry routing hints, sends CONNECT to target, and returns the reply code
+// with the connection.
+func socks5ConnectAs(t *testing.T, proxyAddr, username, target string) (net.Conn, byte) {
+	t.Helper()
+	return socks5ConnectWithPassword(t, proxyAddr, username, "", target)
+}
+
+// socks5ConnectWithPassword is socks5ConnectAs with a password.
+func socks5ConnectWithPassword(t *testing.T, proxyAddr, username, password, target string) (net.Conn, byte) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", proxyAddr, time.Second)
+	if err != nil {
+		t.Fatalf("dial socks listener: %v", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte{0x05, 0x01, 0x02}); err != nil {
+		t.Fatalf("write greeting: %v", err)
+	}
+	selected := make([]byte, 2)
+	if _, err := io.ReadFull(conn, selected); err != nil || selected[1] != 0x02 {
+		t.Fatalf("expected username/password method, got %v err=%v", selected, err)
+	}
+	authReq := append([]byte{0x01, byte(len(username))}, username...)
+	authReq = append(append(authReq, byte(len(password))), password...)
+	if _, err := conn.Write(authReq); err != nil {
+		t.Fatalf("write auth request: %v", err)
+	}
+	if _, err := io.ReadFull(conn, selected); err != nil || selected[1] != 0x00 {
+		t.Fatalf("expected auth success, got %v err=%v", selected, err)
+	}
+
+	host, port := splitAddr(t, target)
+	atyp, addrBytes := encodeSOCKS5Addr(t, host)
+	connectReq := append([]byte{0x05, 0x01, 0x00, atyp}, addrBytes...)
+	if _, err := conn.Write(append(connectReq, byte(port>>8), byte(port))); err != nil {
+		t.Fatalf("write connect request: %v", err)
+	}
+	replyHead := make([]byte, 4)
+	if _, err := io.ReadFull(conn, replyHead); err != nil {
+		t.Fatalf("read connect reply: %v", err)
+	}
+	if err := consumeSOCKS5AddrPort(conn, replyHead[3]); err != nil {
+		t.Fatalf("read connect reply addr: %v", err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, replyHead[1]
+}
+
+func TestSOCKS5ListenerManager_RoutingAndPolicyPipeline(t *testing.T) {
+	t.Parallel()
+
+	target := startPingPongTCPServer(t)
+	defer target.Close()
+	unreachable, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("reserve unreachable port: %v", err)
+	}
+	deadAddr := unreachable.Addr().String()
+	unreachable.Close()
+
+	cfg := &config.Config{
+		Listeners: []config.ListenerConfig{{Name: "socks", Type: "socks5", Address: "127.0.0.1:0", Enabled: true}},
+		Providers: []config.ProviderConfig{
+			{Name: "direct", Type: "direct", Endpoints: []config.ProviderEndpoint{{URL: "http://direct.local", Priority: 1}}},
+			{
+				Name:      "dead-socks",
+				Type:      "socks5_proxy",
+				Endpoints: []config.ProviderEndpoint{{URL: "socks5://" + deadAddr, Priority: 1}},
+				Health:    config.ProviderHealthConfig{FailureThreshold: 3},
+			},
+		},
+		Routing: config.RoutingConfig{Rules: []config.RoutingRule{
+			{Name: "blocked", Match: map[string]string{"tenant": "blocked"}, Provider: "direct", PolicyRef: "deny-all"},
+			{Name: "rerouted", Match: map[string]string{"tenant": "rerouted"}, Provider: "dead-socks", PolicyRef: "use-direct"},
+		}},
+		Policies: []config.PolicyConfig{
+			{Name: "deny-all", Type: "access", Action: "deny"},
+			{Name: "use-direct", Type: "routing", Action: "route_override", Parameters: map[string]string{"provider": "direct"}},
+		},
+	}
+	runtime := NewRequestRuntime(cfg)
+	mgr := NewSOCKS5ListenerManager(cfg.Listeners, time.Second, runtime)
+	if err := mgr.Start(context.Background()); err != nil {
+		t.Fatalf("start socks5 manager: %v", err)
+	}
+	defer func() { _ = mgr.Shutdown(context.Background()) }()
+	proxyAddr := mgr.servers[0].listener.Addr().String()
+	targetAddr := target.Addr().String()
+
+	conn, reply := socks5ConnectAs(t, proxyAddr, "alice+tenant=blocked", targetAddr)
+	conn.Close()
+	if reply != listeners.SOCKS5ReplyConnectionNotAllowed {
+		t.Fatalf("expected policy deny to map to connection not allowed, got %d", reply)
+	}
+
+	conn, reply = socks5ConnectAs(t, proxyAddr, "alice+tenant=rerouted", targetAddr)
+	if reply != listeners.SOCKS5ReplySucceeded {
+		t.Fatalf("expected route_override to reach the target, got reply %d", reply)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write ping: %v", err)
+	}
+	pong := make([]byte, 4)
+	if _, err := io.ReadFull(conn, pong); err != nil || string(pong) != "pong" {
+		t.Fatalf("expected pong through overridden route, got %q err=%v", pong, err)
+	}
+	conn.Close()
+
+	conn, reply = socks5ConnectAs(t, proxyAddr, "alice+provider=dead-socks", targetAddr)
+	conn.Close()
+	if reply != listeners.SOCKS5ReplyConnectionRefused {
+		t.Fatalf("expected refused upstream to map to connection refused, got %d", reply)
+	}
+	health := runtime.Registry.(*ProviderRegistry).SnapshotProviderHealth("dead-socks")
+	if len(health) != 1 || health[0].Health.State != EndpointHealthDegraded {
+		t.Fatalf("expected failed SOCKS dial to degrade the endpoint, got %+v", health)
+	}
+}
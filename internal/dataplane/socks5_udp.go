@@ -0,0 +1,119 @@
+package dataplane
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+)
+
+// socks5UDPBufferSize fits the largest UDP payload plus a relay header.
+const socks5UDPBufferSize = 64 * 1024
+
+// handleUDPAssociate serves a SOCKS5 UDP ASSOCIATE. Datagrams from the client
+// reach a relay socket bound next to the listener and leave through the
+// provider selected for the association; replies come back the same way. The
+// association lives as long as the TCP control connection.
+func (m *SOCKS5ListenerManager) handleUDPAssociate(httpReq *http.Request, clientConn net.Conn, req listeners.SOCKS5ConnectRequest) {
+	association, err := m.handler.AssociateUDP(httpReq)
+	if err != nil {
+		_ = listeners.WriteSOCKS5ConnectReply(clientConn, listeners.SOCKS5ReplyForError(err), nil)
+		return
+	}
+
+	localIP := clientConn.LocalAddr().(*net.TCPAddr).IP
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		_ = association.Close()
+		_ = listeners.WriteSOCKS5ConnectReply(clientConn, listeners.SOCKS5ReplyGeneralFailure, nil)
+		return
+	}
+	if err := listeners.WriteSOCKS5ConnectReply(clientConn, listeners.SOCKS5ReplySucceeded, relay.LocalAddr()); err != nil {
+		_ = relay.Close()
+		_ = association.Close()
+		return
+	}
+
+	client := &udpClient{ip: clientConn.RemoteAddr().(*net.TCPAddr).IP, port: req.Port}
+	meter := m.handler.StartTunnel(httpReq, func() { _ = clientConn.Close() })
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		relayFromClient(relay, association, client, meter)
+	}()
+	go func() {
+		defer wg.Done()
+		relayToClient(relay, association, client, meter)
+	}()
+
+	// RFC 1928: the association ends when the TCP connection does.
+	_, _ = io.Copy(io.Discard, clientConn)
+	_ = relay.Close()
+	_ = association.Close()
+	wg.Wait()
+	m.logTunnel(httpReq, req, meter.Finish())
+}
+
+// udpClient tracks the address the client sends datagrams from. Only the
+// host of the control connection may use the relay; when the client named a
+// port in its request, only that port is accepted.
+type udpClient struct {
+	ip   net.IP
+	port int
+	addr atomic.Pointer[net.UDPAddr]
+}
+
+func (c *udpClient) accept(from *net.UDPAddr) bool {
+	if !from.IP.Equal(c.ip) || (c.port != 0 && from.Port != c.port) {
+		return false
+	}
+	c.addr.Store(from)
+	return true
+}
+
+func relayFromClient(relay *net.UDPConn, association listeners.UDPAssociation, client *udpClient, meter *listeners.TunnelMeter) {
+	buf := make([]byte, socks5UDPBufferSize)
+	for {
+		n, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !client.accept(from) {
+			continue
+		}
+		// Malformed and fragmented datagrams are dropped silently.
+		datagram, err := listeners.ParseSOCKS5UDPDatagram(buf[:n])
+		if err != nil {
+			continue
+		}
+		if association.WriteTo(datagram.Payload, datagram.Target) == nil {
+			meter.RecordSent(int64(len(datagram.Payload)))
+		}
+	}
+}
+
+func relayToClient(relay *net.UDPConn, association listeners.UDPAssociation, client *udpClient, meter *listeners.TunnelMeter) {
+	buf := make([]byte, socks5UDPBufferSize)
+	packet := make([]byte, 0, socks5UDPBufferSize+262)
+	for {
+		n, source, err := association.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		to := client.addr.Load()
+		if to == nil {
+			continue
+		}
+		packet, err = listeners.AppendSOCKS5UDPDatagram(packet[:0], source, buf[:n])
+		if err != nil {
+			continue
+		}
+		if _, err := relay.WriteToUDP(packet, to); err == nil {
+			meter.RecordReceived(int64(n))
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package dataplane
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+func startUDPEchoServer(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return conn
+}
+
+func startSOCKS5Listener(t *testing.T, cfg *config.Config) string {
+	t.Helper()
+	cfg.Listeners = []config.ListenerConfig{{Name: "socks", Type: "socks5", Address: "127.0.0.1:0", Enabled: true}}
+	mgr := NewSOCKS5ListenerManager(cfg.Listeners, time.Second, NewRequestRuntime(cfg))
+	if err := mgr.Start(context.Background()); err != nil {
+		t.Fatalf("start socks5 manager: %v", err)
+	}
+	t.Cleanup(func() { _ = mgr.Shutdown(context.Background()) })
+	return mgr.servers[0].listener.Addr().String()
+}
+
+// socks5UDPAssociate sends UDP ASSOCIATE and returns the control connection,
+// the reply code, and the relay address.
+func socks5UDPAssociate(t *testing.T, proxyAddr string) (net.Conn, byte, *net.UDPAddr) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", proxyAddr, time.Second)
+	if err != nil {
+		t.Fatalf("dial socks listener: %v", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		t.Fatalf("write greeting: %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatalf("read method select: %v", err)
+	}
+	if _, err := conn.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatalf("write udp associate: %v", err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("read udp associate reply: %v", err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	relay := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])}
+	return conn, reply[1], relay
+}
+
+func exchangeSOCKS5UDP(t *testing.T, client *net.UDPConn, relay *net.UDPAddr, target, payload string) (string, string) {
+	t.Helper()
+	packet, err := listeners.AppendSOCKS5UDPDatagram(nil, target, []byte(payload))
+	if err != nil {
+		t.Fatalf("encode datagram: %v", err)
+	}
+	if _, err := client.WriteToUDP(packet, relay); err != nil {
+		t.Fatalf("write datagram: %v", err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("read relayed datagram: %v", err)
+	}
+	datagram, err := listeners.ParseSOCKS5UDPDatagram(buf[:n])
+	if err != nil {
+		t.Fatalf("parse relayed datagram: %v", err)
+	}
+	return datagram.Target, string(datagram.Payload)
+}
+
+func TestSOCKS5ListenerManager_UDPAssociate(t *testing.T) {
+	t.Parallel()
+
+	echo := startUDPEchoServer(t)
+	echoAddr := echo.LocalAddr().String()
+	upstreamAddr := startSOCKS5Listener(t, &config.Config{})
+
+	for _, tc := range []struct {
+		name     string
+		provider config.ProviderConfig
+	}{
+		{name: "direct", provider: config.ProviderConfig{
+			Name: "udp", Type: "direct",
+			Endpoints: []config.ProviderEndpoint{{URL: "http://direct.local", Priority: 1}},
+		}},
+		{name: "socks5_upstream", provider: config.ProviderConfig{
+			Name: "udp", Type: "socks5_proxy", Capabilities: []string{"udp"},
+			Endpoints: []config.ProviderEndpoint{{URL: "socks5://" + upstreamAddr, Priority: 1}},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			proxyAddr := startSOCKS5Listener(t, &config.Config{
+				Providers: []config.ProviderConfig{tc.provider},
+				Routing:   config.RoutingConfig{DefaultProvider: "udp"},
+			})
+			control, status, relay := socks5UDPAssociate(t, proxyAddr)
+			defer control.Close()
+			if status != listeners.SOCKS5ReplySucceeded {
+				t.Fatalf("expected udp associate to succeed, got reply %d", status)
+			}
+
+			client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatalf("listen client udp: %v", err)
+			}
+			defer client.Close()
+
+			source, payload := exchangeSOCKS5UDP(t, client, relay, echoAddr, "ping")
+			if source != echoAddr || payload != "ping" {
+				t.Fatalf("expected echo from %s, got %q from %s", echoAddr, payload, source)
+			}
+
+			// A fragment is dropped, so the next reply belongs to the next datagram.
+			fragment, _ := listeners.AppendSOCKS5UDPDatagram(nil, echoAddr, []byte("frag"))
+			fragment[2] = 1
+			_, _ = client.WriteToUDP(fragment, relay)
+			if _, payload := exchangeSOCKS5UDP(t, client, relay, echoAddr, "again"); payload != "again" {
+				t.Fatalf("expected fragment to be dropped, got %q", payload)
+			}
+		})
+	}
+}
+
+func TestSOCKS5ListenerManager_UDPAssociateTeardown(t *testing.T) {
+	t.Parallel()
+
+	echo := startUDPEchoServer(t)
+	proxyAddr := startSOCKS5Listener(t, &config.Config{})
+	control, status, relay := socks5UDPAssociate(t, proxyAddr)
+	if status != listeners.SOCKS5ReplySucceeded {
+		t.Fatalf("expected udp associate to succeed, got reply %d", status)
+	}
+
+	client, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatalf("dial relay: %v", err)
+	}
+	defer client.Close()
+	packet, _ := listeners.AppendSOCKS5UDPDatagram(nil, echo.LocalAddr().String(), []byte("ping"))
+	if _, err := client.Write(packet); err != nil {
+		t.Fatalf("write datagram: %v", err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Read(make([]byte, 2048)); err != nil {
+		t.Fatalf("expected relay to answer before teardown: %v", err)
+	}
+
+	_ = control.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		_, _ = client.Write(packet)
+		_ = client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := client.Read(make([]byte, 2048)); err != nil && !isTimeoutError(err) {
+			return
+		}
+	}
+	t.Fatalf("expected relay to close with the control connection")
+}
+
+func TestSOCKS5ListenerManager_UDPAssociateUnsupportedProvider(t *testing.T) {
+	t.Parallel()
+
+	upstreamAddr := startSOCKS5Listener(t, &config.Config{})
+	proxyAddr := startSOCKS5Listener(t, &config.Config{
+		Providers: []config.ProviderConfig{{
+			Name: "tcp-only", Type: "socks5_proxy",
+			Endpoints: []config.ProviderEndpoint{{URL: "socks5://" + upstreamAddr, Priority: 1}},
+		}},
+		Routing: config.RoutingConfig{DefaultProvider: "tcp-only"},
+	})
+	control, status, _ := socks5UDPAssociate(t, proxyAddr)
+	defer control.Close()
+	if status != listeners.SOCKS5ReplyCommandNotSupported {
+		t.Fatalf("expected command not supported for provider without udp, got reply %d", status)
+	}
+}
@@ -0,0 +1,165 @@
+package dataplane
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+// Bounds applied to every cached upstream transport. Each transport serves a
+// single endpoint/credential pair, so the per-host limit is the one that
+// matters for proxy upstreams; direct transports fan out to many targets.
+const (
+	defaultTransportCacheSize      = 256
+	cachedTransportMaxIdleConns    = 64
+	cachedTransportMaxIdlePerHost  = 16
+	cachedTransportIdleConnTimeout = 90 * time.Second
+)
+
+// transportCache keeps one http.Transport per upstream endpoint and credential
+// so keep-alive connections survive between requests and retry attempts. The
+// least recently used transport is evicted, and its idle connections closed,
+// once the cache is full.
+type transportCache struct {
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	closed  bool
+}
+
+type cachedTransport struct {
+	key       string
+	transport *http.Transport
+}
+
+func newTransportCache(maxEntries int) *transportCache {
+	if maxEntries <= 0 {
+		maxEntries = defaultTransportCacheSize
+	}
+	return &transportCache{maxEntries: maxEntries, entries: map[string]*list.Element{}, order: list.New()}
+}
+
+// get returns the transport cached under key, building it from base when
+// missing. configure customises the fresh clone before it is cached. After
+// closeAll the cache hands out uncached transports without keep-alives so
+// stragglers from a replaced registry cannot leak idle connections.
+func (c *transportCache) get(key string, base *http.Transport, configure func(*http.Transport)) *http.Transport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		transport := newCachedTransport(base, configure)
+		transport.DisableKeepAlives = true
+		return transport
+	}
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		return element.Value.(*cachedTransport).transport
+	}
+	transport := newCachedTransport(base, configure)
+	c.entries[key] = c.order.PushFront(&cachedTransport{key: key, transport: transport})
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		entry := c.order.Remove(oldest).(*cachedTransport)
+		delete(c.entries, entry.key)
+		entry.transport.CloseIdleConnections()
+	}
+	return transport
+}
+
+func (c *transportCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// closeIdleConnections closes idle connections on every cached transport.
+func (c *transportCache) closeIdleConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for element := c.order.Front(); element != nil; element = element.Next() {
+		element.Value.(*cachedTransport).transport.CloseIdleConnections()
+	}
+}
+
+// closeAll evicts every transport and stops caching new ones.
+func (c *transportCache) closeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for element := c.order.Front(); element != nil; element = element.Next() {
+		element.Value.(*cachedTransport).transport.CloseIdleConnections()
+	}
+	c.entries = map[string]*list.Element{}
+	c.order.Init()
+}
+
+func newCachedTransport(base *http.Transport, configure func(*http.Transport)) *http.Transport {
+	var transport *http.Transport
+	if base != nil {
+		transport = base.Clone()
+	} else {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	transport.MaxIdleConns = cachedTransportMaxIdleConns
+	transport.MaxIdleConnsPerHost = cachedTransportMaxIdlePerHost
+	transport.IdleConnTimeout = cachedTransportIdleConnTimeout
+	// Response header timeouts are applied per attempt by the caller.
+	transport.ResponseHeaderTimeout = 0
+	if configure != nil {
+		configure(transport)
+	}
+	return transport
+}
+
+// credentialFingerprint identifies the credential material used on upstream
+// connections without keeping the secrets themselves in cache keys.
+func credentialFingerprint(auth config.ProviderAuthConfig) string {
+	builder := strings.Builder{}
+	builder.WriteString(strings.ToLower(strings.TrimSpace(auth.Type)))
+	builder.WriteString("\x00" + auth.Username + "\x00" + auth.Password + "\x00" + auth.Token)
+	headers := make([]string, 0, len(auth.Headers))
+	for key := range auth.Headers {
+		headers = append(headers, key)
+	}
+	sort.Strings(headers)
+	for _, key := range headers {
+		builder.WriteString("\x00" + key + "=" + auth.Headers[key])
+	}
+	sum := sha256.Sum256([]byte(builder.String()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// transportKey scopes a cached transport to an adapter kind, an endpoint and
+// the credential used on it. Endpoint user info is folded into the credential
+// part so two users of the same upstream never share a connection.
+func transportKey(kind string, endpoint *url.URL, credential string) string {
+	if endpoint == nil {
+		return kind + "|" + credential
+	}
+	host := endpoint.Scheme + "://" + endpoint.Host
+	if endpoint.User != nil {
+		sum := sha256.Sum256([]byte(endpoint.User.String()))
+		credential += "+" + hex.EncodeToString(sum[:8])
+	}
+	return kind + "|" + host + "|" + credential
+}
+
+// enableHTTP2 lets a cached transport negotiate h2 with TLS origins while
+// keeping HTTP/1.1 for plaintext ones and for Upgrade requests.
+func enableHTTP2(transport *http.Transport) {
+	protocols := listeners.HTTP1Protocols()
+	protocols.SetHTTP2(true)
+	transport.Protocols = protocols
+	transport.ForceAttemptHTTP2 = true
+}
@@ -0,0 +1,224 @@
+package dataplane
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+func TestTransportCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	t.Parallel()
+
+	cache := newTransportCache(2)
+	base := &http.Transport{}
+	first := cache.get("a", base, nil)
+	cache.get("b", base, nil)
+	if again := cache.get("a", base, nil); again != first {
+		t.Fatalf("expected cached transport to be reused")
+	}
+	cache.get("c", base, nil)
+	if cache.len() != 2 {
+		t.Fatalf("expected cache bounded to 2 entries, got %d", cache.len())
+	}
+	if again := cache.get("a", base, nil); again != first {
+		t.Fatalf("expected recently used transport to survive eviction")
+	}
+	if first.MaxIdleConnsPerHost != cachedTransportMaxIdlePerHost || first.ResponseHeaderTimeout != 0 {
+		t.Fatalf("expected bounded idle pool without response header timeout, got %d/%s", first.MaxIdleConnsPerHost, first.ResponseHeaderTimeout)
+	}
+}
+
+func TestTransportCache_KeysByCredential(t *testing.T) {
+	t.Parallel()
+
+	endpoint, _ := url.Parse("http://proxy.example:8080")
+	alice := credentialFingerprint(config.ProviderAuthConfig{Type: "basic", Username: "alice", Password: "secret"})
+	bob := credentialFingerprint(config.ProviderAuthConfig{Type: "basic", Username: "bob", Password: "secret"})
+	if transportKey("http", endpoint, alice) == transportKey("http", endpoint, bob) {
+		t.Fatalf("expected distinct transports per credential")
+	}
+	withUser, _ := url.Parse("socks5://carol:pw@proxy.example:1080")
+	if key := transportKey("socks5", withUser, alice); key == transportKey("socks5", endpoint, alice) {
+		t.Fatalf("expected endpoint user info to scope the transport")
+	}
+}
+
+func TestProviderRegistry_CloseEvictsTransports(t *testing.T) {
+	t.Parallel()
+
+	registry := NewProviderRegistry(&config.Config{})
+	registry.transports.get("a", &http.Transport{}, nil)
+	registry.Close()
+	registry.Close()
+	if registry.transports.len() != 0 {
+		t.Fatalf("expected closed registry to evict transports")
+	}
+	if transport := registry.transports.get("a", &http.Transport{}, nil); !transport.DisableKeepAlives {
+		t.Fatalf("expected closed cache to hand out transports without keep-alives")
+	}
+}
+
+func TestForwardProxy_ReusesUpstreamProxyConnections(t *testing.T) {
+	t.Parallel()
+
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte("ok"))
+	}))
+	defer target.Close()
+	upstream, newConns := startCountingUpstreamProxy(t)
+	defer upstream.Close()
+
+	proxy := startRuntimeProxy(t, upstreamProxyConfig(upstream.URL))
+	defer proxy.Close()
+	client := proxyClient(t, proxy.URL)
+
+	for i := 0; i < 10; i++ {
+		doProxyGet(t, client, target.URL)
+	}
+	if got := newConns.Load(); got != 1 {
+		t.Fatalf("expected one upstream connection reused across requests, got %d", got)
+	}
+}
+
+func TestForwardProxy_SessionLoginsShareCredentialTransport(t *testing.T) {
+	t.Parallel()
+
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte("ok"))
+	}))
+	defer target.Close()
+	var mu sync.Mutex
+	usernames := map[string]bool{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		username, _, _ := (&http.Request{Header: http.Header{"Authorization": req.Header.Values("Proxy-Authorization")}}).BasicAuth()
+		mu.Lock()
+		usernames[username] = true
+		mu.Unlock()
+		req.Header.Del("Proxy-Authorization")
+		rsp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer rsp.Body.Close()
+		rw.WriteHeader(rsp.StatusCode)
+		_, _ = io.Copy(rw, rsp.Body)
+	}))
+	defer upstream.Close()
+
+	cfg := upstreamProxyConfig(upstream.URL)
+	cfg.Providers[0].Auth.UsernameTemplate = "{username}[-session-{session}]"
+	cfg.Providers[0].Session = config.ProviderSessionConfig{Supported: true}
+	runtime := NewRequestRuntime(cfg)
+	registry := runtime.Registry.(*ProviderRegistry)
+	proxy := httptest.NewServer(listeners.MetadataMiddleware(listeners.NewForwardProxyHandlerWithRuntime(runtime)))
+	defer proxy.Close()
+	client := proxyClient(t, proxy.URL)
+
+	for _, session := range []string{"s1", "s2", "s3", "s1"} {
+		req, _ := http.NewRequest(http.MethodGet, target.URL, nil)
+		req.Header.Set(listeners.HintSessionHeader, session)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("forward request failed: %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(usernames) != 3 || !usernames["up-user-session-s1"] {
+		t.Fatalf("expected one login per session, got %v", usernames)
+	}
+	if got := registry.transports.len(); got != 1 {
+		t.Fatalf("expected session logins to share the credential's transport, got %d transports", got)
+	}
+}
+
+func BenchmarkForwardProxy_UpstreamProxyReuse(b *testing.B) {
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte("ok"))
+	}))
+	defer target.Close()
+	upstream, newConns := startCountingUpstreamProxy(b)
+	defer upstream.Close()
+
+	proxy := startRuntimeProxy(b, upstreamProxyConfig(upstream.URL))
+	defer proxy.Close()
+	client := proxyClient(b, proxy.URL)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		doProxyGet(b, client, target.URL)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(newConns.Load())/float64(b.N), "upstream-conns/op")
+}
+
+func startCountingUpstreamProxy(tb testing.TB) (*httptest.Server, *atomic.Int64) {
+	tb.Helper()
+	var newConns atomic.Int64
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rsp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer rsp.Body.Close()
+		rw.WriteHeader(rsp.StatusCode)
+		_, _ = io.Copy(rw, rsp.Body)
+	}))
+	upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			newConns.Add(1)
+		}
+	}
+	upstream.Start()
+	return upstream, &newConns
+}
+
+func upstreamProxyConfig(upstreamURL string) *config.Config {
+	return &config.Config{
+		Providers: []config.ProviderConfig{{
+			Name:      "provider-http-proxy",
+			Type:      "http_proxy",
+			Auth:      config.ProviderAuthConfig{Type: "basic", Username: "up-user", Password: "up-pass"},
+			Endpoints: []config.ProviderEndpoint{{URL: upstreamURL, Priority: 1}},
+		}},
+		Routing: config.RoutingConfig{DefaultProvider: "provider-http-proxy"},
+	}
+}
+
+func proxyClient(tb testing.TB, proxyAddr string) *http.Client {
+	tb.Helper()
+	proxyURL, err := url.Parse(proxyAddr)
+	if err != nil {
+		tb.Fatalf("parse proxy url: %v", err)
+	}
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+}
+
+func doProxyGet(tb testing.TB, client *http.Client, target string) {
+	tb.Helper()
+	resp, err := client.Get(target)
+	if err != nil {
+		tb.Fatalf("proxy request failed: %v", err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		tb.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,123 @@
+package dataplane
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pzaino/microproxy/internal/dataplane/listeners"
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+func startEchoTCPServer(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen echo tcp: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func TestForwardProxy_ConnectTunnelFillsSizes(t *testing.T) {
+	t.Parallel()
+
+	target := startPingPongTCPServer(t)
+	defer target.Close()
+
+	sizes := make(chan listeners.RequestMetadata, 1)
+	proxy := listeners.NewForwardProxyHandlerWithRuntime(NewRequestRuntime(&config.Config{}))
+	server := httptest.NewServer(listeners.MetadataMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		proxy.ServeHTTP(rw, req)
+		metadata, _ := listeners.MetadataFromContext(req.Context())
+		sizes <- metadata
+	})))
+	defer server.Close()
+
+	conn, status := openConnectTunnel(t, server.URL, target.Addr().String())
+	if !strings.Contains(status, "200") {
+		t.Fatalf("expected CONNECT to succeed, got %q", status)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write ping: %v", err)
+	}
+	pong := make([]byte, 4)
+	if _, err := io.ReadFull(conn, pong); err != nil || string(pong) != "pong" {
+		t.Fatalf("expected pong through tunnel, got %q err=%v", pong, err)
+	}
+	conn.Close()
+
+	select {
+	case metadata := <-sizes:
+		if metadata.RequestSize != 4 || metadata.ResponseSize != 4 {
+			t.Fatalf("expected 4 bytes each way, got request=%d response=%d", metadata.RequestSize, metadata.ResponseSize)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected CONNECT handler to return once the tunnel closed")
+	}
+}
+
+func TestSOCKS5ListenerManager_ResponseSizePolicyCutsTunnel(t *testing.T) {
+	t.Parallel()
+
+	target := startEchoTCPServer(t)
+	defer target.Close()
+
+	cfg := &config.Config{
+		Listeners: []config.ListenerConfig{{Name: "socks", Type: "socks5", Address: "127.0.0.1:0", Enabled: true}},
+		Providers: []config.ProviderConfig{
+			{Name: "direct", Type: "direct", Endpoints: []config.ProviderEndpoint{{URL: "http://direct.local", Priority: 1}}},
+		},
+		Routing: config.RoutingConfig{Rules: []config.RoutingRule{
+			{Name: "capped", Match: map[string]string{"tenant": "capped"}, Provider: "direct", PolicyRef: "cap-download"},
+		}},
+		Policies: []config.PolicyConfig{
+			{Name: "cap-download", Type: "access", Action: "deny", Selectors: map[string]string{"response_size_min": "8"}},
+		},
+	}
+	mgr := NewSOCKS5ListenerManager(cfg.Listeners, time.Second, NewRequestRuntime(cfg))
+	if err := mgr.Start(context.Background()); err != nil {
+		t.Fatalf("start socks5 manager: %v", err)
+	}
+	defer func() { _ = mgr.Shutdown(context.Background()) }()
+	proxyAddr := mgr.servers[0].listener.Addr().String()
+
+	conn, reply := socks5ConnectAs(t, proxyAddr, "alice+tenant=capped", target.Addr().String())
+	defer conn.Close()
+	if reply != listeners.SOCKS5ReplySucceeded {
+		t.Fatalf("expected tunnel under the size limit to open, got reply %d", reply)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write ping: %v", err)
+	}
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected echo below the limit, got %q err=%v", buf, err)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write second ping: %v", err)
+	}
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected echo that reaches the limit, got %q err=%v", buf, err)
+	}
+	if _, err := conn.Read(buf); err == nil {
+		t.Fatalf("expected tunnel to close once the response size policy denied it")
+	}
+}
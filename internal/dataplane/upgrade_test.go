@@ -0,0 +1,123 @@
+package dataplane
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+// startEchoUpgradeServer accepts "Upgrade: echo" and echoes raw bytes back.
+func startEchoUpgradeServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !strings.EqualFold(req.Header.Get("Upgrade"), "echo") || req.Header.Get("X-Microproxy-Session") != "" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, buffered, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		_, _ = io.Copy(conn, buffered)
+	}))
+}
+
+func openUpgrade(t *testing.T, proxyURL, target string) (net.Conn, *bufio.Reader, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxyURL, "http://"))
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	host := strings.TrimPrefix(target, "http://")
+	_, _ = fmt.Fprintf(conn, "GET %s/ws HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: echo\r\nX-Microproxy-Session: s1\r\n\r\n", target, host)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		t.Fatalf("read upgrade response: %v", err)
+	}
+	return conn, reader, resp.Status
+}
+
+func assertEcho(t *testing.T, conn net.Conn, reader *bufio.Reader) {
+	t.Helper()
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatalf("write through upgrade: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected echo through upgrade, got %q err=%v", buf, err)
+	}
+}
+
+func TestForwardProxy_UpgradePassthrough(t *testing.T) {
+	t.Parallel()
+
+	backend := startEchoUpgradeServer(t)
+	defer backend.Close()
+
+	proxy := startRuntimeProxy(t, &config.Config{})
+	defer proxy.Close()
+
+	conn, reader, status := openUpgrade(t, proxy.URL, backend.URL)
+	defer conn.Close()
+	if !strings.HasPrefix(status, "101") {
+		t.Fatalf("expected 101, got %s", status)
+	}
+	assertEcho(t, conn, reader)
+}
+
+func TestForwardProxy_UpgradeHoldsProviderSlot(t *testing.T) {
+	t.Parallel()
+
+	backend := startEchoUpgradeServer(t)
+	defer backend.Close()
+
+	cfg := &config.Config{
+		Providers: []config.ProviderConfig{{
+			Name:      "provider-direct",
+			Type:      "direct",
+			Endpoints: []config.ProviderEndpoint{{URL: "http://direct-a.local", Priority: 1}},
+			Limits:    config.ProviderLimitsConfig{Concurrency: 1, Strategy: "reject"},
+		}},
+		Routing: config.RoutingConfig{DefaultProvider: "provider-direct"},
+	}
+	proxy := startRuntimeProxy(t, cfg)
+	defer proxy.Close()
+
+	conn, reader, status := openUpgrade(t, proxy.URL, backend.URL)
+	if !strings.HasPrefix(status, "101") {
+		t.Fatalf("expected 101, got %s", status)
+	}
+	assertEcho(t, conn, reader)
+
+	second, _, status := openUpgrade(t, proxy.URL, backend.URL)
+	second.Close()
+	if !strings.HasPrefix(status, "429") {
+		t.Fatalf("expected open upgrade to hold the provider slot, got %s", status)
+	}
+
+	conn.Close()
+	var reopened string
+	for i := 0; i < 50; i++ {
+		third, _, status := openUpgrade(t, proxy.URL, backend.URL)
+		third.Close()
+		if reopened = status; strings.HasPrefix(status, "101") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.HasPrefix(reopened, "101") {
+		t.Fatalf("expected slot released after tunnel closed, got %s", reopened)
+	}
+}
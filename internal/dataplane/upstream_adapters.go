@@ -11,6 +11,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,34 +19,62 @@ import (
 	"github.com/pzaino/microproxy/pkg/config"
 )
 
-type upstreamAdapterFactory struct{}
-
-func (upstreamAdapterFactory) ForProvider(provider config.ProviderConfig) listeners.UpstreamAdapter {
-	t := strings.ToLower(strings.TrimSpace(provider.Type))
-	switch t {
-	case "direct":
-		return directAdapter{auth: provider.Auth}
-	case "socks5_proxy":
-		return socks5ProxyAdapter{auth: provider.Auth}
-	case "http_proxy", "https_proxy", "legacy_upstream_proxy":
-		return httpProxyAdapter{auth: provider.Auth}
-	default:
-		for _, capability := range provider.Capabilities {
-			switch strings.ToLower(strings.TrimSpace(capability)) {
-			case "direct":
-				return directAdapter{auth: provider.Auth}
-			case "socks5_proxy":
-				return socks5ProxyAdapter{auth: provider.Auth}
-			case "forward_proxy":
-				return httpProxyAdapter{auth: provider.Auth}
-			}
+// upstreamAdapterFactory builds adapters that share the registry's transport
+// cache.
+type upstreamAdapterFactory struct {
+	transports *transportCache
+	sessions   *SessionManager
+}
+
+// ForProvider builds the provider's adapter from the plugin registered for
+// its type. credentials is the provider's credential pool, or nil when it has
+// a single login. Built-in types run their own adapters; other plugins are
+// bridged through pluginAdapter.
+func (f upstreamAdapterFactory) ForProvider(provider config.ProviderConfig, credentials *credentialPool) listeners.UpstreamAdapter {
+	pool := adapterTransports{cache: f.transports, credential: credentialFingerprint(provider.Auth)}
+	plugin := lookupProviderPlugin(provider)
+	if builtin, ok := plugin.(builtinPlugin); ok {
+		return builtin.adapter(f, provider, credentials, pool)
+	}
+	return pluginAdapter{pluginProvider: pluginProvider{plugin: plugin, provider: provider}, transports: pool}
+}
+
+func hasCapability(provider config.ProviderConfig, capability string) bool {
+	for _, candidate := range provider.Capabilities {
+		if strings.EqualFold(strings.TrimSpace(candidate), capability) {
+			return true
 		}
-		return httpProxyAdapter{auth: provider.Auth}
 	}
+	return false
+}
+
+// adapterTransports resolves the cached transport for one provider's
+// credential. Without a cache every call builds a fresh transport.
+type adapterTransports struct {
+	cache      *transportCache
+	credential string
+}
+
+// forAuth scopes the pool to the credential a request uses, so connections
+// opened with one credential are never reused for another.
+func (p adapterTransports) forAuth(auth config.ProviderAuthConfig) adapterTransports {
+	p.credential = credentialFingerprint(auth)
+	return p
+}
+
+func (p adapterTransports) get(kind string, endpoint *url.URL, base *http.Transport, configure func(*http.Transport)) *http.Transport {
+	if p.cache == nil {
+		return newCachedTransport(base, configure)
+	}
+	return p.cache.get(transportKey(kind, endpoint, p.credential), base, configure)
 }
 
 type directAdapter struct {
 	auth config.ProviderAuthConfig
+	// http2 lets TLS origins negotiate HTTP/2; plaintext origins stay on
+	// HTTP/1.1.
+	http2      bool
+	transports adapterTransports
 }
 
 func (a directAdapter) PrepareRequest(req *http.Request, _ *url.URL) (*http.Request, error) {
@@ -59,27 +88,44 @@ func (a directAdapter) DialConnect(ctx context.Context, targetAddr string, _ *ur
 }
 
 func (a directAdapter) RoundTrip(req *http.Request, _ *url.URL, transport *http.Transport, responseHeaderTimeout time.Duration) (*http.Response, error) {
-	cloned := transport.Clone()
-	cloned.ResponseHeaderTimeout = responseHeaderTimeout
-	return cloned.RoundTrip(req)
+	if a.http2 {
+		cached := a.transports.get("direct-h2", nil, transport, enableHTTP2)
+		return listeners.RoundTripWithResponseHeaderTimeout(cached, req, responseHeaderTimeout)
+	}
+	cached := a.transports.get("direct", nil, transport, nil)
+	return listeners.RoundTripWithResponseHeaderTimeout(cached, req, responseHeaderTimeout)
+}
+
+func (a directAdapter) BindTCP(_ context.Context, peerAddr string, _ *url.URL, _ *net.Dialer) (listeners.TCPBinding, error) {
+	return listeners.NewDirectTCPBinding(peerAddr)
+}
+
+func (a directAdapter) AssociateUDP(context.Context, *url.URL, *net.Dialer) (listeners.UDPAssociation, error) {
+	return listeners.NewDirectUDPAssociation()
 }
 
 func (a directAdapter) RotateIdentity(context.Context) error {
 	return listeners.ErrRotateIdentityUnsupported
 }
-func (a directAdapter) Capabilities() []string { return []string{"forward", "connect"} }
+func (a directAdapter) Capabilities() []string { return []string{"forward", "connect", "bind", "udp"} }
 
 type httpProxyAdapter struct {
-	auth config.ProviderAuthConfig
+	auth        config.ProviderAuthConfig
+	login       *loginTemplate
+	credentials *credentialPool
+	rotation    *sessionRotator
+	transports  adapterTransports
 }
 
-func (a httpProxyAdapter) PrepareRequest(req *http.Request, _ *url.URL) (*http.Request, error) {
-	out := req.Clone(req.Context())
-	applyProxyAuth(out.Header, a.auth)
+func (a httpProxyAdapter) PrepareRequest(req *http.Request, endpoint *url.URL) (*http.Request, error) {
+	ctx := a.credentials.withCredential(a.rotation.withSession(req.Context()))
+	out := req.Clone(ctx)
+	applyProxyAuth(out.Header, requestAuth(ctx, endpoint, a.auth, a.login))
 	return out, nil
 }
 
 func (a httpProxyAdapter) DialConnect(ctx context.Context, targetAddr string, endpoint *url.URL, dialer *net.Dialer) (net.Conn, error) {
+	ctx = a.credentials.withCredential(a.rotation.withSession(ctx))
 	if endpoint == nil {
 		return nil, errors.New("missing upstream proxy endpoint")
 	}
@@ -101,17 +147,19 @@ func (a httpProxyAdapter) DialConnect(ctx context.Context, targetAddr string, en
 	}
 
 	connectHeaders := http.Header{}
-	applyProxyAuth(connectHeaders, a.auth)
+	applyProxyAuth(connectHeaders, requestAuth(ctx, endpoint, a.auth, a.login))
 	if err := writeConnect(conn, targetAddr, connectHeaders); err != nil {
 		_ = conn.Close()
 		return nil, err
 	}
-	ok, err := readConnectResponse(conn)
+	status, err := readConnectResponse(conn)
+	a.credentials.observeConnect(ctx, status, err)
+	a.rotation.observe(ctx, status, err)
 	if err != nil {
 		_ = conn.Close()
 		return nil, err
 	}
-	if !ok {
+	if status != http.StatusOK {
 		_ = conn.Close()
 		return nil, errors.New("upstream rejected CONNECT")
 	}
@@ -122,19 +170,44 @@ func (a httpProxyAdapter) RoundTrip(req *http.Request, endpoint *url.URL, transp
 	if endpoint == nil {
 		return nil, errors.New("missing upstream proxy endpoint")
 	}
-	cloned := transport.Clone()
-	cloned.Proxy = http.ProxyURL(endpoint)
-	cloned.ResponseHeaderTimeout = responseHeaderTimeout
-	return cloned.RoundTrip(req)
+	ctx := a.credentials.withCredential(a.rotation.withSession(req.Context()))
+	auth := requestAuth(ctx, endpoint, a.auth, a.login)
+	stable := credentialAuth(ctx, a.auth)
+	cached := a.transports.forAuth(stable).get("http", endpoint, transport, func(t *http.Transport) {
+		t.Proxy = proxyWithLogin(endpoint, "")
+		connectHeaders := http.Header{}
+		if !strings.EqualFold(strings.TrimSpace(stable.Type), "basic") {
+			applyProxyAuth(connectHeaders, stable)
+		}
+		t.ProxyConnectHeader = connectHeaders
+	})
+	req = req.WithContext(context.WithValue(req.Context(), proxyLoginContextKey{}, auth))
+	resp, err := listeners.RoundTripWithResponseHeaderTimeout(cached, req, responseHeaderTimeout)
+	a.credentials.observe(ctx, responseStatus(resp), err)
+	a.rotation.observe(ctx, responseStatus(resp), err)
+	return resp, err
 }
 
+// RotateIdentity moves the provider to a new upstream session. Only
+// providers with session rotation enabled support it.
 func (a httpProxyAdapter) RotateIdentity(context.Context) error {
-	return listeners.ErrRotateIdentityUnsupported
+	if a.rotation == nil {
+		return listeners.ErrRotateIdentityUnsupported
+	}
+	a.rotation.rotate("manual")
+	return nil
 }
 func (a httpProxyAdapter) Capabilities() []string { return []string{"forward", "connect"} }
 
 type socks5ProxyAdapter struct {
-	auth config.ProviderAuthConfig
+	auth        config.ProviderAuthConfig
+	login       *loginTemplate
+	credentials *credentialPool
+	rotation    *sessionRotator
+	// udp is set when the provider lists the "udp" capability, i.e. its
+	// servers accept UDP ASSOCIATE.
+	udp        bool
+	transports adapterTransports
 }
 
 func (a socks5ProxyAdapter) PrepareRequest(req *http.Request, _ *url.URL) (*http.Request, error) {
@@ -142,7 +215,10 @@ func (a socks5ProxyAdapter) PrepareRequest(req *http.Request, _ *url.URL) (*http
 }
 
 func (a socks5ProxyAdapter) DialConnect(ctx context.Context, targetAddr string, endpoint *url.URL, dialer *net.Dialer) (net.Conn, error) {
-	conn, err := dialSocks5(ctx, endpoint, targetAddr, dialer, a.auth)
+	ctx = a.credentials.withCredential(a.rotation.withSession(ctx))
+	conn, err := dialSocks5(ctx, endpoint, targetAddr, dialer, requestAuth(ctx, endpoint, a.auth, a.login))
+	a.credentials.observe(ctx, 0, err)
+	a.rotation.observe(ctx, 0, err)
 	if err != nil {
 		return nil, err
 	}
@@ -150,19 +226,111 @@ func (a socks5ProxyAdapter) DialConnect(ctx context.Context, targetAddr string,
 }
 
 func (a socks5ProxyAdapter) RoundTrip(req *http.Request, endpoint *url.URL, transport *http.Transport, responseHeaderTimeout time.Duration) (*http.Response, error) {
-	cloned := transport.Clone()
-	cloned.Proxy = nil
-	cloned.ResponseHeaderTimeout = responseHeaderTimeout
-	cloned.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
-		return dialSocks5(ctx, endpoint, address, &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}, a.auth)
+	if endpoint == nil {
+		return nil, errors.New("missing socks5 endpoint")
+	}
+	ctx := a.credentials.withCredential(a.rotation.withSession(req.Context()))
+	auth := requestAuth(ctx, endpoint, a.auth, a.login)
+	cached := a.transports.forAuth(credentialAuth(ctx, a.auth)).get("socks5", endpoint, transport, func(t *http.Transport) {
+		t.Proxy = proxyWithLogin(endpoint, "socks5")
+		dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+		t.DialContext = dialer.DialContext
+	})
+	req = req.WithContext(context.WithValue(req.Context(), proxyLoginContextKey{}, auth))
+	resp, err := listeners.RoundTripWithResponseHeaderTimeout(cached, req, responseHeaderTimeout)
+	err = socksTransportError(err)
+	a.credentials.observe(ctx, 0, err)
+	a.rotation.observe(ctx, 0, err)
+	return resp, err
+}
+
+// socksTransportError maps the refused login net/http's SOCKS5 dialer
+// reports, only as text, to errSocksAuthFailed, as dialSocks5 returns it.
+// The transport's dialer is kept so connections stay pooled per login.
+func socksTransportError(err error) error {
+	if err != nil && strings.Contains(err.Error(), "username/password authentication failed") {
+		return fmt.Errorf("%w: %v", errSocksAuthFailed, err)
 	}
-	return cloned.RoundTrip(req)
+	return err
+}
+
+func (a socks5ProxyAdapter) BindTCP(ctx context.Context, peerAddr string, endpoint *url.URL, dialer *net.Dialer) (listeners.TCPBinding, error) {
+	ctx = a.credentials.withCredential(a.rotation.withSession(ctx))
+	binding, err := bindSocks5(ctx, endpoint, peerAddr, dialer, requestAuth(ctx, endpoint, a.auth, a.login))
+	a.credentials.observe(ctx, 0, err)
+	a.rotation.observe(ctx, 0, err)
+	return binding, err
+}
+
+func (a socks5ProxyAdapter) AssociateUDP(ctx context.Context, endpoint *url.URL, dialer *net.Dialer) (listeners.UDPAssociation, error) {
+	if !a.udp {
+		return nil, listeners.ErrUDPUnsupported
+	}
+	ctx = a.credentials.withCredential(a.rotation.withSession(ctx))
+	association, err := associateSocks5UDP(ctx, endpoint, dialer, requestAuth(ctx, endpoint, a.auth, a.login))
+	a.credentials.observe(ctx, 0, err)
+	a.rotation.observe(ctx, 0, err)
+	return association, err
 }
 
 func (a socks5ProxyAdapter) RotateIdentity(context.Context) error {
-	return listeners.ErrRotateIdentityUnsupported
+	if a.rotation == nil {
+		return listeners.ErrRotateIdentityUnsupported
+	}
+	a.rotation.rotate("manual")
+	return nil
+}
+func (a socks5ProxyAdapter) Capabilities() []string {
+	if a.udp {
+		return []string{"forward", "connect", "bind", "udp"}
+	}
+	return []string{"forward", "connect", "bind"}
+}
+
+// requestAuth returns the login to present to endpoint for a request: the
+// credentials an upstream_credentials policy chose, or else auth, or the
+// pooled credential picked for the request, rendered through the provider's
+// login template.
+func requestAuth(ctx context.Context, endpoint *url.URL, auth config.ProviderAuthConfig, login *loginTemplate) config.ProviderAuthConfig {
+	if credentials, ok := listeners.UpstreamCredentialsFromContext(ctx); ok {
+		return config.ProviderAuthConfig{Type: "basic", Username: credentials.Username, Password: credentials.Password}
+	}
+	return login.apply(ctx, endpoint, pooledAuth(ctx, auth))
+}
+
+// credentialAuth returns the credential behind a request's login: the
+// policy-chosen or pooled credential before the login template renders
+// per-request parts such as the session or country into it. Cached transports
+// are keyed on it so those parts do not churn the cache.
+func credentialAuth(ctx context.Context, auth config.ProviderAuthConfig) config.ProviderAuthConfig {
+	if credentials, ok := listeners.UpstreamCredentialsFromContext(ctx); ok {
+		return config.ProviderAuthConfig{Type: "basic", Username: credentials.Username, Password: credentials.Password}
+	}
+	return pooledAuth(ctx, auth)
+}
+
+// proxyLoginContextKey carries the login a request presents upstream to the
+// Proxy func of its cached transport.
+type proxyLoginContextKey struct{}
+
+// proxyWithLogin returns a Proxy func that puts the request's basic login in
+// endpoint's user info, in place of any the endpoint carries. The transport
+// authenticates with it and pools connections per proxy URL, so each login
+// keeps its own connections within the credential's transport. A non-empty
+// scheme replaces the endpoint's.
+func proxyWithLogin(endpoint *url.URL, scheme string) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		proxyURL := *endpoint
+		if scheme != "" {
+			proxyURL.Scheme = scheme
+		}
+		auth, _ := req.Context().Value(proxyLoginContextKey{}).(config.ProviderAuthConfig)
+		if strings.EqualFold(strings.TrimSpace(auth.Type), "basic") {
+			proxyURL.User = url.UserPassword(auth.Username, auth.Password)
+		}
+		return &proxyURL, nil
+	}
 }
-func (a socks5ProxyAdapter) Capabilities() []string { return []string{"forward", "connect"} }
 
 func applyRequestAuth(headers http.Header, auth config.ProviderAuthConfig) {
 	switch strings.ToLower(strings.TrimSpace(auth.Type)) {
@@ -206,34 +374,54 @@ func writeConnect(conn net.Conn, targetAddr string, headers http.Header) error {
 	return err
 }
 
-func readConnectResponse(conn net.Conn) (bool, error) {
+// readConnectResponse returns the status code of the upstream's CONNECT
+// reply, or 0 when the status line does not parse.
+func readConnectResponse(conn net.Conn) (int, error) {
 	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
 	defer conn.SetReadDeadline(time.Time{})
 
 	reader := bufio.NewReader(conn)
 	statusLine, err := reader.ReadString('\n')
 	if err != nil {
-		return false, err
+		return 0, err
 	}
 	for {
 		line, err := reader.ReadString('\n')
 		if err != nil {
-			return false, err
+			return 0, err
 		}
 		if line == "\r\n" {
 			break
 		}
 	}
-	return strings.Contains(statusLine, " 200 "), nil
+	fields := strings.Fields(statusLine)
+	if len(fields) < 2 {
+		return 0, nil
+	}
+	status, _ := strconv.Atoi(fields[1])
+	return status, nil
 }
 
 func dialSocks5(ctx context.Context, endpoint *url.URL, targetAddr string, dialer *net.Dialer, auth config.ProviderAuthConfig) (net.Conn, error) {
+	conn, _, err := openSocks5(ctx, endpoint, socks5CommandConnect, targetAddr, dialer, auth)
+	return conn, err
+}
+
+const (
+	socks5CommandConnect      = 0x01
+	socks5CommandBind         = 0x02
+	socks5CommandUDPAssociate = 0x03
+)
+
+// openSocks5 connects to a SOCKS5 endpoint, authenticates, and issues cmd.
+// It returns the control connection and the bind address from the reply.
+func openSocks5(ctx context.Context, endpoint *url.URL, cmd byte, targetAddr string, dialer *net.Dialer, auth config.ProviderAuthConfig) (net.Conn, string, error) {
 	if endpoint == nil {
-		return nil, errors.New("missing socks5 endpoint")
+		return nil, "", errors.New("missing socks5 endpoint")
 	}
 	conn, err := dialer.DialContext(ctx, "tcp", endpoint.Host)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	username := auth.Username
 	password := auth.Password
@@ -243,60 +431,61 @@ func dialSocks5(ctx context.Context, endpoint *url.URL, targetAddr string, diale
 			password, _ = endpoint.User.Password()
 		}
 	}
-	if err := socks5Handshake(conn, username, password, targetAddr); err != nil {
+	bindAddr, err := socks5Command(conn, cmd, username, password, targetAddr)
+	if err != nil {
 		_ = conn.Close()
-		return nil, err
+		return nil, "", err
 	}
-	return conn, nil
+	return conn, bindAddr, nil
 }
 
-func socks5Handshake(conn net.Conn, username, password, targetAddr string) error {
+func socks5Command(conn net.Conn, cmd byte, username, password, targetAddr string) (string, error) {
 	method := byte(0x00)
 	if username != "" {
 		method = 0x02
 	}
 	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
-		return err
+		return "", err
 	}
 	reply := make([]byte, 2)
 	if _, err := io.ReadFull(conn, reply); err != nil {
-		return err
+		return "", err
 	}
 	if reply[0] != 0x05 {
-		return errors.New("invalid socks version")
+		return "", errors.New("invalid socks version")
 	}
 	if reply[1] == 0xff {
-		return errors.New("socks auth method rejected")
+		return "", errors.New("socks auth method rejected")
 	}
 	if reply[1] == 0x02 {
 		if len(username) > 255 || len(password) > 255 {
-			return errors.New("socks credentials too long")
+			return "", errors.New("socks credentials too long")
 		}
 		payload := []byte{0x01, byte(len(username))}
 		payload = append(payload, []byte(username)...)
 		payload = append(payload, byte(len(password)))
 		payload = append(payload, []byte(password)...)
 		if _, err := conn.Write(payload); err != nil {
-			return err
+			return "", err
 		}
 		authReply := make([]byte, 2)
 		if _, err := io.ReadFull(conn, authReply); err != nil {
-			return err
+			return "", err
 		}
 		if authReply[1] != 0x00 {
-			return errors.New("socks authentication failed")
+			return "", errSocksAuthFailed
 		}
 	}
 
 	host, portStr, err := net.SplitHostPort(targetAddr)
 	if err != nil {
-		return err
+		return "", err
 	}
 	port, err := net.LookupPort("tcp", portStr)
 	if err != nil {
-		return err
+		return "", err
 	}
-	req := []byte{0x05, 0x01, 0x00}
+	req := []byte{0x05, cmd, 0x00}
 	if ip := net.ParseIP(host); ip != nil {
 		if ipv4 := ip.To4(); ipv4 != nil {
 			req = append(req, 0x01)
@@ -307,45 +496,181 @@ func socks5Handshake(conn net.Conn, username, password, targetAddr string) error
 		}
 	} else {
 		if len(host) > 255 {
-			return errors.New("socks hostname too long")
+			return "", errors.New("socks hostname too long")
 		}
 		req = append(req, 0x03, byte(len(host)))
 		req = append(req, []byte(host)...)
 	}
 	req = append(req, byte((port>>8)&0xff), byte(port&0xff))
 	if _, err := conn.Write(req); err != nil {
-		return err
+		return "", err
 	}
 
+	return readSocks5Reply(conn, cmd)
+}
+
+// readSocks5Reply reads one reply to cmd and returns its bound address.
+func readSocks5Reply(conn net.Conn, cmd byte) (string, error) {
 	resp := make([]byte, 4)
 	if _, err := io.ReadFull(conn, resp); err != nil {
-		return err
+		return "", err
 	}
 	if resp[1] != 0x00 {
-		return fmt.Errorf("socks connect failed: %d", resp[1])
+		if resp[1] == 0x07 {
+			switch cmd {
+			case socks5CommandUDPAssociate:
+				return "", fmt.Errorf("socks udp associate refused: %w", listeners.ErrUDPUnsupported)
+			case socks5CommandBind:
+				return "", fmt.Errorf("socks bind refused: %w", listeners.ErrBindUnsupported)
+			}
+		}
+		return "", &listeners.SOCKS5ReplyError{Code: resp[1]}
 	}
-	var addrLen int
+	var addr []byte
 	switch resp[3] {
 	case 0x01:
-		addrLen = 4
+		addr = make([]byte, 4)
 	case 0x03:
 		l := make([]byte, 1)
 		if _, err := io.ReadFull(conn, l); err != nil {
-			return err
+			return "", err
 		}
-		addrLen = int(l[0])
+		addr = make([]byte, int(l[0]))
 	case 0x04:
-		addrLen = 16
+		addr = make([]byte, 16)
 	default:
-		return errors.New("invalid socks bind addr type")
+		return "", errors.New("invalid socks bind addr type")
 	}
-	if addrLen > 0 {
-		if _, err := io.ReadFull(conn, make([]byte, addrLen)); err != nil {
-			return err
+	if len(addr) > 0 {
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", err
 		}
 	}
-	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portBytes); err != nil {
+		return "", err
+	}
+	bindHost := string(addr)
+	if resp[3] != 0x03 {
+		bindHost = net.IP(addr).String()
+	}
+	return net.JoinHostPort(bindHost, strconv.Itoa(int(portBytes[0])<<8|int(portBytes[1]))), nil
+}
+
+// socks5BoundAddr resolves an address from a SOCKS5 reply. Servers that
+// answer with an unspecified IP mean the address the client reached them at.
+func socks5BoundAddr(control net.Conn, bindAddr string) (*net.TCPAddr, error) {
+	addr, err := net.ResolveTCPAddr("tcp", bindAddr)
+	if err != nil {
+		return nil, err
+	}
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		addr.IP = control.RemoteAddr().(*net.TCPAddr).IP
+	}
+	return addr, nil
+}
+
+// bindSocks5 asks a SOCKS5 server to accept one connection from peerAddr.
+// The control connection becomes the data connection once the peer arrives.
+func bindSocks5(ctx context.Context, endpoint *url.URL, peerAddr string, dialer *net.Dialer, auth config.ProviderAuthConfig) (listeners.TCPBinding, error) {
+	control, bindAddr, err := openSocks5(ctx, endpoint, socks5CommandBind, peerAddr, dialer, auth)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := socks5BoundAddr(control, bindAddr)
+	if err != nil {
+		_ = control.Close()
+		return nil, err
+	}
+	return &socks5TCPBinding{control: control, addr: addr}, nil
+}
+
+type socks5TCPBinding struct {
+	control  net.Conn
+	addr     net.Addr
+	accepted bool
+}
+
+func (b *socks5TCPBinding) Addr() net.Addr { return b.addr }
+
+func (b *socks5TCPBinding) Accept(ctx context.Context) (net.Conn, net.Addr, error) {
+	stop := context.AfterFunc(ctx, func() { _ = b.control.SetReadDeadline(time.Now()) })
+	peerAddr, err := readSocks5Reply(b.control, socks5CommandBind)
+	stop()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, nil, ctxErr
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	b.accepted = true
+	peer, _ := net.ResolveTCPAddr("tcp", peerAddr)
+	return b.control, peer, nil
+}
+
+func (b *socks5TCPBinding) Close() error {
+	if b.accepted {
+		return nil
+	}
+	return b.control.Close()
+}
+
+// associateSocks5UDP asks a SOCKS5 server for a UDP relay. The association
+// ends when the server closes the control connection.
+func associateSocks5UDP(ctx context.Context, endpoint *url.URL, dialer *net.Dialer, auth config.ProviderAuthConfig) (listeners.UDPAssociation, error) {
+	control, bindAddr, err := openSocks5(ctx, endpoint, socks5CommandUDPAssociate, "0.0.0.0:0", dialer, auth)
+	if err != nil {
+		return nil, err
+	}
+	relayAddr, err := socks5BoundAddr(control, bindAddr)
+	if err != nil {
+		_ = control.Close()
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: relayAddr.IP, Port: relayAddr.Port})
+	if err != nil {
+		_ = control.Close()
+		return nil, err
+	}
+	association := &socks5UDPAssociation{control: control, conn: conn}
+	go func() {
+		_, _ = io.Copy(io.Discard, control)
+		_ = association.Close()
+	}()
+	return association, nil
+}
+
+type socks5UDPAssociation struct {
+	control net.Conn
+	conn    *net.UDPConn
+}
+
+func (a *socks5UDPAssociation) WriteTo(payload []byte, target string) error {
+	packet, err := listeners.AppendSOCKS5UDPDatagram(nil, target, payload)
+	if err != nil {
 		return err
 	}
-	return nil
+	_, err = a.conn.Write(packet)
+	return err
+}
+
+func (a *socks5UDPAssociation) ReadFrom(buf []byte) (int, string, error) {
+	packet := make([]byte, socks5UDPBufferSize)
+	for {
+		n, err := a.conn.Read(packet)
+		if err != nil {
+			return 0, "", err
+		}
+		datagram, err := listeners.ParseSOCKS5UDPDatagram(packet[:n])
+		if err != nil {
+			continue
+		}
+		return copy(buf, datagram.Payload), datagram.Target, nil
+	}
+}
+
+func (a *socks5UDPAssociation) Close() error {
+	err := a.conn.Close()
+	_ = a.control.Close()
+	return err
 }
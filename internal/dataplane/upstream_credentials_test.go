@@ -0,0 +1,141 @@
+package dataplane
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pzaino/microproxy/pkg/config"
+)
+
+func TestForwardProxy_LegacyLoginRulesAuthenticateUpstream(t *testing.T) {
+	t.Parallel()
+
+	targetHTTP := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte("ok-legacy"))
+	}))
+	defer targetHTTP.Close()
+
+	targetTCP := startPingPongTCPServer(t)
+	defer targetTCP.Close()
+
+	var mu sync.Mutex
+	var seen []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		seen = append(seen, req.Header.Get("Proxy-Authorization"))
+		mu.Unlock()
+
+		if req.Method == http.MethodConnect {
+			handleConnectRelay(rw, req)
+			return
+		}
+		rsp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer rsp.Body.Close()
+		rw.WriteHeader(rsp.StatusCode)
+		_, _ = io.Copy(rw, rsp.Body)
+	}))
+	defer upstream.Close()
+
+	path := filepath.Join(t.TempDir(), "legacy.yaml")
+	legacy := `
+upstream_proxy:
+  proxies:
+    - "` + upstream.URL + `"
+  logins:
+    - ip_range: "192.0.2.0/24"
+      username: "other"
+      password: "other-pass"
+    - ip_range: "127.0.0.0/8"
+      username: "user-${SESSION_ID}"
+      password: "pass"
+`
+	if err := os.WriteFile(path, []byte(legacy), 0o600); err != nil {
+		t.Fatalf("write legacy config: %v", err)
+	}
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("load legacy config: %v", err)
+	}
+
+	proxy := startRuntimeProxy(t, cfg)
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(targetHTTP.URL)
+	if err != nil {
+		t.Fatalf("forward request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for forward, got %d", resp.StatusCode)
+	}
+	if err := assertConnectPingPong(proxy.URL, targetTCP.Addr().String()); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 2 {
+		t.Fatalf("expected a forward and a CONNECT upstream, got %d requests", len(seen))
+	}
+	for _, header := range seen {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(header, "Basic "))
+		if err != nil {
+			t.Fatalf("expected basic proxy authorization, got %q", header)
+		}
+		username, password, _ := strings.Cut(string(decoded), ":")
+		if !strings.HasPrefix(username, "user-session-") || password != "pass" {
+			t.Fatalf("expected loopback login with expanded session id, got %q", decoded)
+		}
+	}
+	if seen[0] == seen[1] {
+		t.Fatalf("expected a fresh session id per request, got %q twice", seen[0])
+	}
+}
+
+func TestForwardProxy_UpstreamCredentialsPolicySOCKS5Adapter(t *testing.T) {
+	t.Parallel()
+
+	targetTCP := startPingPongTCPServer(t)
+	defer targetTCP.Close()
+
+	socksListener := startSOCKS5Proxy(t, "policy-user", "policy-pass")
+	defer socksListener.Close()
+
+	cfg := &config.Config{
+		Providers: []config.ProviderConfig{{
+			Name:      "provider-socks",
+			Type:      "socks5_proxy",
+			Auth:      config.ProviderAuthConfig{Type: "basic", Username: "static-user", Password: "static-pass"},
+			Endpoints: []config.ProviderEndpoint{{URL: "socks5://" + socksListener.Addr().String(), Priority: 1}},
+		}},
+		Policies: []config.PolicyConfig{{
+			Name:       "loopback-login",
+			Type:       "auth",
+			Action:     "upstream_credentials",
+			Selectors:  map[string]string{"ip_range": "127.0.0.0/8"},
+			Parameters: map[string]string{"username": "policy-user", "password": "policy-pass"},
+		}},
+		Routing: config.RoutingConfig{DefaultProvider: "provider-socks", DefaultPolicyRef: "loopback-login"},
+	}
+
+	proxy := startRuntimeProxy(t, cfg)
+	defer proxy.Close()
+
+	if err := assertConnectPingPong(proxy.URL, targetTCP.Addr().String()); err != nil {
+		t.Fatalf("expected policy credentials to replace the provider's, got %v", err)
+	}
+}
@@ -219,6 +219,8 @@ func HTTPMiddleware(next http.Handler, accessLogEnabled bool) http.Handler {
 				"path", req.URL.Path,
 				"policy_category", valueOrDefault(resolvedMetadata.PolicyCategory, "none"),
 				"policy_trace", strings.Join(resolvedMetadata.PolicyTrace, ","),
+				"request_bytes", resolvedMetadata.RequestSize,
+				"response_bytes", max(resolvedMetadata.ResponseSize, rec.bytes),
 			)
 		}
 	})
@@ -227,6 +229,7 @@ func HTTPMiddleware(next http.Handler, accessLogEnabled bool) http.Handler {
 type statusRecorder struct {
 	http.ResponseWriter
 	statusCode int
+	bytes      int64
 }
 
 func (r *statusRecorder) WriteHeader(code int) {
@@ -234,6 +237,12 @@ func (r *statusRecorder) WriteHeader(code int) {
 	r.ResponseWriter.WriteHeader(code)
 }
 
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
 func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	hj, ok := r.ResponseWriter.(http.Hijacker)
 	if !ok {
@@ -262,16 +271,193 @@ type histogramState struct {
 type metricsStore struct {
 	mu sync.Mutex
 
-	requestTotal   map[string]uint64
-	requestLatency map[string]*histogramState
+	requestTotal          map[string]uint64
+	requestLatency        map[string]*histogramState
+	rateLimitRejections   map[string]uint64
+	hedgedRequests        map[string]uint64
+	tunnelBytes           map[string]uint64
+	activeTunnels         map[string]int64
+	tunnelDuration        map[string]*histogramState
+	droppedConnections    map[string]uint64
+	credentialRequests    map[string]uint64
+	credentialQuarantines map[string]uint64
+	sessionsActive        map[string]int64
+	sessionsOpened        map[string]uint64
+	sessionsClosed        map[string]uint64
+	sessionRefreshes      map[string]uint64
 }
 
+// tunnelDurationBounds spans short API tunnels to long-lived sessions.
+var tunnelDurationBounds = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
 func newMetricsStore() *metricsStore {
 	bounds := []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
 	return &metricsStore{
-		requestTotal:   map[string]uint64{},
-		requestLatency: map[string]*histogramState{"": {bounds: bounds, counts: make([]uint64, len(bounds)+1)}},
+		requestTotal:          map[string]uint64{},
+		requestLatency:        map[string]*histogramState{"": {bounds: bounds, counts: make([]uint64, len(bounds)+1)}},
+		rateLimitRejections:   map[string]uint64{},
+		hedgedRequests:        map[string]uint64{},
+		tunnelBytes:           map[string]uint64{},
+		activeTunnels:         map[string]int64{},
+		tunnelDuration:        map[string]*histogramState{},
+		droppedConnections:    map[string]uint64{},
+		credentialRequests:    map[string]uint64{},
+		credentialQuarantines: map[string]uint64{},
+		sessionsActive:        map[string]int64{},
+		sessionsOpened:        map[string]uint64{},
+		sessionsClosed:        map[string]uint64{},
+		sessionRefreshes:      map[string]uint64{},
+	}
+}
+
+// RecordRateLimitRejection counts a request or connection rejected by a listener rate limiter.
+func RecordRateLimitRejection(listener, protocol string) {
+	defaultMetrics.observeRateLimitRejection(listener, protocol)
+}
+
+func (m *metricsStore) observeRateLimitRejection(listener, protocol string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rateLimitRejections[fmt.Sprintf("%s|%s", listener, protocol)]++
+}
+
+// RecordConnectionDropped counts a connection or tunnel a listener closed
+// because it hit one of its limits.
+func RecordConnectionDropped(listener, reason string) {
+	defaultMetrics.observeConnectionDropped(listener, reason)
+}
+
+func (m *metricsStore) observeConnectionDropped(listener, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.droppedConnections[fmt.Sprintf("%s|%s", valueOrDefault(listener, "unknown"), reason)]++
+}
+
+// RecordHedgedRequest counts a forward request that raced a hedge attempt,
+// labelled by which attempt won (primary, hedge) or failed.
+func RecordHedgedRequest(provider, outcome string) {
+	defaultMetrics.observeHedgedRequest(provider, outcome)
+}
+
+func (m *metricsStore) observeHedgedRequest(provider, outcome string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hedgedRequests[fmt.Sprintf("%s|%s", provider, outcome)]++
+}
+
+// RecordUpstreamCredentialUse counts an upstream answer to a pooled
+// credential, labelled success or auth_failure.
+func RecordUpstreamCredentialUse(provider, credential, outcome string) {
+	defaultMetrics.observeUpstreamCredentialUse(provider, credential, outcome)
+}
+
+func (m *metricsStore) observeUpstreamCredentialUse(provider, credential, outcome string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.credentialRequests[fmt.Sprintf("%s|%s|%s", provider, credential, outcome)]++
+}
+
+// RecordUpstreamCredentialQuarantined counts a pooled credential taken out of
+// rotation after repeated authentication failures.
+func RecordUpstreamCredentialQuarantined(provider, credential string) {
+	defaultMetrics.observeUpstreamCredentialQuarantined(provider, credential)
+}
+
+func (m *metricsStore) observeUpstreamCredentialQuarantined(provider, credential string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.credentialQuarantines[fmt.Sprintf("%s|%s", provider, credential)]++
+}
+
+// RecordSessionOpened counts a sticky session opened on provider as active.
+func RecordSessionOpened(provider string) {
+	defaultMetrics.observeSessionOpened(provider)
+}
+
+func (m *metricsStore) observeSessionOpened(provider string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessionsActive[provider]++
+	m.sessionsOpened[provider]++
+}
+
+// RecordSessionClosed releases an active sticky session, labelled by why it
+// ended.
+func RecordSessionClosed(provider, reason string) {
+	defaultMetrics.observeSessionClosed(provider, reason)
+}
+
+func (m *metricsStore) observeSessionClosed(provider, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessionsActive[provider]--
+	m.sessionsClosed[fmt.Sprintf("%s|%s", provider, reason)]++
+}
+
+// RecordSessionRefreshed counts a sticky session moved to a new vendor
+// session ID.
+func RecordSessionRefreshed(provider string) {
+	defaultMetrics.observeSessionRefreshed(provider)
+}
+
+func (m *metricsStore) observeSessionRefreshed(provider string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessionRefreshes[provider]++
+}
+
+// RecordTunnelOpened counts a CONNECT or SOCKS tunnel as active.
+func RecordTunnelOpened(tenant, provider, listener string) {
+	defaultMetrics.observeTunnelOpened(tenant, provider, listener)
+}
+
+// RecordTunnelClosed records the bytes moved by a finished tunnel in each
+// direction and how long it stayed open.
+func RecordTunnelClosed(tenant, provider, listener string, stats listeners.TunnelStats) {
+	defaultMetrics.observeTunnelClosed(tenant, provider, listener, stats)
+}
+
+func tunnelKey(tenant, provider, listener string) string {
+	return fmt.Sprintf("%s|%s|%s", valueOrDefault(tenant, "unknown"), valueOrDefault(provider, "unknown"), valueOrDefault(listener, "unknown"))
+}
+
+func (m *metricsStore) observeTunnelOpened(tenant, provider, listener string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.activeTunnels[tunnelKey(tenant, provider, listener)]++
+}
+
+func (m *metricsStore) observeTunnelClosed(tenant, provider, listener string, stats listeners.TunnelStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := tunnelKey(tenant, provider, listener)
+	m.activeTunnels[key]--
+	m.tunnelBytes[key+"|upstream"] += uint64(max(stats.BytesSent, 0))
+	m.tunnelBytes[key+"|downstream"] += uint64(max(stats.BytesReceived, 0))
+	h, ok := m.tunnelDuration[key]
+	if !ok {
+		h = &histogramState{bounds: tunnelDurationBounds, counts: make([]uint64, len(tunnelDurationBounds)+1)}
+		m.tunnelDuration[key] = h
 	}
+	h.observe(stats.Duration.Seconds())
+}
+
+// TunnelAccessLog emits the access log line for a tunnel served outside the
+// HTTP middleware, such as a SOCKS session.
+func TunnelAccessLog(metadata listeners.RequestMetadata, command, target string, stats listeners.TunnelStats) {
+	slog.Info("access",
+		"request_id", valueOrDefault(metadata.RequestID, "unknown"),
+		"provider", valueOrDefault(metadata.Provider, "unknown"),
+		"tenant", valueOrDefault(metadata.TenantID, "unknown"),
+		"listener", valueOrDefault(metadata.Listener, "unknown"),
+		"method", command,
+		"target", target,
+		"bytes_sent", stats.BytesSent,
+		"bytes_received", stats.BytesReceived,
+		"duration_ms", stats.Duration.Milliseconds(),
+		"policy_action", valueOrDefault(metadata.PolicyAction, "allow"),
+		"policy_trace", strings.Join(metadata.PolicyTrace, ","),
+	)
 }
 
 func (m *metricsStore) observe(method string, status int, provider, tenant, policyAction, policyReason string, latency time.Duration) {
@@ -288,20 +474,19 @@ func (m *metricsStore) observe(method string, status int, provider, tenant, poli
 		h = &histogramState{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
 		m.requestLatency[histKey] = h
 	}
-	seconds := latency.Seconds()
+	h.observe(latency.Seconds())
+}
+
+func (h *histogramState) observe(value float64) {
 	h.count++
-	h.sum += seconds
-	placed := false
+	h.sum += value
 	for i, bound := range h.bounds {
-		if seconds <= bound {
+		if value <= bound {
 			h.counts[i]++
-			placed = true
-			break
+			return
 		}
 	}
-	if !placed {
-		h.counts[len(h.counts)-1]++
-	}
+	h.counts[len(h.counts)-1]++
 }
 
 func (m *metricsStore) handlePrometheus(rw http.ResponseWriter, _ *http.Request) {
@@ -372,6 +557,181 @@ func (m *metricsStore) handlePrometheus(rw http.ResponseWriter, _ *http.Request)
 			escapeLabel(parts[0]), escapeLabel(parts[1]), escapeLabel(parts[2]), escapeLabel(parts[3]), h.count,
 		)))
 	}
+
+	_, _ = rw.Write([]byte("# HELP microproxy_rate_limit_rejections_total Total number of requests rejected by listener rate limits.\n"))
+	_, _ = rw.Write([]byte("# TYPE microproxy_rate_limit_rejections_total counter\n"))
+	rejectionKeys := make([]string, 0, len(m.rateLimitRejections))
+	for key := range m.rateLimitRejections {
+		rejectionKeys = append(rejectionKeys, key)
+	}
+	sort.Strings(rejectionKeys)
+	for _, key := range rejectionKeys {
+		parts := strings.SplitN(key, "|", 2)
+		_, _ = rw.Write([]byte(fmt.Sprintf(
+			"microproxy_rate_limit_rejections_total{listener=%q,protocol=%q} %d\n",
+			escapeLabel(parts[0]), escapeLabel(parts[1]), m.rateLimitRejections[key],
+		)))
+	}
+
+	_, _ = rw.Write([]byte("# HELP microproxy_connections_dropped_total Total number of connections and tunnels closed by listener limits.\n"))
+	_, _ = rw.Write([]byte("# TYPE microproxy_connections_dropped_total counter\n"))
+	droppedKeys := make([]string, 0, len(m.droppedConnections))
+	for key := range m.droppedConnections {
+		droppedKeys = append(droppedKeys, key)
+	}
+	sort.Strings(droppedKeys)
+	for _, key := range droppedKeys {
+		parts := strings.SplitN(key, "|", 2)
+		_, _ = rw.Write([]byte(fmt.Sprintf(
+			"microproxy_connections_dropped_total{listener=%q,reason=%q} %d\n",
+			escapeLabel(parts[0]), escapeLabel(parts[1]), m.droppedConnections[key],
+		)))
+	}
+
+	_, _ = rw.Write([]byte("# HELP microproxy_hedged_requests_total Total number of forward requests that launched a hedge attempt.\n"))
+	_, _ = rw.Write([]byte("# TYPE microproxy_hedged_requests_total counter\n"))
+	hedgeKeys := make([]string, 0, len(m.hedgedRequests))
+	for key := range m.hedgedRequests {
+		hedgeKeys = append(hedgeKeys, key)
+	}
+	sort.Strings(hedgeKeys)
+	for _, key := range hedgeKeys {
+		parts := strings.SplitN(key, "|", 2)
+		_, _ = rw.Write([]byte(fmt.Sprintf(
+			"microproxy_hedged_requests_total{provider=%q,outcome=%q} %d\n",
+			escapeLabel(parts[0]), escapeLabel(parts[1]), m.hedgedRequests[key],
+		)))
+	}
+
+	_, _ = rw.Write([]byte("# HELP microproxy_upstream_credential_requests_total Total number of upstream answers to pooled credentials.\n"))
+	_, _ = rw.Write([]byte("# TYPE microproxy_upstream_credential_requests_total counter\n"))
+	credentialKeys := make([]string, 0, len(m.credentialRequests))
+	for key := range m.credentialRequests {
+		credentialKeys = append(credentialKeys, key)
+	}
+	sort.Strings(credentialKeys)
+	for _, key := range credentialKeys {
+		parts := strings.SplitN(key, "|", 3)
+		_, _ = rw.Write([]byte(fmt.Sprintf(
+			"microproxy_upstream_credential_requests_total{provider=%q,credential=%q,outcome=%q} %d\n",
+			escapeLabel(parts[0]), escapeLabel(parts[1]), escapeLabel(parts[2]), m.credentialRequests[key],
+		)))
+	}
+
+	_, _ = rw.Write([]byte("# HELP microproxy_upstream_credential_quarantines_total Total number of times a pooled credential was quarantined.\n"))
+	_, _ = rw.Write([]byte("# TYPE microproxy_upstream_credential_quarantines_total counter\n"))
+	quarantineKeys := make([]string, 0, len(m.credentialQuarantines))
+	for key := range m.credentialQuarantines {
+		quarantineKeys = append(quarantineKeys, key)
+	}
+	sort.Strings(quarantineKeys)
+	for _, key := range quarantineKeys {
+		parts := strings.SplitN(key, "|", 2)
+		_, _ = rw.Write([]byte(fmt.Sprintf(
+			"microproxy_upstream_credential_quarantines_total{provider=%q,credential=%q} %d\n",
+			escapeLabel(parts[0]), escapeLabel(parts[1]), m.credentialQuarantines[key],
+		)))
+	}
+
+	_, _ = rw.Write([]byte("# HELP microproxy_sessions_active Current number of open sticky sessions.\n"))
+	_, _ = rw.Write([]byte("# TYPE microproxy_sessions_active gauge\n"))
+	sessionKeys := make([]string, 0, len(m.sessionsActive))
+	for key := range m.sessionsActive {
+		sessionKeys = append(sessionKeys, key)
+	}
+	sort.Strings(sessionKeys)
+	for _, key := range sessionKeys {
+		_, _ = rw.Write([]byte(fmt.Sprintf("microproxy_sessions_active{provider=%q} %d\n", escapeLabel(key), m.sessionsActive[key])))
+	}
+
+	_, _ = rw.Write([]byte("# HELP microproxy_sessions_opened_total Total number of sticky sessions opened.\n"))
+	_, _ = rw.Write([]byte("# TYPE microproxy_sessions_opened_total counter\n"))
+	openedKeys := make([]string, 0, len(m.sessionsOpened))
+	for key := range m.sessionsOpened {
+		openedKeys = append(openedKeys, key)
+	}
+	sort.Strings(openedKeys)
+	for _, key := range openedKeys {
+		_, _ = rw.Write([]byte(fmt.Sprintf("microproxy_sessions_opened_total{provider=%q} %d\n", escapeLabel(key), m.sessionsOpened[key])))
+	}
+
+	_, _ = rw.Write([]byte("# HELP microproxy_sessions_closed_total Total number of sticky sessions closed, by reason.\n"))
+	_, _ = rw.Write([]byte("# TYPE microproxy_sessions_closed_total counter\n"))
+	closedKeys := make([]string, 0, len(m.sessionsClosed))
+	for key := range m.sessionsClosed {
+		closedKeys = append(closedKeys, key)
+	}
+	sort.Strings(closedKeys)
+	for _, key := range closedKeys {
+		parts := strings.SplitN(key, "|", 2)
+		_, _ = rw.Write([]byte(fmt.Sprintf(
+			"microproxy_sessions_closed_total{provider=%q,reason=%q} %d\n",
+			escapeLabel(parts[0]), escapeLabel(parts[1]), m.sessionsClosed[key],
+		)))
+	}
+
+	_, _ = rw.Write([]byte("# HELP microproxy_session_refreshes_total Total number of sticky sessions moved to a new vendor session.\n"))
+	_, _ = rw.Write([]byte("# TYPE microproxy_session_refreshes_total counter\n"))
+	refreshKeys := make([]string, 0, len(m.sessionRefreshes))
+	for key := range m.sessionRefreshes {
+		refreshKeys = append(refreshKeys, key)
+	}
+	sort.Strings(refreshKeys)
+	for _, key := range refreshKeys {
+		_, _ = rw.Write([]byte(fmt.Sprintf("microproxy_session_refreshes_total{provider=%q} %d\n", escapeLabel(key), m.sessionRefreshes[key])))
+	}
+
+	_, _ = rw.Write([]byte("# HELP microproxy_tunnel_bytes_total Total bytes relayed through CONNECT and SOCKS tunnels.\n"))
+	_, _ = rw.Write([]byte("# TYPE microproxy_tunnel_bytes_total counter\n"))
+	byteKeys := make([]string, 0, len(m.tunnelBytes))
+	for key := range m.tunnelBytes {
+		byteKeys = append(byteKeys, key)
+	}
+	sort.Strings(byteKeys)
+	for _, key := range byteKeys {
+		parts := strings.SplitN(key, "|", 4)
+		_, _ = rw.Write([]byte(fmt.Sprintf(
+			"microproxy_tunnel_bytes_total{tenant=%q,provider=%q,listener=%q,direction=%q} %d\n",
+			escapeLabel(parts[0]), escapeLabel(parts[1]), escapeLabel(parts[2]), escapeLabel(parts[3]), m.tunnelBytes[key],
+		)))
+	}
+
+	_, _ = rw.Write([]byte("# HELP microproxy_tunnels_active Number of CONNECT and SOCKS tunnels currently open.\n"))
+	_, _ = rw.Write([]byte("# TYPE microproxy_tunnels_active gauge\n"))
+	activeKeys := make([]string, 0, len(m.activeTunnels))
+	for key := range m.activeTunnels {
+		activeKeys = append(activeKeys, key)
+	}
+	sort.Strings(activeKeys)
+	for _, key := range activeKeys {
+		parts := strings.SplitN(key, "|", 3)
+		_, _ = rw.Write([]byte(fmt.Sprintf(
+			"microproxy_tunnels_active{tenant=%q,provider=%q,listener=%q} %d\n",
+			escapeLabel(parts[0]), escapeLabel(parts[1]), escapeLabel(parts[2]), m.activeTunnels[key],
+		)))
+	}
+
+	_, _ = rw.Write([]byte("# HELP microproxy_tunnel_duration_seconds Lifetime distribution for CONNECT and SOCKS tunnels.\n"))
+	_, _ = rw.Write([]byte("# TYPE microproxy_tunnel_duration_seconds histogram\n"))
+	durationKeys := make([]string, 0, len(m.tunnelDuration))
+	for key := range m.tunnelDuration {
+		durationKeys = append(durationKeys, key)
+	}
+	sort.Strings(durationKeys)
+	for _, key := range durationKeys {
+		parts := strings.SplitN(key, "|", 3)
+		labels := fmt.Sprintf("tenant=%q,provider=%q,listener=%q", escapeLabel(parts[0]), escapeLabel(parts[1]), escapeLabel(parts[2]))
+		h := m.tunnelDuration[key]
+		cumulative := uint64(0)
+		for i, bound := range h.bounds {
+			cumulative += h.counts[i]
+			_, _ = rw.Write([]byte(fmt.Sprintf("microproxy_tunnel_duration_seconds_bucket{%s,le=%q} %d\n", labels, trimFloat(bound), cumulative)))
+		}
+		cumulative += h.counts[len(h.counts)-1]
+		_, _ = rw.Write([]byte(fmt.Sprintf("microproxy_tunnel_duration_seconds_bucket{%s,le=%q} %d\n", labels, "+Inf", cumulative)))
+		_, _ = rw.Write([]byte(fmt.Sprintf("microproxy_tunnel_duration_seconds_sum{%s} %s\n", labels, trimFloat(h.sum))))
+		_, _ = rw.Write([]byte(fmt.Sprintf("microproxy_tunnel_duration_seconds_count{%s} %d\n", labels, h.count)))
+	}
 }
 
 func escapeLabel(value string) string {
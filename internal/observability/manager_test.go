@@ -97,3 +97,142 @@ func TestMetricsStore_EmitsPolicyLabelsAndCounters(t *testing.T) {
 		t.Fatalf("expected policy decisions metric in output")
 	}
 }
+
+func TestMetricsStore_EmitsRateLimitRejections(t *testing.T) {
+	t.Parallel()
+
+	store := newMetricsStore()
+	store.observeRateLimitRejection("edge-http", "http")
+	store.observeRateLimitRejection("edge-http", "http")
+
+	rr := httptest.NewRecorder()
+	store.handlePrometheus(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, err := io.ReadAll(rr.Result().Body)
+	if err != nil {
+		t.Fatalf("read metrics body: %v", err)
+	}
+	if !strings.Contains(string(body), `microproxy_rate_limit_rejections_total{listener="edge-http",protocol="http"} 2`) {
+		t.Fatalf("expected rate limit rejection counter, got: %s", string(body))
+	}
+}
+
+func TestMetricsStore_EmitsHedgedRequests(t *testing.T) {
+	t.Parallel()
+
+	store := newMetricsStore()
+	store.observeHedgedRequest("residential", "hedge")
+	store.observeHedgedRequest("residential", "primary")
+	store.observeHedgedRequest("residential", "hedge")
+
+	rr := httptest.NewRecorder()
+	store.handlePrometheus(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, err := io.ReadAll(rr.Result().Body)
+	if err != nil {
+		t.Fatalf("read metrics body: %v", err)
+	}
+	if !strings.Contains(string(body), `microproxy_hedged_requests_total{provider="residential",outcome="hedge"} 2`) {
+		t.Fatalf("expected hedged request counter, got: %s", string(body))
+	}
+}
+
+func TestMetricsStore_EmitsUpstreamCredentialSeries(t *testing.T) {
+	t.Parallel()
+
+	store := newMetricsStore()
+	store.observeUpstreamCredentialUse("residential", "sub-1", "success")
+	store.observeUpstreamCredentialUse("residential", "sub-2", "auth_failure")
+	store.observeUpstreamCredentialUse("residential", "sub-2", "auth_failure")
+	store.observeUpstreamCredentialQuarantined("residential", "sub-2")
+
+	rr := httptest.NewRecorder()
+	store.handlePrometheus(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, err := io.ReadAll(rr.Result().Body)
+	if err != nil {
+		t.Fatalf("read metrics body: %v", err)
+	}
+	text := string(body)
+	for _, want := range []string{
+		`microproxy_upstream_credential_requests_total{provider="residential",credential="sub-1",outcome="success"} 1`,
+		`microproxy_upstream_credential_requests_total{provider="residential",credential="sub-2",outcome="auth_failure"} 2`,
+		`microproxy_upstream_credential_quarantines_total{provider="residential",credential="sub-2"} 1`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("expected %s in metrics, got: %s", want, text)
+		}
+	}
+}
+
+func TestMetricsStore_EmitsSessionSeries(t *testing.T) {
+	t.Parallel()
+
+	store := newMetricsStore()
+	store.observeSessionOpened("residential")
+	store.observeSessionOpened("residential")
+	store.observeSessionRefreshed("residential")
+	store.observeSessionClosed("residential", "idle_timeout")
+
+	rr := httptest.NewRecorder()
+	store.handlePrometheus(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, err := io.ReadAll(rr.Result().Body)
+	if err != nil {
+		t.Fatalf("read metrics body: %v", err)
+	}
+	text := string(body)
+	for _, want := range []string{
+		`microproxy_sessions_active{provider="residential"} 1`,
+		`microproxy_sessions_opened_total{provider="residential"} 2`,
+		`microproxy_sessions_closed_total{provider="residential",reason="idle_timeout"} 1`,
+		`microproxy_session_refreshes_total{provider="residential"} 1`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("expected %s in metrics, got: %s", want, text)
+		}
+	}
+}
+
+func TestMetricsStore_EmitsTunnelSeries(t *testing.T) {
+	t.Parallel()
+
+	store := newMetricsStore()
+	store.observeTunnelOpened("tenant-a", "residential", "edge-socks")
+	store.observeTunnelOpened("tenant-a", "residential", "edge-socks")
+	store.observeTunnelClosed("tenant-a", "residential", "edge-socks", listeners.TunnelStats{BytesSent: 120, BytesReceived: 4096, Duration: 2 * time.Second})
+
+	rr := httptest.NewRecorder()
+	store.handlePrometheus(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, err := io.ReadAll(rr.Result().Body)
+	if err != nil {
+		t.Fatalf("read metrics body: %v", err)
+	}
+	text := string(body)
+	for _, want := range []string{
+		`microproxy_tunnel_bytes_total{tenant="tenant-a",provider="residential",listener="edge-socks",direction="upstream"} 120`,
+		`microproxy_tunnel_bytes_total{tenant="tenant-a",provider="residential",listener="edge-socks",direction="downstream"} 4096`,
+		`microproxy_tunnels_active{tenant="tenant-a",provider="residential",listener="edge-socks"} 1`,
+		`microproxy_tunnel_duration_seconds_bucket{tenant="tenant-a",provider="residential",listener="edge-socks",le="5"} 1`,
+		`microproxy_tunnel_duration_seconds_count{tenant="tenant-a",provider="residential",listener="edge-socks"} 1`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("expected %s in metrics, got: %s", want, text)
+		}
+	}
+}
+
+func TestMetricsStore_EmitsDroppedConnections(t *testing.T) {
+	t.Parallel()
+
+	store := newMetricsStore()
+	store.observeConnectionDropped("edge-socks", "max_connections_per_ip")
+	store.observeConnectionDropped("edge-socks", "max_connections_per_ip")
+	store.observeConnectionDropped("edge-http", "tunnel_idle_timeout")
+
+	rr := httptest.NewRecorder()
+	store.handlePrometheus(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, err := io.ReadAll(rr.Result().Body)
+	if err != nil {
+		t.Fatalf("read metrics body: %v", err)
+	}
+	if !strings.Contains(string(body), `microproxy_connections_dropped_total{listener="edge-socks",reason="max_connections_per_ip"} 2`) {
+		t.Fatalf("expected dropped connection counter, got: %s", string(body))
+	}
+}
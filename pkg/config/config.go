@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/url"
@@ -12,6 +13,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/yaml.v2"
@@ -27,19 +29,21 @@ const (
 // Config holds the configuration for the proxy server.
 //
 // New typed sections are available at the root level:
-// listeners, providers, routing, policies, tenants, and observability.
+// listeners, providers, routing, policies, tenants, interception, and observability.
 //
 // Legacy sections (microproxy, upstream_proxy) are still accepted for one major cycle.
 type Config struct {
 	SchemaVersion string `json:"schema_version" yaml:"schema_version"`
 
-	Listeners     []ListenerConfig    `json:"listeners" yaml:"listeners"`
-	Providers     []ProviderConfig    `json:"providers" yaml:"providers"`
-	Routing       RoutingConfig       `json:"routing" yaml:"routing"`
-	Policies      []PolicyConfig      `json:"policies" yaml:"policies"`
-	PolicyEngine  PolicyEngineConfig  `json:"policy_engine,omitempty" yaml:"policy_engine,omitempty"`
-	Tenants       []TenantConfig      `json:"tenants" yaml:"tenants"`
-	Observability ObservabilityConfig `json:"observability" yaml:"observability"`
+	Listeners       []ListenerConfig       `json:"listeners" yaml:"listeners"`
+	Providers       []ProviderConfig       `json:"providers" yaml:"providers"`
+	ProviderPlugins []ProviderPluginConfig `json:"provider_plugins,omitempty" yaml:"provider_plugins,omitempty"` // external plugin binaries serving provider types
+	Routing         RoutingConfig          `json:"routing" yaml:"routing"`
+	Policies        []PolicyConfig         `json:"policies" yaml:"policies"`
+	PolicyEngine    PolicyEngineConfig     `json:"policy_engine,omitempty" yaml:"policy_engine,omitempty"`
+	Tenants         []TenantConfig         `json:"tenants" yaml:"tenants"`
+	Interception    InterceptionConfig     `json:"interception,omitempty" yaml:"interception,omitempty"`
+	Observability   ObservabilityConfig    `json:"observability" yaml:"observability"`
 
 	// Legacy config sections.
 	MicroProxy    ProxyConfig         `json:"microproxy" yaml:"microproxy"`
@@ -48,20 +52,72 @@ type Config struct {
 
 // ListenerConfig defines a listener endpoint.
 type ListenerConfig struct {
-	Name      string     `json:"name" yaml:"name"`
-	Type      string     `json:"type" yaml:"type"` // http, https, socks5
-	Address   string     `json:"address" yaml:"address"`
-	TLS       *TLSConfig `json:"tls,omitempty" yaml:"tls,omitempty"`
-	RateLimit int        `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty"`
-	AuthType  string     `json:"auth_type,omitempty" yaml:"auth_type,omitempty"`
-	Username  string     `json:"username,omitempty" yaml:"username,omitempty"`
-	Password  string     `json:"password,omitempty" yaml:"password,omitempty"`
-	Enabled   bool       `json:"enabled" yaml:"enabled"`
+	Name           string     `json:"name" yaml:"name"`
+	Type           string     `json:"type" yaml:"type"` // http, https, socks5
+	Address        string     `json:"address" yaml:"address"`
+	TLS            *TLSConfig `json:"tls,omitempty" yaml:"tls,omitempty"`
+	RateLimit      int        `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty"`             // requests per second, 0 disables
+	RateLimitBurst int        `json:"rate_limit_burst,omitempty" yaml:"rate_limit_burst,omitempty"` // defaults to rate_limit
+	RateLimitKey   string     `json:"rate_limit_key,omitempty" yaml:"rate_limit_key,omitempty"`     // listener, client_ip, tenant
+	HTTP2          bool       `json:"http2,omitempty" yaml:"http2,omitempty"`                       // h2 via ALPN on https, h2c on http
+	Intercept      bool       `json:"intercept,omitempty" yaml:"intercept,omitempty"`               // terminate TLS inside CONNECT tunnels
+	AuthType       string     `json:"auth_type,omitempty" yaml:"auth_type,omitempty"`
+	Username       string     `json:"username,omitempty" yaml:"username,omitempty"`
+	Password       string     `json:"password,omitempty" yaml:"password,omitempty"`
+	Enabled        bool       `json:"enabled" yaml:"enabled"`
+
+	// Users and HtpasswdFile add basic-auth accounts next to Username and
+	// Password. The htpasswd file holds bcrypt, {SHA} or plain entries and is
+	// reloaded when it changes.
+	Users        []ListenerUserConfig `json:"users,omitempty" yaml:"users,omitempty"`
+	HtpasswdFile string               `json:"htpasswd_file,omitempty" yaml:"htpasswd_file,omitempty"`
+
+	// Timeouts and connection caps; 0 disables each one.
+	ReadHeaderTimeoutSeconds int `json:"read_header_timeout_seconds,omitempty" yaml:"read_header_timeout_seconds,omitempty"` // HTTP request headers or SOCKS handshake
+	TunnelIdleTimeoutSeconds int `json:"tunnel_idle_timeout_seconds,omitempty" yaml:"tunnel_idle_timeout_seconds,omitempty"`
+	MaxTunnelLifetimeSeconds int `json:"max_tunnel_lifetime_seconds,omitempty" yaml:"max_tunnel_lifetime_seconds,omitempty"`
+	MaxConnections           int `json:"max_connections,omitempty" yaml:"max_connections,omitempty"`
+	MaxConnectionsPerIP      int `json:"max_connections_per_ip,omitempty" yaml:"max_connections_per_ip,omitempty"`
+
+	// Client subnets. A client in DenyCIDRs is refused; when AllowCIDRs is
+	// set, so is any client outside it. SOCKS5 checks at accept time, HTTP
+	// per request.
+	AllowCIDRs []string `json:"allow_cidrs,omitempty" yaml:"allow_cidrs,omitempty"`
+	DenyCIDRs  []string `json:"deny_cidrs,omitempty" yaml:"deny_cidrs,omitempty"`
+}
+
+// ListenerUserConfig binds a listener account to the tenant, provider and
+// policies its traffic runs under.
+type ListenerUserConfig struct {
+	Username string   `json:"username" yaml:"username"`
+	Password string   `json:"password,omitempty" yaml:"password,omitempty"` // plain or htpasswd hash; omit for users in htpasswd_file
+	TenantID string   `json:"tenant_id,omitempty" yaml:"tenant_id,omitempty"`
+	Provider string   `json:"provider,omitempty" yaml:"provider,omitempty"`
+	Policies []string `json:"policies,omitempty" yaml:"policies,omitempty"`
 }
 
 type TLSConfig struct {
 	CertFile string `json:"cert_file" yaml:"cert_file"`
 	KeyFile  string `json:"key_file" yaml:"key_file"`
+
+	// Client certificate authentication, https listeners only. ClientAuth is
+	// none (default), optional or required; certificates are verified against
+	// ClientCAFile and mapped to tenants by ClientTenants.
+	ClientCAFile  string                   `json:"client_ca_file,omitempty" yaml:"client_ca_file,omitempty"`
+	ClientAuth    string                   `json:"client_auth,omitempty" yaml:"client_auth,omitempty"`
+	ClientTenants []ClientCertTenantConfig `json:"client_tenants,omitempty" yaml:"client_tenants,omitempty"`
+}
+
+// ClientCertTenantConfig binds client certificates to a tenant. Exactly one
+// of SPIFFEID, DNSName or CommonName selects the certificates; a leading or
+// trailing "*" matches any prefix or suffix.
+type ClientCertTenantConfig struct {
+	SPIFFEID   string   `json:"spiffe_id,omitempty" yaml:"spiffe_id,omitempty"`     // URI SAN, spiffe://trust-domain/path
+	DNSName    string   `json:"dns_name,omitempty" yaml:"dns_name,omitempty"`       // DNS SAN
+	CommonName string   `json:"common_name,omitempty" yaml:"common_name,omitempty"` // subject CN
+	TenantID   string   `json:"tenant_id" yaml:"tenant_id"`
+	Provider   string   `json:"provider,omitempty" yaml:"provider,omitempty"`
+	Policies   []string `json:"policies,omitempty" yaml:"policies,omitempty"`
 }
 
 // ProviderConfig defines a typed upstream provider.
@@ -76,43 +132,242 @@ type ProviderConfig struct {
 	Session      ProviderSessionConfig      `json:"session,omitempty" yaml:"session,omitempty"`
 	GeoTargeting ProviderGeoTargetingConfig `json:"geo_targeting,omitempty" yaml:"geo_targeting,omitempty"`
 	Limits       ProviderLimitsConfig       `json:"limits,omitempty" yaml:"limits,omitempty"`
+	Selection    ProviderSelectionConfig    `json:"selection,omitempty" yaml:"selection,omitempty"`
+	Affinity     ProviderAffinityConfig     `json:"affinity,omitempty" yaml:"affinity,omitempty"`
+	Retry        ProviderRetryConfig        `json:"retry,omitempty" yaml:"retry,omitempty"`
+	Hedging      ProviderHedgingConfig      `json:"hedging,omitempty" yaml:"hedging,omitempty"`
+	HTTP2        bool                       `json:"http2,omitempty" yaml:"http2,omitempty"` // negotiate HTTP/2 with TLS origins (direct providers)
 	Health       ProviderHealthConfig       `json:"health" yaml:"health"`
 }
 
+// ProviderPluginConfig launches an external plugin binary that serves
+// providers of Type. The data plane speaks to it over the child's stdin and
+// stdout and restarts it with exponential backoff when it exits.
+type ProviderPluginConfig struct {
+	Type                    string            `json:"type" yaml:"type"`
+	Command                 string            `json:"command" yaml:"command"`
+	Args                    []string          `json:"args,omitempty" yaml:"args,omitempty"`
+	Env                     map[string]string `json:"env,omitempty" yaml:"env,omitempty"`
+	CallTimeoutMillis       int               `json:"call_timeout_ms,omitempty" yaml:"call_timeout_ms,omitempty"`               // defaults to 5000
+	RestartBackoffMillis    int               `json:"restart_backoff_ms,omitempty" yaml:"restart_backoff_ms,omitempty"`         // defaults to 500
+	MaxRestartBackoffMillis int               `json:"max_restart_backoff_ms,omitempty" yaml:"max_restart_backoff_ms,omitempty"` // defaults to 30000
+}
+
 type ProviderAuthConfig struct {
 	Type     string            `json:"type" yaml:"type"` // none, basic, bearer, api_key
 	Username string            `json:"username,omitempty" yaml:"username,omitempty"`
 	Password string            `json:"password,omitempty" yaml:"password,omitempty"`
 	Token    string            `json:"token,omitempty" yaml:"token,omitempty"`
 	Headers  map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	// Preset and the templates build a vendor-style basic login that encodes
+	// request targeting; see RenderAuthTemplate. Templates override the
+	// preset's.
+	Preset           string `json:"preset,omitempty" yaml:"preset,omitempty"` // brightdata, oxylabs, smartproxy, iproyal
+	UsernameTemplate string `json:"username_template,omitempty" yaml:"username_template,omitempty"`
+	PasswordTemplate string `json:"password_template,omitempty" yaml:"password_template,omitempty"`
+	// Pool replaces Username and Password with a set of basic credentials
+	// used in turn.
+	Pool ProviderCredentialPoolConfig `json:"pool,omitempty" yaml:"pool,omitempty"`
+}
+
+// ProviderCredentialPoolConfig spreads a provider's traffic over several
+// accounts, such as a vendor's sub-users. A credential the proxy keeps
+// refusing, with a 407 or a 403 to CONNECT, is quarantined for a while.
+type ProviderCredentialPoolConfig struct {
+	Credentials       []ProviderCredential `json:"credentials,omitempty" yaml:"credentials,omitempty"`
+	File              string               `json:"file,omitempty" yaml:"file,omitempty"`                             // username:password per line, read at startup
+	Strategy          string               `json:"strategy,omitempty" yaml:"strategy,omitempty"`                     // round_robin (default), least_used, sticky_session
+	QuarantineAfter   int                  `json:"quarantine_after,omitempty" yaml:"quarantine_after,omitempty"`     // consecutive refusals; default 3
+	QuarantineSeconds int                  `json:"quarantine_seconds,omitempty" yaml:"quarantine_seconds,omitempty"` // default 300
+}
+
+// Enabled reports whether the pool has inline credentials or a file.
+func (p ProviderCredentialPoolConfig) Enabled() bool {
+	return len(p.Credentials) > 0 || strings.TrimSpace(p.File) != ""
+}
+
+type ProviderCredential struct {
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"password,omitempty" yaml:"password,omitempty"`
+}
+
+// authPresets holds the username and password templates of common
+// residential proxy vendors.
+var authPresets = map[string][2]string{
+	"brightdata": {"{username}[-country-{country}][-city-{city}][-session-{session}]", ""},
+	"oxylabs":    {"{username}[-cc-{country}][-city-{city}][-sessid-{session}][-sesstime-{session_ttl}]", ""},
+	"smartproxy": {"user-{username}[-country-{country}][-city-{city}][-session-{session}][-sessionduration-{session_ttl}]", ""},
+	"iproyal":    {"", "{password}[_country-{country}][_city-{city}][_session-{session}][_lifetime-{session_ttl}m]"},
+}
+
+// AuthTemplates returns the username and password templates auth uses, or
+// empty strings when it sends its username and password as configured.
+func (a ProviderAuthConfig) AuthTemplates() (string, string) {
+	preset := authPresets[strings.ToLower(strings.TrimSpace(a.Preset))]
+	username, password := preset[0], preset[1]
+	if tmpl := strings.TrimSpace(a.UsernameTemplate); tmpl != "" {
+		username = tmpl
+	}
+	if tmpl := strings.TrimSpace(a.PasswordTemplate); tmpl != "" {
+		password = tmpl
+	}
+	return username, password
+}
+
+// authTemplateFields are the placeholders RenderAuthTemplate fills.
+var authTemplateFields = map[string]struct{}{
+	"username": {}, "password": {}, "country": {}, "city": {}, "session": {}, "session_ttl": {},
+}
+
+// RenderAuthTemplate fills the {username}, {password}, {country}, {city},
+// {session} and {session_ttl} placeholders of tmpl from values. A segment in
+// square brackets is dropped when any placeholder in it has no value, so
+// "{username}[-country-{country}]" renders as "acme" without a country and
+// "acme-country-us" with one. Brackets do not nest.
+func RenderAuthTemplate(tmpl string, values map[string]string) (string, error) {
+	var out, segment strings.Builder
+	inSegment, segmentComplete := false, true
+	current := &out
+	for idx := 0; idx < len(tmpl); idx++ {
+		switch ch := tmpl[idx]; ch {
+		case '[':
+			if inSegment {
+				return "", errors.New("optional segments cannot nest")
+			}
+			inSegment, segmentComplete = true, true
+			segment.Reset()
+			current = &segment
+		case ']':
+			if !inSegment {
+				return "", errors.New("unmatched ]")
+			}
+			if segmentComplete {
+				out.WriteString(segment.String())
+			}
+			inSegment = false
+			current = &out
+		case '{':
+			end := strings.IndexByte(tmpl[idx:], '}')
+			if end < 0 {
+				return "", errors.New("unterminated placeholder")
+			}
+			name := tmpl[idx+1 : idx+end]
+			if _, ok := authTemplateFields[name]; !ok {
+				return "", fmt.Errorf("unknown placeholder {%s}", name)
+			}
+			value := values[name]
+			if value == "" {
+				segmentComplete = false
+			}
+			current.WriteString(value)
+			idx += end
+		default:
+			current.WriteByte(ch)
+		}
+	}
+	if inSegment {
+		return "", errors.New("unterminated optional segment")
+	}
+	return out.String(), nil
 }
 
 type ProviderEndpoint struct {
-	URL      string `json:"url" yaml:"url"`
-	Priority int    `json:"priority,omitempty" yaml:"priority,omitempty"`
-	Weight   int    `json:"weight,omitempty" yaml:"weight,omitempty"`
-	Region   string `json:"region,omitempty" yaml:"region,omitempty"`
-	Country  string `json:"country,omitempty" yaml:"country,omitempty"`
+	URL                  string `json:"url" yaml:"url"`
+	Priority             int    `json:"priority,omitempty" yaml:"priority,omitempty"`
+	Weight               int    `json:"weight,omitempty" yaml:"weight,omitempty"`
+	Region               string `json:"region,omitempty" yaml:"region,omitempty"`
+	Country              string `json:"country,omitempty" yaml:"country,omitempty"`
+	MaxRequestsPerMinute int    `json:"max_requests_per_minute,omitempty" yaml:"max_requests_per_minute,omitempty"`
+	Concurrency          int    `json:"concurrency,omitempty" yaml:"concurrency,omitempty"`
 }
 
+// ProviderRotationConfig rotates the session token a session-based provider
+// receives through its auth templates. Mode is per_request, interval,
+// on_failure or manual (the default), where the token only changes when the
+// control plane asks for a rotation. Requests that send their own session
+// hint keep it.
 type ProviderRotationConfig struct {
-	Enabled bool   `json:"enabled" yaml:"enabled"`
-	Mode    string `json:"mode,omitempty" yaml:"mode,omitempty"`
+	Enabled         bool   `json:"enabled" yaml:"enabled"`
+	Mode            string `json:"mode,omitempty" yaml:"mode,omitempty"`
+	IntervalSeconds int    `json:"interval_seconds,omitempty" yaml:"interval_seconds,omitempty"`
 }
 
+// ProviderSessionConfig reports whether the provider keeps sticky sessions.
+// Only then are session and session TTL hints passed to its auth templates,
+// and do clients naming a session get one pinned to an endpoint, credential
+// and vendor session ID. A session ends after IdleTTLSeconds without traffic
+// (default 600) or MaxLifetimeSeconds after it opened (default 3600).
+// RefreshSupported lets the control plane give a session a new vendor
+// session ID.
 type ProviderSessionConfig struct {
-	Supported        bool `json:"supported" yaml:"supported"`
-	RefreshSupported bool `json:"refresh_supported" yaml:"refresh_supported"`
+	Supported          bool `json:"supported" yaml:"supported"`
+	RefreshSupported   bool `json:"refresh_supported" yaml:"refresh_supported"`
+	IdleTTLSeconds     int  `json:"idle_ttl_seconds,omitempty" yaml:"idle_ttl_seconds,omitempty"`
+	MaxLifetimeSeconds int  `json:"max_lifetime_seconds,omitempty" yaml:"max_lifetime_seconds,omitempty"`
 }
 
+// ProviderGeoTargetingConfig reports whether the provider targets exits by
+// location. Only then are country and city hints passed to its auth
+// templates; Modes limits which of the two, and is empty to allow both.
 type ProviderGeoTargetingConfig struct {
 	Supported bool     `json:"supported" yaml:"supported"`
-	Modes     []string `json:"modes,omitempty" yaml:"modes,omitempty"`
+	Modes     []string `json:"modes,omitempty" yaml:"modes,omitempty"` // country, city
+}
+
+// Allows reports whether hints for mode ("country" or "city") apply.
+func (g ProviderGeoTargetingConfig) Allows(mode string) bool {
+	if !g.Supported {
+		return false
+	}
+	if len(g.Modes) == 0 {
+		return true
+	}
+	for _, candidate := range g.Modes {
+		if strings.EqualFold(strings.TrimSpace(candidate), mode) {
+			return true
+		}
+	}
+	return false
 }
 
+// ProviderLimitsConfig caps traffic sent to a provider. Concurrency slots are
+// held for the lifetime of a response or CONNECT tunnel.
 type ProviderLimitsConfig struct {
-	MaxRequestsPerMinute int `json:"max_requests_per_minute,omitempty" yaml:"max_requests_per_minute,omitempty"`
-	Concurrency          int `json:"concurrency,omitempty" yaml:"concurrency,omitempty"`
+	MaxRequestsPerMinute int    `json:"max_requests_per_minute,omitempty" yaml:"max_requests_per_minute,omitempty"`
+	Concurrency          int    `json:"concurrency,omitempty" yaml:"concurrency,omitempty"`
+	Strategy             string `json:"strategy,omitempty" yaml:"strategy,omitempty"` // spill (default), queue, reject
+	QueueTimeoutMillis   int    `json:"queue_timeout_ms,omitempty" yaml:"queue_timeout_ms,omitempty"`
+	FallbackProvider     string `json:"fallback_provider,omitempty" yaml:"fallback_provider,omitempty"`
+}
+
+// ProviderSelectionConfig picks how endpoints sharing a priority tier are ordered.
+type ProviderSelectionConfig struct {
+	Strategy string `json:"strategy,omitempty" yaml:"strategy,omitempty"` // priority (default), weighted_round_robin, random_weighted, least_outstanding, latency_ewma
+}
+
+// ProviderAffinityConfig pins requests sharing a key to the same endpoint.
+type ProviderAffinityConfig struct {
+	Key      string `json:"key,omitempty" yaml:"key,omitempty"`       // tenant, session_header, proxy_user, client_ip
+	Header   string `json:"header,omitempty" yaml:"header,omitempty"` // defaults to X-Microproxy-Session
+	Replicas int    `json:"replicas,omitempty" yaml:"replicas,omitempty"`
+}
+
+// ProviderRetryConfig controls how failed forward requests move on to the next
+// endpoint. Request bodies are buffered so they can be replayed.
+type ProviderRetryConfig struct {
+	MaxAttempts     int      `json:"max_attempts,omitempty" yaml:"max_attempts,omitempty"`           // 0 tries every endpoint
+	Methods         []string `json:"methods,omitempty" yaml:"methods,omitempty"`                     // defaults to idempotent methods
+	RetryOnStatus   []int    `json:"retry_on_status,omitempty" yaml:"retry_on_status,omitempty"`     // e.g. 502, 503, 429
+	BodyMemoryBytes int64    `json:"body_memory_bytes,omitempty" yaml:"body_memory_bytes,omitempty"` // spills to a temp file above this
+	MaxBodyBytes    int64    `json:"max_body_bytes,omitempty" yaml:"max_body_bytes,omitempty"`       // larger bodies are attempted once
+}
+
+// ProviderHedgingConfig races a second endpoint against a slow first attempt.
+// Only methods the retry policy allows are hedged. Hedging requires the spill
+// quota strategy: a hedge only takes a free endpoint, so it cannot queue for
+// or be rejected by a saturated one.
+type ProviderHedgingConfig struct {
+	DelayMillis int `json:"delay_ms,omitempty" yaml:"delay_ms,omitempty"` // 0 disables hedging
 }
 
 type ProviderHealthConfig struct {
@@ -125,8 +380,9 @@ type ProviderHealthConfig struct {
 }
 
 type RoutingConfig struct {
-	DefaultProvider string        `json:"default_provider,omitempty" yaml:"default_provider,omitempty"`
-	Rules           []RoutingRule `json:"rules,omitempty" yaml:"rules,omitempty"`
+	DefaultProvider  string        `json:"default_provider,omitempty" yaml:"default_provider,omitempty"`
+	DefaultPolicyRef string        `json:"default_policy_ref,omitempty" yaml:"default_policy_ref,omitempty"` // comma-separated; for requests whose rule sets no policy
+	Rules            []RoutingRule `json:"rules,omitempty" yaml:"rules,omitempty"`
 }
 
 type RoutingRule struct {
@@ -161,6 +417,24 @@ type TenantConfig struct {
 	ID        string   `json:"id" yaml:"id"`
 	Providers []string `json:"providers,omitempty" yaml:"providers,omitempty"`
 	Policies  []string `json:"policies,omitempty" yaml:"policies,omitempty"`
+	Intercept bool     `json:"intercept,omitempty" yaml:"intercept,omitempty"` // terminate TLS inside this tenant's CONNECT tunnels
+
+	// Client subnets this tenant's traffic may come from, checked like the
+	// listener lists once the tenant is known.
+	AllowCIDRs []string `json:"allow_cidrs,omitempty" yaml:"allow_cidrs,omitempty"`
+	DenyCIDRs  []string `json:"deny_cidrs,omitempty" yaml:"deny_cidrs,omitempty"`
+}
+
+// InterceptionConfig configures TLS interception of CONNECT tunnels. A tunnel
+// is intercepted when its listener or tenant opts in or its host matches
+// Domains, unless the host matches Bypass. Entries match the domain and all
+// of its subdomains.
+type InterceptionConfig struct {
+	CA                *TLSConfig `json:"ca,omitempty" yaml:"ca,omitempty"`
+	CertCacheSize     int        `json:"cert_cache_size,omitempty" yaml:"cert_cache_size,omitempty"`         // minted leaf certificates kept, default 1024
+	LeafValidityHours int        `json:"leaf_validity_hours,omitempty" yaml:"leaf_validity_hours,omitempty"` // default 24
+	Domains           []string   `json:"domains,omitempty" yaml:"domains,omitempty"`
+	Bypass            []string   `json:"bypass,omitempty" yaml:"bypass,omitempty"` // pinned domains always tunnelled untouched
 }
 
 type ObservabilityConfig struct {
@@ -276,6 +550,12 @@ func (cfg *UpstreamProxyConfig) GetCredentialsFor(ip net.IP) (string, string) {
 	return "", ""
 }
 
+// ExpandSessionID replaces ${SESSION_ID} in an upstream username with a fresh
+// session identifier, so each request gets its own upstream session.
+func ExpandSessionID(username string) string {
+	return resolveSessionID(username)
+}
+
 func resolveSessionID(username string) string {
 	return strings.ReplaceAll(username, "${SESSION_ID}", generateSessionID())
 }
@@ -396,7 +676,14 @@ func (c *Config) applyLegacyCompatibility() {
 		}
 	}
 
+	if len(c.Providers) > 0 && c.Providers[0].Type == "legacy_upstream_proxy" && strings.TrimSpace(c.Routing.DefaultProvider) == "" {
+		c.Routing.DefaultProvider = c.Providers[0].Name
+	}
+
+	// Login rules become upstream_credentials policies applied to every
+	// request; the first rule whose ip_range holds the client wins.
 	if len(c.Policies) == 0 {
+		loginPolicies := make([]string, 0, len(c.UpstreamProxy.Logins))
 		for i, login := range c.UpstreamProxy.Logins {
 			c.Policies = append(c.Policies, PolicyConfig{
 				Name:   fmt.Sprintf("legacy-login-%d", i),
@@ -410,6 +697,10 @@ func (c *Config) applyLegacyCompatibility() {
 					"password": login.Password,
 				},
 			})
+			loginPolicies = append(loginPolicies, fmt.Sprintf("legacy-login-%d", i))
+		}
+		if len(loginPolicies) > 0 && strings.TrimSpace(c.Routing.DefaultPolicyRef) == "" {
+			c.Routing.DefaultPolicyRef = strings.Join(loginPolicies, ",")
 		}
 	}
 }
@@ -475,6 +766,17 @@ func (c *Config) Validate() error {
 		}
 	}
 
+	pluginTypeSeen := map[string]int{}
+	for idx, plugin := range c.ProviderPlugins {
+		errs.Merge(plugin.Validate(fmt.Sprintf("provider_plugins[%d]", idx)))
+		if pluginType := strings.ToLower(strings.TrimSpace(plugin.Type)); pluginType != "" {
+			if seenIdx, exists := pluginTypeSeen[pluginType]; exists {
+				errs.Add(fmt.Sprintf("provider_plugins[%d].type", idx), fmt.Sprintf("duplicates provider_plugins[%d].type", seenIdx))
+			}
+			pluginTypeSeen[pluginType] = idx
+		}
+	}
+
 	policyNameSeen := map[string]int{}
 	for idx, policy := range c.Policies {
 		errs.Merge(policy.Validate(fmt.Sprintf("policies[%d]", idx)))
@@ -497,6 +799,60 @@ func (c *Config) Validate() error {
 		}
 	}
 
+	for idx, provider := range c.Providers {
+		fallback := strings.TrimSpace(provider.Limits.FallbackProvider)
+		if fallback == "" {
+			continue
+		}
+		path := fmt.Sprintf("providers[%d].limits.fallback_provider", idx)
+		if _, ok := providerNameSeen[fallback]; !ok {
+			errs.Add(path, "must reference an existing provider name")
+		} else if fallback == strings.TrimSpace(provider.Name) {
+			errs.Add(path, "cannot reference the provider itself")
+		}
+	}
+
+	interceptionRequested := len(c.Interception.Domains) > 0
+	for _, listener := range c.Listeners {
+		interceptionRequested = interceptionRequested || listener.Intercept
+	}
+	for _, tenant := range c.Tenants {
+		interceptionRequested = interceptionRequested || tenant.Intercept
+	}
+	errs.Merge(c.Interception.Validate("interception", interceptionRequested))
+
+	for idx, listener := range c.Listeners {
+		for userIdx, user := range listener.Users {
+			userPath := fmt.Sprintf("listeners[%d].users[%d]", idx, userIdx)
+			if p := strings.TrimSpace(user.Provider); p != "" {
+				if _, ok := providerNameSeen[p]; !ok {
+					errs.Add(userPath+".provider", "must reference an existing provider name")
+				}
+			}
+			for policyIdx, policy := range user.Policies {
+				if _, ok := policyNameSeen[strings.TrimSpace(policy)]; !ok {
+					errs.Add(fmt.Sprintf("%s.policies[%d]", userPath, policyIdx), "must reference an existing policy name")
+				}
+			}
+		}
+		if listener.TLS == nil {
+			continue
+		}
+		for mappingIdx, mapping := range listener.TLS.ClientTenants {
+			mappingPath := fmt.Sprintf("listeners[%d].tls.client_tenants[%d]", idx, mappingIdx)
+			if p := strings.TrimSpace(mapping.Provider); p != "" {
+				if _, ok := providerNameSeen[p]; !ok {
+					errs.Add(mappingPath+".provider", "must reference an existing provider name")
+				}
+			}
+			for policyIdx, policy := range mapping.Policies {
+				if _, ok := policyNameSeen[strings.TrimSpace(policy)]; !ok {
+					errs.Add(fmt.Sprintf("%s.policies[%d]", mappingPath, policyIdx), "must reference an existing policy name")
+				}
+			}
+		}
+	}
+
 	errs.Merge(c.Routing.Validate("routing", providerNameSeen, policyNameSeen))
 	errs.Merge(c.PolicyEngine.Validate("policy_engine"))
 	errs.Merge(c.UpstreamProxy.Validate("upstream_proxy"))
@@ -534,9 +890,60 @@ func (l ListenerConfig) Validate(fieldPath string) *ValidationErrors {
 		errs.Add(fieldPath+".tls", "must only be set for https listeners")
 	}
 
+	if l.RateLimit < 0 {
+		errs.Add(fieldPath+".rate_limit", "cannot be negative")
+	}
+	if l.RateLimitBurst < 0 {
+		errs.Add(fieldPath+".rate_limit_burst", "cannot be negative")
+	}
+	switch strings.ToLower(strings.TrimSpace(l.RateLimitKey)) {
+	case "", "listener", "client_ip", "tenant":
+	default:
+		errs.Add(fieldPath+".rate_limit_key", "must be one of: listener, client_ip, tenant")
+	}
+	if l.ReadHeaderTimeoutSeconds < 0 {
+		errs.Add(fieldPath+".read_header_timeout_seconds", "cannot be negative")
+	}
+	if l.TunnelIdleTimeoutSeconds < 0 {
+		errs.Add(fieldPath+".tunnel_idle_timeout_seconds", "cannot be negative")
+	}
+	if l.MaxTunnelLifetimeSeconds < 0 {
+		errs.Add(fieldPath+".max_tunnel_lifetime_seconds", "cannot be negative")
+	}
+	if l.MaxConnections < 0 {
+		errs.Add(fieldPath+".max_connections", "cannot be negative")
+	}
+	if l.MaxConnectionsPerIP < 0 {
+		errs.Add(fieldPath+".max_connections_per_ip", "cannot be negative")
+	}
+	if l.MaxConnections > 0 && l.MaxConnectionsPerIP > l.MaxConnections {
+		errs.Add(fieldPath+".max_connections_per_ip", "cannot exceed max_connections")
+	}
+	errs.Merge(validateCIDRs(fieldPath+".allow_cidrs", l.AllowCIDRs))
+	errs.Merge(validateCIDRs(fieldPath+".deny_cidrs", l.DenyCIDRs))
+	if l.HTTP2 && proto != "http" && proto != "https" {
+		errs.Add(fieldPath+".http2", "must only be set for http and https listeners")
+	}
+	if l.Intercept && proto != "http" && proto != "https" {
+		errs.Add(fieldPath+".intercept", "must only be set for http and https listeners")
+	}
+
+	htpasswdSet := strings.TrimSpace(l.HtpasswdFile) != ""
 	switch strings.ToLower(strings.TrimSpace(l.AuthType)) {
 	case "", "none":
+		if len(l.Users) > 0 {
+			errs.Add(fieldPath+".users", "must only be set for basic auth")
+		}
+		if htpasswdSet {
+			errs.Add(fieldPath+".htpasswd_file", "must only be set for basic auth")
+		}
 	case "basic":
+		if len(l.Users) > 0 || htpasswdSet {
+			if (strings.TrimSpace(l.Username) == "") != (strings.TrimSpace(l.Password) == "") {
+				errs.Add(fieldPath+".username", "username and password must both be set")
+			}
+			break
+		}
 		if strings.TrimSpace(l.Username) == "" {
 			errs.Add(fieldPath+".username", "is required for basic auth")
 		}
@@ -547,6 +954,22 @@ func (l ListenerConfig) Validate(fieldPath string) *ValidationErrors {
 		errs.Add(fieldPath+".auth_type", "must be one of: none, basic")
 	}
 
+	userSeen := map[string]int{}
+	for idx, user := range l.Users {
+		userPath := fmt.Sprintf("%s.users[%d]", fieldPath, idx)
+		name := strings.TrimSpace(user.Username)
+		if name == "" {
+			errs.Add(userPath+".username", "cannot be empty")
+		} else if seenIdx, exists := userSeen[name]; exists {
+			errs.Add(userPath+".username", fmt.Sprintf("duplicates %s.users[%d].username", fieldPath, seenIdx))
+		} else {
+			userSeen[name] = idx
+		}
+		if strings.TrimSpace(user.Password) == "" && !htpasswdSet {
+			errs.Add(userPath+".password", "is required unless htpasswd_file is set")
+		}
+	}
+
 	return errs
 }
 
@@ -564,9 +987,67 @@ func (t *TLSConfig) Validate(fieldPath string) *ValidationErrors {
 		errs.Add(fieldPath, "cert_file and key_file must both be set")
 	}
 
+	clientAuth := strings.ToLower(strings.TrimSpace(t.ClientAuth))
+	switch clientAuth {
+	case "", "none":
+		if len(t.ClientTenants) > 0 {
+			errs.Add(fieldPath+".client_tenants", "requires client_auth optional or required")
+		}
+	case "optional", "required":
+		if strings.TrimSpace(t.ClientCAFile) == "" {
+			errs.Add(fieldPath+".client_ca_file", "is required when client_auth is set")
+		}
+	default:
+		errs.Add(fieldPath+".client_auth", "must be one of: none, optional, required")
+	}
+	for idx, mapping := range t.ClientTenants {
+		mappingPath := fmt.Sprintf("%s.client_tenants[%d]", fieldPath, idx)
+		matchers := 0
+		for _, value := range []string{mapping.SPIFFEID, mapping.DNSName, mapping.CommonName} {
+			if strings.TrimSpace(value) != "" {
+				matchers++
+			}
+		}
+		if matchers != 1 {
+			errs.Add(mappingPath, "exactly one of spiffe_id, dns_name, common_name must be set")
+		}
+		if id := strings.TrimSpace(mapping.SPIFFEID); id != "" && !strings.HasPrefix(id, "spiffe://") {
+			errs.Add(mappingPath+".spiffe_id", "must start with spiffe://")
+		}
+		if strings.TrimSpace(mapping.TenantID) == "" {
+			errs.Add(mappingPath+".tenant_id", "cannot be empty")
+		}
+	}
+
 	return errs
 }
 
+var providerValidators = struct {
+	sync.RWMutex
+	byType map[string]func(ProviderConfig) error
+}{byType: map[string]func(ProviderConfig) error{}}
+
+// RegisterProviderValidator adds a check that ProviderConfig.Validate runs
+// for providers of providerType, so provider plugins can validate their own
+// settings. A *ValidationErrors result keeps its fields, relative to the
+// provider. A nil validate removes the type's check.
+func RegisterProviderValidator(providerType string, validate func(ProviderConfig) error) {
+	providerValidators.Lock()
+	defer providerValidators.Unlock()
+	key := strings.ToLower(strings.TrimSpace(providerType))
+	if validate == nil {
+		delete(providerValidators.byType, key)
+		return
+	}
+	providerValidators.byType[key] = validate
+}
+
+func providerValidator(providerType string) func(ProviderConfig) error {
+	providerValidators.RLock()
+	defer providerValidators.RUnlock()
+	return providerValidators.byType[strings.ToLower(strings.TrimSpace(providerType))]
+}
+
 func (p ProviderConfig) Validate(fieldPath string) *ValidationErrors {
 	errs := &ValidationErrors{}
 
@@ -579,16 +1060,184 @@ func (p ProviderConfig) Validate(fieldPath string) *ValidationErrors {
 	if len(p.Endpoints) == 0 {
 		errs.Add(fieldPath+".endpoints", "must contain at least one endpoint")
 	}
+	if validate := providerValidator(p.Type); validate != nil {
+		if err := validate(p); err != nil {
+			var fieldErrs *ValidationErrors
+			if errors.As(err, &fieldErrs) {
+				for _, fieldErr := range fieldErrs.Errors {
+					field := fieldPath
+					if fieldErr.Field != "" {
+						field += "." + fieldErr.Field
+					}
+					errs.Add(field, fieldErr.Message)
+				}
+			} else {
+				errs.Add(fieldPath, err.Error())
+			}
+		}
+	}
 
 	for idx, endpoint := range p.Endpoints {
 		errs.Merge(endpoint.Validate(fmt.Sprintf("%s.endpoints[%d]", fieldPath, idx)))
 	}
 
 	errs.Merge(p.Auth.Validate(fieldPath + ".auth"))
+	for idx, mode := range p.GeoTargeting.Modes {
+		switch strings.ToLower(strings.TrimSpace(mode)) {
+		case "country", "city":
+		default:
+			errs.Add(fmt.Sprintf("%s.geo_targeting.modes[%d]", fieldPath, idx), "must be one of: country, city")
+		}
+	}
+	if p.Session.IdleTTLSeconds < 0 {
+		errs.Add(fieldPath+".session.idle_ttl_seconds", "cannot be negative")
+	}
+	if p.Session.MaxLifetimeSeconds < 0 {
+		errs.Add(fieldPath+".session.max_lifetime_seconds", "cannot be negative")
+	}
+	errs.Merge(p.Rotation.Validate(fieldPath + ".rotation"))
+	if p.Rotation.Enabled && !p.Session.Supported {
+		errs.Add(fieldPath+".rotation.enabled", "requires session.supported")
+	}
+	errs.Merge(p.Limits.Validate(fieldPath + ".limits"))
+	errs.Merge(p.Selection.Validate(fieldPath + ".selection"))
+	errs.Merge(p.Affinity.Validate(fieldPath + ".affinity"))
+	errs.Merge(p.Retry.Validate(fieldPath + ".retry"))
+	if p.Hedging.DelayMillis < 0 {
+		errs.Add(fieldPath+".hedging.delay_ms", "cannot be negative")
+	}
+	switch strings.ToLower(strings.TrimSpace(p.Limits.Strategy)) {
+	case "", "spill":
+	default:
+		if p.Hedging.DelayMillis > 0 {
+			errs.Add(fieldPath+".hedging.delay_ms", "requires limits.strategy spill")
+		}
+	}
+	if p.HTTP2 && strings.ToLower(strings.TrimSpace(p.Type)) != "direct" {
+		errs.Add(fieldPath+".http2", "must only be set for direct providers")
+	}
 	errs.Merge(p.Health.Validate(fieldPath + ".health"))
 	return errs
 }
 
+func (p ProviderPluginConfig) Validate(fieldPath string) *ValidationErrors {
+	errs := &ValidationErrors{}
+	if strings.TrimSpace(p.Type) == "" {
+		errs.Add(fieldPath+".type", "cannot be empty")
+	}
+	if strings.TrimSpace(p.Command) == "" {
+		errs.Add(fieldPath+".command", "cannot be empty")
+	}
+	if p.CallTimeoutMillis < 0 {
+		errs.Add(fieldPath+".call_timeout_ms", "cannot be negative")
+	}
+	if p.RestartBackoffMillis < 0 {
+		errs.Add(fieldPath+".restart_backoff_ms", "cannot be negative")
+	}
+	if p.MaxRestartBackoffMillis < 0 {
+		errs.Add(fieldPath+".max_restart_backoff_ms", "cannot be negative")
+	} else if p.MaxRestartBackoffMillis > 0 && p.MaxRestartBackoffMillis < p.RestartBackoffMillis {
+		errs.Add(fieldPath+".max_restart_backoff_ms", "cannot be less than restart_backoff_ms")
+	}
+	return errs
+}
+
+func (r ProviderRotationConfig) Validate(fieldPath string) *ValidationErrors {
+	errs := &ValidationErrors{}
+
+	mode := strings.ToLower(strings.TrimSpace(r.Mode))
+	switch mode {
+	case "", "per_request", "interval", "on_failure", "manual":
+	default:
+		errs.Add(fieldPath+".mode", "must be one of: per_request, interval, on_failure, manual")
+	}
+	if r.IntervalSeconds < 0 {
+		errs.Add(fieldPath+".interval_seconds", "cannot be negative")
+	} else if mode == "interval" && r.IntervalSeconds == 0 {
+		errs.Add(fieldPath+".interval_seconds", "is required for interval rotation")
+	}
+
+	return errs
+}
+
+func (s ProviderSelectionConfig) Validate(fieldPath string) *ValidationErrors {
+	errs := &ValidationErrors{}
+
+	switch strings.ToLower(strings.TrimSpace(s.Strategy)) {
+	case "", "priority", "weighted_round_robin", "random_weighted", "least_outstanding", "latency_ewma":
+	default:
+		errs.Add(fieldPath+".strategy", "must be one of: priority, weighted_round_robin, random_weighted, least_outstanding, latency_ewma")
+	}
+
+	return errs
+}
+
+func (a ProviderAffinityConfig) Validate(fieldPath string) *ValidationErrors {
+	errs := &ValidationErrors{}
+
+	switch strings.ToLower(strings.TrimSpace(a.Key)) {
+	case "", "tenant", "session_header", "proxy_user", "client_ip":
+	default:
+		errs.Add(fieldPath+".key", "must be one of: tenant, session_header, proxy_user, client_ip")
+	}
+	if a.Replicas < 0 {
+		errs.Add(fieldPath+".replicas", "cannot be negative")
+	}
+
+	return errs
+}
+
+func (r ProviderRetryConfig) Validate(fieldPath string) *ValidationErrors {
+	errs := &ValidationErrors{}
+
+	if r.MaxAttempts < 0 {
+		errs.Add(fieldPath+".max_attempts", "cannot be negative")
+	}
+	for idx, method := range r.Methods {
+		if strings.TrimSpace(method) == "" {
+			errs.Add(fmt.Sprintf("%s.methods[%d]", fieldPath, idx), "cannot be empty")
+		}
+	}
+	for idx, status := range r.RetryOnStatus {
+		if status < 100 || status > 599 {
+			errs.Add(fmt.Sprintf("%s.retry_on_status[%d]", fieldPath, idx), "must be a valid HTTP status code")
+		}
+	}
+	if r.BodyMemoryBytes < 0 {
+		errs.Add(fieldPath+".body_memory_bytes", "cannot be negative")
+	}
+	if r.MaxBodyBytes < 0 {
+		errs.Add(fieldPath+".max_body_bytes", "cannot be negative")
+	}
+
+	return errs
+}
+
+func (l ProviderLimitsConfig) Validate(fieldPath string) *ValidationErrors {
+	errs := &ValidationErrors{}
+
+	if l.MaxRequestsPerMinute < 0 {
+		errs.Add(fieldPath+".max_requests_per_minute", "cannot be negative")
+	}
+	if l.Concurrency < 0 {
+		errs.Add(fieldPath+".concurrency", "cannot be negative")
+	}
+	if l.QueueTimeoutMillis < 0 {
+		errs.Add(fieldPath+".queue_timeout_ms", "cannot be negative")
+	}
+	switch strings.ToLower(strings.TrimSpace(l.Strategy)) {
+	case "", "spill", "reject":
+	case "queue":
+		if l.QueueTimeoutMillis == 0 {
+			errs.Add(fieldPath+".queue_timeout_ms", "is required for queue strategy")
+		}
+	default:
+		errs.Add(fieldPath+".strategy", "must be one of: spill, queue, reject")
+	}
+
+	return errs
+}
+
 func (a ProviderAuthConfig) Validate(fieldPath string) *ValidationErrors {
 	errs := &ValidationErrors{}
 
@@ -596,6 +1245,9 @@ func (a ProviderAuthConfig) Validate(fieldPath string) *ValidationErrors {
 	case "", "none":
 		return errs
 	case "basic":
+		if a.Pool.Enabled() {
+			break
+		}
 		if strings.TrimSpace(a.Username) == "" {
 			errs.Add(fieldPath+".username", "is required for basic auth")
 		}
@@ -614,9 +1266,73 @@ func (a ProviderAuthConfig) Validate(fieldPath string) *ValidationErrors {
 		errs.Add(fieldPath+".type", "must be one of: none, basic, bearer, api_key")
 	}
 
+	if preset := strings.ToLower(strings.TrimSpace(a.Preset)); preset != "" {
+		if _, ok := authPresets[preset]; !ok {
+			errs.Add(fieldPath+".preset", "must be one of: brightdata, oxylabs, smartproxy, iproyal")
+		}
+	}
+	if _, err := RenderAuthTemplate(a.UsernameTemplate, nil); err != nil {
+		errs.Add(fieldPath+".username_template", err.Error())
+	}
+	if _, err := RenderAuthTemplate(a.PasswordTemplate, nil); err != nil {
+		errs.Add(fieldPath+".password_template", err.Error())
+	}
+	if username, password := a.AuthTemplates(); (username != "" || password != "") && !strings.EqualFold(strings.TrimSpace(a.Type), "basic") {
+		errs.Add(fieldPath+".type", "must be basic when a preset or template is set")
+	}
+	errs.Merge(a.Pool.Validate(fieldPath + ".pool"))
+	if a.Pool.Enabled() && !strings.EqualFold(strings.TrimSpace(a.Type), "basic") {
+		errs.Add(fieldPath+".type", "must be basic when a credential pool is set")
+	}
+
+	return errs
+}
+
+func (p ProviderCredentialPoolConfig) Validate(fieldPath string) *ValidationErrors {
+	errs := &ValidationErrors{}
+
+	for idx, credential := range p.Credentials {
+		if strings.TrimSpace(credential.Username) == "" {
+			errs.Add(fmt.Sprintf("%s.credentials[%d].username", fieldPath, idx), "cannot be empty")
+		}
+	}
+	switch strings.ToLower(strings.TrimSpace(p.Strategy)) {
+	case "", "round_robin", "least_used", "sticky_session":
+	default:
+		errs.Add(fieldPath+".strategy", "must be one of: round_robin, least_used, sticky_session")
+	}
+	if p.QuarantineAfter < 0 {
+		errs.Add(fieldPath+".quarantine_after", "cannot be negative")
+	}
+	if p.QuarantineSeconds < 0 {
+		errs.Add(fieldPath+".quarantine_seconds", "cannot be negative")
+	}
+
 	return errs
 }
 
+// LoadCredentialsFile reads username:password lines from path. Blank lines
+// and lines starting with # are skipped; the password may be empty.
+func LoadCredentialsFile(path string) ([]ProviderCredential, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var credentials []ProviderCredential
+	for lineNo, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, password, _ := strings.Cut(line, ":")
+		if strings.TrimSpace(username) == "" {
+			return nil, fmt.Errorf("%s:%d: expected username:password", path, lineNo+1)
+		}
+		credentials = append(credentials, ProviderCredential{Username: username, Password: password})
+	}
+	return credentials, nil
+}
+
 func (e ProviderEndpoint) Validate(fieldPath string) *ValidationErrors {
 	errs := &ValidationErrors{}
 
@@ -635,6 +1351,12 @@ func (e ProviderEndpoint) Validate(fieldPath string) *ValidationErrors {
 	if e.Weight < 0 {
 		errs.Add(fieldPath+".weight", "cannot be negative")
 	}
+	if e.MaxRequestsPerMinute < 0 {
+		errs.Add(fieldPath+".max_requests_per_minute", "cannot be negative")
+	}
+	if e.Concurrency < 0 {
+		errs.Add(fieldPath+".concurrency", "cannot be negative")
+	}
 
 	return errs
 }
@@ -663,6 +1385,14 @@ func (r RoutingConfig) Validate(fieldPath string, providerNames map[string]int,
 			errs.Add(fieldPath+".default_provider", "must reference an existing provider name")
 		}
 	}
+	for _, policy := range strings.Split(r.DefaultPolicyRef, ",") {
+		if policy = strings.TrimSpace(policy); policy == "" {
+			continue
+		}
+		if _, ok := policyNames[policy]; !ok {
+			errs.Add(fieldPath+".default_policy_ref", fmt.Sprintf("%q must reference an existing policy name", policy))
+		}
+	}
 
 	ruleNameSeen := map[string]int{}
 	for idx, rule := range r.Rules {
@@ -698,7 +1428,7 @@ func (r RoutingRule) Validate(fieldPath string, providerNames map[string]int, po
 
 	for key, value := range r.Match {
 		if strings.Contains(strings.ToLower(key), "cidr") || strings.HasSuffix(strings.ToLower(key), "ip_range") {
-			if _, _, err := net.ParseCIDR(value); err != nil {
+			if !validCIDRList(value) {
 				errs.Add(fieldPath+".match."+key, "must be a valid CIDR")
 			}
 		}
@@ -727,8 +1457,12 @@ func (p PolicyConfig) Validate(fieldPath string) *ValidationErrors {
 	if action := strings.ToLower(strings.TrimSpace(p.Action)); action != "" {
 		switch action {
 		case "allow", "deny", "route_override", "headers_patch", "redirect", "rewrite", "response_headers_patch", "body_mutation_hook":
+		case "upstream_credentials":
+			if strings.TrimSpace(p.Parameters["username"]) == "" {
+				errs.Add(fieldPath+".parameters.username", "is required for upstream_credentials")
+			}
 		default:
-			errs.Add(fieldPath+".action", "must be one of: allow, deny, route_override, headers_patch, redirect, rewrite, response_headers_patch, body_mutation_hook")
+			errs.Add(fieldPath+".action", "must be one of: allow, deny, route_override, headers_patch, redirect, rewrite, response_headers_patch, body_mutation_hook, upstream_credentials")
 		}
 	}
 	for key, value := range p.Selectors {
@@ -746,6 +1480,10 @@ func (p PolicyConfig) Validate(fieldPath string) *ValidationErrors {
 			if err := validateTimeWindow(strings.TrimSpace(value)); err != nil {
 				errs.Add(selectorPath, err.Error())
 			}
+		case "client_cidr":
+			if !validCIDRList(value) {
+				errs.Add(selectorPath, "must be a comma-separated list of CIDRs")
+			}
 		}
 	}
 	if strings.TrimSpace(p.Parameters["deny_category"]) != "" {
@@ -790,6 +1528,57 @@ func (t TenantConfig) Validate(fieldPath string) *ValidationErrors {
 	if strings.TrimSpace(t.ID) == "" {
 		errs.Add(fieldPath+".id", "cannot be empty")
 	}
+	errs.Merge(validateCIDRs(fieldPath+".allow_cidrs", t.AllowCIDRs))
+	errs.Merge(validateCIDRs(fieldPath+".deny_cidrs", t.DenyCIDRs))
+	return errs
+}
+
+func validateCIDRs(fieldPath string, cidrs []string) *ValidationErrors {
+	errs := &ValidationErrors{}
+	for idx, cidr := range cidrs {
+		if _, _, err := net.ParseCIDR(strings.TrimSpace(cidr)); err != nil {
+			errs.Add(fmt.Sprintf("%s[%d]", fieldPath, idx), "must be a valid CIDR")
+		}
+	}
+	return errs
+}
+
+// validCIDRList reports whether value is a comma-separated list of CIDRs, as
+// taken by the client_cidr selector.
+func validCIDRList(value string) bool {
+	for _, cidr := range strings.Split(value, ",") {
+		if _, _, err := net.ParseCIDR(strings.TrimSpace(cidr)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (i InterceptionConfig) Validate(fieldPath string, requested bool) *ValidationErrors {
+	errs := &ValidationErrors{}
+	if i.CA == nil {
+		if requested {
+			errs.Add(fieldPath+".ca", "is required when interception is enabled")
+		}
+	} else if strings.TrimSpace(i.CA.CertFile) == "" || strings.TrimSpace(i.CA.KeyFile) == "" {
+		errs.Add(fieldPath+".ca", "cert_file and key_file must both be set")
+	}
+	if i.CertCacheSize < 0 {
+		errs.Add(fieldPath+".cert_cache_size", "cannot be negative")
+	}
+	if i.LeafValidityHours < 0 {
+		errs.Add(fieldPath+".leaf_validity_hours", "cannot be negative")
+	}
+	for idx, domain := range i.Domains {
+		if strings.Trim(strings.TrimSpace(domain), "*.") == "" {
+			errs.Add(fmt.Sprintf("%s.domains[%d]", fieldPath, idx), "cannot be empty")
+		}
+	}
+	for idx, domain := range i.Bypass {
+		if strings.Trim(strings.TrimSpace(domain), "*.") == "" {
+			errs.Add(fmt.Sprintf("%s.bypass[%d]", fieldPath, idx), "cannot be empty")
+		}
+	}
 	return errs
 }
 
@@ -88,6 +88,15 @@ microproxy:
 			if len(cfg.Policies) != 1 || cfg.Policies[0].Parameters["username"] != "user-${SESSION_ID}" {
 				t.Fatalf("expected login rule mapped into policy, got %+v", cfg.Policies)
 			}
+			if cfg.Policies[0].Action != "upstream_credentials" || cfg.Routing.DefaultPolicyRef != "legacy-login-0" {
+				t.Fatalf("expected login policy applied by default, got action %q and default_policy_ref %q", cfg.Policies[0].Action, cfg.Routing.DefaultPolicyRef)
+			}
+			if cfg.Routing.DefaultProvider != "legacy-upstream-0" {
+				t.Fatalf("expected legacy provider as default, got %q", cfg.Routing.DefaultProvider)
+			}
+			if err := cfg.Validate(); err != nil {
+				t.Fatalf("expected legacy config to validate, got %v", err)
+			}
 		})
 	}
 }
@@ -236,3 +245,69 @@ func TestResolveSessionIDReplacementSemantics(t *testing.T) {
 		})
 	}
 }
+
+func TestRenderAuthTemplate(t *testing.T) {
+	values := map[string]string{"username": "acme", "country": "us", "session": "abc123", "session_ttl": "10"}
+	tests := []struct {
+		tmpl string
+		want string
+	}{
+		{tmpl: "", want: ""},
+		{tmpl: "{username}", want: "acme"},
+		{tmpl: "user-{username}[-country-{country}][-city-{city}][-session-{session}][-sesstime-{session_ttl}]", want: "user-acme-country-us-session-abc123-sesstime-10"},
+		{tmpl: "{username}[-zone-{city}-{country}]", want: "acme"},
+	}
+	for _, tt := range tests {
+		got, err := RenderAuthTemplate(tt.tmpl, values)
+		if err != nil {
+			t.Fatalf("render %q: %v", tt.tmpl, err)
+		}
+		if got != tt.want {
+			t.Fatalf("render %q: expected %q, got %q", tt.tmpl, tt.want, got)
+		}
+	}
+
+	for _, tmpl := range []string{"{user}", "{username", "[-a[-b]]", "-a]", "[-country-{country}"} {
+		if _, err := RenderAuthTemplate(tmpl, values); err == nil {
+			t.Fatalf("expected %q to be rejected", tmpl)
+		}
+	}
+}
+
+func TestLoadCredentialsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.txt")
+	if err := os.WriteFile(path, []byte("# sub-users\nsub-1:pa:ss\n\n  sub-2:secret  \n"), 0o600); err != nil {
+		t.Fatalf("write credentials file: %v", err)
+	}
+	credentials, err := LoadCredentialsFile(path)
+	if err != nil {
+		t.Fatalf("load credentials file: %v", err)
+	}
+	want := []ProviderCredential{{Username: "sub-1", Password: "pa:ss"}, {Username: "sub-2", Password: "secret"}}
+	if !reflect.DeepEqual(credentials, want) {
+		t.Fatalf("expected %+v, got %+v", want, credentials)
+	}
+
+	if err := os.WriteFile(path, []byte(":no-user\n"), 0o600); err != nil {
+		t.Fatalf("write credentials file: %v", err)
+	}
+	if _, err := LoadCredentialsFile(path); err == nil || !strings.Contains(err.Error(), ":1: expected username:password") {
+		t.Fatalf("expected line error, got %v", err)
+	}
+}
+
+func TestProviderAuthConfigAuthTemplates(t *testing.T) {
+	username, password := ProviderAuthConfig{Type: "basic", Preset: "Oxylabs"}.AuthTemplates()
+	if !strings.HasPrefix(username, "{username}[-cc-{country}]") || password != "" {
+		t.Fatalf("expected oxylabs preset, got %q / %q", username, password)
+	}
+
+	username, password = ProviderAuthConfig{Type: "basic", Preset: "iproyal", UsernameTemplate: "{username}-x"}.AuthTemplates()
+	if username != "{username}-x" || !strings.HasPrefix(password, "{password}[_country-{country}]") {
+		t.Fatalf("expected explicit username template over iproyal preset, got %q / %q", username, password)
+	}
+
+	if username, password := (ProviderAuthConfig{Type: "basic"}).AuthTemplates(); username != "" || password != "" {
+		t.Fatalf("expected no templates without a preset, got %q / %q", username, password)
+	}
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"errors"
 	"os"
 	"strings"
 	"testing"
@@ -155,3 +156,622 @@ func TestConfigExampleHasNoValidationErrors(t *testing.T) {
 		t.Fatalf("expected zero validation errors for deploy/config.example.yaml, got: %v", err)
 	}
 }
+
+func TestValidateListenerRateLimitFields(t *testing.T) {
+	cfg := &Config{
+		SchemaVersion: "1",
+		Listeners: []ListenerConfig{{
+			Name:           "l1",
+			Type:           "http",
+			Address:        ":8080",
+			RateLimit:      -1,
+			RateLimitBurst: -5,
+			RateLimitKey:   "session",
+			Enabled:        true,
+		}},
+	}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected rate limit validation errors")
+	}
+
+	msg := err.Error()
+	for _, expected := range []string{
+		"listeners[0].rate_limit",
+		"listeners[0].rate_limit_burst",
+		"listeners[0].rate_limit_key",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Fatalf("expected %q in validation message, got %q", expected, msg)
+		}
+	}
+}
+
+func TestValidateListenerTimeoutsAndConnectionCaps(t *testing.T) {
+	cfg := &Config{
+		SchemaVersion: "1",
+		Listeners: []ListenerConfig{
+			{
+				Name:                     "l1",
+				Type:                     "http",
+				Address:                  ":8080",
+				ReadHeaderTimeoutSeconds: -1,
+				TunnelIdleTimeoutSeconds: -1,
+				MaxTunnelLifetimeSeconds: -1,
+				MaxConnections:           -1,
+				MaxConnectionsPerIP:      -1,
+				Enabled:                  true,
+			},
+			{Name: "l2", Type: "socks5", Address: ":1080", MaxConnections: 10, MaxConnectionsPerIP: 20, Enabled: true},
+		},
+	}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected listener limit validation errors")
+	}
+
+	msg := err.Error()
+	for _, expected := range []string{
+		"listeners[0].read_header_timeout_seconds",
+		"listeners[0].tunnel_idle_timeout_seconds",
+		"listeners[0].max_tunnel_lifetime_seconds",
+		"listeners[0].max_connections",
+		"listeners[0].max_connections_per_ip",
+		"listeners[1].max_connections_per_ip: cannot exceed max_connections",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Fatalf("expected %q in validation message, got %q", expected, msg)
+		}
+	}
+}
+
+func TestValidateListenerUsers(t *testing.T) {
+	cfg := &Config{
+		SchemaVersion: "1",
+		Providers:     []ProviderConfig{{Name: "p1", Type: "direct", Endpoints: []ProviderEndpoint{{URL: "http://direct.local"}}}},
+		Policies:      []PolicyConfig{{Name: "allow", Type: "inline", Action: "allow"}},
+		Listeners: []ListenerConfig{
+			{
+				Name:     "l1",
+				Type:     "http",
+				Address:  ":8080",
+				AuthType: "basic",
+				Users: []ListenerUserConfig{
+					{Username: "ci", Password: "secret", TenantID: "t1", Provider: "p1", Policies: []string{"allow"}},
+					{Username: "ci", Password: "other"},
+					{Password: "x"},
+					{Username: "nopass"},
+					{Username: "ghost", Password: "x", Provider: "missing", Policies: []string{"missing"}},
+				},
+				Enabled: true,
+			},
+			{Name: "l2", Type: "socks5", Address: ":1080", HtpasswdFile: "/etc/htpasswd", Enabled: true},
+			{Name: "l3", Type: "http", Address: ":8081", AuthType: "basic", HtpasswdFile: "/etc/htpasswd", Enabled: true},
+		},
+	}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected listener user validation errors")
+	}
+
+	msg := err.Error()
+	for _, expected := range []string{
+		"listeners[0].users[1].username: duplicates listeners[0].users[0].username",
+		"listeners[0].users[2].username: cannot be empty",
+		"listeners[0].users[3].password: is required unless htpasswd_file is set",
+		"listeners[0].users[4].provider: must reference an existing provider name",
+		"listeners[0].users[4].policies[0]: must reference an existing policy name",
+		"listeners[1].htpasswd_file: must only be set for basic auth",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Fatalf("expected %q in validation message, got %q", expected, msg)
+		}
+	}
+	for _, unexpected := range []string{"listeners[0].username", "listeners[0].password", "listeners[2]", "users[0].provider", "users[1].password"} {
+		if strings.Contains(msg, unexpected) {
+			t.Fatalf("did not expect %q in validation message, got %q", unexpected, msg)
+		}
+	}
+}
+
+func TestValidateListenerClientCertificates(t *testing.T) {
+	cfg := &Config{
+		SchemaVersion: "1",
+		Listeners: []ListenerConfig{
+			{
+				Name:    "l1",
+				Type:    "https",
+				Address: ":8443",
+				TLS: &TLSConfig{
+					CertFile:   "server.pem",
+					KeyFile:    "server-key.pem",
+					ClientAuth: "required",
+					ClientTenants: []ClientCertTenantConfig{
+						{SPIFFEID: "spiffe://fleet/crawler/*", TenantID: "crawlers", Provider: "missing", Policies: []string{"missing"}},
+						{SPIFFEID: "fleet/crawler", DNSName: "crawler.example", TenantID: "t"},
+						{CommonName: "bot"},
+					},
+				},
+				Enabled: true,
+			},
+			{
+				Name:    "l2",
+				Type:    "https",
+				Address: ":8444",
+				TLS: &TLSConfig{
+					CertFile:      "server.pem",
+					KeyFile:       "server-key.pem",
+					ClientAuth:    "sometimes",
+					ClientTenants: []ClientCertTenantConfig{{CommonName: "bot", TenantID: "t"}},
+				},
+				Enabled: true,
+			},
+			{
+				Name:    "l3",
+				Type:    "https",
+				Address: ":8445",
+				TLS:     &TLSConfig{CertFile: "server.pem", KeyFile: "server-key.pem", ClientTenants: []ClientCertTenantConfig{{CommonName: "bot", TenantID: "t"}}},
+				Enabled: true,
+			},
+		},
+	}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected client certificate validation errors")
+	}
+
+	msg := err.Error()
+	for _, expected := range []string{
+		"listeners[0].tls.client_ca_file: is required when client_auth is set",
+		"listeners[0].tls.client_tenants[0].provider: must reference an existing provider name",
+		"listeners[0].tls.client_tenants[0].policies[0]: must reference an existing policy name",
+		"listeners[0].tls.client_tenants[1]: exactly one of spiffe_id, dns_name, common_name must be set",
+		"listeners[0].tls.client_tenants[1].spiffe_id: must start with spiffe://",
+		"listeners[0].tls.client_tenants[2].tenant_id: cannot be empty",
+		"listeners[1].tls.client_auth: must be one of: none, optional, required",
+		"listeners[2].tls.client_tenants: requires client_auth optional or required",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Fatalf("expected %q in validation message, got %q", expected, msg)
+		}
+	}
+}
+
+func TestValidateClientCIDRs(t *testing.T) {
+	cfg := &Config{
+		SchemaVersion: "1",
+		Providers:     []ProviderConfig{{Name: "p1", Type: "direct", Endpoints: []ProviderEndpoint{{URL: "http://direct.local"}}}},
+		Listeners: []ListenerConfig{{
+			Name:       "l1",
+			Type:       "socks5",
+			Address:    ":1080",
+			AllowCIDRs: []string{"10.0.0.0/8", "10.0.0.1"},
+			DenyCIDRs:  []string{"bogus"},
+			Enabled:    true,
+		}},
+		Tenants: []TenantConfig{{Name: "t1", ID: "t1", AllowCIDRs: []string{"192.168.0.0/33"}}},
+		Policies: []PolicyConfig{
+			{Name: "ok", Type: "access", Action: "deny", Selectors: map[string]string{"client_cidr": "10.0.0.0/8, 2001:db8::/32"}},
+			{Name: "bad", Type: "access", Action: "deny", Selectors: map[string]string{"client_cidr": "10.0.0.0/8,nope"}},
+		},
+		Routing: RoutingConfig{Rules: []RoutingRule{
+			{Name: "office", Match: map[string]string{"client_cidr": "10.0.0.0/8,192.168.0.0/16"}, Provider: "p1"},
+			{Name: "broken", Match: map[string]string{"client_cidr": "10.0.0.0"}, Provider: "p1"},
+		}},
+	}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected client CIDR validation errors")
+	}
+
+	msg := err.Error()
+	for _, expected := range []string{
+		"listeners[0].allow_cidrs[1]: must be a valid CIDR",
+		"listeners[0].deny_cidrs[0]: must be a valid CIDR",
+		"tenants[0].allow_cidrs[0]: must be a valid CIDR",
+		"policies[1].selectors.client_cidr: must be a comma-separated list of CIDRs",
+		"routing.rules[1].match.client_cidr: must be a valid CIDR",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Fatalf("expected %q in validation message, got %q", expected, msg)
+		}
+	}
+	for _, unexpected := range []string{"listeners[0].allow_cidrs[0]", "policies[0]", "rules[0]"} {
+		if strings.Contains(msg, unexpected) {
+			t.Fatalf("did not expect %q in validation message, got %q", unexpected, msg)
+		}
+	}
+}
+
+func TestValidateUpstreamCredentialsPolicies(t *testing.T) {
+	cfg := &Config{
+		SchemaVersion: "1",
+		Providers:     []ProviderConfig{{Name: "p1", Type: "http_proxy", Endpoints: []ProviderEndpoint{{URL: "http://proxy.local:3128"}}}},
+		Policies: []PolicyConfig{
+			{Name: "office", Type: "auth", Action: "upstream_credentials", Selectors: map[string]string{"ip_range": "10.0.0.0/8"}, Parameters: map[string]string{"username": "user-${SESSION_ID}"}},
+			{Name: "nameless", Type: "auth", Action: "upstream_credentials", Parameters: map[string]string{"password": "secret"}},
+		},
+		Routing: RoutingConfig{DefaultProvider: "p1", DefaultPolicyRef: "office, missing"},
+	}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected upstream credentials validation errors")
+	}
+
+	msg := err.Error()
+	for _, expected := range []string{
+		"policies[1].parameters.username: is required for upstream_credentials",
+		`routing.default_policy_ref: "missing" must reference an existing policy name`,
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Fatalf("expected %q in validation message, got %q", expected, msg)
+		}
+	}
+	for _, unexpected := range []string{"policies[0]", `"office"`} {
+		if strings.Contains(msg, unexpected) {
+			t.Fatalf("did not expect %q in validation message, got %q", unexpected, msg)
+		}
+	}
+}
+
+func TestValidateProviderAuthTemplates(t *testing.T) {
+	endpoints := []ProviderEndpoint{{URL: "http://proxy.local:3128"}}
+	cfg := &Config{
+		SchemaVersion: "1",
+		Providers: []ProviderConfig{
+			{Name: "ok", Type: "http_proxy", Endpoints: endpoints, Auth: ProviderAuthConfig{Type: "basic", Username: "acme", Password: "secret", Preset: "brightdata"}, GeoTargeting: ProviderGeoTargetingConfig{Supported: true, Modes: []string{"country"}}},
+			{Name: "bad-preset", Type: "http_proxy", Endpoints: endpoints, Auth: ProviderAuthConfig{Type: "basic", Username: "acme", Password: "secret", Preset: "acme-proxies"}},
+			{Name: "bad-template", Type: "http_proxy", Endpoints: endpoints, Auth: ProviderAuthConfig{Type: "basic", Username: "acme", Password: "secret", UsernameTemplate: "{username}-{region}", PasswordTemplate: "[{password}"}},
+			{Name: "bearer", Type: "http_proxy", Endpoints: endpoints, Auth: ProviderAuthConfig{Type: "bearer", Token: "t", Preset: "oxylabs"}},
+			{Name: "bad-mode", Type: "http_proxy", Endpoints: endpoints, GeoTargeting: ProviderGeoTargetingConfig{Supported: true, Modes: []string{"city", "asn"}}},
+		},
+	}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected provider auth template validation errors")
+	}
+
+	msg := err.Error()
+	for _, expected := range []string{
+		"providers[1].auth.preset: must be one of: brightdata, oxylabs, smartproxy, iproyal",
+		"providers[2].auth.username_template: unknown placeholder {region}",
+		"providers[2].auth.password_template: unterminated optional segment",
+		"providers[3].auth.type: must be basic when a preset or template is set",
+		"providers[4].geo_targeting.modes[1]: must be one of: country, city",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Fatalf("expected %q in validation message, got %q", expected, msg)
+		}
+	}
+	for _, unexpected := range []string{"providers[0]", "modes[0]"} {
+		if strings.Contains(msg, unexpected) {
+			t.Fatalf("did not expect %q in validation message, got %q", unexpected, msg)
+		}
+	}
+}
+
+func TestValidateProviderCredentialPool(t *testing.T) {
+	endpoints := []ProviderEndpoint{{URL: "http://proxy.local:3128"}}
+	pool := ProviderCredentialPoolConfig{Credentials: []ProviderCredential{{Username: "sub-1", Password: "p"}}, Strategy: "sticky_session"}
+	cfg := &Config{
+		SchemaVersion: "1",
+		Providers: []ProviderConfig{
+			{Name: "ok", Type: "http_proxy", Endpoints: endpoints, Auth: ProviderAuthConfig{Type: "basic", Pool: pool}},
+			{Name: "bad-pool", Type: "http_proxy", Endpoints: endpoints, Auth: ProviderAuthConfig{Type: "basic", Pool: ProviderCredentialPoolConfig{
+				Credentials:       []ProviderCredential{{Username: "sub-1"}, {Password: "p"}},
+				Strategy:          "random",
+				QuarantineAfter:   -1,
+				QuarantineSeconds: -5,
+			}}},
+			{Name: "bearer", Type: "http_proxy", Endpoints: endpoints, Auth: ProviderAuthConfig{Type: "bearer", Token: "t", Pool: pool}},
+		},
+	}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected credential pool validation errors")
+	}
+
+	msg := err.Error()
+	for _, expected := range []string{
+		"providers[1].auth.pool.credentials[1].username: cannot be empty",
+		"providers[1].auth.pool.strategy: must be one of: round_robin, least_used, sticky_session",
+		"providers[1].auth.pool.quarantine_after: cannot be negative",
+		"providers[1].auth.pool.quarantine_seconds: cannot be negative",
+		"providers[2].auth.type: must be basic when a credential pool is set",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Fatalf("expected %q in validation message, got %q", expected, msg)
+		}
+	}
+	for _, unexpected := range []string{"providers[0]", "credentials[0]", "providers[1].auth.username"} {
+		if strings.Contains(msg, unexpected) {
+			t.Fatalf("did not expect %q in validation message, got %q", unexpected, msg)
+		}
+	}
+}
+
+func TestValidateProviderRotation(t *testing.T) {
+	endpoints := []ProviderEndpoint{{URL: "http://proxy.local:3128"}}
+	session := ProviderSessionConfig{Supported: true}
+	cfg := &Config{
+		SchemaVersion: "1",
+		Providers: []ProviderConfig{
+			{Name: "ok", Type: "http_proxy", Endpoints: endpoints, Session: session, Rotation: ProviderRotationConfig{Enabled: true, Mode: "interval", IntervalSeconds: 300}},
+			{Name: "bad-mode", Type: "http_proxy", Endpoints: endpoints, Session: session, Rotation: ProviderRotationConfig{Enabled: true, Mode: "hourly"}},
+			{Name: "no-interval", Type: "http_proxy", Endpoints: endpoints, Session: session, Rotation: ProviderRotationConfig{Enabled: true, Mode: "interval"}},
+			{Name: "no-session", Type: "http_proxy", Endpoints: endpoints, Rotation: ProviderRotationConfig{Enabled: true, Mode: "per_request", IntervalSeconds: -1}},
+		},
+	}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected rotation validation errors")
+	}
+
+	msg := err.Error()
+	for _, expected := range []string{
+		"providers[1].rotation.mode: must be one of: per_request, interval, on_failure, manual",
+		"providers[2].rotation.interval_seconds: is required for interval rotation",
+		"providers[3].rotation.interval_seconds: cannot be negative",
+		"providers[3].rotation.enabled: requires session.supported",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Fatalf("expected %q in validation message, got %q", expected, msg)
+		}
+	}
+	if strings.Contains(msg, "providers[0]") {
+		t.Fatalf("did not expect providers[0] in validation message, got %q", msg)
+	}
+}
+
+func TestValidateProviderSessionTTLs(t *testing.T) {
+	cfg := &Config{
+		SchemaVersion: "1",
+		Providers: []ProviderConfig{
+			{Name: "ok", Type: "http_proxy", Endpoints: []ProviderEndpoint{{URL: "http://proxy.local:3128"}}, Session: ProviderSessionConfig{Supported: true, IdleTTLSeconds: 300, MaxLifetimeSeconds: 1800}},
+			{Name: "bad", Type: "http_proxy", Endpoints: []ProviderEndpoint{{URL: "http://proxy.local:3128"}}, Session: ProviderSessionConfig{Supported: true, IdleTTLSeconds: -1, MaxLifetimeSeconds: -1}},
+		},
+	}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected session TTL validation errors")
+	}
+
+	msg := err.Error()
+	for _, expected := range []string{
+		"providers[1].session.idle_ttl_seconds: cannot be negative",
+		"providers[1].session.max_lifetime_seconds: cannot be negative",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Fatalf("expected %q in validation message, got %q", expected, msg)
+		}
+	}
+	if strings.Contains(msg, "providers[0]") {
+		t.Fatalf("did not expect providers[0] in validation message, got %q", msg)
+	}
+}
+
+func TestValidateRunsProviderTypeValidators(t *testing.T) {
+	RegisterProviderValidator("Validator_Test", func(p ProviderConfig) error {
+		errs := &ValidationErrors{}
+		if len(p.Capabilities) == 0 {
+			errs.Add("capabilities", "must name the vendor region")
+		}
+		return errs.OrNil()
+	})
+	RegisterProviderValidator("validator_plain_test", func(ProviderConfig) error {
+		return errors.New("vendor api key missing")
+	})
+	endpoints := []ProviderEndpoint{{URL: "http://proxy.local:3128"}}
+	cfg := &Config{
+		SchemaVersion: "1",
+		Providers: []ProviderConfig{
+			{Name: "ok", Type: "validator_test", Endpoints: endpoints, Capabilities: []string{"eu"}},
+			{Name: "fields", Type: "validator_test", Endpoints: endpoints},
+			{Name: "plain", Type: "validator_plain_test", Endpoints: endpoints},
+		},
+	}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected provider type validation errors")
+	}
+
+	msg := err.Error()
+	for _, expected := range []string{
+		"providers[1].capabilities: must name the vendor region",
+		"providers[2]: vendor api key missing",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Fatalf("expected %q in validation message, got %q", expected, msg)
+		}
+	}
+	if strings.Contains(msg, "providers[0]") {
+		t.Fatalf("did not expect providers[0] in validation message, got %q", msg)
+	}
+}
+
+func TestValidateHTTP2Toggles(t *testing.T) {
+	cfg := &Config{
+		SchemaVersion: "1",
+		Listeners: []ListenerConfig{
+			{Name: "web", Type: "http", Address: ":8080", HTTP2: true, Enabled: true},
+			{Name: "socks", Type: "socks5", Address: ":1080", HTTP2: true, Enabled: true},
+		},
+		Providers: []ProviderConfig{
+			{Name: "origin", Type: "direct", HTTP2: true, Endpoints: []ProviderEndpoint{{URL: "http://direct.local"}}},
+			{Name: "corp", Type: "http_proxy", HTTP2: true, Endpoints: []ProviderEndpoint{{URL: "http://proxy.local:3128"}}},
+		},
+	}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected http2 validation errors")
+	}
+
+	msg := err.Error()
+	for _, expected := range []string{"listeners[1].http2", "providers[1].http2"} {
+		if !strings.Contains(msg, expected) {
+			t.Fatalf("expected %q in validation message, got %q", expected, msg)
+		}
+	}
+	for _, unexpected := range []string{"listeners[0].http2", "providers[0].http2"} {
+		if strings.Contains(msg, unexpected) {
+			t.Fatalf("did not expect %q in validation message, got %q", unexpected, msg)
+		}
+	}
+}
+
+func TestValidateInterception(t *testing.T) {
+	cfg := &Config{
+		SchemaVersion: "1",
+		Listeners: []ListenerConfig{
+			{Name: "web", Type: "http", Address: ":8080", Intercept: true, Enabled: true},
+			{Name: "socks", Type: "socks5", Address: ":1080", Intercept: true, Enabled: true},
+		},
+		Interception: InterceptionConfig{CertCacheSize: -1, Bypass: []string{"*."}},
+	}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected interception validation errors")
+	}
+
+	msg := err.Error()
+	for _, expected := range []string{
+		"listeners[1].intercept",
+		"interception.ca",
+		"interception.cert_cache_size",
+		"interception.bypass[0]",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Fatalf("expected %q in validation message, got %q", expected, msg)
+		}
+	}
+}
+
+func TestValidateProviderLimitsAndSelection(t *testing.T) {
+	cfg := &Config{
+		SchemaVersion: "1",
+		Listeners: []ListenerConfig{{
+			Name:    "l1",
+			Type:    "http",
+			Address: ":8080",
+			Enabled: true,
+		}},
+		Providers: []ProviderConfig{{
+			Name: "p1",
+			Type: "direct",
+			Endpoints: []ProviderEndpoint{
+				{URL: "http://direct.local", Concurrency: -1},
+			},
+			Limits: ProviderLimitsConfig{
+				MaxRequestsPerMinute: -1,
+				Strategy:             "drop",
+				FallbackProvider:     "missing",
+			},
+			Selection: ProviderSelectionConfig{Strategy: "fastest"},
+			Affinity:  ProviderAffinityConfig{Key: "cookie"},
+			Retry:     ProviderRetryConfig{MaxAttempts: -1, RetryOnStatus: []int{503, 42}},
+			Hedging:   ProviderHedgingConfig{DelayMillis: -5},
+		}},
+	}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected provider limits validation errors")
+	}
+
+	msg := err.Error()
+	for _, expected := range []string{
+		"providers[0].endpoints[0].concurrency",
+		"providers[0].limits.max_requests_per_minute",
+		"providers[0].limits.strategy",
+		"providers[0].limits.fallback_provider",
+		"providers[0].selection.strategy",
+		"providers[0].affinity.key",
+		"providers[0].retry.max_attempts",
+		"providers[0].retry.retry_on_status[1]",
+		"providers[0].hedging.delay_ms",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Fatalf("expected %q in validation message, got %q", expected, msg)
+		}
+	}
+}
+
+func TestValidateProviderHedgingRequiresSpill(t *testing.T) {
+	provider := func(strategy string) ProviderConfig {
+		return ProviderConfig{
+			Name:      "p-" + strategy,
+			Type:      "direct",
+			Endpoints: []ProviderEndpoint{{URL: "http://direct.local"}},
+			Limits:    ProviderLimitsConfig{Strategy: strategy, QueueTimeoutMillis: 100},
+			Hedging:   ProviderHedgingConfig{DelayMillis: 50},
+		}
+	}
+	cfg := &Config{
+		SchemaVersion: "1",
+		Providers:     []ProviderConfig{provider("spill"), provider("queue"), provider("reject")},
+	}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected hedging validation errors")
+	}
+
+	msg := err.Error()
+	if strings.Contains(msg, "providers[0].hedging.delay_ms") {
+		t.Fatalf("expected hedging with spill to validate, got %q", msg)
+	}
+	for _, expected := range []string{
+		"providers[1].hedging.delay_ms: requires limits.strategy spill",
+		"providers[2].hedging.delay_ms: requires limits.strategy spill",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Fatalf("expected %q in validation message, got %q", expected, msg)
+		}
+	}
+}
+
+func TestValidateProviderPlugins(t *testing.T) {
+	cfg := &Config{
+		SchemaVersion: "1",
+		ProviderPlugins: []ProviderPluginConfig{
+			{Type: "vendor", Command: "/usr/local/bin/vendor-plugin", CallTimeoutMillis: -1},
+			{Type: "Vendor", RestartBackoffMillis: 1000, MaxRestartBackoffMillis: 100},
+			{Command: "/usr/local/bin/other-plugin", RestartBackoffMillis: -1},
+		},
+	}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected provider plugin validation errors")
+	}
+
+	msg := err.Error()
+	for _, expected := range []string{
+		"provider_plugins[0].call_timeout_ms: cannot be negative",
+		"provider_plugins[1].command: cannot be empty",
+		"provider_plugins[1].type: duplicates provider_plugins[0].type",
+		"provider_plugins[1].max_restart_backoff_ms: cannot be less than restart_backoff_ms",
+		"provider_plugins[2].type: cannot be empty",
+		"provider_plugins[2].restart_backoff_ms: cannot be negative",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Fatalf("expected %q in validation message, got %q", expected, msg)
+		}
+	}
+	if strings.Contains(msg, "provider_plugins[0].type:") || strings.Contains(msg, "provider_plugins[0].command:") {
+		t.Fatalf("did not expect provider_plugins[0] type or command errors, got %q", msg)
+	}
+}